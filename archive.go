@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+
+	"github.com/galleybytes/monitor/pkg/archive"
+	"github.com/galleybytes/monitor/pkg/handlers"
+	"github.com/galleybytes/monitor/pkg/monitor"
+	gocache "github.com/patrickmn/go-cache"
+)
+
+// archiveFlags are how export and import reach the backend, the same way the monitor does: the api backend gets a
+// token scoped to the resource from the monitor manager with the service account token, the database backend
+// connects with the PG* env
+type archiveFlags struct {
+	backend   *string
+	host      *string
+	tokenFile *string
+}
+
+func addArchiveFlags(flags *flag.FlagSet) archiveFlags {
+	backend := os.Getenv("MONITOR_BACKEND")
+	if backend == "" {
+		backend = "api"
+	}
+	return archiveFlags{
+		backend:   flags.String("backend", backend, "api or database"),
+		host:      flags.String("manager-host", os.Getenv("MONITOR_MANAGER_SERVICE_HOST"), "monitor manager to get API access from"),
+		tokenFile: flags.String("token-file", os.Getenv("MONITOR_SERVICE_ACCOUNT_TOKEN_FILE"), "service account token to authenticate to the monitor manager with"),
+	}
+}
+
+// newBackend connects to the backend for the resource, a scoped token only grants access to that resource
+func (f archiveFlags) newBackend(uuid string) handlers.Backend {
+	if *f.backend == "api" && *f.host == "" {
+		log.Fatal("-manager-host or MONITOR_MANAGER_SERVICE_HOST is required")
+	}
+	// The config has no SpecSanitizer: export and import copy the specs as they were stored, redacted by whoever
+	// recorded them, and never record a spec themselves
+	config := monitor.Config{
+		Backend:                 *f.backend,
+		ManagerServiceHost:      *f.host,
+		ServiceAccountTokenFile: *f.tokenFile,
+		ResourceUUID:            uuid,
+	}
+	backend, err := monitor.NewBackend(config, gocache.New(gocache.NoExpiration, gocache.NoExpiration))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return backend
+}
+
+// exportArchive writes the run history of a resource to a tar.gz
+func exportArchive(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	backendFlags := addArchiveFlags(flags)
+	uuid := flags.String("resource-uuid", os.Getenv("TFO_RESOURCE_UUID"), "uuid of the resource to export")
+	output := flags.String("o", "", "file to write the archive to (default <resource-uuid>.tar.gz)")
+	flags.Parse(args)
+
+	if *uuid == "" {
+		log.Fatal("-resource-uuid or TFO_RESOURCE_UUID is required")
+	}
+	if *output == "" {
+		*output = *uuid + ".tar.gz"
+	}
+	backend := backendFlags.newBackend(*uuid)
+
+	f, err := os.Create(*output)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	if err := archive.Export(backend, *uuid, f); err != nil {
+		os.Remove(*output)
+		log.Fatal(err)
+	}
+	log.Printf("Exported %s to %s", *uuid, *output)
+}
+
+// importArchive replays an archive created by export into the backend
+func importArchive(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	backendFlags := addArchiveFlags(flags)
+	cluster := flags.String("cluster", os.Getenv("CLUSTER_NAME"), "cluster to register the resource to (default is the cluster in the archive)")
+	input := flags.String("i", "", "archive to import")
+	flags.Parse(args)
+
+	if *input == "" {
+		log.Fatal("-i is required")
+	}
+
+	f, err := os.Open(*input)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	// The manifest names the resource the backend is asked access for
+	manifest, _, err := archive.Read(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		log.Fatal(err)
+	}
+	backend := backendFlags.newBackend(manifest.TFOResource.UUID)
+	if err := archive.Import(backend, *cluster, f); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Imported %s", *input)
+}
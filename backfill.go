@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/galleybytes/monitor/pkg/handlers"
+	"github.com/galleybytes/monitor/pkg/models"
+	"github.com/galleybytes/monitor/pkg/monitor"
+	"github.com/galleybytes/monitor/pkg/tfoclient"
+	"github.com/galleybytes/monitor/pkg/util"
+	gocache "github.com/patrickmn/go-cache"
+)
+
+// readResource reads the resource of the monitor from the Kubernetes API
+func readResource(config monitor.Config) (*tfoclient.Resource, error) {
+	client, err := tfoclient.NewFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	resource, err := client.Get(context.TODO(), config.ResourceNamespace, config.ResourceName)
+	if err != nil {
+		return nil, err
+	}
+	if string(resource.UID) != config.ResourceUUID {
+		return nil, fmt.Errorf("terraform '%s/%s' is %s and not %s, it was recreated", config.ResourceNamespace, config.ResourceName, resource.UID, config.ResourceUUID)
+	}
+	return resource, nil
+}
+
+// generationDirs returns the generation directories under TFO_ROOT_PATH/generations sorted by generation
+func generationDirs(rootPath string) ([]string, error) {
+	root := filepath.Join(rootPath, "generations")
+	fileInfos, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+
+	generations := []int{}
+	for _, fileInfo := range fileInfos {
+		if !fileInfo.IsDir() {
+			continue
+		}
+		generation, err := strconv.Atoi(fileInfo.Name())
+		if err != nil {
+			continue
+		}
+		generations = append(generations, generation)
+	}
+	sort.Ints(generations)
+
+	dirs := []string{}
+	for _, generation := range generations {
+		dirs = append(dirs, filepath.Join(root, strconv.Itoa(generation)))
+	}
+	return dirs, nil
+}
+
+// backfill ships the logs of every generation found under TFO_ROOT_PATH. Lines that the API already has are
+// skipped, so it is safe to run against generations that were partially shipped.
+func backfill(config monitor.Config, args []string) {
+	flags := flag.NewFlagSet("backfill", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "print what would be uploaded without writing anything")
+	onlyGeneration := flags.String("generation", "", "only backfill this generation")
+	flags.Parse(args)
+
+	dirs, err := generationDirs(config.RootPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *onlyGeneration != "" {
+		dir := filepath.Join(config.RootPath, "generations", *onlyGeneration)
+		if !util.ContainsString(dirs, dir) {
+			log.Fatalf("generation %s was not found in %s", *onlyGeneration, config.RootPath)
+		}
+		dirs = []string{dir}
+	}
+	if len(dirs) == 0 {
+		log.Printf("No generations found in %s", config.RootPath)
+		return
+	}
+
+	cache := gocache.New(gocache.NoExpiration, gocache.NoExpiration)
+	requestHandler, err := monitor.NewBackend(config, cache)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// The monitor manager registers the resource, backfill only ships the logs of the generations it registered
+	latestGeneration := filepath.Base(dirs[len(dirs)-1])
+	found, reason, err := monitor.FindRegistration(requestHandler, config, latestGeneration)
+	if err != nil {
+		log.Fatalf("could not look up the registration of %s/%s: %s", config.ResourceNamespace, config.ResourceName, err)
+	}
+	if found == nil {
+		log.Fatalf("generation %s of %s/%s is not registered, %s: check that the monitor manager is running", latestGeneration, config.ResourceNamespace, config.ResourceName, reason)
+	}
+	tfoResource := *found
+
+	// The spec of the resource is only the spec of its current generation, the generations before keep the spec
+	// the manager registered them with
+	resource, err := readResource(config)
+	if err != nil {
+		slog.Error("Could not read the resource spec, the specs are not recorded", "error", err)
+	} else if err := config.RequireSpecSanitizer(); err != nil {
+		slog.Error("The specs are not recorded", "error", err)
+		resource = nil
+	}
+
+	total := 0
+	for _, dir := range dirs {
+		fileInfos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			slog.Error("Could not list the generation directory", "dir", dir, "error", err)
+			continue
+		}
+		dirGeneration := filepath.Base(dir)
+		fmt.Printf("generation %s\n", dirGeneration)
+		if resource != nil && strconv.FormatInt(resource.Generation, 10) == dirGeneration {
+			saved, err := requestHandler.FindResourceSpec(tfoResource.UUID, dirGeneration)
+			switch {
+			case err != nil:
+				slog.Error("Could not read the saved spec, the spec is not recorded", "dir", dir, "error", err)
+			case saved != nil:
+				// The manager registered the spec of the generation
+			case *dryRun:
+				fmt.Printf("  the spec would be recorded\n")
+			case requestHandler.RecordResourceSpec(tfoResource.UUID, dirGeneration, resource.Spec):
+				fmt.Printf("  recorded the spec\n")
+			}
+		}
+		for _, fileInfo := range fileInfos {
+			file := filepath.Join(dir, fileInfo.Name())
+			isLog, taskType, rerun, generation, uid := handlers.ParseFile(file)
+			if !isLog {
+				continue
+			}
+
+			taskPod := models.TaskPod{UUID: uid, TaskType: taskType, Rerun: rerun, Generation: generation}
+			if !*dryRun {
+				taskPod, err = requestHandler.GetOrSetTaskPod(tfoResource, taskType, generation, rerun, uid)
+				if err != nil {
+					slog.Error("Could not register the task pod", "file", file, "error", err)
+					continue
+				}
+			}
+			lines := handlers.ReadLines(file, tfoResource, taskPod)
+			if *dryRun {
+				missingLines, err := requestHandler.MissingLines(taskPod, lines)
+				if err != nil {
+					slog.Error("Could not read the lines already uploaded", "file", file, "error", err)
+					continue
+				}
+				total += len(missingLines)
+				fmt.Printf("  %s rerun=%d uuid=%s: %d of %d lines missing\n", taskType, rerun, uid, len(missingLines), len(lines))
+				continue
+			}
+			written, err := requestHandler.WriteAllLines(tfoResource, taskPod, lines)
+			if err != nil {
+				slog.Error("Could not upload the log file", "file", file, "error", err)
+				continue
+			}
+			total += written
+			fmt.Printf("  %s rerun=%d uuid=%s: uploaded %d of %d lines, %d were already uploaded\n", taskType, rerun, uid, written, len(lines), len(lines)-written)
+		}
+	}
+
+	if *dryRun {
+		fmt.Printf("%d lines would be uploaded\n", total)
+	} else {
+		fmt.Printf("%d lines uploaded\n", total)
+	}
+}
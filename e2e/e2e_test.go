@@ -0,0 +1,604 @@
+// Package e2e runs a monitor binary against the fake terraform-operator-api in pkg/fakeapi. The monitor is built
+// from the repo unless one is passed with -monitor, eg
+//
+//	go test ./e2e -run 'TestScenarios/spec' -args -watcher auto
+//
+// The scenarios are skipped with -short.
+package e2e
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/galleybytes/monitor/pkg/access"
+	"github.com/galleybytes/monitor/pkg/archive"
+	"github.com/galleybytes/monitor/pkg/fakeapi"
+	"github.com/galleybytes/monitor/pkg/handlers"
+	"github.com/galleybytes/monitor/pkg/models"
+	gocache "github.com/patrickmn/go-cache"
+)
+
+const timeout = 30 * time.Second
+
+type scenario struct {
+	name string
+	run  func(ctx context.Context, h *fakeapi.Harness, monitor string) error
+}
+
+var scenarios = []scenario{
+	{"ships existing and appended lines", shipsLines},
+	{"follows a new generation", followsNewGeneration},
+	{"writes approval files", writesApprovalFiles},
+	{"survives api latency", survivesLatency},
+	{"backfill ships history", backfillShipsHistory},
+	{"exits on api errors", exitsOnAPIErrors},
+	{"resolves resources bound to another cluster", resolvesClusterMismatch},
+	{"verifies registration", verifiesRegistration},
+	{"purges deleted resources", purgesDeletedResources},
+	{"ships with scoped tokens", shipsWithScopedTokens},
+	{"marks spec edits", marksSpecEdits},
+	{"renders spec diffs", rendersSpecDiffs},
+	{"redacts specs", redactsSpecs},
+}
+
+func shipsLines(ctx context.Context, h *fakeapi.Harness, monitor string) error {
+	if err := h.AppendLog("1", "init", 0, "aaa", "one", "two"); err != nil {
+		return err
+	}
+	if err := h.Start(ctx, monitor); err != nil {
+		return err
+	}
+	if err := h.WaitForLines("aaa", 2, timeout); err != nil {
+		return err
+	}
+	if err := h.AppendLog("1", "init", 0, "aaa", "three"); err != nil {
+		return err
+	}
+	if err := h.WaitForLines("aaa", 3, timeout); err != nil {
+		return err
+	}
+	if cluster := h.API.Clusters(); len(cluster) != 1 || cluster[0].Name != h.Cluster {
+		return fmt.Errorf("expected cluster %s to be registered once but got %v", h.Cluster, cluster)
+	}
+	return nil
+}
+
+func followsNewGeneration(ctx context.Context, h *fakeapi.Harness, monitor string) error {
+	if err := h.Start(ctx, monitor); err != nil {
+		return err
+	}
+	if err := h.AppendLog("1", "init", 0, "aaa", "one"); err != nil {
+		return err
+	}
+	if err := h.WaitForLines("aaa", 1, timeout); err != nil {
+		return err
+	}
+	if err := h.AddGeneration("2"); err != nil {
+		return err
+	}
+	// Give the watcher a moment to register the new dir before writing into it
+	time.Sleep(500 * time.Millisecond)
+	if err := h.AppendLog("2", "init", 0, "bbb", "one", "two"); err != nil {
+		return err
+	}
+	if err := h.WaitForLines("bbb", 2, timeout); err != nil {
+		return err
+	}
+	tfoResource, found := h.API.TFOResource(h.UUID)
+	if !found || tfoResource.CurrentGeneration != "2" {
+		return fmt.Errorf("expected the resource to be at generation 2 but got %+v", tfoResource)
+	}
+	return nil
+}
+
+func writesApprovalFiles(ctx context.Context, h *fakeapi.Harness, monitor string) error {
+	if err := h.AppendLog("1", "plan", 0, "aaa", "Plan: 1 to add"); err != nil {
+		return err
+	}
+	if err := h.Start(ctx, monitor); err != nil {
+		return err
+	}
+	if err := h.WaitForLines("aaa", 1, timeout); err != nil {
+		return err
+	}
+	h.API.SetApproval("aaa", true)
+	return h.WaitForFile("1", "_approved_aaa", timeout)
+}
+
+func survivesLatency(ctx context.Context, h *fakeapi.Harness, monitor string) error {
+	h.API.InjectFault(fakeapi.Fault{PathPrefix: "/api/v1/logs", Latency: 2 * time.Second, Count: 1})
+	if err := h.AppendLog("1", "init", 0, "aaa", "one", "two"); err != nil {
+		return err
+	}
+	if err := h.Start(ctx, monitor); err != nil {
+		return err
+	}
+	return h.WaitForLines("aaa", 2, timeout)
+}
+
+func backfillShipsHistory(ctx context.Context, h *fakeapi.Harness, monitor string) error {
+	if err := h.AppendLog("1", "init", 0, "aaa", "one", "two"); err != nil {
+		return err
+	}
+	if err := h.AddGeneration("2"); err != nil {
+		return err
+	}
+	if err := h.AppendLog("2", "init", 0, "bbb", "one"); err != nil {
+		return err
+	}
+	if err := h.Run(ctx, monitor, "backfill"); err != nil {
+		return fmt.Errorf("backfill failed: %s\n%s", err, h.Output())
+	}
+	if n := len(h.API.TaskLogs("aaa")); n != 2 {
+		return fmt.Errorf("expected 2 lines for aaa but got %d", n)
+	}
+	if n := len(h.API.TaskLogs("bbb")); n != 1 {
+		return fmt.Errorf("expected 1 line for bbb but got %d", n)
+	}
+
+	// The monitor manager registers generations, backfill does not
+	if err := os.MkdirAll(filepath.Join(h.RootPath, "generations", "3"), 0755); err != nil {
+		return err
+	}
+	if err := h.Run(ctx, monitor, "backfill"); err == nil {
+		return fmt.Errorf("expected backfill to fail for a generation that is not registered")
+	}
+	if tfoResource, _ := h.API.TFOResource(h.UUID); tfoResource.CurrentGeneration != "2" {
+		return fmt.Errorf("expected backfill to leave the resource at generation 2 but got %s", tfoResource.CurrentGeneration)
+	}
+	return nil
+}
+
+// exitsOnAPIErrors checks the monitor exits, so the pod restarts it, instead of silently dropping logs when the
+// API fails
+func exitsOnAPIErrors(ctx context.Context, h *fakeapi.Harness, monitor string) error {
+	for _, fault := range []fakeapi.Fault{
+		{PathPrefix: "/api/v1/cluster", StatusCode: 503},
+		{PathPrefix: "/api/v1/cluster", Unauthorized: true},
+		{PathPrefix: "/api/v1/cluster", Malformed: true},
+	} {
+		h.API.ClearFaults()
+		h.API.InjectFault(fault)
+		if err := h.Run(ctx, monitor); err == nil {
+			return fmt.Errorf("expected the monitor to exit with an error for %+v", fault)
+		}
+	}
+	return nil
+}
+
+func resolvesClusterMismatch(ctx context.Context, h *fakeapi.Harness, monitor string) error {
+	other := h.API.AddCluster("other")
+	h.API.AddTFOResource(models.TFOResource{UUID: h.UUID, Namespace: h.Namespace, Name: h.Name, CurrentGeneration: "1", Cluster: other})
+	if err := h.AppendLog("1", "init", 0, "aaa", "one"); err != nil {
+		return err
+	}
+
+	if _, err := h.Register("1"); err == nil {
+		return fmt.Errorf("expected registration to fail with the fail policy")
+	}
+	if err := h.Run(ctx, monitor); err == nil {
+		return fmt.Errorf("expected the monitor to exit when the resource is bound to another cluster")
+	}
+
+	h.ClusterMismatchPolicy = handlers.ClusterMismatchFork
+	fork, err := h.Register("1")
+	if err != nil {
+		return err
+	}
+	if fork.UUID == h.UUID || fork.CreatedBy == "" {
+		return fmt.Errorf("expected a fork with an audit record but got %+v", fork)
+	}
+	if err := h.Start(ctx, monitor); err != nil {
+		return err
+	}
+	if err := h.WaitForLines("aaa", 1, timeout); err != nil {
+		return err
+	}
+	h.Stop()
+	if taskPods := h.API.TaskPods(); len(taskPods) != 1 || taskPods[0].TFOResourceUUID != fork.UUID {
+		return fmt.Errorf("expected the task to be shipped under the fork %s but got %+v", fork.UUID, taskPods)
+	}
+	if original, _ := h.API.TFOResource(h.UUID); original.ClusterID != other.ID {
+		return fmt.Errorf("expected the original resource to stay bound to cluster #%d but got #%d", other.ID, original.ClusterID)
+	}
+
+	h.ClusterMismatchPolicy = handlers.ClusterMismatchAdopt
+	adopted, err := h.Register("1")
+	if err != nil {
+		return err
+	}
+	if adopted.ClusterID == other.ID || adopted.UpdatedBy == "" {
+		return fmt.Errorf("expected the resource to be adopted with an audit record but got %+v", adopted)
+	}
+	if adoptions := h.API.ClusterAdoptions(h.UUID); len(adoptions) != 1 || adoptions[0].FromClusterID != other.ID || adoptions[0].ToClusterID != adopted.ClusterID {
+		return fmt.Errorf("expected the adoption from cluster #%d to be recorded but got %+v", other.ID, adoptions)
+	}
+	return nil
+}
+
+func verifiesRegistration(ctx context.Context, h *fakeapi.Harness, monitor string) error {
+	// The operator created the next generation but the manager has not registered it
+	if err := os.MkdirAll(filepath.Join(h.RootPath, "generations", "2"), 0755); err != nil {
+		return err
+	}
+	h.Generation = "2"
+	if err := h.Run(ctx, monitor); err == nil {
+		return fmt.Errorf("expected the monitor to exit when the generation is not registered")
+	}
+	if _, err := h.Register("2"); err != nil {
+		return err
+	}
+	if err := h.AppendLog("2", "init", 0, "aaa", "one"); err != nil {
+		return err
+	}
+	if err := h.Start(ctx, monitor); err != nil {
+		return err
+	}
+	return h.WaitForLines("aaa", 1, timeout)
+}
+
+// purgesDeletedResources marks the resource deleted as the manager does and checks only its history is purged
+// once the retention policy no longer keeps it
+func purgesDeletedResources(ctx context.Context, h *fakeapi.Harness, monitor string) error {
+	if err := h.AppendLog("1", "init", 0, "aaa", "one"); err != nil {
+		return err
+	}
+	if err := h.Start(ctx, monitor); err != nil {
+		return err
+	}
+	if err := h.WaitForLines("aaa", 1, timeout); err != nil {
+		return err
+	}
+	h.Stop()
+
+	backend := handlers.NewWithToken(h.API.URL, h.API.Token, gocache.New(gocache.NoExpiration, gocache.NoExpiration))
+	cluster, err := backend.GetOrSetCluster(h.Cluster)
+	if err != nil {
+		return err
+	}
+	deleted := backend.DeleteTFOResource(h.UUID, handlers.DeletedBy(*cluster))
+	if deleted == nil || deleted.DeletedAt.IsZero() || deleted.DeletedBy == "" {
+		return fmt.Errorf("expected the resource to be marked deleted but got %+v", deleted)
+	}
+
+	retention, err := handlers.ParseRetentionPolicy("1d")
+	if err != nil {
+		return err
+	}
+	before, _ := retention.PurgeBefore(time.Now())
+	if n := len(backend.FindDeletedTFOResources(before)); n != 0 {
+		return fmt.Errorf("expected the history to be kept for a day but %d resources are due", n)
+	}
+	due := backend.FindDeletedTFOResources(time.Now())
+	if len(due) != 1 || due[0].UUID != h.UUID {
+		return fmt.Errorf("expected the deleted resource to be due but got %+v", due)
+	}
+	backend.PurgeTFOResource(h.UUID)
+
+	if n := len(h.API.TaskLogs("aaa")); n != 0 {
+		return fmt.Errorf("expected the logs to be purged but %d are left", n)
+	}
+	if n := len(h.API.ResourceSpecs(h.UUID)); n != 0 {
+		return fmt.Errorf("expected the specs to be purged but %d are left", n)
+	}
+	if _, found := h.API.TFOResource(h.UUID); !found {
+		return fmt.Errorf("expected the deleted resource to be kept as a record")
+	}
+	if n := len(backend.FindDeletedTFOResources(time.Now())); n != 0 {
+		return fmt.Errorf("expected nothing left to purge but %d resources are due", n)
+	}
+	return nil
+}
+
+// shipsWithScopedTokens gets short lived tokens from the manager's token exchange instead of using the API's
+// token, and checks they are refreshed when they expire, that export uses them too and that they are revoked when
+// the resource is deleted
+func shipsWithScopedTokens(ctx context.Context, h *fakeapi.Harness, monitor string) error {
+	key := []byte("e2e-signing-key")
+	h.API.SigningKeys = [][]byte{key}
+	backend := handlers.NewWithToken(h.API.URL, h.API.Token, gocache.New(gocache.NoExpiration, gocache.NoExpiration))
+	var mu sync.Mutex
+	minted := 0
+	exchanger := access.Exchanger{
+		Host:        h.API.URL,
+		Key:         key,
+		TTL:         2 * time.Second,
+		ClusterName: h.Cluster,
+		Backend:     backend,
+		Review: func(token string) (string, error) {
+			if token != "e2e-service-account-token" {
+				return "", fmt.Errorf("unknown service account token")
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			minted++
+			return h.Namespace, nil
+		},
+	}
+	manager := httptest.NewServer(exchanger)
+	defer manager.Close()
+
+	tokenFile := filepath.Join(h.RootPath, "token")
+	if err := os.WriteFile(tokenFile, []byte("e2e-service-account-token"), 0600); err != nil {
+		return err
+	}
+	h.ExtraEnv = append(h.ExtraEnv,
+		"MONITOR_MANAGER_SERVICE_HOST="+manager.URL,
+		"MONITOR_SERVICE_ACCOUNT_TOKEN_FILE="+tokenFile,
+	)
+
+	if err := h.AppendLog("1", "init", 0, "aaa", "one"); err != nil {
+		return err
+	}
+	if err := h.Start(ctx, monitor); err != nil {
+		return err
+	}
+	if err := h.WaitForLines("aaa", 1, timeout); err != nil {
+		return err
+	}
+	time.Sleep(3 * time.Second)
+	if err := h.AppendLog("1", "init", 0, "aaa", "two"); err != nil {
+		return err
+	}
+	if err := h.WaitForLines("aaa", 2, timeout); err != nil {
+		return err
+	}
+	mu.Lock()
+	if minted < 2 {
+		mu.Unlock()
+		return fmt.Errorf("expected the token to be refreshed after it expired but %d were minted", minted)
+	}
+	mu.Unlock()
+
+	// export gets its access from the manager like the monitor does
+	exported := filepath.Join(h.RootPath, "export.tar.gz")
+	export := exec.CommandContext(ctx, monitor, "export", "-o", exported)
+	export.Env = h.Env()
+	if output, err := export.CombinedOutput(); err != nil {
+		return fmt.Errorf("export failed: %s\n%s", err, output)
+	}
+	f, err := os.Open(exported)
+	if err != nil {
+		return err
+	}
+	manifest, _, err := archive.Read(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if len(manifest.Generations) != 1 || len(manifest.Generations[0].Tasks) != 1 || manifest.Generations[0].Tasks[0].Lines != 2 {
+		return fmt.Errorf("expected the export to hold the 2 shipped lines, got %+v", manifest.Generations)
+	}
+
+	response, err := http.Get(manager.URL + "/api-token-please?resource_uuid=" + h.UUID)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusUnauthorized {
+		return fmt.Errorf("expected a request without a service account token to be refused but got a %d", response.StatusCode)
+	}
+
+	cluster, err := backend.GetOrSetCluster(h.Cluster)
+	if err != nil {
+		return err
+	}
+	backend.DeleteTFOResource(h.UUID, handlers.DeletedBy(*cluster))
+	if err := h.AppendLog("1", "init", 0, "aaa", "three"); err != nil {
+		return err
+	}
+	if err := h.WaitFor(timeout, h.Exited, func() string { return "the monitor kept running after its resource was deleted" }); err != nil {
+		return err
+	}
+	if n := len(h.API.TaskLogs("aaa")); n != 2 {
+		return fmt.Errorf("expected no lines to be shipped after the resource was deleted but got %d lines", n)
+	}
+	return nil
+}
+
+func marksSpecEdits(ctx context.Context, h *fakeapi.Harness, monitor string) error {
+	h.ExtraEnv = append(h.ExtraEnv, "MONITOR_SPEC_INTERVAL=200ms")
+	if err := h.AppendLog("1", "plan", 0, "aaa", "Plan: 1 to add"); err != nil {
+		return err
+	}
+	if err := h.Start(ctx, monitor); err != nil {
+		return err
+	}
+	if err := h.WaitForLines("aaa", 1, timeout); err != nil {
+		return err
+	}
+	// Let the first read of the resource happen before it is edited
+	if err := h.WaitFor(timeout, func() bool { return strings.Contains(h.Output(), "Starting spec watcher") },
+		func() string { return "the spec watcher did not start" }); err != nil {
+		return err
+	}
+	time.Sleep(time.Second)
+
+	// Only the metadata changes, which is not an edit of the spec
+	h.SetSpec("1", map[string]interface{}{})
+	time.Sleep(time.Second)
+	marker := handlers.MarkerTaskPodUUID(h.UUID, "1")
+	if n := len(h.API.TaskLogs(marker)); n != 0 {
+		return fmt.Errorf("expected no marker when the spec did not change but got %d", n)
+	}
+
+	h.SetSpec("2", map[string]interface{}{"requireApproval": true})
+	if err := h.WaitForLines(marker, 1, timeout); err != nil {
+		return err
+	}
+	if message := h.API.TaskLogs(marker)[0].Message; !strings.Contains(message, "generation 1 -> 2") {
+		return fmt.Errorf("expected the marker to name the generations but got %q", message)
+	}
+	// The manager registers the spec of the new generation, the monitor has no key to redact it with
+	for _, resourceSpec := range h.API.ResourceSpecs(h.UUID) {
+		if resourceSpec.Generation == "2" {
+			return fmt.Errorf("expected the monitor not to record the spec but got %v", resourceSpec)
+		}
+	}
+	return nil
+}
+
+func rendersSpecDiffs(ctx context.Context, h *fakeapi.Harness, monitor string) error {
+	// Only the diffs at the start of each generation are shipped, not the edits
+	h.ExtraEnv = append(h.ExtraEnv, "MONITOR_SPEC_INTERVAL=0")
+	if err := h.Start(ctx, monitor); err != nil {
+		return err
+	}
+	if err := h.AppendLog("1", "init", 0, "aaa", "one"); err != nil {
+		return err
+	}
+	if err := h.WaitForLines("aaa", 1, timeout); err != nil {
+		return err
+	}
+	h.SetSpec("2", map[string]interface{}{"terraformVersion": "1.5.0", "keepLatestPodsOnly": true})
+	if err := h.AddGeneration("2"); err != nil {
+		return err
+	}
+	if err := h.WaitForLines(handlers.MarkerTaskPodUUID(h.UUID, "2"), 3, timeout); err != nil {
+		return err
+	}
+	h.SetSpec("3", map[string]interface{}{"terraformVersion": "1.5.7", "requireApproval": true})
+	if err := h.AddGeneration("3"); err != nil {
+		return err
+	}
+	marker := handlers.MarkerTaskPodUUID(h.UUID, "3")
+	if err := h.WaitForLines(marker, 4, timeout); err != nil {
+		return err
+	}
+	messages := []string{}
+	for _, line := range h.API.TaskLogs(marker) {
+		messages = append(messages, line.Message)
+	}
+	expected := []string{
+		"--- monitor: 3 changes to the spec since generation 2 ---",
+		"- keepLatestPodsOnly",
+		"+ requireApproval = true",
+		`~ terraformVersion = "1.5.7"`,
+	}
+	if strings.Join(messages, "\n") != strings.Join(expected, "\n") {
+		return fmt.Errorf("expected the diff\n%s\nbut got\n%s", strings.Join(expected, "\n"), strings.Join(messages, "\n"))
+	}
+	for _, resourceSpec := range h.API.ResourceSpecs(h.UUID) {
+		if resourceSpec.Generation == "3" && !strings.Contains(resourceSpec.SpecDiff, `"path":"/terraformVersion"`) {
+			return fmt.Errorf("expected the spec diff to be stored with generation 3 but got %q", resourceSpec.SpecDiff)
+		}
+	}
+	return nil
+}
+
+func redactsSpecs(ctx context.Context, h *fakeapi.Harness, monitor string) error {
+	h.SpecRedact = []string{"$.terraformModule.token"}
+	h.ExtraEnv = append(h.ExtraEnv, "MONITOR_SPEC_INTERVAL=0")
+	if err := h.Start(ctx, monitor); err != nil {
+		return err
+	}
+	if err := h.AppendLog("1", "init", 0, "aaa", "one"); err != nil {
+		return err
+	}
+	if err := h.WaitForLines("aaa", 1, timeout); err != nil {
+		return err
+	}
+
+	secrets := []string{"AKIA-e2e-secret", "hunter2", "ghp-e2e-secret"}
+	h.SetSpec("2", map[string]interface{}{
+		"terraformVersion": "1.5.7",
+		"backend":          `terraform { backend "s3" { access_key = "AKIA-e2e-secret" } }`,
+		"taskOptions": []interface{}{map[string]interface{}{
+			"for": []string{"*"},
+			"env": []interface{}{map[string]interface{}{"name": "TF_VAR_password", "value": "hunter2"}},
+		}},
+		"terraformModule": map[string]interface{}{"source": "https://github.com/galleybytes/e2e.git", "token": "ghp-e2e-secret"},
+	})
+	if err := h.AddGeneration("2"); err != nil {
+		return err
+	}
+	var recorded *models.TFOResourceSpec
+	for _, resourceSpec := range h.API.ResourceSpecs(h.UUID) {
+		if resourceSpec.Generation == "2" {
+			recorded = &resourceSpec
+		}
+	}
+	if recorded == nil {
+		return fmt.Errorf("the spec of generation 2 was not registered")
+	}
+	for _, secret := range secrets {
+		if strings.Contains(recorded.ResourceSpec, secret) || strings.Contains(recorded.SpecDiff, secret) {
+			return fmt.Errorf("expected %s to be redacted but got %s", secret, recorded.ResourceSpec)
+		}
+	}
+	for _, kept := range []string{"1.5.7", "TF_VAR_password", "https://github.com/galleybytes/e2e.git", "redacted:hmac-sha256:"} {
+		if !strings.Contains(recorded.ResourceSpec, kept) {
+			return fmt.Errorf("expected %s to be kept but got %s", kept, recorded.ResourceSpec)
+		}
+	}
+
+	// The diff the monitor ships at the start of the generation only has the redacted values
+	marker := handlers.MarkerTaskPodUUID(h.UUID, "2")
+	if err := h.WaitForLines(marker, 1, timeout); err != nil {
+		return err
+	}
+	for _, line := range h.API.TaskLogs(marker) {
+		for _, secret := range secrets {
+			if strings.Contains(line.Message, secret) {
+				return fmt.Errorf("expected %s to be redacted in the spec diff but got %q", secret, line.Message)
+			}
+		}
+	}
+	return nil
+}
+
+var (
+	monitorFlag = flag.String("monitor", "", "path to the monitor binary, it is built from the repo when empty")
+	watcher     = flag.String("watcher", "", "MONITOR_WATCHER passed to the monitor")
+)
+
+// buildMonitor returns the -monitor binary or builds the monitor into dir
+func buildMonitor(t *testing.T, dir string) string {
+	if *monitorFlag != "" {
+		if _, err := os.Stat(*monitorFlag); err != nil {
+			t.Fatalf("monitor binary not found: %s", err)
+		}
+		return *monitorFlag
+	}
+	monitor := filepath.Join(dir, "monitor")
+	build := exec.Command("go", "build", "-o", monitor, "..")
+	if output, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("could not build the monitor: %s\n%s", err, output)
+	}
+	return monitor
+}
+
+func TestScenarios(t *testing.T) {
+	if testing.Short() {
+		t.Skip("the scenarios run the monitor binary")
+	}
+	monitor := buildMonitor(t, t.TempDir())
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			h, err := fakeapi.NewHarness("1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer h.Close()
+			if *watcher != "" {
+				h.ExtraEnv = append(h.ExtraEnv, "MONITOR_WATCHER="+*watcher)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 2*timeout)
+			defer cancel()
+			if err := s.run(ctx, h, monitor); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -1,182 +1,83 @@
 package main
 
 import (
-	"fmt"
-	"io/fs"
-	"io/ioutil"
+	"context"
 	"log"
+	"log/slog"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/fsnotify/fsnotify"
-	"github.com/galleybytes/monitor/pkg/handlers"
-	gocache "github.com/patrickmn/go-cache"
+	"github.com/galleybytes/monitor/pkg/logging"
+	"github.com/galleybytes/monitor/pkg/metrics"
+	"github.com/galleybytes/monitor/pkg/monitor"
+	"github.com/galleybytes/monitor/pkg/tracing"
 )
 
-var (
-	err                error
-	watcher            *fsnotify.Watcher
-	clusterName        string
-	resourceUUID       string
-	resourceName       string
-	resourceNamespace  string
-	resourceGeneration string
-	generationsDir     string
-	managerServiceHost string
-)
-
-// addWatcher adds files under the generation dir
-func addWatcher(fileInfo fs.FileInfo, path string) {
-	file := filepath.Join(path, fileInfo.Name())
-	if _, err := os.Stat(file); err == nil {
-		if filepath.Ext(file) == ".out" {
-			watcher.Add(file)
-		}
-	}
-}
-
-func init() {
-	managerServiceHost = os.Getenv("MONITOR_MANAGER_SERVICE_HOST")
-	if managerServiceHost == "" {
-		log.Fatal("MONITOR_MANAGER_SERVICE_HOST cannot be empty")
-	}
-
-	clusterName = os.Getenv("CLUSTER_NAME")
-	if clusterName == "" {
-		log.Fatal("CLUSTER_NAME cannot be empty")
-	}
-
-	resourceUUID = os.Getenv("TFO_RESOURCE_UUID")
-	if resourceUUID == "" {
-		log.Fatal("TFO_RESOURCE_UUID cannot be empty")
-	}
-
-	resourceNamespace = os.Getenv("TFO_NAMESPACE")
-	if resourceNamespace == "" {
-		log.Fatal("TFO_NAMESPACE cannot be empty")
-	}
-
-	resourceName = os.Getenv("TFO_RESOURCE")
-	if resourceName == "" {
-		log.Fatal("TFO_RESOURCE cannot be empty")
+func main() {
+	if err := logging.FromEnv(); err != nil {
+		log.Fatal(err)
 	}
 
-	resourceGeneration = os.Getenv("TFO_GENERATION")
-	if resourceGeneration == "" {
-		log.Fatal("TFO_GENERATION cannot be empty")
+	command := ""
+	if len(os.Args) > 1 {
+		command = os.Args[1]
 	}
 
-	generationsRootDir := os.Getenv("TFO_ROOT_PATH")
-	if generationsRootDir == "" {
-		log.Fatal("TFO_ROOT_PATH cannot be empty")
+	switch command {
+	case "export":
+		exportArchive(os.Args[2:])
+		return
+	case "import":
+		importArchive(os.Args[2:])
+		return
+	case "schema":
+		schema(os.Args[2:])
+		return
 	}
-	generationsDir = fmt.Sprintf("%s/generations/%s", generationsRootDir, resourceGeneration)
 
-}
-
-func main() {
-	// cancelChan := make(chan os.Signal, 1)
-	// // catch SIGETRM or SIGINTERRUPT
-	// signal.Notify(cancelChan, syscall.SIGTERM, syscall.SIGINT)
-	// go func() {
-	// 	for {
-	// 		time.Sleep(time.Second)
-	// 	}
-	// }()
-	cache := gocache.New(gocache.NoExpiration, gocache.NoExpiration)
-	requestHandler := handlers.New(managerServiceHost+"/api-token-please", cache)
-
-	cluster := requestHandler.GetOrSetCluster(clusterName)
-	tfoResource := requestHandler.GetOrSetTFOResource(resourceUUID, resourceNamespace, resourceName, resourceGeneration, *cluster)
-	log.Print("TFO Resource is ", tfoResource.Namespace, "/", tfoResource.Name, ", UUID:", tfoResource.UUID)
-	watcher, err = fsnotify.NewWatcher()
+	config, err := monitor.ConfigFromEnv()
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer watcher.Close()
 
-	log.Print("Finding files")
-	for {
-		fileInfo, err := os.Stat(generationsDir)
-		if err == nil {
-			if fileInfo.IsDir() {
-				break
-			}
-		}
-		time.Sleep(50 * time.Millisecond)
+	// Every record of this process is about the one resource
+	slog.SetDefault(slog.Default().With(
+		logging.Cluster, config.ClusterName,
+		logging.Namespace, config.ResourceNamespace,
+		logging.Resource, config.ResourceName,
+		logging.ResourceUUID, config.ResourceUUID,
+	))
+
+	metrics.ServeFromEnv()
+
+	switch command {
+	case "":
+	case "backfill":
+		backfill(config, os.Args[2:])
+		return
+	default:
+		log.Fatalf("unknown command '%s'", command)
 	}
 
-	watcher.Add(generationsDir)
-	// List the directory of the generation which is where logs will be
-	fileInfos, err := ioutil.ReadDir(generationsDir)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	shutdownTracing, err := tracing.FromEnv(ctx)
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	// Read in all files on init
-	for _, fileInfo := range fileInfos {
-		file := filepath.Join(generationsDir, fileInfo.Name())
-		isLog, taskType, rerun, generation, uid := handlers.ParseFile(file)
-		if !isLog {
-			continue
-		}
-		requestHandler.EventWriter(file, tfoResource, taskType, generation, rerun, uid)
-	}
-	log.Print("Starting log watcher")
-	// done := make(chan bool)
-	go func() {
-		for {
-			select {
-			case event, ok := <-watcher.Events:
-				if !ok {
-					return
-				}
-				log.Printf("event: '%s': %s", event.Name, event.Op)
-
-				if event.Op == fsnotify.Create {
-					file, err := os.Stat(event.Name)
-					if err == nil {
-						if file.IsDir() {
-							// I don't think we need any more watchers?
-							// addWatcher(file, generationsDir)
-							continue
-						}
-					}
-				}
-				if event.Op == fsnotify.Create || event.Op == fsnotify.Write {
-					isLog, taskType, rerun, generation, uid := handlers.ParseFile(event.Name)
-					if !isLog {
-						continue
-					}
-					requestHandler.EventWriter(event.Name, tfoResource, taskType, generation, rerun, uid)
-				}
-			case err, ok := <-watcher.Errors:
-				if !ok {
-					return
-				}
-				log.Println("error:", err)
-
-				// case sig := <-cancelChan:
-				// 	log.Printf("Caught SIGTERM %v", sig)
-				// 	done <- true
-			}
-
+	defer func() {
+		// Flush the spans of the last events before exiting
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Error("Could not flush traces", "error", err)
 		}
 	}()
 
-	// Start a poll for messages on the approvals model
-	log.Println("Starting approval watcher")
-	for {
-		items := cache.Items()
-		uids := []string{}
-		for key, _ := range items {
-			uids = append(uids, key)
-		}
-		requestHandler.FindApprovals(uids, generationsDir)
-		time.Sleep(15 * time.Second)
+	if err := monitor.New(config).Run(ctx); err != nil {
+		log.Fatal(err)
 	}
-
-	// // Wait until done is returned.
-	// <-done
 }
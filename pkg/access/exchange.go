@@ -0,0 +1,124 @@
+package access
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/galleybytes/monitor/pkg/handlers"
+	"github.com/galleybytes/monitor/pkg/logging"
+)
+
+// Reviewer authenticates the service account token of a monitor and returns the namespace of its service
+// account. The manager uses the Kubernetes TokenReview API.
+type Reviewer func(token string) (namespace string, err error)
+
+// Response is what the monitor gets from /api-token-please
+type Response struct {
+	Host      string    `json:"host"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Exchanger serves /api-token-please. The monitor sends its service account token as a bearer token and the
+// UUID of its resource as resource_uuid. A token is only minted when the resource is registered in the namespace
+// of the service account, by this cluster, and not deleted.
+type Exchanger struct {
+	// Host is the API the monitors use the tokens with
+	Host string
+
+	// Key signs the tokens. The API verifies the tokens with a Verifier that holds the same key.
+	Key []byte
+
+	// TTL is how long a token is valid. The monitor gets a new one before it expires.
+	TTL time.Duration
+
+	ClusterName string
+	Backend     handlers.Backend
+	Review      Reviewer
+	Now         func() time.Time
+}
+
+func (e Exchanger) now() time.Time {
+	if e.Now == nil {
+		return time.Now()
+	}
+	return e.Now()
+}
+
+// exchange returns the response for the service account token and resource, or the status code and error to
+// respond with
+func (e Exchanger) exchange(bearer, resourceUUID string) (Response, int, error) {
+	if bearer == "" {
+		return Response{}, http.StatusUnauthorized, fmt.Errorf("a service account token is required")
+	}
+	if resourceUUID == "" {
+		return Response{}, http.StatusBadRequest, fmt.Errorf("resource_uuid is required")
+	}
+	namespace, err := e.Review(bearer)
+	if err != nil {
+		return Response{}, http.StatusUnauthorized, err
+	}
+
+	claims := Claims{ResourceUUID: resourceUUID, Namespace: namespace}
+	cluster, err := e.Backend.FindCluster(e.ClusterName)
+	if err != nil {
+		return Response{}, http.StatusServiceUnavailable, err
+	}
+	tfoResource, err := e.Backend.FindTFOResource(resourceUUID)
+	if err != nil {
+		return Response{}, http.StatusServiceUnavailable, err
+	}
+	if cluster != nil && tfoResource != nil && tfoResource.ClusterID != cluster.ID {
+		// The monitor ships under the fork when the resource was forked by this cluster
+		tfoResource, err = e.Backend.FindTFOResource(handlers.ForkUUID(resourceUUID, *cluster))
+		if err != nil {
+			return Response{}, http.StatusServiceUnavailable, err
+		}
+		claims = Claims{ResourceUUID: handlers.ForkUUID(resourceUUID, *cluster), Namespace: namespace, ForkOf: resourceUUID}
+	}
+	switch {
+	case cluster == nil || tfoResource == nil:
+		return Response{}, http.StatusForbidden, fmt.Errorf("resource %s is not registered by this cluster", resourceUUID)
+	case tfoResource.Namespace != namespace:
+		return Response{}, http.StatusForbidden, fmt.Errorf("resource %s is not in namespace %s", resourceUUID, namespace)
+	case !tfoResource.DeletedAt.IsZero():
+		return Response{}, http.StatusForbidden, fmt.Errorf("resource %s was deleted", resourceUUID)
+	}
+
+	token, claims, err := Mint(e.Key, claims, e.TTL, e.now())
+	if err != nil {
+		return Response{}, http.StatusInternalServerError, err
+	}
+	slog.Info("Minted a token", logging.ResourceUUID, tfoResource.UUID, logging.Namespace, namespace, "token_id", claims.ID)
+	return Response{Host: e.Host, Token: token, ExpiresAt: time.Unix(claims.ExpiresAt, 0).UTC()}, http.StatusOK, nil
+}
+
+func (e Exchanger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	resourceUUID := r.URL.Query().Get("resource_uuid")
+
+	var response Response
+	var status int
+	var err error
+	func() {
+		// The backends panic when they cannot be reached
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				status, err = http.StatusServiceUnavailable, fmt.Errorf("%v", recovered)
+			}
+		}()
+		response, status, err = e.exchange(bearer, resourceUUID)
+	}()
+	if err != nil {
+		slog.Warn("Refused a token", logging.ResourceUUID, resourceUUID, logging.StatusCode, status, "error", err)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,119 @@
+// Package access hands out API access to the monitors. The monitor manager exchanges the projected service
+// account token of a monitor for a short lived API token that is scoped to the monitor's resource, so the
+// credentials of the API or the database are never copied into the namespaces of the resources.
+package access
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// tokenPrefix tells scoped tokens apart from the API's own tokens
+const tokenPrefix = "tfo1."
+
+// Claims are what a scoped token grants
+type Claims struct {
+	// ID identifies the token in logs
+	ID string `json:"jti"`
+
+	// KeyID names the key the token was signed with, see KeyID
+	KeyID string `json:"kid,omitempty"`
+
+	ResourceUUID string `json:"resource_uuid"`
+	Namespace    string `json:"namespace"`
+	ExpiresAt    int64  `json:"exp"`
+
+	// ForkOf is the resource the monitor was started for when it ships under a fork. It may only be read.
+	ForkOf string `json:"fork_of,omitempty"`
+}
+
+func (c Claims) Expired(now time.Time) bool {
+	return now.Unix() >= c.ExpiresAt
+}
+
+// Covers checks the claims grant access to the resource. The resource the monitor was started for may only be
+// read when the monitor ships under a fork.
+func (c Claims) Covers(resourceUUID string, write bool) bool {
+	return resourceUUID == c.ResourceUUID || (!write && c.ForkOf != "" && resourceUUID == c.ForkOf)
+}
+
+// KeyID identifies a signing key without revealing it, so the API can pick the key a token was signed with
+// while it accepts the keys of a rotation
+func KeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+// IsScopedToken checks if the token was minted by Mint, as opposed to being one of the API's own tokens
+func IsScopedToken(token string) bool {
+	return strings.HasPrefix(token, tokenPrefix)
+}
+
+func sign(key []byte, payload string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Mint signs a token with the claims that expires after ttl. The API verifies it with the same key.
+func Mint(key []byte, claims Claims, ttl time.Duration, now time.Time) (string, Claims, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", Claims{}, err
+	}
+	claims.ID = hex.EncodeToString(id)
+	claims.KeyID = KeyID(key)
+	claims.ExpiresAt = now.Add(ttl).Unix()
+	b, err := json.Marshal(claims)
+	if err != nil {
+		return "", Claims{}, err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return tokenPrefix + payload + "." + sign(key, payload), claims, nil
+}
+
+// Verify checks the signature and the expiry of a token minted with the key and returns its claims. The caller
+// still has to check the claims cover the resource of the request and that the resource was not deleted, which
+// revokes its tokens. The API uses a Verifier, which does both and accepts the keys of a rotation.
+func Verify(key []byte, token string, now time.Time) (Claims, error) {
+	payload, signature, found := strings.Cut(strings.TrimPrefix(token, tokenPrefix), ".")
+	if !IsScopedToken(token) || !found {
+		return Claims{}, fmt.Errorf("not a scoped token")
+	}
+	if !hmac.Equal([]byte(signature), []byte(sign(key, payload))) {
+		return Claims{}, fmt.Errorf("invalid signature")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return Claims{}, err
+	}
+	claims := Claims{}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return Claims{}, err
+	}
+	if claims.Expired(now) {
+		return claims, fmt.Errorf("token %s expired", claims.ID)
+	}
+	return claims, nil
+}
+
+// unverifiedKeyID reads the key ID of a token before its signature is checked. It only picks the key to check.
+func unverifiedKeyID(token string) string {
+	payload, _, _ := strings.Cut(strings.TrimPrefix(token, tokenPrefix), ".")
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return ""
+	}
+	claims := Claims{}
+	if json.Unmarshal(b, &claims) != nil {
+		return ""
+	}
+	return claims.KeyID
+}
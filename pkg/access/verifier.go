@@ -0,0 +1,120 @@
+package access
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/galleybytes/monitor/pkg/models"
+)
+
+// Verifier is what the API verifies scoped tokens with. It accepts tokens signed with any of its keys, so the
+// signing key of the manager can be rotated without rejecting the tokens handed out before.
+type Verifier struct {
+	// Keys are the keys the tokens may be signed with, the current signing key of the manager and the keys it
+	// signed with before a rotation
+	Keys [][]byte
+
+	// Resource looks up the resource a token is scoped to. Tokens of resources that are not registered or were
+	// deleted are revoked.
+	Resource func(uuid string) *models.TFOResource
+
+	// Revoked optionally revokes single tokens, eg by their ID, before they expire
+	Revoked func(claims Claims) bool
+
+	Now func() time.Time
+}
+
+// VerifierFromEnv returns a verifier for MONITOR_TOKEN_SIGNING_KEY and the comma separated keys in
+// MONITOR_TOKEN_PREVIOUS_SIGNING_KEYS that were used before a rotation
+func VerifierFromEnv(resource func(uuid string) *models.TFOResource) (Verifier, error) {
+	key := os.Getenv("MONITOR_TOKEN_SIGNING_KEY")
+	if key == "" {
+		return Verifier{}, fmt.Errorf("MONITOR_TOKEN_SIGNING_KEY is not set")
+	}
+	keys := [][]byte{[]byte(key)}
+	for _, previous := range strings.Split(os.Getenv("MONITOR_TOKEN_PREVIOUS_SIGNING_KEYS"), ",") {
+		if previous = strings.TrimSpace(previous); previous != "" {
+			keys = append(keys, []byte(previous))
+		}
+	}
+	return Verifier{Keys: keys, Resource: resource}, nil
+}
+
+func (v Verifier) now() time.Time {
+	if v.Now == nil {
+		return time.Now()
+	}
+	return v.Now()
+}
+
+// Verify checks the token was signed with one of the keys, has not expired and was not revoked, and returns its
+// claims. The caller still has to check the claims cover the resource of the request with Covers.
+func (v Verifier) Verify(token string) (Claims, error) {
+	claims, err := v.verifySignature(token)
+	if err != nil {
+		return Claims{}, err
+	}
+	if v.Resource == nil {
+		return Claims{}, fmt.Errorf("token %s cannot be checked for revocation", claims.ID)
+	}
+	if tfoResource := v.Resource(claims.ResourceUUID); tfoResource == nil || !tfoResource.DeletedAt.IsZero() {
+		return Claims{}, fmt.Errorf("token %s was revoked", claims.ID)
+	}
+	if v.Revoked != nil && v.Revoked(claims) {
+		return Claims{}, fmt.Errorf("token %s was revoked", claims.ID)
+	}
+	return claims, nil
+}
+
+// verifySignature tries the key the token names. Tokens without a key ID are tried with every key.
+func (v Verifier) verifySignature(token string) (Claims, error) {
+	if len(v.Keys) == 0 {
+		return Claims{}, fmt.Errorf("no signing key is configured")
+	}
+	keyID := unverifiedKeyID(token)
+	err := fmt.Errorf("token was signed with the unknown key %s", keyID)
+	for _, key := range v.Keys {
+		if keyID != "" && keyID != KeyID(key) {
+			continue
+		}
+		claims, verifyErr := Verify(key, token, v.now())
+		if verifyErr == nil {
+			return claims, nil
+		}
+		err = verifyErr
+	}
+	return Claims{}, err
+}
+
+type claimsKey struct{}
+
+// Middleware verifies scoped tokens in the Token header before passing the request on with the claims in its
+// context, see ClaimsFromContext. Requests with any other token are passed on as is for the API to check.
+func (v Verifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get("Token")
+		if !IsScopedToken(token) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		claims, err := v.Verify(token)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims)))
+	})
+}
+
+// ClaimsFromContext returns the claims of the scoped token the request was made with
+func ClaimsFromContext(ctx context.Context) (Claims, bool) {
+	claims, ok := ctx.Value(claimsKey{}).(Claims)
+	return claims, ok
+}
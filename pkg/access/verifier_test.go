@@ -0,0 +1,180 @@
+package access
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/galleybytes/monitor/pkg/models"
+)
+
+var testNow = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func mint(t *testing.T, key string, claims Claims) string {
+	t.Helper()
+	token, _, err := Mint([]byte(key), claims, time.Hour, testNow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func testVerifier(keys ...string) Verifier {
+	v := Verifier{
+		Resource: func(uuid string) *models.TFOResource {
+			switch uuid {
+			case "uid-1":
+				return &models.TFOResource{UUID: uuid}
+			case "deleted":
+				return &models.TFOResource{UUID: uuid, DeletedAt: testNow}
+			}
+			return nil
+		},
+		Now: func() time.Time { return testNow },
+	}
+	for _, key := range keys {
+		v.Keys = append(v.Keys, []byte(key))
+	}
+	return v
+}
+
+func TestVerifierVerify(t *testing.T) {
+	// Tokens minted before key IDs were added are checked with every key
+	withoutKeyID := signClaims(t, "old", Claims{ID: "id", ResourceUUID: "uid-1", ExpiresAt: testNow.Add(time.Hour).Unix()})
+
+	for _, test := range []struct {
+		name     string
+		verifier Verifier
+		token    string
+		err      string
+	}{
+		{name: "current key", verifier: testVerifier("new", "old"), token: mint(t, "new", Claims{ResourceUUID: "uid-1"})},
+		{name: "previous key during a rotation", verifier: testVerifier("new", "old"), token: mint(t, "old", Claims{ResourceUUID: "uid-1"})},
+		{name: "without a key ID", verifier: testVerifier("new", "old"), token: withoutKeyID},
+		{name: "key removed after the rotation", verifier: testVerifier("new"), token: mint(t, "old", Claims{ResourceUUID: "uid-1"}), err: "unknown key"},
+		{name: "no keys", verifier: testVerifier(), token: mint(t, "new", Claims{ResourceUUID: "uid-1"}), err: "no signing key"},
+		{name: "forged", verifier: testVerifier("new"), token: mint(t, "new", Claims{ResourceUUID: "uid-1"}) + "x", err: "invalid signature"},
+		{name: "deleted resource", verifier: testVerifier("new"), token: mint(t, "new", Claims{ResourceUUID: "deleted"}), err: "revoked"},
+		{name: "unknown resource", verifier: testVerifier("new"), token: mint(t, "new", Claims{ResourceUUID: "uid-2"}), err: "revoked"},
+		{
+			name: "revoked token",
+			verifier: func() Verifier {
+				v := testVerifier("new")
+				v.Revoked = func(claims Claims) bool { return claims.ResourceUUID == "uid-1" }
+				return v
+			}(),
+			token: mint(t, "new", Claims{ResourceUUID: "uid-1"}),
+			err:   "revoked",
+		},
+		{
+			name: "expired",
+			verifier: func() Verifier {
+				v := testVerifier("new")
+				v.Now = func() time.Time { return testNow.Add(2 * time.Hour) }
+				return v
+			}(),
+			token: mint(t, "new", Claims{ResourceUUID: "uid-1"}),
+			err:   "expired",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			claims, err := test.verifier.Verify(test.token)
+			if test.err == "" {
+				if err != nil || claims.ResourceUUID != "uid-1" {
+					t.Errorf("expected the token to be verified, got %+v %v", claims, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected an error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+// signClaims signs the claims as they are, unlike Mint which sets the ID and the key ID
+func signClaims(t *testing.T, key string, claims Claims) string {
+	t.Helper()
+	b, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return tokenPrefix + payload + "." + sign([]byte(key), payload)
+}
+
+func TestClaimsCovers(t *testing.T) {
+	claims := Claims{ResourceUUID: "fork", ForkOf: "uid-1"}
+	for _, test := range []struct {
+		uuid     string
+		write    bool
+		expected bool
+	}{
+		{uuid: "fork", write: true, expected: true},
+		{uuid: "uid-1", write: false, expected: true},
+		{uuid: "uid-1", write: true, expected: false},
+		{uuid: "uid-2", write: false, expected: false},
+	} {
+		if got := claims.Covers(test.uuid, test.write); got != test.expected {
+			t.Errorf("expected Covers(%s, %t) to be %t", test.uuid, test.write, test.expected)
+		}
+	}
+	if (Claims{ResourceUUID: "uid-1"}).Covers("", false) {
+		t.Error("expected claims without a fork not to cover an empty resource")
+	}
+}
+
+func TestVerifierFromEnv(t *testing.T) {
+	t.Setenv("MONITOR_TOKEN_SIGNING_KEY", "new")
+	t.Setenv("MONITOR_TOKEN_PREVIOUS_SIGNING_KEYS", "old, older")
+	v, err := VerifierFromEnv(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v.Keys) != 3 || string(v.Keys[0]) != "new" || string(v.Keys[2]) != "older" {
+		t.Errorf("unexpected keys %q", v.Keys)
+	}
+
+	t.Setenv("MONITOR_TOKEN_SIGNING_KEY", "")
+	if _, err := VerifierFromEnv(nil); err == nil {
+		t.Error("expected a missing signing key to fail")
+	}
+}
+
+func TestVerifierMiddleware(t *testing.T) {
+	v := testVerifier("new")
+	handler := v.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := ClaimsFromContext(r.Context())
+		if ok {
+			w.Write([]byte(claims.ResourceUUID))
+		}
+	}))
+
+	for _, test := range []struct {
+		name  string
+		token string
+		code  int
+		body  string
+	}{
+		{name: "scoped token", token: mint(t, "new", Claims{ResourceUUID: "uid-1"}), code: http.StatusOK, body: "uid-1"},
+		{name: "revoked token", token: mint(t, "new", Claims{ResourceUUID: "deleted"}), code: http.StatusUnauthorized},
+		{name: "api token", token: "api-token", code: http.StatusOK, body: ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/api/v1/resource/uid-1", nil)
+			request.Header.Set("Token", test.token)
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			if recorder.Code != test.code {
+				t.Fatalf("expected a %d, got %d: %s", test.code, recorder.Code, recorder.Body.String())
+			}
+			if test.code == http.StatusOK && recorder.Body.String() != test.body {
+				t.Errorf("expected the claims of %q, got %q", test.body, recorder.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,355 @@
+package archive
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/galleybytes/monitor/pkg/handlers"
+	"github.com/galleybytes/monitor/pkg/models"
+)
+
+const (
+	Kind         = "MonitorArchive"
+	Version      = 2
+	ManifestFile = "manifest.json"
+)
+
+// Manifest describes everything in the archive. Task logs are stored next to it as plain text files, one line
+// per log line, named like the files the tasks write to TFO_ROOT_PATH. Version 1 archives have no line numbers.
+type Manifest struct {
+	Kind        string             `json:"kind"`
+	Version     int                `json:"version"`
+	CreatedAt   time.Time          `json:"created_at"`
+	TFOResource models.TFOResource `json:"tfo_resource"`
+	Generations []Generation       `json:"generations"`
+}
+
+type Generation struct {
+	Generation   string                  `json:"generation"`
+	ResourceSpec *models.TFOResourceSpec `json:"resource_spec,omitempty"`
+	Tasks        []Task                  `json:"tasks"`
+}
+
+type Task struct {
+	TaskPod  models.TaskPod   `json:"task_pod"`
+	Approval *models.Approval `json:"approval,omitempty"`
+	LogFile  string           `json:"log_file"`
+	Lines    int              `json:"lines"`
+
+	// LineNos are the line numbers of the lines in LogFile, in the same order. They are saved with the lines
+	// because the backends skip lines by their number, and a log shipped after a restart can have gaps.
+	LineNos []string `json:"line_nos,omitempty"`
+}
+
+// logFile names the log of the i-th task of its generation. The index keeps the names of task pods that were
+// saved without a UUID apart.
+func logFile(i int, taskPod models.TaskPod) string {
+	return fmt.Sprintf("logs/%s/%d.%s.%d.%s.out", taskPod.Generation, i, taskPod.TaskType, taskPod.Rerun, taskPod.UUID)
+}
+
+// Export reads the run history of the resource from the backend and writes it to w as a tar.gz
+func Export(h handlers.Backend, uuid string, w io.Writer) error {
+	tfoResource, err := h.FindTFOResource(uuid)
+	if err != nil {
+		return err
+	}
+	if tfoResource == nil {
+		return fmt.Errorf("resource '%s' was not found", uuid)
+	}
+	currentGeneration, err := strconv.Atoi(tfoResource.CurrentGeneration)
+	if err != nil {
+		return fmt.Errorf("resource '%s' has an invalid generation '%s'", uuid, tfoResource.CurrentGeneration)
+	}
+
+	manifest := Manifest{
+		Kind:        Kind,
+		Version:     Version,
+		CreatedAt:   time.Now().UTC(),
+		TFOResource: *tfoResource,
+		Generations: []Generation{},
+	}
+	logs := map[string][]byte{}
+	for i := 1; i <= currentGeneration; i++ {
+		resourceSpec, err := h.FindResourceSpec(uuid, strconv.Itoa(i))
+		if err != nil {
+			return err
+		}
+		generation := Generation{
+			Generation:   strconv.Itoa(i),
+			ResourceSpec: resourceSpec,
+			Tasks:        []Task{},
+		}
+
+		taskPods, err := h.FindTaskPods(uuid, generation.Generation)
+		if err != nil {
+			return err
+		}
+		for index, taskPod := range taskPods {
+			// The resource is already in the manifest
+			taskPod.TFOResource = models.TFOResource{}
+			task := Task{
+				TaskPod: taskPod,
+				LogFile: logFile(index, taskPod),
+			}
+			tfoTaskLogs := []models.TFOTaskLog{}
+			if taskPod.UUID != "" {
+				approvalStatus, err := h.FindApprovalStatus(taskPod.UUID)
+				if err != nil {
+					return err
+				}
+				if approvalStatus != nil {
+					approval := approvalStatus.Approval
+					approval.TaskPod = models.TaskPod{}
+					task.Approval = &approval
+				}
+				tfoTaskLogs, err = h.FindTaskLogs(taskPod.UUID)
+				if err != nil {
+					return err
+				}
+			}
+			sort.SliceStable(tfoTaskLogs, func(i, j int) bool {
+				a, _ := strconv.Atoi(tfoTaskLogs[i].LineNo)
+				b, _ := strconv.Atoi(tfoTaskLogs[j].LineNo)
+				return a < b
+			})
+			var buf bytes.Buffer
+			for _, tfoTaskLog := range tfoTaskLogs {
+				buf.WriteString(tfoTaskLog.Message)
+				buf.WriteString("\n")
+				task.LineNos = append(task.LineNos, tfoTaskLog.LineNo)
+			}
+			task.Lines = len(tfoTaskLogs)
+			logs[task.LogFile] = buf.Bytes()
+			generation.Tasks = append(generation.Tasks, task)
+		}
+
+		if generation.ResourceSpec == nil && len(generation.Tasks) == 0 {
+			continue
+		}
+		manifest.Generations = append(manifest.Generations, generation)
+	}
+
+	return write(w, manifest, logs)
+}
+
+func write(w io.Writer, manifest Manifest, logs map[string][]byte) error {
+	gzipWriter := gzip.NewWriter(w)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	files := []string{}
+	for name := range logs {
+		files = append(files, name)
+	}
+	sort.Strings(files)
+
+	// The manifest goes first so readers can stream the archive
+	if err := writeFile(tarWriter, ManifestFile, manifestData, manifest.CreatedAt); err != nil {
+		return err
+	}
+	for _, name := range files {
+		if err := writeFile(tarWriter, name, logs[name], manifest.CreatedAt); err != nil {
+			return err
+		}
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+	return gzipWriter.Close()
+}
+
+func writeFile(tarWriter *tar.Writer, name string, data []byte, modTime time.Time) error {
+	err := tarWriter.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: modTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tarWriter.Write(data)
+	return err
+}
+
+// Read returns the manifest and the log files of an archive
+func Read(r io.Reader) (*Manifest, map[string][]byte, error) {
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer gzipReader.Close()
+	tarReader := tar.NewReader(gzipReader)
+
+	var manifest *Manifest
+	logs := map[string][]byte{}
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := io.ReadAll(tarReader)
+		if err != nil {
+			return nil, nil, err
+		}
+		if header.Name == ManifestFile {
+			manifest = &Manifest{}
+			if err := json.Unmarshal(data, manifest); err != nil {
+				return nil, nil, fmt.Errorf("could not read %s: %s", ManifestFile, err)
+			}
+			continue
+		}
+		logs[header.Name] = data
+	}
+
+	if manifest == nil {
+		return nil, nil, fmt.Errorf("archive does not contain %s", ManifestFile)
+	}
+	if manifest.Kind != Kind {
+		return nil, nil, fmt.Errorf("expected an archive of kind '%s' but got '%s'", Kind, manifest.Kind)
+	}
+	if manifest.Version > Version {
+		return nil, nil, fmt.Errorf("archive version %d is newer than the supported version %d", manifest.Version, Version)
+	}
+	return manifest, logs, nil
+}
+
+// Import replays an archive into the backend. The resource is registered to the cluster named clusterName.
+// Anything that already exists in the backend is left as is and only missing log lines are written, so importing
+// the same archive twice is safe. Task pods are looked up by their UUID, so an archive with a task pod without one
+// is refused before anything is written.
+func Import(h handlers.Backend, clusterName string, r io.Reader) error {
+	manifest, logs, err := Read(r)
+	if err != nil {
+		return err
+	}
+	for _, generation := range manifest.Generations {
+		for _, task := range generation.Tasks {
+			if task.TaskPod.UUID == "" {
+				return fmt.Errorf("task %s of generation %s has no UUID and cannot be imported", task.LogFile, generation.Generation)
+			}
+		}
+	}
+
+	if clusterName == "" {
+		clusterName = manifest.TFOResource.Cluster.Name
+	}
+	cluster, err := h.GetOrSetCluster(clusterName)
+	if err != nil {
+		return err
+	}
+
+	uuid := manifest.TFOResource.UUID
+	tfoResource, err := h.FindTFOResource(uuid)
+	if err != nil {
+		return err
+	}
+	if tfoResource == nil {
+		// Only the fields of the resource are copied, the keys and associations of the exporting database are
+		// replaced with the ones of this API so they cannot collide with or overwrite existing rows
+		resource := models.TFOResource{
+			UUID:              uuid,
+			CreatedBy:         manifest.TFOResource.CreatedBy,
+			UpdatedBy:         manifest.TFOResource.UpdatedBy,
+			Namespace:         manifest.TFOResource.Namespace,
+			Name:              manifest.TFOResource.Name,
+			CurrentGeneration: manifest.TFOResource.CurrentGeneration,
+			Cluster:           *cluster,
+			ClusterID:         cluster.ID,
+		}
+		added, err := h.AddTFOResource(resource)
+		if err != nil {
+			return err
+		}
+		tfoResource = &added
+	}
+
+	for _, generation := range manifest.Generations {
+		if generation.ResourceSpec != nil {
+			saved, err := h.FindResourceSpec(uuid, generation.Generation)
+			if err != nil {
+				return err
+			}
+			if saved == nil {
+				resourceSpec := *generation.ResourceSpec
+				resourceSpec.TFOResource = models.TFOResource{}
+				resourceSpec.ID = 0
+				if err := h.AddResourceSpec(resourceSpec); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, task := range generation.Tasks {
+			taskPod, err := h.GetOrSetTaskPod(*tfoResource, task.TaskPod.TaskType, task.TaskPod.Generation, task.TaskPod.Rerun, task.TaskPod.UUID)
+			if err != nil {
+				return err
+			}
+
+			data, found := logs[task.LogFile]
+			if !found {
+				return fmt.Errorf("archive is missing %s", task.LogFile)
+			}
+			lines := []models.TFOTaskLog{}
+			scanner := bufio.NewScanner(bytes.NewReader(data))
+			scanner.Buffer(make([]byte, 64*1024), len(data)+1)
+			for scanner.Scan() {
+				lineNo := strconv.Itoa(len(lines) + 1)
+				if manifest.Version > 1 {
+					if len(lines) >= len(task.LineNos) {
+						return fmt.Errorf("%s has more lines than the %d line numbers of the manifest", task.LogFile, len(task.LineNos))
+					}
+					lineNo = task.LineNos[len(lines)]
+				}
+				lines = append(lines, models.TFOTaskLog{
+					Message:     scanner.Text(),
+					TFOResource: *tfoResource,
+					TaskPod:     taskPod,
+					LineNo:      lineNo,
+				})
+			}
+			if err := scanner.Err(); err != nil {
+				return fmt.Errorf("could not read %s: %s", task.LogFile, err)
+			}
+			if manifest.Version > 1 && len(lines) != len(task.LineNos) {
+				return fmt.Errorf("%s has %d lines but the manifest has %d line numbers", task.LogFile, len(lines), len(task.LineNos))
+			}
+			if _, err := h.WriteAllLines(*tfoResource, taskPod, lines); err != nil {
+				return fmt.Errorf("could not import %s: %s", task.LogFile, err)
+			}
+
+			if task.Approval == nil {
+				continue
+			}
+			approvalStatus, err := h.FindApprovalStatus(taskPod.UUID)
+			if err != nil {
+				return err
+			}
+			if approvalStatus == nil {
+				approval := *task.Approval
+				approval.TaskPod = models.TaskPod{}
+				approval.TaskPodUUID = taskPod.UUID
+				approval.ID = 0
+				if err := h.AddApproval(approval); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package archive
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/galleybytes/monitor/pkg/fakeapi"
+	"github.com/galleybytes/monitor/pkg/handlers"
+	"github.com/galleybytes/monitor/pkg/models"
+	"github.com/galleybytes/monitor/pkg/sanitize"
+	gocache "github.com/patrickmn/go-cache"
+)
+
+const testUUID = "00000000-0000-0000-0000-000000000001"
+
+func newTestBackend(t *testing.T) (*fakeapi.Server, handlers.Backend) {
+	t.Helper()
+	api := fakeapi.New()
+	t.Cleanup(api.Close)
+	specSanitizer, err := sanitize.New([]byte("test-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return api, handlers.NewWithToken(api.URL, api.Token, gocache.New(gocache.NoExpiration, gocache.NoExpiration)).
+		WithSpecSanitizer(specSanitizer)
+}
+
+// writeHistory saves two generations of a resource with a spec, logs and an approval
+func writeHistory(t *testing.T, h handlers.Backend) {
+	t.Helper()
+	cluster, err := h.GetOrSetCluster("source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tfoResource, err := h.RegisterTFOResource(testUUID, "default", "example", "1", *cluster, []byte(`{"terraformVersion":"1.5.6"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tfoResource, err = h.RegisterTFOResource(testUUID, "default", "example", "2", *cluster, []byte(`{"terraformVersion":"1.5.7"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, task := range []struct {
+		generation, taskType, uid string
+		lines                     []string
+	}{
+		{"1", "init", "init-1", []string{"Initializing", "Done"}},
+		{"2", "plan", "plan-2", []string{"Plan: 1 to add", "", "  indented"}},
+	} {
+		taskPod, err := h.GetOrSetTaskPod(tfoResource, task.taskType, task.generation, 0, task.uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := []models.TFOTaskLog{}
+		for i, line := range task.lines {
+			lines = append(lines, models.TFOTaskLog{Message: line, LineNo: strconv.Itoa(i + 1), TaskPod: taskPod, TFOResource: tfoResource})
+		}
+		if _, err := h.WriteAllLines(tfoResource, taskPod, lines); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := h.AddApproval(models.Approval{IsApproved: true, TaskPodUUID: "plan-2"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func export(t *testing.T, h handlers.Backend) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := Export(h, testUUID, &buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	_, source := newTestBackend(t)
+	writeHistory(t, source)
+	exported := export(t, source)
+
+	api, target := newTestBackend(t)
+	if err := Import(target, "target", bytes.NewReader(exported)); err != nil {
+		t.Fatal(err)
+	}
+	// Importing again only writes what is missing
+	if err := Import(target, "target", bytes.NewReader(exported)); err != nil {
+		t.Fatal(err)
+	}
+
+	want, wantLogs, err := Read(bytes.NewReader(exported))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, gotLogs, err := Read(bytes.NewReader(export(t, target)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.TFOResource.Cluster.Name != "target" || got.TFOResource.CurrentGeneration != "2" {
+		t.Errorf("unexpected imported resource %+v", got.TFOResource)
+	}
+	if len(got.Generations) != len(want.Generations) {
+		t.Fatalf("expected %d generations, got %d", len(want.Generations), len(got.Generations))
+	}
+	for i, generation := range want.Generations {
+		imported := got.Generations[i]
+		if imported.ResourceSpec == nil || imported.ResourceSpec.ResourceSpec != generation.ResourceSpec.ResourceSpec ||
+			imported.ResourceSpec.SpecDiff != generation.ResourceSpec.SpecDiff {
+			t.Errorf("generation %s: expected the spec %+v, got %+v", generation.Generation, generation.ResourceSpec, imported.ResourceSpec)
+		}
+		if len(imported.Tasks) != len(generation.Tasks) {
+			t.Fatalf("generation %s: expected %d tasks, got %d", generation.Generation, len(generation.Tasks), len(imported.Tasks))
+		}
+		for j, task := range generation.Tasks {
+			importedTask := imported.Tasks[j]
+			if importedTask.TaskPod.UUID != task.TaskPod.UUID || importedTask.Lines != task.Lines {
+				t.Errorf("expected the task %+v, got %+v", task, importedTask)
+			}
+			if !bytes.Equal(gotLogs[importedTask.LogFile], wantLogs[task.LogFile]) {
+				t.Errorf("expected the log %q, got %q", wantLogs[task.LogFile], gotLogs[importedTask.LogFile])
+			}
+			if (task.Approval == nil) != (importedTask.Approval == nil) ||
+				(task.Approval != nil && task.Approval.IsApproved != importedTask.Approval.IsApproved) {
+				t.Errorf("expected the approval %+v, got %+v", task.Approval, importedTask.Approval)
+			}
+		}
+	}
+	if n := len(api.TaskLogs("plan-2")); n != 3 {
+		t.Errorf("expected the lines to be imported once, got %d", n)
+	}
+}
+
+func TestExportImportKeepsLineNumbers(t *testing.T) {
+	_, source := newTestBackend(t)
+	cluster, err := source.GetOrSetCluster("source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tfoResource, err := source.RegisterTFOResource(testUUID, "default", "example", "1", *cluster, []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	taskPod, err := source.GetOrSetTaskPod(tfoResource, "apply", "1", 0, "apply-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The lines of a monitor that restarted after a line was lost
+	lines := []models.TFOTaskLog{}
+	for _, lineNo := range []string{"1", "2", "4", "5"} {
+		lines = append(lines, models.TFOTaskLog{Message: "line " + lineNo, LineNo: lineNo, TaskPod: taskPod, TFOResource: tfoResource})
+	}
+	if _, err := source.WriteAllLines(tfoResource, taskPod, lines); err != nil {
+		t.Fatal(err)
+	}
+
+	api, target := newTestBackend(t)
+	if err := Import(target, "target", bytes.NewReader(export(t, source))); err != nil {
+		t.Fatal(err)
+	}
+	imported := []string{}
+	for _, tfoTaskLog := range api.TaskLogs("apply-1") {
+		imported = append(imported, tfoTaskLog.LineNo+":"+tfoTaskLog.Message)
+	}
+	if got, want := strings.Join(imported, ","), "1:line 1,2:line 2,4:line 4,5:line 5"; got != want {
+		t.Errorf("imported the lines %s, want %s", got, want)
+	}
+}
+
+func TestExportImportReturnBackendFailures(t *testing.T) {
+	api, source := newTestBackend(t)
+	writeHistory(t, source)
+	exported := export(t, source)
+
+	api.InjectFault(fakeapi.Fault{PathPrefix: "/api/v1/resource/" + testUUID + "/generation/", StatusCode: 500})
+	if err := Export(source, testUUID, &bytes.Buffer{}); err == nil {
+		t.Error("Export() returned no error when the task pods could not be read")
+	}
+
+	api, target := newTestBackend(t)
+	api.InjectFault(fakeapi.Fault{PathPrefix: "/api/v1/approval", StatusCode: 500})
+	if err := Import(target, "target", bytes.NewReader(exported)); err == nil {
+		t.Error("Import() returned no error when the approval could not be saved")
+	}
+}
+
+func TestLogFileKeepsTaskPodsWithoutUUIDApart(t *testing.T) {
+	taskPod := models.TaskPod{TaskType: "plan", Generation: "1"}
+	if logFile(0, taskPod) == logFile(1, taskPod) {
+		t.Errorf("expected task pods without a UUID to get their own log file, got %s", logFile(0, taskPod))
+	}
+}
+
+func TestImportRefusesTaskPodsWithoutUUID(t *testing.T) {
+	var buf bytes.Buffer
+	manifest := Manifest{
+		Kind:        Kind,
+		Version:     Version,
+		TFOResource: models.TFOResource{UUID: testUUID, CurrentGeneration: "1"},
+		Generations: []Generation{{Generation: "1", Tasks: []Task{{TaskPod: models.TaskPod{TaskType: "plan", Generation: "1"}, LogFile: "logs/1/0.plan.0..out"}}}},
+	}
+	if err := write(&buf, manifest, map[string][]byte{"logs/1/0.plan.0..out": []byte("line\n")}); err != nil {
+		t.Fatal(err)
+	}
+	api, h := newTestBackend(t)
+	err := Import(h, "target", &buf)
+	if err == nil || !strings.Contains(err.Error(), "has no UUID") {
+		t.Errorf("expected the archive to be refused, got %v", err)
+	}
+	if len(api.Clusters()) != 0 {
+		t.Error("expected nothing to be written")
+	}
+}
@@ -0,0 +1,562 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/galleybytes/monitor/pkg/handlers"
+	"github.com/galleybytes/monitor/pkg/logging"
+	"github.com/galleybytes/monitor/pkg/models"
+	"github.com/galleybytes/monitor/pkg/sanitize"
+	"github.com/galleybytes/monitor/pkg/tracing"
+	"github.com/galleybytes/monitor/pkg/util"
+	gocache "github.com/patrickmn/go-cache"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Backend writes directly to the database the terraform-operator-api uses. It is meant for air-gapped clusters
+// that do not run the API. Like the HTTP handler, failures to communicate with the database will cause a panic.
+type Backend struct {
+	db    *gorm.DB
+	cache *gocache.Cache
+
+	clusterMismatchPolicy handlers.ClusterMismatchPolicy
+
+	// specSanitizer redacts the resource spec before it is saved. Saving a spec without setting it with
+	// WithSpecSanitizer panics.
+	specSanitizer sanitize.Sanitizer
+
+	// specDiff is whether the table of the specs has the spec_diff column
+	specDiff bool
+
+	// adoptions is whether the database has the table of the cluster adoptions
+	adoptions bool
+}
+
+var _ handlers.Backend = Backend{}
+
+// DSNFromEnv builds the connection string from the env the monitor manager distributes to each namespace
+func DSNFromEnv() (string, error) {
+	host := os.Getenv("DBHOST")
+	if host == "" {
+		return "", fmt.Errorf("DBHOST cannot be empty")
+	}
+	port := os.Getenv("PGPORT")
+	if port == "" {
+		port = "5432"
+	}
+	user := os.Getenv("PGUSER")
+	if user == "" {
+		return "", fmt.Errorf("PGUSER cannot be empty")
+	}
+	database := os.Getenv("PGDATABASE")
+	if database == "" {
+		return "", fmt.Errorf("PGDATABASE cannot be empty")
+	}
+	sslMode := os.Getenv("PGSSLMODE")
+	if sslMode == "" {
+		sslMode = "disable"
+	}
+	return fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
+		dsnValue(host), dsnValue(port), dsnValue(user), dsnValue(os.Getenv("PGPASSWORD")), dsnValue(database),
+		dsnValue(sslMode)), nil
+}
+
+// dsnValue quotes a value of a keyword/value connection string the way libpq reads it, so passwords with spaces,
+// quotes or backslashes are passed as is
+func dsnValue(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
+
+// WithContext returns a copy of the backend that runs its queries with ctx
+func (b Backend) WithContext(ctx context.Context) handlers.Backend {
+	b.db = b.db.WithContext(ctx)
+	return b
+}
+
+// startSpan starts a child span of the backend's context and returns a copy of the backend that runs its
+// queries within the span
+func (b Backend) startSpan(name string, attrs ...attribute.KeyValue) (Backend, trace.Span) {
+	ctx, span := tracing.Start(b.db.Statement.Context, name, attrs...)
+	b.db = b.db.WithContext(ctx)
+	return b, span
+}
+
+// New connects to Postgres. When autoMigrate is true the tables are created or updated to match pkg/models.
+func New(dsn string, autoMigrate bool, cache *gocache.Cache) (Backend, error) {
+	return Open(postgres.Open(dsn), autoMigrate, cache)
+}
+
+// Open connects to the database of the dialector, like New does for Postgres
+func Open(dialector gorm.Dialector, autoMigrate bool, cache *gocache.Cache) (Backend, error) {
+	db, err := gorm.Open(dialector, &gorm.Config{})
+	if err != nil {
+		return Backend{}, err
+	}
+	if autoMigrate {
+		err = db.AutoMigrate(
+			&models.Cluster{},
+			&models.TFOResource{},
+			&models.TFOResourceSpec{},
+			&models.TaskPod{},
+			&models.TFOTaskLog{},
+			&models.Approval{},
+			&models.ClusterAdoption{},
+		)
+		if err != nil {
+			return Backend{}, fmt.Errorf("schema migration failed: %s", err)
+		}
+	}
+	return Backend{
+		db:                    db,
+		cache:                 cache,
+		clusterMismatchPolicy: handlers.ClusterMismatchFail,
+		specDiff:              db.Migrator().HasColumn(&models.TFOResourceSpec{}, "SpecDiff"),
+		adoptions:             db.Migrator().HasTable(&models.ClusterAdoption{}),
+	}, nil
+}
+
+// SpecDiffSupported returns why the database cannot save TFOResourceSpec.SpecDiff, nil when it can. The column is
+// only there once the schema was migrated to models.SpecDiffSchemaVersion.
+func (b Backend) SpecDiffSupported() error {
+	if !b.specDiff {
+		return fmt.Errorf("the table of the specs has no spec_diff column, migrate the schema to version %s", models.SpecDiffSchemaVersion)
+	}
+	return nil
+}
+
+// WithClusterMismatchPolicy returns a copy of the backend that resolves resources bound to another cluster with
+// the policy
+func (b Backend) WithClusterMismatchPolicy(policy handlers.ClusterMismatchPolicy) Backend {
+	b.clusterMismatchPolicy = policy
+	return b
+}
+
+// WithSpecSanitizer returns a copy of the backend that redacts the resource spec with the sanitizer instead of
+// only the builtin rules
+func (b Backend) WithSpecSanitizer(specSanitizer sanitize.Sanitizer) Backend {
+	b.specSanitizer = specSanitizer
+	return b
+}
+
+// GetOrSetCluster will find an existing cluster or create a new one in the db
+func (b Backend) GetOrSetCluster(name string) (*models.Cluster, error) {
+	b, span := b.startSpan("register cluster", attribute.String(logging.Cluster, name))
+	defer span.End()
+	cluster := models.Cluster{}
+	result := b.db.Where(models.Cluster{Name: name}).FirstOrCreate(&cluster)
+	if result.Error != nil {
+		return nil, fmt.Errorf("error finding cluster '%s': %w", name, result.Error)
+	}
+	return &cluster, nil
+}
+
+// FindCluster returns the cluster registered under name or nil when it has not been registered yet
+func (b Backend) FindCluster(name string) (*models.Cluster, error) {
+	cluster := models.Cluster{}
+	result := b.db.Where("name = ?", name).Limit(1).Find(&cluster)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+	return &cluster, nil
+}
+
+// FindTFOResource returns the resource registered under uuid or nil when it has not been registered yet
+func (b Backend) FindTFOResource(uuid string) (*models.TFOResource, error) {
+	tfoResource := models.TFOResource{}
+	result := b.db.Preload("Cluster").Where("uuid = ?", uuid).Limit(1).Find(&tfoResource)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+	return &tfoResource, nil
+}
+
+// mustFindTFOResource is FindTFOResource for the calls that panic when the database cannot be reached
+func (b Backend) mustFindTFOResource(uuid string) *models.TFOResource {
+	tfoResource, err := b.FindTFOResource(uuid)
+	if err != nil {
+		log.Panic(err)
+	}
+	return tfoResource
+}
+
+// FindResourceSpec returns the latest spec saved for the generation of the resource or nil if there is none
+func (b Backend) FindResourceSpec(uuid, generation string) (*models.TFOResourceSpec, error) {
+	resourceSpec := models.TFOResourceSpec{}
+	result := b.db.Where("tfo_resource_uuid = ? AND generation = ?", uuid, generation).Order("id desc").Limit(1).Find(&resourceSpec)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+	return &resourceSpec, nil
+}
+
+// FindPreviousResourceSpec returns the spec saved for the latest generation of the resource below the generation,
+// or nil if there is none
+func (b Backend) FindPreviousResourceSpec(uuid, generation string) (*models.TFOResourceSpec, error) {
+	n, err := strconv.Atoi(generation)
+	if err != nil {
+		return nil, nil
+	}
+	// Generations are saved as strings so they are compared as numbers here
+	generations := []string{}
+	result := b.db.Model(&models.TFOResourceSpec{}).Where("tfo_resource_uuid = ?", uuid).Distinct().Pluck("generation", &generations)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	previous := 0
+	for _, g := range generations {
+		if i, err := strconv.Atoi(g); err == nil && i < n && i > previous {
+			previous = i
+		}
+	}
+	if previous == 0 {
+		return nil, nil
+	}
+	return b.FindResourceSpec(uuid, strconv.Itoa(previous))
+}
+
+// addResourceSpec saves the spec with its diff to the spec of the previous generation, or without it when the
+// database cannot save it
+func (b Backend) addResourceSpec(uuid, generation string, resourceSpec []byte) {
+	if err := b.SpecDiffSupported(); err != nil {
+		slog.Warn("The spec diff is not saved", logging.ResourceUUID, uuid, logging.Generation, generation, "error", err)
+		if err := b.AddResourceSpec(models.TFOResourceSpec{TFOResourceUUID: uuid, Generation: generation, ResourceSpec: string(resourceSpec)}); err != nil {
+			log.Panic(err)
+		}
+		return
+	}
+	var previous []byte
+	saved, err := b.FindPreviousResourceSpec(uuid, generation)
+	if err != nil {
+		log.Panic(err)
+	}
+	if saved != nil {
+		previous = []byte(saved.ResourceSpec)
+	}
+	result := b.db.Omit(clause.Associations).Create(&models.TFOResourceSpec{
+		TFOResourceUUID: uuid,
+		Generation:      generation,
+		ResourceSpec:    string(resourceSpec),
+		SpecDiff:        handlers.SpecDiff(previous, resourceSpec),
+	})
+	if result.Error != nil {
+		log.Panic(result.Error)
+	}
+}
+
+// RecordResourceSpec saves the spec of the generation, redacted by the spec sanitizer, unless the latest spec saved
+// for it is the same
+func (b Backend) RecordResourceSpec(uuid, generation string, resourceSpec []byte) bool {
+	b, span := b.startSpan("record resource spec",
+		attribute.String(logging.ResourceUUID, uuid),
+		attribute.String(logging.Generation, generation),
+	)
+	defer span.End()
+	resourceSpec = b.specSanitizer.Sanitize(resourceSpec)
+
+	saved, err := b.FindResourceSpec(uuid, generation)
+	if err != nil {
+		log.Panic(err)
+	}
+	if saved != nil && handlers.SameSpec([]byte(saved.ResourceSpec), resourceSpec) {
+		return false
+	}
+	b.addResourceSpec(uuid, generation, resourceSpec)
+	return true
+}
+
+// RegisterTFOResource finds or updates the tfo_resource table in the database. The resourceSpec is added as the
+// tfo_resource_spec, redacted by the spec sanitizer, when the resource is created or the generation changed and a
+// resource bound to another cluster is resolved with the ClusterMismatchPolicy, the same as the API handler.
+func (b Backend) RegisterTFOResource(uuid, namespace, name, currentGeneration string, cluster models.Cluster, resourceSpec []byte) (models.TFOResource, error) {
+	b, span := b.startSpan("register resource",
+		attribute.String(logging.ResourceUUID, uuid),
+		attribute.String(logging.Generation, currentGeneration),
+	)
+	defer span.End()
+	resourceSpec = b.specSanitizer.Sanitize(resourceSpec)
+
+	found := b.mustFindTFOResource(uuid)
+	if found == nil {
+		tfoResource := models.TFOResource{
+			UUID:              uuid,
+			Namespace:         namespace,
+			Name:              name,
+			CurrentGeneration: currentGeneration,
+			ClusterID:         cluster.ID,
+		}
+		result := b.db.Omit(clause.Associations).Create(&tfoResource)
+		if result.Error != nil {
+			log.Panic(result.Error)
+		}
+		b.addResourceSpec(uuid, currentGeneration, resourceSpec)
+		return *b.mustFindTFOResource(uuid), nil
+	}
+
+	tfoResource := *found
+	if tfoResource.ClusterID != cluster.ID {
+		if err := handlers.ReportClusterMismatch(b.clusterMismatchPolicy, tfoResource, cluster); err != nil {
+			return tfoResource, err
+		}
+		switch b.clusterMismatchPolicy {
+		case handlers.ClusterMismatchAdopt:
+			// The adoption is recorded before the resource is rebound, the same as the API handler
+			err := b.addClusterAdoption(models.ClusterAdoption{
+				TFOResourceUUID: uuid,
+				FromClusterID:   tfoResource.ClusterID,
+				ToClusterID:     cluster.ID,
+				Generation:      currentGeneration,
+			})
+			if err != nil {
+				return tfoResource, err
+			}
+			tfoResource.UpdatedBy = handlers.AdoptedBy(tfoResource.ClusterID, cluster)
+			tfoResource.ClusterID = cluster.ID
+			tfoResource.Cluster = cluster
+		case handlers.ClusterMismatchFork:
+			forkUUID := handlers.ForkUUID(uuid, cluster)
+			fork := b.mustFindTFOResource(forkUUID)
+			if fork == nil {
+				result := b.db.Omit(clause.Associations).Create(&models.TFOResource{
+					UUID:              forkUUID,
+					CreatedBy:         handlers.ForkedBy(uuid, tfoResource.ClusterID),
+					Namespace:         namespace,
+					Name:              name,
+					CurrentGeneration: currentGeneration,
+					ClusterID:         cluster.ID,
+				})
+				if result.Error != nil {
+					log.Panic(result.Error)
+				}
+				b.addResourceSpec(forkUUID, currentGeneration, resourceSpec)
+				return *b.mustFindTFOResource(forkUUID), nil
+			}
+			uuid = forkUUID
+			tfoResource = *fork
+		}
+	}
+
+	if !tfoResource.DeletedAt.IsZero() {
+		// The resource was restored after it was deleted
+		tfoResource.DeletedAt = time.Time{}
+		tfoResource.DeletedBy = ""
+	}
+
+	if tfoResource.CurrentGeneration != currentGeneration {
+		tfoResource.CurrentGeneration = currentGeneration
+		b.addResourceSpec(uuid, currentGeneration, resourceSpec)
+	}
+
+	result := b.db.Omit(clause.Associations).Save(&tfoResource)
+	if result.Error != nil {
+		log.Panic(result.Error)
+	}
+	return *b.mustFindTFOResource(uuid), nil
+}
+
+// DeleteTFOResource marks the resource as deleted. It returns nil when the resource has not been registered.
+func (b Backend) DeleteTFOResource(uuid, deletedBy string) *models.TFOResource {
+	b, span := b.startSpan("delete resource", attribute.String(logging.ResourceUUID, uuid))
+	defer span.End()
+
+	tfoResource := b.mustFindTFOResource(uuid)
+	if tfoResource == nil {
+		return nil
+	}
+	tfoResource.DeletedAt = time.Now()
+	tfoResource.DeletedBy = deletedBy
+	result := b.db.Omit(clause.Associations).Save(tfoResource)
+	if result.Error != nil {
+		log.Panic(result.Error)
+	}
+	return tfoResource
+}
+
+// FindDeletedTFOResources returns the resources deleted before the time whose history has not been purged yet
+func (b Backend) FindDeletedTFOResources(before time.Time) []models.TFOResource {
+	tfoResources := []models.TFOResource{}
+	result := b.db.Where("deleted_at > ? AND deleted_at <= ?", time.Time{}, before).
+		Where(b.db.Where("EXISTS (SELECT 1 FROM tfo_task_logs WHERE tfo_task_logs.tfo_resource_uuid = tfo_resources.uuid)").
+			Or("EXISTS (SELECT 1 FROM tfo_resource_specs WHERE tfo_resource_specs.tfo_resource_uuid = tfo_resources.uuid)").
+			Or("EXISTS (SELECT 1 FROM approvals JOIN task_pods ON task_pods.uuid = approvals.task_pod_uuid WHERE task_pods.tfo_resource_uuid = tfo_resources.uuid)")).
+		Find(&tfoResources)
+	if result.Error != nil {
+		log.Panic(result.Error)
+	}
+	return tfoResources
+}
+
+// PurgeTFOResource removes the task logs, specs and approvals of the resource
+func (b Backend) PurgeTFOResource(uuid string) {
+	b, span := b.startSpan("purge resource", attribute.String(logging.ResourceUUID, uuid))
+	defer span.End()
+
+	err := b.db.Transaction(func(tx *gorm.DB) error {
+		taskPods := tx.Model(&models.TaskPod{}).Select("uuid").Where("tfo_resource_uuid = ?", uuid)
+		if err := tx.Unscoped().Where("task_pod_uuid IN (?)", taskPods).Delete(&models.Approval{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("tfo_resource_uuid = ?", uuid).Delete(&models.TFOTaskLog{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Where("tfo_resource_uuid = ?", uuid).Delete(&models.TFOResourceSpec{}).Error
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	slog.Info("Purged the history of the deleted resource", logging.ResourceUUID, uuid)
+}
+
+// RetentionSupported always returns nil, the database is queried directly
+func (b Backend) RetentionSupported() error {
+	return nil
+}
+
+// GetOrSetTaskPod returns the task pod from the cache or registers it in the database
+func (b Backend) GetOrSetTaskPod(tfoResource models.TFOResource, taskType, generation string, rerun int, uid string) (models.TaskPod, error) {
+	if cached, found := b.cache.Get(uid); found {
+		return cached.(models.TaskPod), nil
+	}
+	b, span := b.startSpan("register task pod", attribute.String(logging.TaskPodUUID, uid))
+	defer span.End()
+
+	taskPod := models.TaskPod{
+		UUID:            uid,
+		TaskType:        taskType,
+		Rerun:           rerun,
+		Generation:      generation,
+		TFOResourceUUID: tfoResource.UUID,
+	}
+	result := b.db.Omit(clause.Associations).Where(models.TaskPod{UUID: uid}).FirstOrCreate(&taskPod)
+	if result.Error != nil {
+		return models.TaskPod{}, fmt.Errorf("error handling request for task with uid '%s' of type '%s': %s", uid, taskType, result.Error)
+	}
+
+	taskPod.TFOResource = tfoResource
+	b.cache.Set(uid, taskPod, gocache.NoExpiration)
+	return taskPod, nil
+}
+
+// MissingLines returns the lines whose LINENO has not been written for the task pod
+func (b Backend) MissingLines(taskPod models.TaskPod, tfoTaskLogs []models.TFOTaskLog) ([]models.TFOTaskLog, error) {
+	b, span := b.startSpan("dedupe lines", attribute.String(logging.TaskPodUUID, taskPod.UUID))
+	defer span.End()
+	savedIndicies := []string{}
+	result := b.db.Model(&models.TFOTaskLog{}).Where("task_pod_uuid = ?", taskPod.UUID).Pluck("line_no", &savedIndicies)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	linesToWrite := []models.TFOTaskLog{}
+	for _, initLog := range tfoTaskLogs {
+		if !util.ContainsString(savedIndicies, initLog.LineNo) {
+			linesToWrite = append(linesToWrite, initLog)
+		}
+	}
+	return linesToWrite, nil
+}
+
+// WriteAllLines saves the lines that have not been written yet and returns how many were written
+func (b Backend) WriteAllLines(tfoResource models.TFOResource, taskPod models.TaskPod, tfoTaskLogs []models.TFOTaskLog) (int, error) {
+	if len(tfoTaskLogs) == 0 {
+		return 0, nil
+	}
+	linesToWrite, err := b.MissingLines(taskPod, tfoTaskLogs)
+	if err != nil {
+		return 0, err
+	}
+	if len(linesToWrite) == 0 {
+		return 0, nil
+	}
+
+	b, span := b.startSpan("upload lines",
+		attribute.String(logging.TaskPodUUID, taskPod.UUID),
+		attribute.Int("lines", len(linesToWrite)),
+	)
+	defer span.End()
+
+	tfoTaskLogsToCreate := []models.TFOTaskLog{}
+	for _, line := range linesToWrite {
+		tfoTaskLogsToCreate = append(tfoTaskLogsToCreate, models.TFOTaskLog{
+			TaskPodUUID:     taskPod.UUID,
+			TFOResourceUUID: tfoResource.UUID,
+			Message:         line.Message,
+			LineNo:          line.LineNo,
+		})
+	}
+	result := b.db.Omit(clause.Associations).CreateInBatches(tfoTaskLogsToCreate, 500)
+	if result.Error != nil {
+		tracing.Fail(span, result.Error)
+		return 0, result.Error
+	}
+	slog.Info("Wrote lines", append(logging.TaskAttrs(taskPod), "lines", len(linesToWrite))...)
+	return len(linesToWrite), nil
+}
+
+// FindApprovals reads the latest approval decision of each task pod
+func (b Backend) FindApprovals(uids []string) ([]models.Approval, error) {
+	approvals := []models.Approval{}
+	for _, uid := range uids {
+		approval := models.Approval{}
+		result := b.db.Where("task_pod_uuid = ?", uid).Order("created_at desc").Limit(1).Find(&approval)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		if result.RowsAffected == 0 {
+			continue
+		}
+		approvals = append(approvals, approval)
+	}
+	return approvals, nil
+}
+
+// GenerationStatus returns the task pods registered for the generation with their line counts and approvals. The
+// lines are counted by the database whatever the stage of the generation.
+func (b Backend) GenerationStatus(uuid, generation string, stage handlers.Stage) (handlers.GenerationStatus, error) {
+	b, span := b.startSpan("generation status", attribute.String(logging.ResourceUUID, uuid))
+	defer span.End()
+
+	taskPods := []models.TaskPod{}
+	result := b.db.Where("tfo_resource_uuid = ? AND generation = ?", uuid, generation).Find(&taskPods)
+	if result.Error != nil {
+		return handlers.GenerationStatus{}, result.Error
+	}
+	status := handlers.GenerationStatus{TaskPods: []handlers.TaskPodStatus{}}
+	for _, taskPod := range taskPods {
+		var lines int64
+		result := b.db.Model(&models.TFOTaskLog{}).Where("task_pod_uuid = ?", taskPod.UUID).Count(&lines)
+		if result.Error != nil {
+			return handlers.GenerationStatus{}, result.Error
+		}
+		taskPodStatus := handlers.TaskPodStatus{TaskPod: taskPod, Lines: int(lines)}
+		approval := models.Approval{}
+		result = b.db.Where("task_pod_uuid = ?", taskPod.UUID).Order("created_at desc").Limit(1).Find(&approval)
+		if result.Error != nil {
+			return handlers.GenerationStatus{}, result.Error
+		}
+		if result.RowsAffected > 0 {
+			taskPodStatus.Approval = &approval
+		}
+		status.TaskPods = append(status.TaskPods, taskPodStatus)
+	}
+	return status, nil
+}
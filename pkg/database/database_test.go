@@ -0,0 +1,489 @@
+package database_test
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/galleybytes/monitor/pkg/archive"
+	"github.com/galleybytes/monitor/pkg/database"
+	"github.com/galleybytes/monitor/pkg/handlers"
+	"github.com/galleybytes/monitor/pkg/models"
+	"github.com/galleybytes/monitor/pkg/sanitize"
+	gocache "github.com/patrickmn/go-cache"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+const testUUID = "00000000-0000-0000-0000-000000000001"
+
+// newTestBackend migrates a new SQLite database. The queries are the same the backend runs against Postgres.
+func newTestBackend(t *testing.T) database.Backend {
+	t.Helper()
+	return openTestBackend(t, filepath.Join(t.TempDir(), "monitor.db"))
+}
+
+// openTestBackend opens the SQLite database at path with an empty cache
+func openTestBackend(t *testing.T, path string) database.Backend {
+	t.Helper()
+	backend, err := database.Open(sqlite.Open(path), true, gocache.New(gocache.NoExpiration, gocache.NoExpiration))
+	if err != nil {
+		t.Fatal(err)
+	}
+	specSanitizer, err := sanitize.New([]byte("test-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend.WithSpecSanitizer(specSanitizer)
+}
+
+func getOrSetCluster(t *testing.T, backend handlers.Backend, name string) models.Cluster {
+	t.Helper()
+	cluster, err := backend.GetOrSetCluster(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *cluster
+}
+
+func register(t *testing.T, backend handlers.Backend, generation string, cluster models.Cluster, spec string) models.TFOResource {
+	t.Helper()
+	tfoResource, err := backend.RegisterTFOResource(testUUID, "default", "example", generation, cluster, []byte(spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tfoResource
+}
+
+func getOrSetTaskPod(t *testing.T, backend handlers.Backend, tfoResource models.TFOResource, taskType, generation string, rerun int, uid string) models.TaskPod {
+	t.Helper()
+	taskPod, err := backend.GetOrSetTaskPod(tfoResource, taskType, generation, rerun, uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return taskPod
+}
+
+func findResourceSpec(t *testing.T, backend handlers.Backend, generation string) *models.TFOResourceSpec {
+	t.Helper()
+	resourceSpec, err := backend.FindResourceSpec(testUUID, generation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resourceSpec
+}
+
+func findTaskPods(t *testing.T, backend handlers.Backend, uuid, generation string) []models.TaskPod {
+	t.Helper()
+	taskPods, err := backend.FindTaskPods(uuid, generation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return taskPods
+}
+
+func findApprovalStatus(t *testing.T, backend handlers.Backend, uid string) *handlers.ApprovalStatus {
+	t.Helper()
+	approvalStatus, err := backend.FindApprovalStatus(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return approvalStatus
+}
+
+func addApproval(t *testing.T, backend handlers.Backend, approval models.Approval) {
+	t.Helper()
+	if err := backend.AddApproval(approval); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func findTaskLogs(t *testing.T, backend handlers.Backend, uid string) []models.TFOTaskLog {
+	t.Helper()
+	tfoTaskLogs, err := backend.FindTaskLogs(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tfoTaskLogs
+}
+
+func writeAllLines(t *testing.T, backend handlers.Backend, tfoResource models.TFOResource, taskPod models.TaskPod, tfoTaskLogs []models.TFOTaskLog) int {
+	t.Helper()
+	n, err := backend.WriteAllLines(tfoResource, taskPod, tfoTaskLogs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func lines(taskPod models.TaskPod, lineNos ...int) []models.TFOTaskLog {
+	tfoTaskLogs := []models.TFOTaskLog{}
+	for _, lineNo := range lineNos {
+		tfoTaskLogs = append(tfoTaskLogs, models.TFOTaskLog{
+			TaskPod: taskPod,
+			LineNo:  strconv.Itoa(lineNo),
+			Message: "line " + strconv.Itoa(lineNo),
+		})
+	}
+	return tfoTaskLogs
+}
+
+func TestRegisterTFOResourceWithoutSpecDiffColumn(t *testing.T) {
+	// The schema of a database migrated before the spec diff was added
+	path := filepath.Join(t.TempDir(), "monitor.db")
+	openTestBackend(t, path)
+	db, err := gorm.Open(sqlite.Open(path), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Migrator().DropColumn(&models.TFOResourceSpec{}, "SpecDiff"); err != nil {
+		t.Fatal(err)
+	}
+
+	backend, err := database.Open(sqlite.Open(path), false, gocache.New(gocache.NoExpiration, gocache.NoExpiration))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.SpecDiffSupported(); err == nil {
+		t.Fatal("SpecDiffSupported() returned no error without the spec_diff column")
+	}
+	specSanitizer, err := sanitize.New([]byte("test-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend = backend.WithSpecSanitizer(specSanitizer)
+	cluster := getOrSetCluster(t, backend, "test-cluster")
+	register(t, backend, "1", cluster, `{"terraformVersion":"1.5.6"}`)
+	register(t, backend, "2", cluster, `{"terraformVersion":"1.5.7"}`)
+	if spec := findResourceSpec(t, backend, "2"); spec == nil || spec.ResourceSpec != `{"terraformVersion":"1.5.7"}` || spec.SpecDiff != "" {
+		t.Errorf("expected the spec to be saved without its diff, got %+v", spec)
+	}
+}
+
+func TestRegisterTFOResource(t *testing.T) {
+	backend := newTestBackend(t)
+	cluster := getOrSetCluster(t, backend, "test-cluster")
+	if again := getOrSetCluster(t, backend, "test-cluster"); again.ID != cluster.ID {
+		t.Errorf("expected the cluster to be registered once, got %d and %d", cluster.ID, again.ID)
+	}
+
+	tfoResource := register(t, backend, "1", cluster, `{"terraformVersion":"1.5.6"}`)
+	if tfoResource.UUID != testUUID || tfoResource.ClusterID != cluster.ID || tfoResource.Cluster.Name != "test-cluster" {
+		t.Errorf("unexpected resource %+v", tfoResource)
+	}
+	if spec := findResourceSpec(t, backend, "1"); spec == nil || spec.SpecDiff != "" {
+		t.Errorf("expected the spec of the first generation without a diff, got %+v", spec)
+	}
+
+	// Registering the same generation again does not save another spec
+	register(t, backend, "1", cluster, `{"terraformVersion":"1.5.7"}`)
+	if spec := findResourceSpec(t, backend, "1"); spec.ResourceSpec != `{"terraformVersion":"1.5.6"}` {
+		t.Errorf("expected the spec to be kept, got %s", spec.ResourceSpec)
+	}
+
+	tfoResource = register(t, backend, "10", cluster, `{"terraformVersion":"1.5.7"}`)
+	if tfoResource.CurrentGeneration != "10" {
+		t.Errorf("expected the generation to be updated, got %s", tfoResource.CurrentGeneration)
+	}
+	spec := findResourceSpec(t, backend, "10")
+	if want := `[{"op":"replace","path":"/terraformVersion","value":"1.5.7"}]`; spec == nil || spec.SpecDiff != want {
+		t.Errorf("expected the diff %s, got %+v", want, spec)
+	}
+	// Generations are compared as numbers, 10 is after 9
+	if err := backend.AddResourceSpec(models.TFOResourceSpec{TFOResourceUUID: testUUID, Generation: "9", ResourceSpec: `{}`}); err != nil {
+		t.Fatal(err)
+	}
+	if previous, err := backend.FindPreviousResourceSpec(testUUID, "11"); err != nil || previous == nil || previous.Generation != "10" {
+		t.Errorf("expected the spec of generation 10, got %+v", previous)
+	}
+
+	if deleted := backend.DeleteTFOResource(testUUID, "test"); deleted == nil || deleted.DeletedAt.IsZero() {
+		t.Fatalf("expected the resource to be marked deleted, got %+v", deleted)
+	}
+	if restored := register(t, backend, "10", cluster, `{"terraformVersion":"1.5.7"}`); !restored.DeletedAt.IsZero() || restored.DeletedBy != "" {
+		t.Errorf("expected the resource to be restored, got %+v", restored)
+	}
+}
+
+func TestRegisterTFOResourceRecordsEveryAdoption(t *testing.T) {
+	backend := newTestBackend(t).WithClusterMismatchPolicy(handlers.ClusterMismatchAdopt)
+	first := getOrSetCluster(t, backend, "first")
+	second := getOrSetCluster(t, backend, "second")
+	register(t, backend, "1", first, `{}`)
+	register(t, backend, "1", second, `{}`)
+	register(t, backend, "2", second, `{}`)
+	register(t, backend, "3", first, `{}`)
+
+	adoptions, err := backend.FindClusterAdoptions(testUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, adoption := range adoptions {
+		got = append(got, fmt.Sprintf("%d->%d@%s", adoption.FromClusterID, adoption.ToClusterID, adoption.Generation))
+	}
+	want := fmt.Sprintf("[%d->%d@1 %d->%d@3]", first.ID, second.ID, second.ID, first.ID)
+	if fmt.Sprint(got) != want {
+		t.Errorf("expected the adoptions %s, got %v", want, got)
+	}
+}
+
+func TestRegisterTFOResourceWithoutAdoptionTable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "monitor.db")
+	setup := openTestBackend(t, path)
+	first := getOrSetCluster(t, setup, "first")
+	second := getOrSetCluster(t, setup, "second")
+	register(t, setup, "1", first, `{}`)
+	db, err := gorm.Open(sqlite.Open(path), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Migrator().DropTable(&models.ClusterAdoption{}); err != nil {
+		t.Fatal(err)
+	}
+
+	backend, err := database.Open(sqlite.Open(path), false, gocache.New(gocache.NoExpiration, gocache.NoExpiration))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.AdoptionSupported(); err == nil {
+		t.Fatal("AdoptionSupported() returned no error without the cluster_adoptions table")
+	}
+	specSanitizer, err := sanitize.New([]byte("test-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = backend.WithSpecSanitizer(specSanitizer).WithClusterMismatchPolicy(handlers.ClusterMismatchAdopt).
+		RegisterTFOResource(testUUID, "default", "example", "1", second, []byte(`{}`))
+	if err == nil {
+		t.Fatal("expected the adoption to fail without the cluster_adoptions table")
+	}
+	if tfoResource, err := backend.FindTFOResource(testUUID); err != nil || tfoResource == nil || tfoResource.ClusterID != first.ID {
+		t.Errorf("expected the resource to stay bound to the first cluster, got %+v, %v", tfoResource, err)
+	}
+}
+
+func TestRegisterTFOResourceBoundToAnotherCluster(t *testing.T) {
+	for _, test := range []struct {
+		policy   handlers.ClusterMismatchPolicy
+		err      bool
+		expected string
+	}{
+		{policy: handlers.ClusterMismatchFail, err: true},
+		{policy: handlers.ClusterMismatchAdopt, expected: testUUID},
+		{policy: handlers.ClusterMismatchFork},
+	} {
+		t.Run(string(test.policy), func(t *testing.T) {
+			backend := newTestBackend(t)
+			register(t, backend, "1", getOrSetCluster(t, backend, "first"), `{}`)
+
+			second := getOrSetCluster(t, backend, "second")
+			tfoResource, err := backend.WithClusterMismatchPolicy(test.policy).
+				RegisterTFOResource(testUUID, "default", "example", "1", second, []byte(`{}`))
+			if test.err {
+				if err == nil {
+					t.Error("expected the registration to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := test.expected
+			if expected == "" {
+				expected = handlers.ForkUUID(testUUID, second)
+			}
+			if tfoResource.UUID != expected || tfoResource.ClusterID != second.ID {
+				t.Errorf("expected %s to be bound to the second cluster, got %+v", expected, tfoResource)
+			}
+		})
+	}
+}
+
+func TestGetOrSetTaskPod(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "monitor.db")
+	backend := openTestBackend(t, path)
+	tfoResource := register(t, backend, "1", getOrSetCluster(t, backend, "test-cluster"), `{}`)
+
+	taskPod := getOrSetTaskPod(t, backend, tfoResource, "plan", "1", 0, "plan-uid")
+	if taskPod.UUID != "plan-uid" || taskPod.TFOResourceUUID != testUUID || taskPod.TFOResource.UUID != testUUID {
+		t.Errorf("unexpected task pod %+v", taskPod)
+	}
+	// A new backend without the cache finds the saved task pod instead of registering it again
+	if again := getOrSetTaskPod(t, openTestBackend(t, path), tfoResource, "apply", "1", 1, "plan-uid"); again.TaskType != "plan" || again.Rerun != 0 {
+		t.Errorf("expected the saved task pod, got %+v", again)
+	}
+	getOrSetTaskPod(t, backend, tfoResource, "apply", "1", 0, "apply-uid")
+	getOrSetTaskPod(t, backend, tfoResource, "init", "2", 0, "init-uid")
+	if taskPods := findTaskPods(t, backend, testUUID, "1"); len(taskPods) != 2 {
+		t.Errorf("expected the 2 task pods of generation 1, got %+v", taskPods)
+	}
+}
+
+func TestWriteAllLines(t *testing.T) {
+	backend := newTestBackend(t)
+	tfoResource := register(t, backend, "1", getOrSetCluster(t, backend, "test-cluster"), `{}`)
+	taskPod := getOrSetTaskPod(t, backend, tfoResource, "plan", "1", 0, "plan-uid")
+	other := getOrSetTaskPod(t, backend, tfoResource, "apply", "1", 0, "apply-uid")
+
+	for _, test := range []struct {
+		name     string
+		lineNos  []int
+		expected int
+	}{
+		{name: "first lines", lineNos: []int{1, 2, 10}, expected: 3},
+		{name: "nothing new", lineNos: []int{1, 2}, expected: 0},
+		{name: "lines in between and appended", lineNos: []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}, expected: 8},
+		{name: "empty", expected: 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := writeAllLines(t, backend, tfoResource, taskPod, lines(taskPod, test.lineNos...)); got != test.expected {
+				t.Errorf("expected %d lines to be written, got %d", test.expected, got)
+			}
+		})
+	}
+	// Line numbers are per task pod
+	if got := writeAllLines(t, backend, tfoResource, other, lines(other, 1)); got != 1 {
+		t.Errorf("expected the line of another task pod to be written, got %d", got)
+	}
+
+	// The lines are read by line number, not in the order they were written
+	tfoTaskLogs := findTaskLogs(t, backend, "plan-uid")
+	if len(tfoTaskLogs) != 11 {
+		t.Fatalf("expected 11 lines, got %d", len(tfoTaskLogs))
+	}
+	for i, tfoTaskLog := range tfoTaskLogs {
+		if tfoTaskLog.LineNo != strconv.Itoa(i+1) || tfoTaskLog.TFOResourceUUID != testUUID || tfoTaskLog.TaskPodUUID != "plan-uid" {
+			t.Errorf("expected line %d in order, got %+v", i+1, tfoTaskLog)
+		}
+	}
+	if missing, err := backend.MissingLines(taskPod, lines(taskPod, 11, 12)); err != nil || len(missing) != 1 || missing[0].LineNo != "12" {
+		t.Errorf("expected line 12 to be missing, got %+v %v", missing, err)
+	}
+
+	status, err := backend.GenerationStatus(testUUID, "1", handlers.Stage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]int{}
+	for _, taskPodStatus := range status.TaskPods {
+		counts[taskPodStatus.TaskPod.UUID] = taskPodStatus.Lines
+	}
+	if counts["plan-uid"] != 11 || counts["apply-uid"] != 1 {
+		t.Errorf("unexpected line counts %v", counts)
+	}
+}
+
+func TestApprovals(t *testing.T) {
+	backend := newTestBackend(t)
+	tfoResource := register(t, backend, "1", getOrSetCluster(t, backend, "test-cluster"), `{}`)
+	getOrSetTaskPod(t, backend, tfoResource, "plan", "1", 0, "approved-uid")
+	getOrSetTaskPod(t, backend, tfoResource, "plan", "1", 1, "canceled-uid")
+	getOrSetTaskPod(t, backend, tfoResource, "plan", "1", 2, "undecided-uid")
+
+	if status := findApprovalStatus(t, backend, "approved-uid"); status != nil {
+		t.Errorf("expected no approval yet, got %+v", status)
+	}
+	addApproval(t, backend, models.Approval{TaskPodUUID: "approved-uid", IsApproved: false})
+	// The latest decision counts
+	approval := models.Approval{TaskPodUUID: "approved-uid", IsApproved: true}
+	approval.CreatedAt = time.Now().Add(time.Minute)
+	addApproval(t, backend, approval)
+	addApproval(t, backend, models.Approval{TaskPodUUID: "canceled-uid", IsApproved: false})
+
+	if status := findApprovalStatus(t, backend, "approved-uid"); status == nil || !status.IsApproved {
+		t.Errorf("expected the latest approval, got %+v", status)
+	}
+
+	approvals, err := backend.FindApprovals([]string{"approved-uid", "canceled-uid", "undecided-uid"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decisions := map[string]bool{}
+	for _, approval := range approvals {
+		decisions[approval.TaskPodUUID] = approval.IsApproved
+	}
+	if len(decisions) != 2 || !decisions["approved-uid"] || decisions["canceled-uid"] {
+		t.Errorf("expected the latest decisions of the approved and canceled task pods, got %v", decisions)
+	}
+
+	status, err := backend.GenerationStatus(testUUID, "1", handlers.Stage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, taskPodStatus := range status.TaskPods {
+		if taskPodStatus.TaskPod.UUID == "approved-uid" && (taskPodStatus.Approval == nil || !taskPodStatus.Approval.IsApproved) {
+			t.Errorf("expected the status to hold the approval, got %+v", taskPodStatus)
+		}
+	}
+}
+
+func TestPurgeTFOResource(t *testing.T) {
+	backend := newTestBackend(t)
+	tfoResource := register(t, backend, "1", getOrSetCluster(t, backend, "test-cluster"), `{}`)
+	taskPod := getOrSetTaskPod(t, backend, tfoResource, "plan", "1", 0, "plan-uid")
+	writeAllLines(t, backend, tfoResource, taskPod, lines(taskPod, 1, 2))
+	addApproval(t, backend, models.Approval{TaskPodUUID: "plan-uid", IsApproved: true})
+
+	if due := backend.FindDeletedTFOResources(time.Now()); len(due) != 0 {
+		t.Errorf("expected nothing to purge before the resource is deleted, got %+v", due)
+	}
+	backend.DeleteTFOResource(testUUID, "test")
+	if due := backend.FindDeletedTFOResources(time.Now().Add(-time.Hour)); len(due) != 0 {
+		t.Errorf("expected nothing to purge before the retention passed, got %+v", due)
+	}
+	if due := backend.FindDeletedTFOResources(time.Now().Add(time.Second)); len(due) != 1 {
+		t.Fatalf("expected the deleted resource to be due, got %+v", due)
+	}
+
+	backend.PurgeTFOResource(testUUID)
+	if n := len(findTaskLogs(t, backend, "plan-uid")); n != 0 {
+		t.Errorf("expected the logs to be purged, got %d", n)
+	}
+	if findApprovalStatus(t, backend, "plan-uid") != nil || findResourceSpec(t, backend, "1") != nil {
+		t.Error("expected the approvals and specs to be purged")
+	}
+	if found, err := backend.FindTFOResource(testUUID); err != nil || found == nil {
+		t.Error("expected the deleted resource to be kept as a record")
+	}
+	if due := backend.FindDeletedTFOResources(time.Now().Add(time.Second)); len(due) != 0 {
+		t.Errorf("expected nothing left to purge, got %+v", due)
+	}
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	source := newTestBackend(t)
+	tfoResource := register(t, source, "1", getOrSetCluster(t, source, "source"), `{"terraformVersion":"1.5.6"}`)
+	taskPod := getOrSetTaskPod(t, source, tfoResource, "plan", "1", 0, "plan-uid")
+	writeAllLines(t, source, tfoResource, taskPod, lines(taskPod, 1, 2, 3))
+	addApproval(t, source, models.Approval{TaskPodUUID: "plan-uid", IsApproved: true})
+
+	var buf bytes.Buffer
+	if err := archive.Export(source, testUUID, &buf); err != nil {
+		t.Fatal(err)
+	}
+	target := newTestBackend(t)
+	if err := archive.Import(target, "target", bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	imported, err := target.FindTFOResource(testUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported == nil || imported.Cluster.Name != "target" {
+		t.Fatalf("expected the resource to be registered to the target cluster, got %+v", imported)
+	}
+	if spec := findResourceSpec(t, target, "1"); spec == nil || spec.ResourceSpec != `{"terraformVersion":"1.5.6"}` {
+		t.Errorf("expected the spec to be imported, got %+v", spec)
+	}
+	if n := len(findTaskLogs(t, target, "plan-uid")); n != 3 {
+		t.Errorf("expected 3 lines to be imported, got %d", n)
+	}
+	if status := findApprovalStatus(t, target, "plan-uid"); status == nil || !status.IsApproved {
+		t.Errorf("expected the approval to be imported, got %+v", status)
+	}
+}
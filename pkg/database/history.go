@@ -0,0 +1,113 @@
+package database
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+
+	"github.com/galleybytes/monitor/pkg/handlers"
+	"github.com/galleybytes/monitor/pkg/logging"
+	"github.com/galleybytes/monitor/pkg/models"
+	"gorm.io/gorm/clause"
+)
+
+// AddResourceSpec saves the spec of a generation of the resource as is
+func (b Backend) AddResourceSpec(tfoResourceSpec models.TFOResourceSpec) error {
+	omit := []string{clause.Associations}
+	if err := b.SpecDiffSupported(); err != nil {
+		if tfoResourceSpec.SpecDiff != "" {
+			slog.Warn("The spec diff is not saved", logging.ResourceUUID, tfoResourceSpec.TFOResourceUUID,
+				logging.Generation, tfoResourceSpec.Generation, "error", err)
+		}
+		omit = append(omit, "SpecDiff")
+	}
+	return b.db.Omit(omit...).Create(&tfoResourceSpec).Error
+}
+
+// AddTFOResource registers the resource as is and returns the saved resource
+func (b Backend) AddTFOResource(tfoResource models.TFOResource) (models.TFOResource, error) {
+	result := b.db.Omit(clause.Associations).Create(&tfoResource)
+	if result.Error != nil {
+		return tfoResource, result.Error
+	}
+	saved, err := b.FindTFOResource(tfoResource.UUID)
+	if err != nil {
+		return tfoResource, err
+	}
+	if saved == nil {
+		return tfoResource, fmt.Errorf("resource '%s' was not found after it was added", tfoResource.UUID)
+	}
+	return *saved, nil
+}
+
+// AddApproval records the approval decision of a task
+func (b Backend) AddApproval(approval models.Approval) error {
+	return b.db.Omit(clause.Associations).Create(&approval).Error
+}
+
+// FindTaskPods returns the task pods registered for the generation of the resource
+func (b Backend) FindTaskPods(uuid, generation string) ([]models.TaskPod, error) {
+	taskPods := []models.TaskPod{}
+	result := b.db.Where("tfo_resource_uuid = ? AND generation = ?", uuid, generation).Find(&taskPods)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return taskPods, nil
+}
+
+// FindTaskLogs returns the logs saved for the task ordered by their line number
+func (b Backend) FindTaskLogs(uid string) ([]models.TFOTaskLog, error) {
+	tfoTaskLogs := []models.TFOTaskLog{}
+	result := b.db.Where("task_pod_uuid = ?", uid).Order("id").Find(&tfoTaskLogs)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	// Line numbers are saved as strings so they are compared as numbers here
+	sort.SliceStable(tfoTaskLogs, func(i, j int) bool {
+		a, _ := strconv.Atoi(tfoTaskLogs[i].LineNo)
+		b, _ := strconv.Atoi(tfoTaskLogs[j].LineNo)
+		return a < b
+	})
+	return tfoTaskLogs, nil
+}
+
+// FindApprovalStatus returns the latest approval of the task or nil when there is none
+func (b Backend) FindApprovalStatus(uid string) (*handlers.ApprovalStatus, error) {
+	approval := models.Approval{}
+	result := b.db.Where("task_pod_uuid = ?", uid).Order("created_at desc").Limit(1).Find(&approval)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+	return &handlers.ApprovalStatus{Approval: approval, Status: "complete"}, nil
+}
+
+// AdoptionSupported returns why the database cannot record adoptions, nil when it can. The table is only there
+// once the schema was migrated to models.ClusterAdoptionSchemaVersion.
+func (b Backend) AdoptionSupported() error {
+	if !b.adoptions {
+		return fmt.Errorf("the database has no cluster_adoptions table, migrate the schema to version %s", models.ClusterAdoptionSchemaVersion)
+	}
+	return nil
+}
+
+// addClusterAdoption records that the resource was adopted
+func (b Backend) addClusterAdoption(adoption models.ClusterAdoption) error {
+	if err := b.AdoptionSupported(); err != nil {
+		return err
+	}
+	return b.db.Create(&adoption).Error
+}
+
+// FindClusterAdoptions returns the adoptions of the resource, the oldest first
+func (b Backend) FindClusterAdoptions(uuid string) ([]models.ClusterAdoption, error) {
+	adoptions := []models.ClusterAdoption{}
+	result := b.db.Where("tfo_resource_uuid = ?", uuid).Order("id").Find(&adoptions)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return adoptions, nil
+}
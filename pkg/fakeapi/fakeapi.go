@@ -0,0 +1,574 @@
+// Package fakeapi is an in-process stand-in for the terraform-operator-api and the monitor manager's token
+// endpoint. It keeps everything in memory and can inject faults so the monitor can be exercised without a
+// live API.
+package fakeapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/galleybytes/monitor/pkg/access"
+	"github.com/galleybytes/monitor/pkg/models"
+)
+
+// Fault changes the response of requests whose path starts with PathPrefix. Count limits how many requests the
+// fault applies to; zero applies it to every matching request until the fault is cleared.
+type Fault struct {
+	PathPrefix string
+	Method     string
+	Count      int
+
+	// Latency is added before the request is handled
+	Latency time.Duration
+
+	// StatusCode responds with the status instead of handling the request, eg 500 or 503
+	StatusCode int
+
+	// Unauthorized responds with a 401 as if the token was rejected
+	Unauthorized bool
+
+	// Malformed responds with a body that is not valid JSON
+	Malformed bool
+}
+
+func (f Fault) matches(r *http.Request) bool {
+	if f.Method != "" && f.Method != r.Method {
+		return false
+	}
+	return strings.HasPrefix(r.URL.Path, f.PathPrefix)
+}
+
+type Server struct {
+	*httptest.Server
+	Token string
+
+	// SigningKeys accepts tokens minted by the monitor manager with any of the keys, besides Token. They are
+	// verified with an access.Verifier like the API does.
+	SigningKeys [][]byte
+
+	mu            sync.Mutex
+	faults        []*Fault
+	requests      []string
+	nextID        uint
+	clusters      []models.Cluster
+	tfoResources  map[string]models.TFOResource
+	resourceSpecs []models.TFOResourceSpec
+	taskPods      map[string]models.TaskPod
+	taskLogs      map[string][]models.TFOTaskLog
+	approvals     map[string]models.Approval
+	adoptions     []models.ClusterAdoption
+}
+
+// New starts a fake API. Close it when done.
+func New() *Server {
+	s := &Server{
+		Token:        "fake-token",
+		nextID:       1,
+		tfoResources: map[string]models.TFOResource{},
+		taskPods:     map[string]models.TaskPod{},
+		taskLogs:     map[string][]models.TFOTaskLog{},
+		approvals:    map[string]models.Approval{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// TokenURL is what the monitor uses as MONITOR_MANAGER_SERVICE_HOST + "/api-token-please"
+func (s *Server) TokenURL() string {
+	return s.URL + "/api-token-please"
+}
+
+// InjectFault adds a fault. Faults are checked in the order they were added.
+func (s *Server) InjectFault(fault Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &fault)
+}
+
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+}
+
+// Requests returns "<METHOD> <path>" of every request received
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+func (s *Server) Clusters() []models.Cluster {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]models.Cluster{}, s.clusters...)
+}
+
+// AddCluster registers a cluster as if another monitor had
+func (s *Server) AddCluster(name string) models.Cluster {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cluster := models.Cluster{Name: name}
+	cluster.ID = s.nextID
+	cluster.CreatedAt = time.Now()
+	s.nextID++
+	s.clusters = append(s.clusters, cluster)
+	return cluster
+}
+
+// AddTFOResource registers a resource as if another monitor had, eg to bind it to another cluster
+func (s *Server) AddTFOResource(tfoResource models.TFOResource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tfoResource.ClusterID = tfoResource.Cluster.ID
+	tfoResource.CreatedAt = time.Now()
+	tfoResource.UpdatedAt = time.Now()
+	s.tfoResources[tfoResource.UUID] = tfoResource
+}
+
+func (s *Server) TFOResource(uuid string) (models.TFOResource, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tfoResource, found := s.tfoResources[uuid]
+	return tfoResource, found
+}
+
+func (s *Server) ResourceSpecs(uuid string) []models.TFOResourceSpec {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resourceSpecs := []models.TFOResourceSpec{}
+	for _, resourceSpec := range s.resourceSpecs {
+		if resourceSpec.TFOResourceUUID == uuid {
+			resourceSpecs = append(resourceSpecs, resourceSpec)
+		}
+	}
+	return resourceSpecs
+}
+
+func (s *Server) TaskPods() []models.TaskPod {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	taskPods := []models.TaskPod{}
+	for _, taskPod := range s.taskPods {
+		taskPods = append(taskPods, taskPod)
+	}
+	sort.Slice(taskPods, func(i, j int) bool { return taskPods[i].UUID < taskPods[j].UUID })
+	return taskPods
+}
+
+// TaskLogs returns the logs of the task pod sorted by line number
+func (s *Server) TaskLogs(uid string) []models.TFOTaskLog {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sortedTaskLogs(uid)
+}
+
+// ClusterAdoptions returns the adoptions recorded for the resource, the oldest first
+func (s *Server) ClusterAdoptions(uuid string) []models.ClusterAdoption {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	adoptions := []models.ClusterAdoption{}
+	for _, adoption := range s.adoptions {
+		if adoption.TFOResourceUUID == uuid {
+			adoptions = append(adoptions, adoption)
+		}
+	}
+	return adoptions
+}
+
+// SetApproval records an approval decision as if a user had made it
+func (s *Server) SetApproval(uid string, isApproved bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.approvals[uid] = models.Approval{IsApproved: isApproved, TaskPodUUID: uid}
+}
+
+func (s *Server) sortedTaskLogs(uid string) []models.TFOTaskLog {
+	taskLogs := append([]models.TFOTaskLog{}, s.taskLogs[uid]...)
+	sort.SliceStable(taskLogs, func(i, j int) bool {
+		a, _ := strconv.Atoi(taskLogs[i].LineNo)
+		b, _ := strconv.Atoi(taskLogs[j].LineNo)
+		return a < b
+	})
+	return taskLogs
+}
+
+// fault returns the first fault matching the request and uses up one of its counts
+func (s *Server) fault(r *http.Request) *Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, fault := range s.faults {
+		if !fault.matches(r) {
+			continue
+		}
+		matched := *fault
+		if fault.Count > 0 {
+			fault.Count--
+			if fault.Count == 0 {
+				s.faults = append(s.faults[:i], s.faults[i+1:]...)
+			}
+		}
+		return &matched
+	}
+	return nil
+}
+
+func respond(w http.ResponseWriter, statusCode int, data []interface{}, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(models.Response{
+		StatusInfo: models.StatusInfo{StatusCode: statusCode, Message: message},
+		Data:       data,
+	})
+}
+
+func ok(w http.ResponseWriter, data ...interface{}) {
+	if data == nil {
+		data = []interface{}{}
+	}
+	respond(w, http.StatusOK, data, "")
+}
+
+func fail(w http.ResponseWriter, statusCode int, format string, a ...interface{}) {
+	respond(w, statusCode, nil, fmt.Sprintf(format, a...))
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+	s.mu.Unlock()
+
+	if fault := s.fault(r); fault != nil {
+		time.Sleep(fault.Latency)
+		switch {
+		case fault.Unauthorized:
+			fail(w, http.StatusUnauthorized, "invalid token")
+			return
+		case fault.StatusCode != 0:
+			fail(w, fault.StatusCode, "injected fault")
+			return
+		case fault.Malformed:
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"status_info": {"status_code": 200}, "data": [`))
+			return
+		}
+	}
+
+	if r.URL.Path == "/api-token-please" {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		json.NewEncoder(w).Encode(map[string]string{"host": s.URL, "token": s.Token})
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1"), "/"), "/")
+	body, _ := ioutil.ReadAll(r.Body)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if statusCode, err := s.authorize(r.Header.Get("Token"), r.Method, parts); err != nil {
+		fail(w, statusCode, "%s", err)
+		return
+	}
+	switch {
+	case r.Method == "GET" && len(parts) == 1 && parts[0] == "schema-version":
+		ok(w, map[string]string{"schema_version": models.SchemaVersion})
+
+	case r.Method == "GET" && len(parts) == 2 && parts[0] == "cluster":
+		id, _ := strconv.Atoi(parts[1])
+		for _, cluster := range s.clusters {
+			if cluster.ID == uint(id) {
+				ok(w, cluster)
+				return
+			}
+		}
+		ok(w)
+
+	case r.Method == "GET" && len(parts) == 2 && parts[0] == "cluster-name":
+		for _, cluster := range s.clusters {
+			if cluster.Name == parts[1] {
+				ok(w, cluster)
+				return
+			}
+		}
+		ok(w)
+
+	case r.Method == "POST" && len(parts) == 1 && parts[0] == "cluster":
+		request := struct {
+			ClusterName string `json:"cluster_name"`
+		}{}
+		if err := json.Unmarshal(body, &request); err != nil || request.ClusterName == "" {
+			fail(w, http.StatusBadRequest, "cluster_name is required")
+			return
+		}
+		s.mu.Unlock()
+		cluster := s.AddCluster(request.ClusterName)
+		s.mu.Lock()
+		ok(w, cluster)
+
+	case r.Method == "GET" && len(parts) == 2 && parts[0] == "resource":
+		if tfoResource, found := s.tfoResources[parts[1]]; found {
+			ok(w, tfoResource)
+			return
+		}
+		ok(w)
+
+	case r.Method == "GET" && len(parts) == 2 && parts[0] == "resources" && parts[1] == "deleted":
+		before, err := time.Parse(time.RFC3339Nano, r.URL.Query().Get("before"))
+		if err != nil {
+			fail(w, http.StatusBadRequest, "before is required")
+			return
+		}
+		tfoResources := []interface{}{}
+		for _, tfoResource := range s.tfoResources {
+			if !tfoResource.DeletedAt.IsZero() && !tfoResource.DeletedAt.After(before) && s.hasHistory(tfoResource.UUID) {
+				tfoResources = append(tfoResources, tfoResource)
+			}
+		}
+		ok(w, tfoResources...)
+
+	case r.Method == "DELETE" && len(parts) == 3 && parts[0] == "resource" && parts[2] == "history":
+		for uid, taskPod := range s.taskPods {
+			if taskPod.TFOResourceUUID == parts[1] {
+				delete(s.taskLogs, uid)
+				delete(s.approvals, uid)
+			}
+		}
+		resourceSpecs := []models.TFOResourceSpec{}
+		for _, resourceSpec := range s.resourceSpecs {
+			if resourceSpec.TFOResourceUUID != parts[1] {
+				resourceSpecs = append(resourceSpecs, resourceSpec)
+			}
+		}
+		s.resourceSpecs = resourceSpecs
+		w.WriteHeader(http.StatusNoContent)
+
+	case (r.Method == "POST" || r.Method == "PUT") && len(parts) == 1 && parts[0] == "resource":
+		request := struct {
+			TFOResource models.TFOResource `json:"tfo_resource"`
+		}{}
+		if err := json.Unmarshal(body, &request); err != nil || request.TFOResource.UUID == "" {
+			fail(w, http.StatusBadRequest, "tfo_resource is required")
+			return
+		}
+		tfoResource := request.TFOResource
+		if tfoResource.ClusterID == 0 {
+			tfoResource.ClusterID = tfoResource.Cluster.ID
+		}
+		for _, cluster := range s.clusters {
+			if cluster.ID == tfoResource.ClusterID {
+				tfoResource.Cluster = cluster
+			}
+		}
+		existing, found := s.tfoResources[tfoResource.UUID]
+		if r.Method == "POST" && found {
+			fail(w, http.StatusConflict, "resource %s already exists", tfoResource.UUID)
+			return
+		}
+		if r.Method == "PUT" && !found {
+			fail(w, http.StatusNotFound, "resource %s does not exist", tfoResource.UUID)
+			return
+		}
+		if found {
+			tfoResource.CreatedAt = existing.CreatedAt
+		} else {
+			tfoResource.CreatedAt = time.Now()
+		}
+		tfoResource.UpdatedAt = time.Now()
+		s.tfoResources[tfoResource.UUID] = tfoResource
+		ok(w, tfoResource)
+
+	case r.Method == "POST" && len(parts) == 3 && parts[0] == "resource" && parts[2] == "adoption":
+		request := struct {
+			ClusterAdoption models.ClusterAdoption `json:"cluster_adoption"`
+		}{}
+		if err := json.Unmarshal(body, &request); err != nil || request.ClusterAdoption.TFOResourceUUID != parts[1] {
+			fail(w, http.StatusBadRequest, "cluster_adoption of resource %s is required", parts[1])
+			return
+		}
+		adoption := request.ClusterAdoption
+		adoption.ID = s.nextID
+		adoption.CreatedAt = time.Now()
+		s.nextID++
+		s.adoptions = append(s.adoptions, adoption)
+		ok(w)
+
+	case r.Method == "GET" && len(parts) == 3 && parts[0] == "resource" && parts[2] == "adoptions":
+		adoptions := []interface{}{}
+		for _, adoption := range s.adoptions {
+			if adoption.TFOResourceUUID == parts[1] {
+				adoptions = append(adoptions, adoption)
+			}
+		}
+		ok(w, adoptions...)
+
+	case r.Method == "POST" && len(parts) == 1 && parts[0] == "resource-spec":
+		request := struct {
+			TFOResourceSpec models.TFOResourceSpec `json:"tfo_resource_spec"`
+		}{}
+		if err := json.Unmarshal(body, &request); err != nil || request.TFOResourceSpec.TFOResourceUUID == "" {
+			fail(w, http.StatusBadRequest, "tfo_resource_spec is required")
+			return
+		}
+		resourceSpec := request.TFOResourceSpec
+		resourceSpec.ID = s.nextID
+		resourceSpec.CreatedAt = time.Now()
+		s.nextID++
+		s.resourceSpecs = append(s.resourceSpecs, resourceSpec)
+		ok(w)
+
+	case r.Method == "GET" && len(parts) == 5 && parts[0] == "resource" && parts[2] == "resource-spec" && parts[3] == "generation":
+		// The latest spec posted for the generation wins
+		for i := len(s.resourceSpecs) - 1; i >= 0; i-- {
+			resourceSpec := s.resourceSpecs[i]
+			if resourceSpec.TFOResourceUUID == parts[1] && resourceSpec.Generation == parts[4] {
+				ok(w, resourceSpec)
+				return
+			}
+		}
+		ok(w)
+
+	case r.Method == "GET" && len(parts) == 5 && parts[0] == "resource" && parts[2] == "generation" && parts[4] == "tasks":
+		taskPods := []interface{}{}
+		for _, taskPod := range s.taskPods {
+			if taskPod.TFOResourceUUID == parts[1] && taskPod.Generation == parts[3] {
+				taskPods = append(taskPods, taskPod)
+			}
+		}
+		ok(w, taskPods...)
+
+	case r.Method == "POST" && len(parts) == 1 && parts[0] == "task":
+		request := struct {
+			TaskPod models.TaskPod `json:"task_pod"`
+		}{}
+		if err := json.Unmarshal(body, &request); err != nil {
+			fail(w, http.StatusBadRequest, "task_pod is required")
+			return
+		}
+		taskPod := request.TaskPod
+		if taskPod.TFOResourceUUID == "" {
+			taskPod.TFOResourceUUID = taskPod.TFOResource.UUID
+		}
+		if _, found := s.tfoResources[taskPod.TFOResourceUUID]; !found {
+			fail(w, http.StatusBadRequest, "resource %s does not exist", taskPod.TFOResourceUUID)
+			return
+		}
+		if existing, found := s.taskPods[taskPod.UUID]; found {
+			ok(w, existing)
+			return
+		}
+		s.taskPods[taskPod.UUID] = taskPod
+		ok(w, taskPod)
+
+	case r.Method == "GET" && len(parts) == 3 && parts[0] == "task" && parts[2] == "logs":
+		taskLogs := []interface{}{}
+		for _, taskLog := range s.sortedTaskLogs(parts[1]) {
+			taskLogs = append(taskLogs, taskLog)
+		}
+		ok(w, taskLogs...)
+
+	case r.Method == "GET" && len(parts) == 3 && parts[0] == "task" && parts[2] == "approval-status":
+		approval, found := s.approvals[parts[1]]
+		if !found {
+			ok(w, map[string]string{"status": "nodata"})
+			return
+		}
+		ok(w, struct {
+			models.Approval
+			Status string `json:"status"`
+		}{approval, "complete"})
+
+	case r.Method == "POST" && len(parts) == 2 && parts[0] == "approval":
+		request := struct {
+			Approval models.Approval `json:"approval"`
+		}{}
+		if err := json.Unmarshal(body, &request); err != nil {
+			fail(w, http.StatusBadRequest, "approval is required")
+			return
+		}
+		approval := request.Approval
+		approval.TaskPodUUID = parts[1]
+		approval.ID = s.nextID
+		s.nextID++
+		s.approvals[parts[1]] = approval
+		ok(w)
+
+	case r.Method == "POST" && len(parts) == 1 && parts[0] == "logs":
+		request := struct {
+			TFOTaskLogs []models.TFOTaskLog `json:"tfo_task_logs"`
+		}{}
+		if err := json.Unmarshal(body, &request); err != nil {
+			fail(w, http.StatusBadRequest, "tfo_task_logs is required")
+			return
+		}
+		for _, taskLog := range request.TFOTaskLogs {
+			uid := taskLog.TaskPodUUID
+			if uid == "" {
+				uid = taskLog.TaskPod.UUID
+			}
+			taskLog.TaskPodUUID = uid
+			if taskLog.TFOResourceUUID == "" {
+				taskLog.TFOResourceUUID = taskLog.TFOResource.UUID
+			}
+			taskLog.TaskPod = models.TaskPod{}
+			taskLog.TFOResource = models.TFOResource{}
+			taskLog.ID = s.nextID
+			s.nextID++
+			s.taskLogs[uid] = append(s.taskLogs[uid], taskLog)
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		fail(w, http.StatusNotFound, "%s %s is not handled by the fake api", r.Method, r.URL.Path)
+	}
+}
+
+// authorize checks the token. Call it with mu held.
+func (s *Server) authorize(token, method string, parts []string) (int, error) {
+	if token == s.Token {
+		return 0, nil
+	}
+	if s.SigningKeys == nil || !access.IsScopedToken(token) {
+		return http.StatusUnauthorized, fmt.Errorf("invalid token")
+	}
+	verifier := access.Verifier{Keys: s.SigningKeys, Resource: func(uuid string) *models.TFOResource {
+		tfoResource, found := s.tfoResources[uuid]
+		if !found {
+			return nil
+		}
+		return &tfoResource
+	}}
+	claims, err := verifier.Verify(token)
+	if err != nil {
+		return http.StatusUnauthorized, err
+	}
+	if len(parts) >= 2 && parts[0] == "resource" && !claims.Covers(parts[1], method != http.MethodGet) {
+		return http.StatusForbidden, fmt.Errorf("token %s is scoped to resource %s", claims.ID, claims.ResourceUUID)
+	}
+	return 0, nil
+}
+
+// hasHistory reports whether any logs, specs or approvals of the resource are kept. Call it with mu held.
+func (s *Server) hasHistory(uuid string) bool {
+	for _, resourceSpec := range s.resourceSpecs {
+		if resourceSpec.TFOResourceUUID == uuid {
+			return true
+		}
+	}
+	for uid, taskPod := range s.taskPods {
+		if taskPod.TFOResourceUUID != uuid {
+			continue
+		}
+		if _, found := s.approvals[uid]; found || len(s.taskLogs[uid]) > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,288 @@
+package fakeapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/galleybytes/monitor/pkg/handlers"
+	"github.com/galleybytes/monitor/pkg/models"
+	"github.com/galleybytes/monitor/pkg/sanitize"
+	gocache "github.com/patrickmn/go-cache"
+)
+
+// Harness runs a monitor binary against a fake API and a temporary TFO_ROOT_PATH, the same layout the
+// terraform-operator mounts into the task pods.
+type Harness struct {
+	API       *Server
+	Kube      *KubeServer
+	RootPath  string
+	Cluster   string
+	UUID      string
+	Namespace string
+	Name      string
+
+	// Generation is the TFO_GENERATION the monitor is started with
+	Generation string
+
+	// Spec is the spec of the resource in the fake Kubernetes API and what Register registers
+	Spec map[string]interface{}
+
+	// ExtraEnv is added to the monitor's env, eg to set MONITOR_WATCHER=poll
+	ExtraEnv []string
+
+	// ClusterMismatchPolicy is used by Register the same way the monitor manager uses it
+	ClusterMismatchPolicy handlers.ClusterMismatchPolicy
+
+	// SpecRedactKey and SpecRedact are the MONITOR_SPEC_REDACT_KEY and MONITOR_SPEC_REDACT of the manager, Register
+	// redacts the spec with them as the manager does. The monitor is not given the key.
+	SpecRedactKey string
+	SpecRedact    []string
+
+	mu     sync.Mutex
+	output bytes.Buffer
+	cmd    *exec.Cmd
+	done   chan struct{}
+	err    error
+}
+
+// NewHarness starts a fake API and creates the generation dir the monitor watches
+func NewHarness(generation string) (*Harness, error) {
+	rootPath, err := ioutil.TempDir("", "monitor-e2e-")
+	if err != nil {
+		return nil, err
+	}
+	h := &Harness{
+		API:        New(),
+		Kube:       NewKube(),
+		RootPath:   rootPath,
+		Cluster:    "e2e",
+		UUID:       "00000000-0000-0000-0000-00000000e2e0",
+		Namespace:  "default",
+		Name:       "e2e",
+		Generation: generation,
+
+		ClusterMismatchPolicy: handlers.ClusterMismatchFail,
+		SpecRedactKey:         "e2e-redact-key",
+	}
+	if err := ioutil.WriteFile(h.kubeconfigPath(), []byte(h.Kube.Kubeconfig()), 0600); err != nil {
+		h.Close()
+		return nil, err
+	}
+	h.SetSpec(generation, map[string]interface{}{})
+	if err := h.AddGeneration(generation); err != nil {
+		h.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+// AddGeneration creates the dir of the generation as the operator does when the resource spec changes and
+// registers it as the monitor manager does
+func (h *Harness) AddGeneration(generation string) error {
+	if err := os.MkdirAll(filepath.Join(h.RootPath, "generations", generation), 0755); err != nil {
+		return err
+	}
+	_, err := h.Register(generation)
+	return err
+}
+
+// Register registers the cluster and the generation of the resource the way the monitor manager does when the
+// resource is added or updated
+func (h *Harness) Register(generation string) (models.TFOResource, error) {
+	specSanitizer, err := sanitize.New([]byte(h.SpecRedactKey), h.SpecRedact...)
+	if err != nil {
+		return models.TFOResource{}, err
+	}
+	handler, err := handlers.NewWithToken(h.API.URL, h.API.Token, gocache.New(gocache.NoExpiration, gocache.NoExpiration)).
+		NegotiateSchemaVersion()
+	if err != nil {
+		return models.TFOResource{}, err
+	}
+	handler = handler.WithClusterMismatchPolicy(h.ClusterMismatchPolicy).WithSpecSanitizer(specSanitizer)
+	cluster, err := handler.GetOrSetCluster(h.Cluster)
+	if err != nil {
+		return models.TFOResource{}, err
+	}
+	resourceSpec, err := json.Marshal(h.Spec)
+	if err != nil {
+		return models.TFOResource{}, err
+	}
+	return handler.RegisterTFOResource(h.UUID, h.Namespace, h.Name, generation, *cluster, resourceSpec)
+}
+
+// SetSpec edits the spec of the resource in the fake Kubernetes API, as kubectl apply does, at the generation
+func (h *Harness) SetSpec(generation string, spec map[string]interface{}) {
+	h.Spec = spec
+	n, _ := strconv.Atoi(generation)
+	h.Kube.SetTerraform(h.Namespace, h.Name, map[string]interface{}{
+		"metadata": map[string]interface{}{"uid": h.UUID, "generation": n},
+		"spec":     spec,
+	})
+}
+
+// kubeconfigPath is next to the generations dir the monitor watches
+func (h *Harness) kubeconfigPath() string {
+	return filepath.Join(h.RootPath, "kubeconfig")
+}
+
+// LogPath is the path of the log file of a task. The file name is parsed by the monitor as
+// "<taskType>.<rerun>.<uid>.out".
+func (h *Harness) LogPath(generation, taskType string, rerun int, uid string) string {
+	return filepath.Join(h.RootPath, "generations", generation, fmt.Sprintf("%s.%d.%s.out", taskType, rerun, uid))
+}
+
+// AppendLog appends lines to the log file of a task, creating it when it does not exist
+func (h *Harness) AppendLog(generation, taskType string, rerun int, uid string, lines ...string) error {
+	f, err := os.OpenFile(h.LogPath(generation, taskType, rerun, uid), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(f, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Env is the env the monitor is started with
+func (h *Harness) Env() []string {
+	env := []string{
+		"PATH=" + os.Getenv("PATH"),
+		"MONITOR_MANAGER_SERVICE_HOST=" + h.API.URL,
+		"CLUSTER_NAME=" + h.Cluster,
+		"TFO_RESOURCE_UUID=" + h.UUID,
+		"TFO_NAMESPACE=" + h.Namespace,
+		"TFO_RESOURCE=" + h.Name,
+		"TFO_GENERATION=" + h.Generation,
+		"TFO_ROOT_PATH=" + h.RootPath,
+		"MONITOR_REGISTRATION_TIMEOUT=5s",
+		"KUBECONFIG=" + h.kubeconfigPath(),
+	}
+	return append(env, h.ExtraEnv...)
+}
+
+// Start runs the monitor binary in the background. The monitor is stopped when ctx is done or by Stop.
+func (h *Harness) Start(ctx context.Context, binary string, args ...string) error {
+	cmd := exec.CommandContext(ctx, binary, args...)
+	cmd.Env = h.Env()
+	cmd.Stdout = &lockedWriter{mu: &h.mu, w: &h.output}
+	cmd.Stderr = cmd.Stdout
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	h.cmd = cmd
+	h.done = make(chan struct{})
+	go func() {
+		h.err = cmd.Wait()
+		close(h.done)
+	}()
+	return nil
+}
+
+// Run runs the monitor binary to completion, eg for the backfill or export commands
+func (h *Harness) Run(ctx context.Context, binary string, args ...string) error {
+	if err := h.Start(ctx, binary, args...); err != nil {
+		return err
+	}
+	<-h.done
+	return h.err
+}
+
+// Stop kills the monitor if it is still running
+func (h *Harness) Stop() {
+	if h.cmd == nil || h.cmd.Process == nil {
+		return
+	}
+	select {
+	case <-h.done:
+	default:
+		h.cmd.Process.Kill()
+		<-h.done
+	}
+}
+
+// Exited reports whether the monitor started by Start has exited
+func (h *Harness) Exited() bool {
+	select {
+	case <-h.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Output returns what the monitor wrote to stdout and stderr so far
+func (h *Harness) Output() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.output.String()
+}
+
+// WaitForLines waits until the fake API has n lines for the task pod
+func (h *Harness) WaitForLines(uid string, n int, timeout time.Duration) error {
+	return h.WaitFor(timeout, func() bool {
+		return len(h.API.TaskLogs(uid)) >= n
+	}, func() string {
+		return fmt.Sprintf("task %s has %d of %d lines", uid, len(h.API.TaskLogs(uid)), n)
+	})
+}
+
+// WaitForFile waits until the file at the path relative to the generation dir exists, eg an approval file
+func (h *Harness) WaitForFile(generation, name string, timeout time.Duration) error {
+	path := filepath.Join(h.RootPath, "generations", generation, name)
+	return h.WaitFor(timeout, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}, func() string {
+		return fmt.Sprintf("%s does not exist", path)
+	})
+}
+
+// WaitFor polls the condition until it is true. describe explains what was expected when it times out.
+func (h *Harness) WaitFor(timeout time.Duration, condition func() bool, describe func() string) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		if condition() {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %s: %s\nmonitor output:\n%s", timeout, describe(), indent(h.Output()))
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Close stops the monitor and the fake API and removes the TFO_ROOT_PATH
+func (h *Harness) Close() {
+	h.Stop()
+	h.API.Close()
+	h.Kube.Close()
+	os.RemoveAll(h.RootPath)
+}
+
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  *bytes.Buffer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+func indent(s string) string {
+	return "    " + strings.ReplaceAll(strings.TrimRight(s, "\n"), "\n", "\n    ")
+}
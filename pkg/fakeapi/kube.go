@@ -0,0 +1,124 @@
+package fakeapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// kubeGroupVersion is the group version the fake Kubernetes API serves the Terraform resources in
+const kubeGroupVersion = "tf.isaaguilar.com/v1alpha2"
+
+// KubeServer is an in-process stand-in for the parts of the Kubernetes API the monitor reads: discovery and
+// getting Terraform resources. It is separate from Server since both serve /api.
+type KubeServer struct {
+	*httptest.Server
+
+	mu              sync.Mutex
+	resourceVersion int
+	terraforms      map[string]map[string]interface{}
+}
+
+// NewKube starts a fake Kubernetes API. Close it when done.
+func NewKube() *KubeServer {
+	s := &KubeServer{terraforms: map[string]map[string]interface{}{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// SetTerraform creates or replaces the Terraform resource. The apiVersion, kind, namespace, name and a new
+// resourceVersion are set in its metadata the way the API server does on every write.
+func (s *KubeServer) SetTerraform(namespace, name string, obj map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resourceVersion++
+	metadata, _ := obj["metadata"].(map[string]interface{})
+	if metadata == nil {
+		metadata = map[string]interface{}{}
+	}
+	metadata["namespace"] = namespace
+	metadata["name"] = name
+	metadata["resourceVersion"] = strconv.Itoa(s.resourceVersion)
+	obj["metadata"] = metadata
+	obj["apiVersion"] = kubeGroupVersion
+	obj["kind"] = "Terraform"
+	b, err := json.Marshal(obj)
+	if err != nil {
+		panic(err)
+	}
+	stored := map[string]interface{}{}
+	json.Unmarshal(b, &stored)
+	s.terraforms[namespace+"/"+name] = stored
+}
+
+// Kubeconfig is a kubeconfig for the fake Kubernetes API
+func (s *KubeServer) Kubeconfig() string {
+	return fmt.Sprintf(`apiVersion: v1
+kind: Config
+clusters:
+- name: fake
+  cluster:
+    server: %s
+contexts:
+- name: fake
+  context:
+    cluster: fake
+    user: fake
+current-context: fake
+users:
+- name: fake
+  user:
+    token: fake-token
+`, s.URL)
+}
+
+func (s *KubeServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/api":
+		json.NewEncoder(w).Encode(map[string]interface{}{"kind": "APIVersions", "versions": []string{"v1"}})
+	case r.Method == "GET" && r.URL.Path == "/apis":
+		version := map[string]string{"groupVersion": kubeGroupVersion, "version": strings.Split(kubeGroupVersion, "/")[1]}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"kind":       "APIGroupList",
+			"apiVersion": "v1",
+			"groups": []interface{}{map[string]interface{}{
+				"name":             strings.Split(kubeGroupVersion, "/")[0],
+				"versions":         []interface{}{version},
+				"preferredVersion": version,
+			}},
+		})
+	// /apis/<group>/<version>/namespaces/<namespace>/terraforms/<name>
+	case r.Method == "GET" && len(parts) == 7 && parts[0] == "apis" && parts[1]+"/"+parts[2] == kubeGroupVersion &&
+		parts[3] == "namespaces" && parts[5] == "terraforms":
+		obj, found := s.terraforms[parts[4]+"/"+parts[6]]
+		if !found {
+			kubeStatus(w, http.StatusNotFound, "NotFound", fmt.Sprintf("terraforms %q not found", parts[6]))
+			return
+		}
+		json.NewEncoder(w).Encode(obj)
+	default:
+		kubeStatus(w, http.StatusNotFound, "NotFound", "the server could not find the requested resource")
+	}
+}
+
+// kubeStatus responds with a metav1.Status so client-go returns a status error
+func kubeStatus(w http.ResponseWriter, statusCode int, reason, message string) {
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"kind":       "Status",
+		"apiVersion": "v1",
+		"status":     "Failure",
+		"reason":     reason,
+		"message":    message,
+		"code":       statusCode,
+	})
+}
@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// managerAccess is the API access handed out by the monitor manager. The tokens minted by the manager expire, so
+// a new one is fetched once most of its lifetime has passed and when the API rejects it.
+type managerAccess struct {
+	url string
+
+	// serviceAccountTokenFile is the projected service account token the monitor authenticates to the manager
+	// with. The kubelet rotates the file so it is read for every exchange.
+	serviceAccountTokenFile string
+
+	mu        sync.Mutex
+	host      string
+	token     string
+	fetchedAt time.Time
+	expiresAt time.Time
+}
+
+// ErrAccessRevoked is returned once the monitor manager refuses to hand out API access, eg because the resource
+// was deleted. Asking again will not help.
+var ErrAccessRevoked = errors.New("the monitor manager revoked the API access")
+
+type apiAccessResponse struct {
+	Host      string    `json:"host"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// managerTLSConfig verifies the certificate of the monitor manager with the CA in MONITOR_MANAGER_CA, which the
+// manager distributes with the CA of its webhook certificate, on top of the system roots
+func managerTLSConfig() (*tls.Config, error) {
+	rootCAs, _ := x509.SystemCertPool()
+	if rootCAs == nil {
+		rootCAs = x509.NewCertPool()
+	}
+	if managerCA := os.Getenv("MONITOR_MANAGER_CA"); managerCA != "" {
+		if ok := rootCAs.AppendCertsFromPEM([]byte(managerCA)); !ok {
+			return nil, fmt.Errorf("MONITOR_MANAGER_CA does not contain a PEM encoded certificate")
+		}
+	}
+	return &tls.Config{RootCAs: rootCAs}, nil
+}
+
+func fetchAPIAccess(url, serviceAccountTokenFile string) (apiAccessResponse, error) {
+	accessResponseData := apiAccessResponse{}
+	tlsConfig, err := managerTLSConfig()
+	if err != nil {
+		return accessResponseData, err
+	}
+	tr := &http.Transport{
+		TLSClientConfig: tlsConfig,
+	}
+	client := &http.Client{Transport: tr}
+
+	request, err := http.NewRequest("GET", url, bytes.NewBuffer([]byte{}))
+	if err != nil {
+		return accessResponseData, err
+	}
+	request.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	if serviceAccountTokenFile != "" {
+		b, err := os.ReadFile(serviceAccountTokenFile)
+		if err != nil {
+			return accessResponseData, err
+		}
+		request.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(b)))
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return accessResponseData, err
+	}
+	defer response.Body.Close()
+
+	responseBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return accessResponseData, err
+	}
+	if response.StatusCode == http.StatusForbidden {
+		return accessResponseData, fmt.Errorf("%w: %s", ErrAccessRevoked, strings.TrimSpace(string(responseBody)))
+	}
+	if response.StatusCode != 200 {
+		return accessResponseData, fmt.Errorf("request to %s returned a %d but expected 200: %s", request.URL, response.StatusCode, strings.TrimSpace(string(responseBody)))
+	}
+	err = json.Unmarshal(responseBody, &accessResponseData)
+	return accessResponseData, err
+}
+
+// refresh fetches a new token. Call it with mu held. The previous token is kept when the manager cannot be reached.
+func (a *managerAccess) refresh() error {
+	accessResponseData, err := fetchAPIAccess(a.url, a.serviceAccountTokenFile)
+	if err != nil {
+		return fmt.Errorf("could not get API access from the monitor manager: %w", err)
+	}
+	a.host = accessResponseData.Host
+	a.token = accessResponseData.Token
+	a.fetchedAt = time.Now()
+	a.expiresAt = accessResponseData.ExpiresAt
+	return nil
+}
+
+// current returns the token, fetching a new one when 80% of its lifetime has passed. Tokens without an expiry
+// are used until the API rejects them. A token that is due to be refreshed but has not expired yet is still
+// returned when the refresh fails.
+func (a *managerAccess) current() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token == "" || (!a.expiresAt.IsZero() && time.Now().After(a.fetchedAt.Add(a.expiresAt.Sub(a.fetchedAt)*4/5))) {
+		if err := a.refresh(); err != nil && (a.token == "" || time.Now().After(a.expiresAt)) {
+			return "", err
+		}
+	}
+	return a.token, nil
+}
+
+// rejected fetches a new token after the API rejected the token
+func (a *managerAccess) rejected(token string) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token == token {
+		if err := a.refresh(); err != nil {
+			return "", err
+		}
+	}
+	return a.token, nil
+}
+
+// GetAPIAccess asks the monitor manager at url for the API host and token
+func GetAPIAccess(url string) (string, string) {
+	accessResponseData, err := fetchAPIAccess(url, "")
+	if err != nil {
+		log.Panic(err)
+	}
+	return accessResponseData.Host, accessResponseData.Token
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFetchAPIAccessVerifiesTheManager(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(apiAccessResponse{Host: "http://api", Token: "tfo1.token", ExpiresAt: time.Now().Add(time.Hour)})
+	}))
+	defer server.Close()
+
+	t.Setenv("MONITOR_MANAGER_CA", "")
+	if _, err := fetchAPIAccess(server.URL, ""); err == nil {
+		t.Fatal("fetchAPIAccess() trusted a manager certificate that is not signed by MONITOR_MANAGER_CA")
+	}
+
+	t.Setenv("MONITOR_MANAGER_CA", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})))
+	access, err := fetchAPIAccess(server.URL, "")
+	if err != nil {
+		t.Fatalf("fetchAPIAccess() error = %v", err)
+	}
+	if access.Token != "tfo1.token" {
+		t.Errorf("fetchAPIAccess() token = %q, want %q", access.Token, "tfo1.token")
+	}
+}
+
+func TestManagerTLSConfigInvalidCA(t *testing.T) {
+	t.Setenv("MONITOR_MANAGER_CA", "not a certificate")
+	if _, err := managerTLSConfig(); err == nil {
+		t.Error("managerTLSConfig() accepted a MONITOR_MANAGER_CA without a certificate")
+	}
+}
+
+func TestManagerAccessReturnsRefreshErrors(t *testing.T) {
+	t.Setenv("MONITOR_MANAGER_CA", "")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	access := &managerAccess{url: server.URL}
+	if _, err := access.current(); err == nil {
+		t.Error("current() without a token returned no error when the manager is unavailable")
+	}
+
+	// A token that is due to be refreshed but has not expired is still used
+	access.token = "tfo1.token"
+	access.fetchedAt = time.Now().Add(-50 * time.Minute)
+	access.expiresAt = time.Now().Add(10 * time.Minute)
+	if token, err := access.current(); err != nil || token != "tfo1.token" {
+		t.Errorf("current() = %q, %v, want the token that has not expired", token, err)
+	}
+	access.expiresAt = time.Now().Add(-time.Minute)
+	if _, err := access.current(); err == nil {
+		t.Error("current() returned an expired token when the manager is unavailable")
+	}
+	if _, err := access.rejected("tfo1.token"); err == nil {
+		t.Error("rejected() returned no error when the manager is unavailable")
+	}
+}
+
+func TestNewFromManagerReturnsTheErrorOfTheFirstToken(t *testing.T) {
+	t.Setenv("MONITOR_MANAGER_CA", "")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	if _, err := NewFromManager(server.URL, "", nil); err == nil {
+		t.Error("NewFromManager() returned no error when the manager is unavailable")
+	}
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/galleybytes/monitor/pkg/models"
+)
+
+func fnClusterAdoptionsResponse(arr interface{}) (interface{}, error) {
+	b, err := json.Marshal(arr)
+	if err != nil {
+		return nil, err
+	}
+	var obj []models.ClusterAdoption
+	err = json.Unmarshal(b, &obj)
+	if err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// AdoptionSupported returns why the API cannot record the adoptions of the adopt policy, nil when it can. The
+// records were added in models.ClusterAdoptionSchemaVersion, an API that did not report that version to
+// NegotiateSchemaVersion would respond with a 404.
+func (h Handler) AdoptionSupported() error {
+	return h.requireSchemaVersion(models.ClusterAdoptionSchemaVersion, "adoption records")
+}
+
+// addClusterAdoption records that the resource was adopted. Failures to communicate with the API are returned.
+func (h Handler) addClusterAdoption(adoption models.ClusterAdoption) error {
+	if err := h.AdoptionSupported(); err != nil {
+		return err
+	}
+	jsonData, err := json.Marshal(map[string]interface{}{
+		"cluster_adoption": adoption,
+	})
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/api/v1/resource/%s/adoption", h.host, adoption.TFOResourceUUID)
+	request, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+
+	_, found, reason, err := h.doRequest(request, fnAnyContent)
+	if err != nil {
+		return fmt.Errorf("error recording the adoption of resource '%s': %w", adoption.TFOResourceUUID, err)
+	}
+	if found == nil || !*found {
+		return fmt.Errorf("error recording the adoption of resource '%s': %v", adoption.TFOResourceUUID, reason)
+	}
+	return nil
+}
+
+// FindClusterAdoptions returns the adoptions of the resource, the oldest first. Failures to communicate with the
+// API are returned.
+func (h Handler) FindClusterAdoptions(uuid string) ([]models.ClusterAdoption, error) {
+	url := fmt.Sprintf("%s/api/v1/resource/%s/adoptions", h.host, uuid)
+	request, err := http.NewRequest("GET", url, bytes.NewBuffer([]byte{}))
+	if err != nil {
+		return nil, err
+	}
+
+	untypedAdoptions, found, reason, err := h.doRequest(request, fnClusterAdoptionsResponse)
+	if err != nil {
+		return nil, fmt.Errorf("error finding the adoptions of resource '%s': %w", uuid, err)
+	}
+	if err := serverFailed(reason); err != nil {
+		return nil, fmt.Errorf("error finding the adoptions of resource '%s': %w", uuid, err)
+	}
+	if found == nil || !*found || untypedAdoptions == nil {
+		return []models.ClusterAdoption{}, nil
+	}
+	return untypedAdoptions.([]models.ClusterAdoption), nil
+}
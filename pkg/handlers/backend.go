@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"context"
+	"time"
+
+	"github.com/galleybytes/monitor/pkg/models"
+)
+
+// Backend is where the monitor registers resources and task pods, saves logs and reads approvals from. Handler
+// talks to the terraform-operator-api. The database package implements the same calls directly against
+// Postgres for clusters that do not run the API.
+//
+// The monitor manager uses the same calls to register resources, mark them deleted and purge their history, and
+// reads the GenerationStatus to report the monitoring state on the resource. GenerationStatus returns its errors so
+// the manager reports them on the resource.
+//
+// The archive package exports and imports the run history of a resource with GetOrSetCluster and the Find and Add
+// calls, which save the records as they are. They return their errors so export and import exit with a message.
+//
+// FindCluster, FindTFOResource, FindResourceSpec, FindPreviousResourceSpec, GetOrSetTaskPod, FindTaskLogs,
+// MissingLines, WriteAllLines and FindApprovals are what a running monitor calls. They return their errors so the monitor keeps
+// running and retries, the other calls panic when the backend cannot be reached.
+//
+// WithContext returns a copy whose calls are made with ctx, so they are traced as children of the span in ctx.
+type Backend interface {
+	WithContext(ctx context.Context) Backend
+	GetOrSetCluster(name string) (*models.Cluster, error)
+	FindCluster(name string) (*models.Cluster, error)
+	RegisterTFOResource(uuid, namespace, name, currentGeneration string, cluster models.Cluster, resourceSpec []byte) (models.TFOResource, error)
+	AdoptionSupported() error
+	FindClusterAdoptions(uuid string) ([]models.ClusterAdoption, error)
+	FindTFOResource(uuid string) (*models.TFOResource, error)
+	GetOrSetTaskPod(tfoResource models.TFOResource, taskType, generation string, rerun int, uid string) (models.TaskPod, error)
+	MissingLines(taskPod models.TaskPod, tfoTaskLogs []models.TFOTaskLog) ([]models.TFOTaskLog, error)
+	WriteAllLines(tfoResource models.TFOResource, taskPod models.TaskPod, tfoTaskLogs []models.TFOTaskLog) (int, error)
+	FindApprovals(uids []string) ([]models.Approval, error)
+	DeleteTFOResource(uuid, deletedBy string) *models.TFOResource
+	FindDeletedTFOResources(before time.Time) []models.TFOResource
+	PurgeTFOResource(uuid string)
+	RetentionSupported() error
+	GenerationStatus(uuid, generation string, stage Stage) (GenerationStatus, error)
+	RecordResourceSpec(uuid, generation string, resourceSpec []byte) bool
+	FindResourceSpec(uuid, generation string) (*models.TFOResourceSpec, error)
+	FindPreviousResourceSpec(uuid, generation string) (*models.TFOResourceSpec, error)
+	SpecDiffSupported() error
+	FindTaskPods(uuid, generation string) ([]models.TaskPod, error)
+	FindTaskLogs(uid string) ([]models.TFOTaskLog, error)
+	FindApprovalStatus(uid string) (*ApprovalStatus, error)
+	AddTFOResource(tfoResource models.TFOResource) (models.TFOResource, error)
+	AddResourceSpec(tfoResourceSpec models.TFOResourceSpec) error
+	AddApproval(approval models.Approval) error
+}
+
+var _ Backend = Handler{}
@@ -3,11 +3,14 @@ package handlers
 import (
 	"bufio"
 	"bytes"
-	"crypto/tls"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -15,42 +18,167 @@ import (
 	"strings"
 	"time"
 
-	"github.com/galleybytes/monitor/pkg/tfohttpclient"
+	"github.com/galleybytes/monitor/pkg/logging"
+	"github.com/galleybytes/monitor/pkg/models"
+	"github.com/galleybytes/monitor/pkg/sanitize"
+	"github.com/galleybytes/monitor/pkg/tracing"
 	"github.com/galleybytes/monitor/pkg/util"
-	"github.com/galleybytes/terraform-operator-api/pkg/api"
-	"github.com/galleybytes/terraform-operator-api/pkg/common/models"
 	gocache "github.com/patrickmn/go-cache"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func boolp(b bool) *bool {
 	return &b
 }
 
-type handler struct {
+type Handler struct {
 	client *http.Client
 	host   string
 	token  string
 	cache  *gocache.Cache
+	ctx    context.Context
+
+	// access is set when the token is handed out by the monitor manager and has to be refreshed
+	access *managerAccess
+
+	clusterMismatchPolicy ClusterMismatchPolicy
+
+	// specSanitizer redacts the resource spec before it is saved. Saving a spec without setting it with
+	// WithSpecSanitizer panics.
+	specSanitizer sanitize.Sanitizer
+
+	// schemaVersion is the schema version the API reported to NegotiateSchemaVersion, empty when it reported none
+	schemaVersion string
+}
+
+// New returns a handler that gets its API access from the monitor manager at url. Failing to get the first token
+// will cause a panic.
+func New(url string, cache *gocache.Cache) Handler {
+	h, err := NewFromManager(url, "", cache)
+	if err != nil {
+		log.Panic(err)
+	}
+	return h
+}
+
+// NewFromManager returns a handler that gets its API access from the monitor manager at url, authenticating
+// with the service account token in serviceAccountTokenFile when it is set. The token is refreshed before it
+// expires and when the API rejects it. Failing to get the first token is returned.
+func NewFromManager(url, serviceAccountTokenFile string, cache *gocache.Cache) (Handler, error) {
+	access := &managerAccess{url: url, serviceAccountTokenFile: serviceAccountTokenFile}
+	token, err := access.current()
+	if err != nil {
+		return Handler{}, err
+	}
+	h := NewWithToken(access.host, token, cache)
+	h.access = access
+	return h, nil
 }
 
-func New(url string, cache *gocache.Cache) handler {
-	host, token := GetAPIAccess(url)
-	return handler{
+// NewWithToken returns a handler for the API at host that uses the token as-is instead of asking the monitor
+// manager for access
+func NewWithToken(host, token string, cache *gocache.Cache) Handler {
+	return Handler{
 		client: &http.Client{},
 		host:   host,
 		token:  token,
 		cache:  cache,
+
+		clusterMismatchPolicy: ClusterMismatchFail,
 	}
 }
 
-func (h handler) doRequest(request *http.Request, fn func(interface{}) (interface{}, error)) (interface{}, *bool, error, error) {
-	request.Header.Set("Token", h.token)
+// WithClusterMismatchPolicy returns a copy of the handler that resolves resources bound to another cluster with
+// the policy
+func (h Handler) WithClusterMismatchPolicy(policy ClusterMismatchPolicy) Handler {
+	h.clusterMismatchPolicy = policy
+	return h
+}
+
+// WithSpecSanitizer returns a copy of the handler that redacts the resource spec with the sanitizer instead of
+// only the builtin rules
+func (h Handler) WithSpecSanitizer(specSanitizer sanitize.Sanitizer) Handler {
+	h.specSanitizer = specSanitizer
+	return h
+}
+
+// WithContext returns a copy of the handler that makes its requests with ctx
+func (h Handler) WithContext(ctx context.Context) Backend {
+	h.ctx = ctx
+	return h
+}
+
+func (h Handler) context() context.Context {
+	if h.ctx == nil {
+		return context.Background()
+	}
+	return h.ctx
+}
+
+// startSpan starts a child span of the handler's context and returns a copy of the handler that makes its
+// requests within the span
+func (h Handler) startSpan(name string, attrs ...attribute.KeyValue) (Handler, trace.Span) {
+	ctx, span := tracing.Start(h.context(), name, attrs...)
+	h.ctx = ctx
+	return h, span
+}
+
+func (h Handler) doRequest(request *http.Request, fn func(interface{}) (interface{}, error)) (interface{}, *bool, error, error) {
+	ctx, span := tracing.Start(h.context(), "api "+request.Method,
+		attribute.String(logging.Method, request.Method),
+		attribute.String(logging.Endpoint, request.URL.Path),
+	)
+	defer span.End()
+	request = request.WithContext(ctx)
+	tracing.Inject(ctx, propagation.HeaderCarrier(request.Header))
+
+	token := h.token
+	if h.access != nil {
+		var err error
+		if token, err = h.access.current(); err != nil {
+			tracing.Fail(span, err)
+			return nil, nil, nil, err
+		}
+	}
+	request.Header.Set("Token", token)
 	request.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	start := time.Now()
 	response, err := h.client.Do(request)
+	if err == nil && response.StatusCode == http.StatusUnauthorized && h.access != nil && request.GetBody != nil {
+		// The token expired or was revoked. Retry once with a new one.
+		response.Body.Close()
+		request.Body, err = request.GetBody()
+		if err == nil {
+			token, err = h.access.rejected(token)
+		}
+		if err == nil {
+			request.Header.Set("Token", token)
+			response, err = h.client.Do(request)
+		}
+	}
 	if err != nil {
+		tracing.Fail(span, err)
+		slog.Error("API request failed",
+			logging.Method, request.Method,
+			logging.Endpoint, request.URL.Path,
+			logging.Latency, time.Since(start).String(),
+			"error", err,
+		)
 		return nil, nil, nil, err
 	}
 	defer response.Body.Close()
+	span.SetAttributes(attribute.Int(logging.StatusCode, response.StatusCode))
+	if response.StatusCode >= 400 {
+		tracing.Fail(span, fmt.Errorf("request returned a %d", response.StatusCode))
+	}
+	slog.Debug("API request",
+		logging.Method, request.Method,
+		logging.Endpoint, request.URL.Path,
+		logging.StatusCode, response.StatusCode,
+		logging.Latency, time.Since(start).String(),
+	)
 	if response.StatusCode == http.StatusNoContent {
 		return nil, nil, nil, nil
 	}
@@ -69,10 +197,14 @@ func (h handler) doRequest(request *http.Request, fn func(interface{}) (interfac
 		return nil, nil, nil, err
 	}
 
-	structuredResponse := api.Response{}
+	structuredResponse := models.Response{}
 	err = json.Unmarshal(responseBody, &structuredResponse)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, &responseError{
+			statusCode:     response.StatusCode,
+			notAPIResponse: true,
+			message:        fmt.Sprintf("response of %s is not an api response: %s", request.URL, err),
+		}
 	}
 
 	if !status200 {
@@ -98,8 +230,32 @@ func (h handler) doRequest(request *http.Request, fn func(interface{}) (interfac
 		}
 	}
 
-	return data, boolp(status200 && hasData), fmt.Errorf(errMsg), nil
+	return data, boolp(status200 && hasData), &responseError{statusCode: response.StatusCode, message: errMsg}, nil
+
+}
+
+// responseError is the reason doRequest returns. It keeps the status code for the callers that handle some
+// status codes differently.
+type responseError struct {
+	statusCode int
+
+	// notAPIResponse is set when the body could not be read as an api response, eg the 404 page of a proxy
+	notAPIResponse bool
+	message        string
+}
+
+func (e *responseError) Error() string {
+	return e.message
+}
 
+// serverFailed returns the reason of a response the API failed to handle, eg a 500, so the reads that take any
+// other response for missing data do not take a failure for it
+func serverFailed(reason error) error {
+	var responseErr *responseError
+	if errors.As(reason, &responseErr) && responseErr.statusCode >= 500 {
+		return reason
+	}
+	return nil
 }
 
 func fnClusterResponse(arr interface{}) (interface{}, error) {
@@ -191,19 +347,8 @@ func fnAnyContent(n interface{}) (interface{}, error) {
 	return new(interface{}), nil
 }
 
-// findClusterByID find the cluster by id. Returns the cluster model if found.
-func (h handler) findClusterByID(id uint) (interface{}, *bool, error, error) {
-	url := fmt.Sprintf("%s/api/v1/cluster/%d", h.host, id)
-	request, err := http.NewRequest("GET", url, bytes.NewBuffer([]byte{}))
-	if err != nil {
-		return nil, nil, nil, err
-	}
-
-	return h.doRequest(request, fnClusterResponse)
-}
-
 // findCluster find the cluster by name. Returns the cluster model if found.
-func (h handler) findCluster(name string) (interface{}, *bool, error, error) {
+func (h Handler) findCluster(name string) (interface{}, *bool, error, error) {
 	url := fmt.Sprintf("%s/api/v1/cluster-name/%s", h.host, name)
 	request, err := http.NewRequest("GET", url, bytes.NewBuffer([]byte{}))
 	if err != nil {
@@ -215,7 +360,7 @@ func (h handler) findCluster(name string) (interface{}, *bool, error, error) {
 }
 
 // addCluster registers a new cluster and returns the new cluster model
-func (h handler) addCluster(name string) (interface{}, *bool, error, error) {
+func (h Handler) addCluster(name string) (interface{}, *bool, error, error) {
 	jsonData, err := json.Marshal(map[string]interface{}{
 		"cluster_name": name,
 	})
@@ -231,58 +376,92 @@ func (h handler) addCluster(name string) (interface{}, *bool, error, error) {
 	return h.doRequest(request, fnClusterResponse)
 }
 
-// GetOrSetCluster will find an existing cluster or create a new one in the db.
-// In any event where the cluster fails to be found or created, the monitor will panic.
-func (h handler) GetOrSetCluster(name string) *models.Cluster {
-	cluster := models.Cluster{}
-	untypedCluster, found, _, err := h.findCluster(name)
-	if untypedCluster != nil {
-		cluster = untypedCluster.(models.Cluster)
+// GetOrSetCluster will find an existing cluster or create a new one in the db. Failures to communicate with the
+// API are returned.
+func (h Handler) GetOrSetCluster(name string) (*models.Cluster, error) {
+	h, span := h.startSpan("register cluster", attribute.String(logging.Cluster, name))
+	defer span.End()
+	untypedCluster, found, reason, err := h.findCluster(name)
+	if err != nil {
+		return nil, fmt.Errorf("error finding cluster '%s': %w", name, err)
+	}
+	if err := serverFailed(reason); err != nil {
+		return nil, fmt.Errorf("error finding cluster '%s': %w", name, err)
+	}
+	if found != nil && *found && untypedCluster != nil {
+		cluster := untypedCluster.(models.Cluster)
+		return &cluster, nil
 	}
+
+	untypedNewCluster, found, reason, err := h.addCluster(name)
 	if err != nil {
-		log.Printf("Finding cluster '%s' failed", name)
-		panic(err)
+		return nil, fmt.Errorf("error adding cluster '%s': %w", name, err)
 	}
-	if found == nil {
-		log.Panic("Type 'bool' was expected but got 'nil'")
+	if found == nil || !*found || untypedNewCluster == nil {
+		return nil, fmt.Errorf("error adding cluster '%s': %v", name, reason)
 	}
-	if !*found {
-		untypedNewCluster, found, reason, err := h.addCluster(name)
-		if err != nil {
-			log.Printf("Adding cluster '%s' failed", name)
-			panic(err)
-		}
-		if found == nil {
-			log.Panic("Type 'bool' was expected but got 'nil'")
-		}
-		if !*found {
-			log.Panic(reason)
-		}
-		if untypedNewCluster == nil {
-			log.Panic("expected a cluster type but found something else...fix me")
-		}
-		cluster = untypedNewCluster.(models.Cluster)
+	cluster := untypedNewCluster.(models.Cluster)
+	return &cluster, nil
+}
+
+// FindCluster returns the cluster registered under name or nil when it has not been registered yet. The monitor
+// waits for the registration with it, so failures to communicate with the API are returned for it to retry.
+func (h Handler) FindCluster(name string) (*models.Cluster, error) {
+	untypedCluster, found, _, err := h.findCluster(name)
+	if err != nil {
+		return nil, fmt.Errorf("error finding cluster '%s': %w", name, err)
+	}
+	if found == nil || !*found || untypedCluster == nil {
+		return nil, nil
+	}
+	cluster := untypedCluster.(models.Cluster)
+	return &cluster, nil
+}
 
+// FindTFOResource returns the resource registered under uuid or nil when it has not been registered yet.
+// Failures to communicate with the API are returned.
+func (h Handler) FindTFOResource(uuid string) (*models.TFOResource, error) {
+	url := fmt.Sprintf("%s/api/v1/resource/%s", h.host, uuid)
+	request, err := http.NewRequest("GET", url, bytes.NewBuffer([]byte{}))
+	if err != nil {
+		return nil, err
 	}
 
-	return &cluster
+	untypedTFOResource, found, _, err := h.doRequest(request, fnTFOResourceResponse)
+	if err != nil {
+		return nil, fmt.Errorf("error finding resource '%s': %w", uuid, err)
+	}
+	if found == nil || !*found || untypedTFOResource == nil {
+		return nil, nil
+	}
+	tfoResource := untypedTFOResource.(models.TFOResource)
+	return &tfoResource, nil
 }
 
-// GetOrSetTFOResource finds or updates the tfo_resource table in the database. The tfo_resource_spec is also
-// updated in this call.
-//
-// TODO The "Create" part of this function is probably not a good place to create the resource. There is a
-// chance that the monitor fails to start. In that case, the tfo_resource or the tfo_resource_spec is never
-// created nor updated.
-// The soltuion is to let the "monitor manager", a project that has the responsibility of modifying the
-// "tf" kubernetes spec, be in charge of managing the tfo_resource and tfo_resource_spec to the database.
-func (h handler) GetOrSetTFOResource(uuid, namespace, name, currentGeneration string, cluster models.Cluster) models.TFOResource {
-	// resources := []models.TFOResource{}
-	resourceSpec, err := tfohttpclient.ResourceSpec()
+// mustFindTFOResource is FindTFOResource for the calls that panic when the API cannot be reached
+func (h Handler) mustFindTFOResource(uuid string) *models.TFOResource {
+	tfoResource, err := h.FindTFOResource(uuid)
 	if err != nil {
-		// Print err and continue with blank spec
-		log.Printf("ERROR could not read the resource spec: %s", err.Error())
+		log.Panic(err)
 	}
+	return tfoResource
+}
+
+// RegisterTFOResource finds or updates the tfo_resource table in the database. The resourceSpec is saved as the
+// tfo_resource_spec of the generation, redacted by the spec sanitizer, when the resource is created or the
+// generation changed. A resource bound
+// to another cluster is resolved with the handler's ClusterMismatchPolicy; when it is forked the fork is
+// returned, and the fail policy returns a *ClusterMismatchError.
+//
+// Registration is done by the monitor manager when the resource is added or updated, so the resource is
+// registered even when a monitor fails to start.
+func (h Handler) RegisterTFOResource(uuid, namespace, name, currentGeneration string, cluster models.Cluster, resourceSpec []byte) (models.TFOResource, error) {
+	h, span := h.startSpan("register resource",
+		attribute.String(logging.ResourceUUID, uuid),
+		attribute.String(logging.Generation, currentGeneration),
+	)
+	defer span.End()
+	resourceSpec = h.specSanitizer.Sanitize(resourceSpec)
 
 	url := fmt.Sprintf("%s/api/v1/resource/%s", h.host, uuid)
 	request, err := http.NewRequest("GET", url, bytes.NewBuffer([]byte{}))
@@ -300,123 +479,76 @@ func (h handler) GetOrSetTFOResource(uuid, namespace, name, currentGeneration st
 	if !*found {
 		// The TFOResource is not found so a new one has to be created.
 
-		jsonData, err := json.Marshal(map[string]interface{}{
-			"tfo_resource": models.TFOResource{
-				UUID:              uuid,
-				Namespace:         namespace,
-				Name:              name,
-				CurrentGeneration: currentGeneration,
-				Cluster:           cluster,
-			},
+		tfoResource, err := h.AddTFOResource(models.TFOResource{
+			UUID:              uuid,
+			Namespace:         namespace,
+			Name:              name,
+			CurrentGeneration: currentGeneration,
+			Cluster:           cluster,
 		})
 		if err != nil {
-			log.Panic(err)
-		}
-		url := fmt.Sprintf("%s/api/v1/resource", h.host)
-		request, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-		if err != nil {
-			log.Panic(err)
+			return tfoResource, err
 		}
 
-		untypedTFOResource, found, reason, err := h.doRequest(request, fnTFOResourceResponse)
-		if err != nil {
-			log.Panic(err)
-		}
-		if found == nil {
-			log.Panic("Type 'bool' was expected but got 'nil'")
-		}
-		if !*found {
-			log.Panic(reason)
-		}
-
-		jsonData, err = json.Marshal(map[string]interface{}{
-			"tfo_resource_spec": models.TFOResourceSpec{
-				TFOResourceUUID: uuid,
-				Generation:      currentGeneration,
-				ResourceSpec:    string(resourceSpec),
-			},
-		})
-		if err != nil {
-			log.Panic(err)
-		}
-		url = fmt.Sprintf("%s/api/v1/resource-spec", h.host)
-		request, err = http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-		if err != nil {
-			log.Panic(err)
-		}
-
-		_, found, reason, err = h.doRequest(request, fnAnyContent)
-		if err != nil {
-			log.Panic(err)
-		}
-		if found == nil {
-			log.Panic("Type 'bool' was expected but got 'nil'")
-		}
-		if !*found {
-			log.Panic(reason)
-		}
-
-		return untypedTFOResource.(models.TFOResource)
+		return tfoResource, h.AddResourceSpec(h.newResourceSpec(uuid, currentGeneration, resourceSpec))
 	}
 
 	// The TFOResource was found in the database. First do a quick sanity check of the clusterID that the
 	// TFOResource stored in the database has.
 	tfoResource := untypedTFOResource.(models.TFOResource)
 	if tfoResource.ClusterID != cluster.ID {
-		//TODO The clusterID was detected to not match. What should happen if the clusterID is different?
-
-		// TODO This code resolves the cluster to get the name of the cluster. The name is used only for a error message.
-		// The query to resolve the name should be removed. The user can query the api with the given cluster id if they
-		// need more information.
-		foundCluster := models.Cluster{}
-		untypedCluster, found, reason, err := h.findClusterByID(tfoResource.ClusterID)
-		if err != nil {
-			log.Panic(err)
-		}
-		if found == nil {
-			log.Panic("Type 'bool' was expected but got 'nil'")
-		}
-		if !*found {
-			log.Panic(reason)
-		}
-		if untypedCluster == nil {
-			log.Panic("expected a cluster type but found something else...fix me")
+		if err := ReportClusterMismatch(h.clusterMismatchPolicy, tfoResource, cluster); err != nil {
+			return tfoResource, err
+		}
+		switch h.clusterMismatchPolicy {
+		case ClusterMismatchAdopt:
+			// The adoption is recorded before the resource is rebound, a registration that is retried can record
+			// it twice but never loses it
+			err := h.addClusterAdoption(models.ClusterAdoption{
+				TFOResourceUUID: uuid,
+				FromClusterID:   tfoResource.ClusterID,
+				ToClusterID:     cluster.ID,
+				Generation:      currentGeneration,
+			})
+			if err != nil {
+				return tfoResource, err
+			}
+			tfoResource.UpdatedBy = AdoptedBy(tfoResource.ClusterID, cluster)
+			tfoResource.ClusterID = cluster.ID
+			tfoResource.Cluster = cluster
+		case ClusterMismatchFork:
+			forkUUID := ForkUUID(uuid, cluster)
+			fork := h.mustFindTFOResource(forkUUID)
+			if fork == nil {
+				fork, err := h.AddTFOResource(models.TFOResource{
+					UUID:              forkUUID,
+					CreatedBy:         ForkedBy(uuid, tfoResource.ClusterID),
+					Namespace:         namespace,
+					Name:              name,
+					CurrentGeneration: currentGeneration,
+					Cluster:           cluster,
+				})
+				if err != nil {
+					return fork, err
+				}
+				return fork, h.AddResourceSpec(h.newResourceSpec(forkUUID, currentGeneration, resourceSpec))
+			}
+			uuid = forkUUID
+			tfoResource = *fork
 		}
-		foundCluster = untypedCluster.(models.Cluster)
-		log.Fatalf("Resource UUID is bound to cluster #%d:%s but found cluster defined as #%d:%s",
-			foundCluster.ID, foundCluster.Name,
-			cluster.ID, cluster.Name,
-		)
+	}
+
+	if !tfoResource.DeletedAt.IsZero() {
+		// The resource was restored after it was deleted
+		tfoResource.DeletedAt = time.Time{}
+		tfoResource.DeletedBy = ""
 	}
 
 	if tfoResource.CurrentGeneration != currentGeneration {
 		tfoResource.CurrentGeneration = currentGeneration
 
-		jsonData, err := json.Marshal(map[string]interface{}{
-			"tfo_resource_spec": models.TFOResourceSpec{
-				TFOResourceUUID: uuid,
-				Generation:      currentGeneration,
-				ResourceSpec:    string(resourceSpec),
-			},
-		})
-		if err != nil {
-			log.Panic(err)
-		}
-		url = fmt.Sprintf("%s/api/v1/resource-spec", h.host)
-		request, err = http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-		if err != nil {
-			log.Panic(err)
-		}
-
-		_, found, reason, err := h.doRequest(request, fnAnyContent)
-		if err != nil {
-			log.Panic(err)
-		}
-		if found == nil {
-			log.Panic("Type 'bool' was expected but got 'nil'")
-		}
-		if !*found {
-			log.Panic(reason)
+		if err := h.AddResourceSpec(h.newResourceSpec(uuid, currentGeneration, resourceSpec)); err != nil {
+			return tfoResource, err
 		}
 	}
 
@@ -442,121 +574,132 @@ func (h handler) GetOrSetTFOResource(uuid, namespace, name, currentGeneration st
 	if !*found {
 		log.Panic(reason)
 	}
-	return untypedTFOResource.(models.TFOResource)
+	return untypedTFOResource.(models.TFOResource), nil
 }
 
-// WriteAllLines compares logs-to-write with logs-already-written (in the database) to check if the LINENO exists.
-// It does not check the contents of the line. It prunes the lines that already have been written based on LINENO.
-// After determining what lines to write, it sends the logs to get saved to the database.
-//
-// Failures to communicate with the database will cause a panic.
-func (h handler) WriteAllLines(tfoResource models.TFOResource, taskPod models.TaskPod, tfoTaskLogs []models.TFOTaskLog) {
-	start := time.Now()
-	if len(tfoTaskLogs) == 0 {
-		return
-	}
-
-	url := fmt.Sprintf("%s/api/v1/task/%s/logs", h.host, taskPod.UUID)
-	request, err := http.NewRequest("GET", url, bytes.NewBuffer([]byte{}))
+// MissingLines compares logs-to-write with logs-already-written (in the database) to check if the LINENO exists.
+// It does not check the contents of the line. It returns the lines that have not been written based on LINENO.
+func (h Handler) MissingLines(taskPod models.TaskPod, tfoTaskLogs []models.TFOTaskLog) ([]models.TFOTaskLog, error) {
+	h, span := h.startSpan("dedupe lines", attribute.String(logging.TaskPodUUID, taskPod.UUID))
+	defer span.End()
+	foundTFOTaskLogs, err := h.FindTaskLogs(taskPod.UUID)
 	if err != nil {
-		log.Panic(err)
-	}
-
-	untypedTFOTaskLogs, found, _, err := h.doRequest(request, fnTFOTaskLogs)
-	if err != nil {
-		log.Panic(err)
-	}
-	if found == nil {
-		log.Panic("Type 'bool' was expected but got 'nil'")
+		return nil, err
 	}
-	foundTFOTaskLogs := untypedTFOTaskLogs.([]models.TFOTaskLog)
 	savedIndicies := []string{}
 	for _, initLog := range foundTFOTaskLogs {
-		// log.Printf("%s Already have %s", "func WriteAllLines", initLog.Message)
 		savedIndicies = append(savedIndicies, initLog.LineNo)
 	}
 
 	linesToWrite := []models.TFOTaskLog{}
 	for _, initLog := range tfoTaskLogs {
 		if !util.ContainsString(savedIndicies, initLog.LineNo) {
-			// log.Printf("%s Will write %s", "func WriteAllLines", initLog.Message)
 			linesToWrite = append(linesToWrite, initLog)
 		}
 	}
+	return linesToWrite, nil
+}
 
+// WriteAllLines prunes the lines that already have been written using MissingLines. After determining what lines
+// to write, it sends the logs to get saved to the database. It returns how many lines were written.
+func (h Handler) WriteAllLines(tfoResource models.TFOResource, taskPod models.TaskPod, tfoTaskLogs []models.TFOTaskLog) (int, error) {
+	start := time.Now()
+	if len(tfoTaskLogs) == 0 {
+		return 0, nil
+	}
+
+	linesToWrite, err := h.MissingLines(taskPod, tfoTaskLogs)
+	if err != nil {
+		return 0, err
+	}
 	if len(linesToWrite) > 0 {
+		h, span := h.startSpan("upload lines",
+			attribute.String(logging.TaskPodUUID, taskPod.UUID),
+			attribute.Int("lines", len(linesToWrite)),
+		)
+		defer span.End()
 
 		jsonData, err := json.Marshal(map[string]interface{}{
 			"tfo_task_logs": linesToWrite,
 		})
 		if err != nil {
-			log.Panic(err)
+			return 0, err
 		}
 		url := fmt.Sprintf("%s/api/v1/logs", h.host)
 		request, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
 		if err != nil {
-			log.Panic(err)
+			return 0, err
 		}
 
 		_, _, reason, err := h.doRequest(request, fnAnyContent)
 		if err != nil {
-			log.Panic(err)
+			tracing.Fail(span, err)
+			return 0, err
 		}
 		if reason != nil {
-			log.Panic(reason)
+			tracing.Fail(span, reason)
+			return 0, reason
 		}
 	}
 
-	log.Printf("Wrote %d lines in %s", len(linesToWrite), time.Since(start).String())
+	slog.Info("Wrote lines", append(logging.TaskAttrs(taskPod), "lines", len(linesToWrite), logging.Latency, time.Since(start).String())...)
+	return len(linesToWrite), nil
 }
 
-func (h handler) EventWriter(file string, tfoResource models.TFOResource, taskType, generation string, rerun int, uid string) {
-	// Let's write any .out to the database
-
-	taskPod := models.TaskPod{}
+// GetOrSetTaskPod returns the task pod from the cache or registers it in the database
+func (h Handler) GetOrSetTaskPod(tfoResource models.TFOResource, taskType, generation string, rerun int, uid string) (models.TaskPod, error) {
 	if cached, found := h.cache.Get(uid); found {
-		taskPod = cached.(models.TaskPod)
-	} else {
-		jsonData, err := json.Marshal(map[string]interface{}{
-			"task_pod": models.TaskPod{
-				UUID:        uid,
-				Rerun:       rerun,
-				Generation:  generation,
-				TaskType:    taskType,
-				TFOResource: tfoResource,
-			},
-		})
-		if err != nil {
-			log.Panic(err)
-		}
-		url := fmt.Sprintf("%s/api/v1/task", h.host)
-		request, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-		if err != nil {
-			log.Panic(err)
-		}
+		return cached.(models.TaskPod), nil
+	}
+	h, span := h.startSpan("register task pod", attribute.String(logging.TaskPodUUID, uid))
+	defer span.End()
 
-		untypedTaskPod, found, reason, err := h.doRequest(request, fnTaskPodResponse)
-		if err != nil {
-			log.Panicf("error handling request for task with uid '%s' of type '%s': %s", uid, taskType, err)
-		}
-		if found == nil {
-			log.Panic("Type 'bool' was expected but got 'nil'")
-		}
-		if !*found {
-			log.Panicf("error handling request for task with uid '%s' of type '%s': %s", uid, taskType, reason)
+	jsonData, err := json.Marshal(map[string]interface{}{
+		"task_pod": models.TaskPod{
+			UUID:        uid,
+			Rerun:       rerun,
+			Generation:  generation,
+			TaskType:    taskType,
+			TFOResource: tfoResource,
+		},
+	})
+	if err != nil {
+		return models.TaskPod{}, err
+	}
+	url := fmt.Sprintf("%s/api/v1/task", h.host)
+	request, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return models.TaskPod{}, err
+	}
 
-		}
-		taskPod = untypedTaskPod.(models.TaskPod)
-		h.cache.Set(uid, taskPod, gocache.NoExpiration)
+	untypedTaskPod, found, reason, err := h.doRequest(request, fnTaskPodResponse)
+	if err != nil {
+		return models.TaskPod{}, fmt.Errorf("error handling request for task with uid '%s' of type '%s': %w", uid, taskType, err)
+	}
+	if found == nil {
+		return models.TaskPod{}, fmt.Errorf("type 'bool' was expected but got 'nil'")
 	}
+	if !*found {
+		return models.TaskPod{}, fmt.Errorf("error handling request for task with uid '%s' of type '%s': %s", uid, taskType, reason)
+	}
+	taskPod := untypedTaskPod.(models.TaskPod)
+	h.cache.Set(uid, taskPod, gocache.NoExpiration)
+	return taskPod, nil
+}
 
+// ReadLines reads the log file into numbered task logs
+func ReadLines(file string, tfoResource models.TFOResource, taskPod models.TaskPod) []models.TFOTaskLog {
 	f, err := os.Open(file)
 	if err != nil {
 		panic(err)
 	}
 	defer f.Close()
+	return ScanLines(f, tfoResource, taskPod)
+}
 
-	fileScanner := bufio.NewScanner(f)
+// ScanLines numbers each line read from r starting at 1, the same as ReadLines does for a file
+func ScanLines(r io.Reader, tfoResource models.TFOResource, taskPod models.TaskPod) []models.TFOTaskLog {
+	fileScanner := bufio.NewScanner(r)
 	fileScanner.Split(bufio.ScanLines)
 
 	i := 0
@@ -570,8 +713,18 @@ func (h handler) EventWriter(file string, tfoResource models.TFOResource, taskTy
 			LineNo:      fmt.Sprintf("%d", i),
 		})
 	}
+	return lines
+}
 
-	h.WriteAllLines(tfoResource, taskPod, lines)
+func (h Handler) EventWriter(file string, tfoResource models.TFOResource, taskType, generation string, rerun int, uid string) error {
+	// Let's write any .out to the database
+	taskPod, err := h.GetOrSetTaskPod(tfoResource, taskType, generation, rerun, uid)
+	if err != nil {
+		return err
+	}
+	lines := ReadLines(file, tfoResource, taskPod)
+	_, err = h.WriteAllLines(tfoResource, taskPod, lines)
+	return err
 }
 
 type ApprovalStatus = struct {
@@ -579,54 +732,61 @@ type ApprovalStatus = struct {
 	Status          string `json:"status"`
 }
 
-// FindApprovals checks logs by the task_log_uuid for approval statuses in the database. When approved, a file
-// is created using a specific naming convention.
-// See https://github.com/GalleyBytes/terraform-operator-tasks/commit/7b2ab6813696def5ca806de9fe52b09a164de6fb
-func (h handler) FindApprovals(uids []string, dir string) {
+// FindApprovalStatus returns the approval status of the task or nil when there is no approval data. Failures to
+// communicate with the API are returned.
+func (h Handler) FindApprovalStatus(uid string) (*ApprovalStatus, error) {
+	url := fmt.Sprintf("%s/api/v1/task/%s/approval-status", h.host, uid)
+	request, err := http.NewRequest("GET", url, bytes.NewBuffer([]byte{}))
+	if err != nil {
+		return nil, err
+	}
 
-	approvalStatuses := []ApprovalStatus{}
-	for _, uid := range uids {
-		url := fmt.Sprintf("%s/api/v1/task/%s/approval-status", h.host, uid)
-		request, err := http.NewRequest("GET", url, bytes.NewBuffer([]byte{}))
-		if err != nil {
-			log.Panic(err)
-		}
+	untypedApprovalStatus, found, reason, err := h.doRequest(request, fnApprovalStatusResponse)
+	if err != nil {
+		return nil, err
+	}
+	if err := serverFailed(reason); err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, fmt.Errorf("type 'bool' was expected but got 'nil'")
+	}
+	if !*found {
+		// TODO Should fail because the response should always have something
+		return nil, nil
+	}
+	approvalStatus := untypedApprovalStatus.(ApprovalStatus)
+	if approvalStatus.Status == "nodata" {
+		return nil, nil
+	}
+	return &approvalStatus, nil
+}
 
-		untypedApprovalStatus, found, _, err := h.doRequest(request, fnApprovalStatusResponse)
+// FindApprovals checks logs by the task_log_uuid for approval statuses in the database and returns the approval
+// decisions that were made
+func (h Handler) FindApprovals(uids []string) ([]models.Approval, error) {
+	approvals := []models.Approval{}
+	for _, uid := range uids {
+		approvalStatus, err := h.FindApprovalStatus(uid)
 		if err != nil {
-			log.Panic(err)
-		}
-		if found == nil {
-			log.Panic("Type 'bool' was expected but got 'nil'")
-		}
-		if !*found {
-			// TODO Should panic because the response should always have something
-			continue
+			return nil, err
 		}
-		approvalStatus := untypedApprovalStatus.(ApprovalStatus)
-		if approvalStatus.Status == "nodata" {
+		if approvalStatus == nil {
 			continue
 		}
-		approvalStatuses = append(approvalStatuses, approvalStatus)
+		approvals = append(approvals, approvalStatus.Approval)
 	}
+	return approvals, nil
+}
 
-	result := struct{ Error error }{}
-	if result.Error != nil {
-		log.Println("Error fetching approvals")
-	}
-	for _, approval := range approvalStatuses {
-		if approval.IsApproved {
-			approveFilename := fmt.Sprintf("%s/_approved_%s", dir, approval.TaskPodUUID)
-			if _, err := os.Stat(approveFilename); err != nil {
-				ioutil.WriteFile(approveFilename, []byte{}, 0644)
-			}
-		} else {
-			cancelFilename := fmt.Sprintf("%s/_canceled_%s", dir, approval.TaskPodUUID)
-			if _, err := os.Stat(cancelFilename); err != nil {
-				ioutil.WriteFile(cancelFilename, []byte{}, 0644)
-			}
-		}
+// ApprovalFile is the file in dir that tells a task it has been approved or canceled, using the naming convention
+// of the tasks.
+// See https://github.com/GalleyBytes/terraform-operator-tasks/commit/7b2ab6813696def5ca806de9fe52b09a164de6fb
+func ApprovalFile(dir string, approval models.Approval) string {
+	if approval.IsApproved {
+		return fmt.Sprintf("%s/_approved_%s", dir, approval.TaskPodUUID)
 	}
+	return fmt.Sprintf("%s/_canceled_%s", dir, approval.TaskPodUUID)
 }
 
 // ParseFile takes the file path on the filesystem to check that is it a log file and returns the
@@ -663,42 +823,3 @@ func ParseFile(file string) (bool, string, int, string, string) {
 	return true, taskType, rerun, generation, uid
 
 }
-
-func GetAPIAccess(url string) (string, string) {
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	client := &http.Client{Transport: tr}
-
-	request, err := http.NewRequest("GET", url, bytes.NewBuffer([]byte{}))
-	if err != nil {
-		log.Panic(err)
-	}
-
-	request.Header.Set("Content-Type", "application/json; charset=UTF-8")
-	response, err := client.Do(request)
-	if err != nil {
-		log.Panic(err)
-	}
-	defer response.Body.Close()
-
-	if response.StatusCode != 200 {
-		log.Panicf("Request to %s returned a %d but expected 200", request.URL, response.StatusCode)
-	}
-
-	responseBody, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		log.Panic(err)
-	}
-
-	accessResponseData := struct {
-		Host  string `json:"host"`
-		Token string `json:"token"`
-	}{}
-	err = json.Unmarshal(responseBody, &accessResponseData)
-	if err != nil {
-		log.Panic(err)
-	}
-
-	return accessResponseData.Host, accessResponseData.Token
-}
@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+
+	"github.com/galleybytes/monitor/pkg/logging"
+	"github.com/galleybytes/monitor/pkg/models"
+)
+
+func fnResourceSpecResponse(arr interface{}) (interface{}, error) {
+	i := arr.([]interface{})
+	if len(i) == 0 {
+		return nil, fmt.Errorf("did not contain data")
+	}
+	b, err := json.Marshal(i[0])
+	if err != nil {
+		return nil, err
+	}
+
+	var obj models.TFOResourceSpec
+	err = json.Unmarshal(b, &obj)
+	if err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+func fnTaskPodsResponse(arr interface{}) (interface{}, error) {
+	i := arr.([]interface{})
+	b, err := json.Marshal(i)
+	if err != nil {
+		return nil, err
+	}
+
+	var obj []models.TaskPod
+	err = json.Unmarshal(b, &obj)
+	if err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// AddResourceSpec saves the spec of a generation of the resource. Failures to communicate with the API are
+// returned.
+func (h Handler) AddResourceSpec(tfoResourceSpec models.TFOResourceSpec) error {
+	if err := h.SpecDiffSupported(); err != nil && tfoResourceSpec.SpecDiff != "" {
+		slog.Warn("The spec diff is not saved", logging.ResourceUUID, tfoResourceSpec.TFOResourceUUID,
+			logging.Generation, tfoResourceSpec.Generation, "error", err)
+		tfoResourceSpec.SpecDiff = ""
+	}
+	jsonData, err := json.Marshal(map[string]interface{}{
+		"tfo_resource_spec": tfoResourceSpec,
+	})
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/api/v1/resource-spec", h.host)
+	request, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+
+	_, found, reason, err := h.doRequest(request, fnAnyContent)
+	if err != nil {
+		return fmt.Errorf("error saving the spec of generation %s of resource '%s': %w", tfoResourceSpec.Generation, tfoResourceSpec.TFOResourceUUID, err)
+	}
+	if found == nil || !*found {
+		return fmt.Errorf("error saving the spec of generation %s of resource '%s': %v", tfoResourceSpec.Generation, tfoResourceSpec.TFOResourceUUID, reason)
+	}
+	return nil
+}
+
+// AddTFOResource registers the resource as-is and returns the saved resource. Failures to communicate with the
+// API are returned.
+func (h Handler) AddTFOResource(tfoResource models.TFOResource) (models.TFOResource, error) {
+	jsonData, err := json.Marshal(map[string]interface{}{
+		"tfo_resource": tfoResource,
+	})
+	if err != nil {
+		return tfoResource, err
+	}
+	url := fmt.Sprintf("%s/api/v1/resource", h.host)
+	request, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return tfoResource, err
+	}
+
+	untypedTFOResource, found, reason, err := h.doRequest(request, fnTFOResourceResponse)
+	if err != nil {
+		return tfoResource, fmt.Errorf("error adding resource '%s': %w", tfoResource.UUID, err)
+	}
+	if found == nil || !*found || untypedTFOResource == nil {
+		return tfoResource, fmt.Errorf("error adding resource '%s': %v", tfoResource.UUID, reason)
+	}
+	return untypedTFOResource.(models.TFOResource), nil
+}
+
+// AddApproval records the approval decision of a task. Failures to communicate with the API are returned.
+func (h Handler) AddApproval(approval models.Approval) error {
+	jsonData, err := json.Marshal(map[string]interface{}{
+		"approval": approval,
+	})
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/api/v1/approval/%s", h.host, approval.TaskPodUUID)
+	request, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+
+	_, found, reason, err := h.doRequest(request, fnAnyContent)
+	if err != nil {
+		return fmt.Errorf("error adding the approval of task '%s': %w", approval.TaskPodUUID, err)
+	}
+	if found == nil || !*found {
+		return fmt.Errorf("error adding the approval of task '%s': %v", approval.TaskPodUUID, reason)
+	}
+	return nil
+}
+
+// FindResourceSpec returns the spec saved for the generation of the resource or nil if there is none. Failures to
+// communicate with the API are returned.
+func (h Handler) FindResourceSpec(uuid, generation string) (*models.TFOResourceSpec, error) {
+	url := fmt.Sprintf("%s/api/v1/resource/%s/resource-spec/generation/%s", h.host, uuid, generation)
+	request, err := http.NewRequest("GET", url, bytes.NewBuffer([]byte{}))
+	if err != nil {
+		return nil, err
+	}
+
+	untypedResourceSpec, found, _, err := h.doRequest(request, fnResourceSpecResponse)
+	if err != nil {
+		return nil, fmt.Errorf("error finding the spec of generation %s of resource '%s': %w", generation, uuid, err)
+	}
+	if found == nil || !*found || untypedResourceSpec == nil {
+		return nil, nil
+	}
+	resourceSpec := untypedResourceSpec.(models.TFOResourceSpec)
+	return &resourceSpec, nil
+}
+
+// mustFindResourceSpec is FindResourceSpec for the calls that panic when the API cannot be reached
+func (h Handler) mustFindResourceSpec(uuid, generation string) *models.TFOResourceSpec {
+	resourceSpec, err := h.FindResourceSpec(uuid, generation)
+	if err != nil {
+		log.Panic(err)
+	}
+	return resourceSpec
+}
+
+// FindTaskPods returns the task pods registered for the generation of the resource. Failures to communicate with
+// the API are returned.
+func (h Handler) FindTaskPods(uuid, generation string) ([]models.TaskPod, error) {
+	url := fmt.Sprintf("%s/api/v1/resource/%s/generation/%s/tasks", h.host, uuid, generation)
+	request, err := http.NewRequest("GET", url, bytes.NewBuffer([]byte{}))
+	if err != nil {
+		return nil, err
+	}
+
+	untypedTaskPods, found, reason, err := h.doRequest(request, fnTaskPodsResponse)
+	if err != nil {
+		return nil, err
+	}
+	if err := serverFailed(reason); err != nil {
+		return nil, err
+	}
+	if found == nil || untypedTaskPods == nil {
+		return []models.TaskPod{}, nil
+	}
+	return untypedTaskPods.([]models.TaskPod), nil
+}
+
+// FindTaskLogs returns the logs saved for the task. A task that has not been registered yet has no logs. Failures to
+// communicate with the API are returned.
+func (h Handler) FindTaskLogs(uid string) ([]models.TFOTaskLog, error) {
+	url := fmt.Sprintf("%s/api/v1/task/%s/logs", h.host, uid)
+	request, err := http.NewRequest("GET", url, bytes.NewBuffer([]byte{}))
+	if err != nil {
+		return nil, err
+	}
+
+	untypedTFOTaskLogs, found, reason, err := h.doRequest(request, fnTFOTaskLogs)
+	if err != nil {
+		return nil, err
+	}
+	if err := serverFailed(reason); err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, fmt.Errorf("type 'bool' was expected but got 'nil'")
+	}
+	if untypedTFOTaskLogs == nil {
+		return []models.TFOTaskLog{}, nil
+	}
+	return untypedTFOTaskLogs.([]models.TFOTaskLog), nil
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"log/slog"
+
+	"github.com/galleybytes/monitor/pkg/logging"
+	"github.com/galleybytes/monitor/pkg/metrics"
+	"github.com/galleybytes/monitor/pkg/models"
+)
+
+// ClusterMismatchPolicy decides what happens when a resource UUID is already bound to another cluster, which is
+// what happens when resources are restored onto a new cluster
+type ClusterMismatchPolicy string
+
+const (
+	// ClusterMismatchFail stops the monitor. The resource stays bound to the other cluster.
+	ClusterMismatchFail ClusterMismatchPolicy = "fail"
+
+	// ClusterMismatchAdopt rebinds the resource to the current cluster. Every adoption is recorded as a
+	// models.ClusterAdoption, UpdatedBy shows the latest until the resource is updated again.
+	ClusterMismatchAdopt ClusterMismatchPolicy = "adopt"
+
+	// ClusterMismatchFork registers the resource under a new UUID derived from the original UUID and the current
+	// cluster. The history of the original resource is left untouched and CreatedBy records where the fork came
+	// from.
+	ClusterMismatchFork ClusterMismatchPolicy = "fork"
+)
+
+func ParseClusterMismatchPolicy(s string) (ClusterMismatchPolicy, error) {
+	switch policy := ClusterMismatchPolicy(s); policy {
+	case "":
+		return ClusterMismatchFail, nil
+	case ClusterMismatchFail, ClusterMismatchAdopt, ClusterMismatchFork:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown cluster mismatch policy '%s', use fail, adopt or fork", s)
+	}
+}
+
+// ForkUUID is the UUID the fork of the resource on the cluster is registered under. It is a name based (version
+// 5 style) UUID so every monitor of the resource on the cluster finds the same fork.
+func ForkUUID(uuid string, cluster models.Cluster) string {
+	return nameUUID(fmt.Sprintf("%s/cluster/%d", uuid, cluster.ID))
+}
+
+// nameUUID is a version 5 style UUID of the name, the same every time
+func nameUUID(name string) string {
+	sum := sha1.Sum([]byte(name))
+	sum[6] = (sum[6] & 0x0f) | 0x50
+	sum[8] = (sum[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// AdoptedBy is the audit record saved as UpdatedBy when a resource is adopted
+func AdoptedBy(fromClusterID uint, cluster models.Cluster) string {
+	return fmt.Sprintf("monitor: adopted from cluster #%d by cluster #%d:%s", fromClusterID, cluster.ID, cluster.Name)
+}
+
+// ForkedBy is the audit record saved as CreatedBy of a fork
+func ForkedBy(uuid string, fromClusterID uint) string {
+	return fmt.Sprintf("monitor: forked from resource %s of cluster #%d", uuid, fromClusterID)
+}
+
+// ClusterMismatchError is returned by the fail policy
+type ClusterMismatchError struct {
+	UUID           string
+	BoundClusterID uint
+	Cluster        models.Cluster
+}
+
+func (e *ClusterMismatchError) Error() string {
+	return fmt.Sprintf("resource UUID %s is bound to cluster #%d but found cluster defined as #%d:%s. Set MONITOR_CLUSTER_MISMATCH_POLICY to adopt or fork to resolve it.",
+		e.UUID, e.BoundClusterID, e.Cluster.ID, e.Cluster.Name)
+}
+
+// ReportClusterMismatch logs and counts the mismatch. The fail policy returns a *ClusterMismatchError.
+func ReportClusterMismatch(policy ClusterMismatchPolicy, tfoResource models.TFOResource, cluster models.Cluster) error {
+	metrics.ClusterMismatches.Add(string(policy), 1)
+	attrs := []any{
+		logging.ResourceUUID, tfoResource.UUID,
+		"bound_cluster_id", tfoResource.ClusterID,
+		"cluster_id", cluster.ID,
+		"policy", string(policy),
+	}
+	switch policy {
+	case ClusterMismatchAdopt:
+		slog.Warn("Resource is bound to another cluster, adopting it", attrs...)
+	case ClusterMismatchFork:
+		slog.Warn("Resource is bound to another cluster, forking it", append(attrs, "fork_uuid", ForkUUID(tfoResource.UUID, cluster))...)
+	default:
+		slog.Error("Resource is bound to another cluster", attrs...)
+		return &ClusterMismatchError{UUID: tfoResource.UUID, BoundClusterID: tfoResource.ClusterID, Cluster: cluster}
+	}
+	return nil
+}
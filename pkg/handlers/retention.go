@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/galleybytes/monitor/pkg/logging"
+	"github.com/galleybytes/monitor/pkg/models"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// RetentionPolicy decides how long the history of a deleted resource is kept. The history is the task logs,
+// the specs and the approvals. The resource itself is kept with its DeletedAt and DeletedBy as a record of the
+// deletion.
+type RetentionPolicy struct {
+	// Forever keeps the history of deleted resources
+	Forever bool
+
+	// Days the history is kept after the resource was deleted. Zero purges the history when the resource is
+	// deleted.
+	Days int
+}
+
+// ParseRetentionPolicy reads "forever", "purge" or a number of days like "30d". "" defaults to forever.
+func ParseRetentionPolicy(s string) (RetentionPolicy, error) {
+	switch s {
+	case "", "forever":
+		return RetentionPolicy{Forever: true}, nil
+	case "purge":
+		return RetentionPolicy{}, nil
+	}
+	days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+	if err != nil || days < 0 {
+		return RetentionPolicy{}, fmt.Errorf("unknown retention policy '%s', use forever, purge or a number of days like 30d", s)
+	}
+	return RetentionPolicy{Days: days}, nil
+}
+
+func (p RetentionPolicy) String() string {
+	switch {
+	case p.Forever:
+		return "forever"
+	case p.Days == 0:
+		return "purge"
+	default:
+		return fmt.Sprintf("%dd", p.Days)
+	}
+}
+
+// PurgeBefore returns the time before which deleted resources are purged. It returns false when the policy keeps
+// the history forever.
+func (p RetentionPolicy) PurgeBefore(now time.Time) (time.Time, bool) {
+	if p.Forever {
+		return time.Time{}, false
+	}
+	return now.AddDate(0, 0, -p.Days), true
+}
+
+// DeletedBy is the audit record saved as DeletedBy when the resource is deleted from the cluster
+func DeletedBy(cluster models.Cluster) string {
+	return fmt.Sprintf("manager: deleted from cluster #%d:%s", cluster.ID, cluster.Name)
+}
+
+func fnTFOResourcesResponse(arr interface{}) (interface{}, error) {
+	b, err := json.Marshal(arr)
+	if err != nil {
+		return nil, err
+	}
+	var obj []models.TFOResource
+	err = json.Unmarshal(b, &obj)
+	if err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// DeleteTFOResource marks the resource as deleted. It returns nil when the resource has not been registered.
+// Failures to communicate with the database will cause a panic.
+func (h Handler) DeleteTFOResource(uuid, deletedBy string) *models.TFOResource {
+	h, span := h.startSpan("delete resource", attribute.String(logging.ResourceUUID, uuid))
+	defer span.End()
+
+	tfoResource := h.mustFindTFOResource(uuid)
+	if tfoResource == nil {
+		return nil
+	}
+	tfoResource.DeletedAt = time.Now()
+	tfoResource.DeletedBy = deletedBy
+
+	jsonData, err := json.Marshal(map[string]interface{}{
+		"tfo_resource": tfoResource,
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	url := fmt.Sprintf("%s/api/v1/resource", h.host)
+	request, err := http.NewRequest("PUT", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		log.Panic(err)
+	}
+	untypedTFOResource, found, reason, err := h.doRequest(request, fnTFOResourceResponse)
+	if err != nil {
+		log.Panic(err)
+	}
+	if found == nil {
+		log.Panic("Type 'bool' was expected but got 'nil'")
+	}
+	if !*found {
+		log.Panic(reason)
+	}
+	deleted := untypedTFOResource.(models.TFOResource)
+	return &deleted
+}
+
+// FindDeletedTFOResources returns the resources deleted before the time whose history has not been purged yet.
+// Failures to communicate with the database will cause a panic.
+func (h Handler) FindDeletedTFOResources(before time.Time) []models.TFOResource {
+	query := url.Values{"before": {before.UTC().Format(time.RFC3339Nano)}}.Encode()
+	url := fmt.Sprintf("%s/api/v1/resources/deleted?%s", h.host, query)
+	request, err := http.NewRequest("GET", url, bytes.NewBuffer([]byte{}))
+	if err != nil {
+		log.Panic(err)
+	}
+	untypedTFOResources, found, _, err := h.doRequest(request, fnTFOResourcesResponse)
+	if err != nil {
+		log.Panic(err)
+	}
+	if found == nil || !*found || untypedTFOResources == nil {
+		return nil
+	}
+	return untypedTFOResources.([]models.TFOResource)
+}
+
+// PurgeTFOResource removes the task logs, specs and approvals of the resource.
+// Failures to communicate with the database will cause a panic.
+func (h Handler) PurgeTFOResource(uuid string) {
+	h, span := h.startSpan("purge resource", attribute.String(logging.ResourceUUID, uuid))
+	defer span.End()
+
+	url := fmt.Sprintf("%s/api/v1/resource/%s/history", h.host, uuid)
+	request, err := http.NewRequest("DELETE", url, bytes.NewBuffer([]byte{}))
+	if err != nil {
+		log.Panic(err)
+	}
+	_, found, reason, err := h.doRequest(request, fnAnyContent)
+	if err != nil {
+		log.Panic(err)
+	}
+	if found != nil && !*found {
+		log.Panic(reason)
+	}
+}
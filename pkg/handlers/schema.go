@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/galleybytes/monitor/pkg/models"
+)
+
+// SchemaVersion asks the API which version of the models it uses. The terraform-operator-api does not serve
+// /api/v1/schema-version yet, an empty string is returned when the API does not report a version, which is when
+// it responds with a 404 or with a body that is not an api response. Any other failure is returned.
+func (h Handler) SchemaVersion() (string, error) {
+	url := fmt.Sprintf("%s/api/v1/schema-version", h.host)
+	request, err := http.NewRequest("GET", url, bytes.NewBuffer([]byte{}))
+	if err != nil {
+		return "", err
+	}
+
+	untypedVersion, found, reason, err := h.doRequest(request, func(arr interface{}) (interface{}, error) {
+		i := arr.([]interface{})
+		if len(i) == 0 {
+			return nil, fmt.Errorf("did not contain data")
+		}
+		data, ok := i[0].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected an object but got %T", i[0])
+		}
+		version, ok := data["schema_version"].(string)
+		if !ok {
+			return nil, fmt.Errorf("schema_version is missing")
+		}
+		return version, nil
+	})
+	if err != nil {
+		// The API responds to unknown routes with a body that is not an api response
+		var responseErr *responseError
+		if errors.As(err, &responseErr) && responseErr.notAPIResponse && responseErr.statusCode < 500 {
+			return "", nil
+		}
+		return "", err
+	}
+	if found == nil || !*found {
+		var responseErr *responseError
+		if errors.As(reason, &responseErr) && responseErr.statusCode == http.StatusNotFound {
+			return "", nil
+		}
+		if reason == nil {
+			return "", fmt.Errorf("request to %s returned no content", url)
+		}
+		return "", reason
+	}
+	return untypedVersion.(string), nil
+}
+
+// NegotiateSchemaVersion checks that the API uses models this monitor understands and returns a copy of the
+// handler that knows the version for the features that need one, SpecDiffSupported and RetentionSupported. It returns an explanation
+// when the versions are not compatible rather than letting requests fail later on.
+func (h Handler) NegotiateSchemaVersion() (Handler, error) {
+	version, err := h.SchemaVersion()
+	if err != nil {
+		return h, fmt.Errorf("could not read the schema version of the API at %s: %s", h.host, err)
+	}
+	if version == "" {
+		// The models are encoded the way the API encodes them, only an API that reports a version is checked. The
+		// features that need a version are turned off.
+		slog.Warn("The API does not report a schema version, spec diffs are not saved and history is not purged", "host", h.host)
+		return h, nil
+	}
+	if err := models.CompatibleSchemaVersion(version); err != nil {
+		return h, fmt.Errorf("the API at %s uses schema version %s but this monitor uses %s, upgrade the monitor or the API so the major versions match",
+			h.host, version, models.SchemaVersion)
+	}
+	slog.Info("Negotiated the schema version", "host", h.host, "schema_version", version)
+	h.schemaVersion = version
+	return h, nil
+}
+
+// SpecDiffSupported returns why the API cannot save TFOResourceSpec.SpecDiff, nil when it can. The field was added
+// in models.SpecDiffSchemaVersion, an API that did not report that version to NegotiateSchemaVersion would drop it.
+func (h Handler) SpecDiffSupported() error {
+	return h.requireSchemaVersion(models.SpecDiffSchemaVersion, "spec diffs")
+}
+
+// RetentionSupported returns why the API cannot purge the history of deleted resources, nil when it can. The routes
+// were added in models.RetentionSchemaVersion, an API that did not report that version to NegotiateSchemaVersion
+// would respond to them with a 404.
+func (h Handler) RetentionSupported() error {
+	return h.requireSchemaVersion(models.RetentionSchemaVersion, "retention policies")
+}
+
+func (h Handler) requireSchemaVersion(minimum, feature string) error {
+	if err := models.RequireSchemaVersion(h.schemaVersion, minimum, feature); err != nil {
+		return fmt.Errorf("the API at %s does not support them: %s", h.host, err)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSchemaVersion(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		body        string
+		wantVersion string
+		wantErr     bool
+	}{
+		{
+			name:        "reported",
+			status:      http.StatusOK,
+			body:        `{"status_info":{"status_code":200},"data":[{"schema_version":"1.1"}]}`,
+			wantVersion: "1.1",
+		},
+		{
+			name:   "api not found",
+			status: http.StatusNotFound,
+			body:   `{"status_info":{"status_code":404,"message":"not found"},"data":null}`,
+		},
+		{
+			name:   "older api not found page",
+			status: http.StatusNotFound,
+			body:   `404 page not found`,
+		},
+		{
+			name:    "server error",
+			status:  http.StatusInternalServerError,
+			body:    `{"status_info":{"status_code":500,"message":"database is down"},"data":null}`,
+			wantErr: true,
+		},
+		{
+			name:    "proxy error page",
+			status:  http.StatusBadGateway,
+			body:    `<html>bad gateway</html>`,
+			wantErr: true,
+		},
+		{
+			name:    "forbidden",
+			status:  http.StatusForbidden,
+			body:    `{"status_info":{"status_code":403,"message":"invalid token"},"data":null}`,
+			wantErr: true,
+		},
+		{
+			name:    "version missing",
+			status:  http.StatusOK,
+			body:    `{"status_info":{"status_code":200},"data":[{}]}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/api/v1/schema-version" {
+					t.Errorf("unexpected request to %s", r.URL.Path)
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			version, err := NewWithToken(server.URL, "token", nil).SchemaVersion()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SchemaVersion() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if version != tt.wantVersion {
+				t.Errorf("SchemaVersion() = %q, want %q", version, tt.wantVersion)
+			}
+		})
+	}
+}
+
+func TestSchemaVersionTransportError(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	if _, err := NewWithToken(server.URL, "token", nil).SchemaVersion(); err == nil {
+		t.Fatal("SchemaVersion() of an unreachable API did not return an error")
+	}
+}
+
+func TestNegotiateSchemaVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		wantErr  bool
+		features bool
+		adoption bool
+	}{
+		{name: "adoptions", status: http.StatusOK, body: `{"status_info":{"status_code":200},"data":[{"schema_version":"1.2"}]}`, features: true, adoption: true},
+		{name: "spec diffs", status: http.StatusOK, body: `{"status_info":{"status_code":200},"data":[{"schema_version":"1.1"}]}`, features: true},
+		{name: "before spec diffs", status: http.StatusOK, body: `{"status_info":{"status_code":200},"data":[{"schema_version":"1.0"}]}`},
+		{name: "not reported", status: http.StatusNotFound, body: `404 page not found`},
+		{name: "other major", status: http.StatusOK, body: `{"status_info":{"status_code":200},"data":[{"schema_version":"2.0"}]}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			h, err := NewWithToken(server.URL, "token", nil).NegotiateSchemaVersion()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NegotiateSchemaVersion() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if err := h.SpecDiffSupported(); (err == nil) != tt.features {
+				t.Errorf("SpecDiffSupported() = %v, want supported %t", err, tt.features)
+			}
+			if err := h.RetentionSupported(); (err == nil) != tt.features {
+				t.Errorf("RetentionSupported() = %v, want supported %t", err, tt.features)
+			}
+			if err := h.AdoptionSupported(); (err == nil) != tt.adoption {
+				t.Errorf("AdoptionSupported() = %v, want supported %t", err, tt.adoption)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/galleybytes/monitor/pkg/logging"
+	"github.com/galleybytes/monitor/pkg/models"
+	"github.com/mattbaird/jsonpatch"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// MarkerTaskType is the task type of the task pod the monitor ships its own markers under, eg when the spec was
+// edited, so they show in the timeline of the generation next to the logs of the tasks
+const MarkerTaskType = "monitor"
+
+// MarkerTaskPodUUID is the task pod of the markers of a generation of the resource
+func MarkerTaskPodUUID(uuid, generation string) string {
+	return nameUUID(fmt.Sprintf("%s/generation/%s/%s", uuid, generation, MarkerTaskType))
+}
+
+// SameSpec compares two saved specs regardless of the order and formatting of their fields. Specs that are not
+// JSON are compared as is.
+func SameSpec(a, b []byte) bool {
+	var objA, objB interface{}
+	if json.Unmarshal(a, &objA) != nil || json.Unmarshal(b, &objB) != nil {
+		return string(a) == string(b)
+	}
+	return reflect.DeepEqual(objA, objB)
+}
+
+// SpecDiff is the JSON Patch (RFC 6902) from the spec of the previous generation to the spec, eg
+// [{"op":"replace","path":"/terraformVersion","value":"1.5.7"}]. It is "" when there is no previous spec or
+// either is not JSON.
+func SpecDiff(previous, resourceSpec []byte) string {
+	if previous == nil {
+		return ""
+	}
+	patches, err := jsonpatch.CreatePatch(previous, resourceSpec)
+	if err != nil {
+		return ""
+	}
+	sort.Sort(jsonpatch.ByPath(patches))
+	diff, err := json.Marshal(patches)
+	if err != nil {
+		return ""
+	}
+	return string(diff)
+}
+
+// previousSpecGenerations is how many generations FindPreviousResourceSpec looks back
+const previousSpecGenerations = 5
+
+// FindPreviousResourceSpec returns the spec saved for the latest generation of the resource below the generation,
+// or nil if there is none. Generations without a saved spec, eg when the resource was edited while the manager was
+// down, are skipped. The API has no route to list the specs of a resource so each generation is asked for, at most
+// previousSpecGenerations of them: a spec that was not saved for that many generations is too old to diff against.
+func (h Handler) FindPreviousResourceSpec(uuid, generation string) (*models.TFOResourceSpec, error) {
+	n, err := strconv.Atoi(generation)
+	if err != nil {
+		return nil, nil
+	}
+	for i := n - 1; i > 0 && i >= n-previousSpecGenerations; i-- {
+		saved, err := h.FindResourceSpec(uuid, strconv.Itoa(i))
+		if err != nil {
+			return nil, err
+		}
+		if saved != nil {
+			return saved, nil
+		}
+	}
+	return nil, nil
+}
+
+// newResourceSpec is the spec of the generation with its diff to the spec saved for the previous generation, or
+// without it when the API cannot save it
+func (h Handler) newResourceSpec(uuid, generation string, resourceSpec []byte) models.TFOResourceSpec {
+	if err := h.SpecDiffSupported(); err != nil {
+		slog.Warn("The spec diff is not saved", logging.ResourceUUID, uuid, logging.Generation, generation, "error", err)
+		return models.TFOResourceSpec{TFOResourceUUID: uuid, Generation: generation, ResourceSpec: string(resourceSpec)}
+	}
+	var previous []byte
+	saved, err := h.FindPreviousResourceSpec(uuid, generation)
+	if err != nil {
+		log.Panic(err)
+	}
+	if saved != nil {
+		previous = []byte(saved.ResourceSpec)
+	}
+	return models.TFOResourceSpec{
+		TFOResourceUUID: uuid,
+		Generation:      generation,
+		ResourceSpec:    string(resourceSpec),
+		SpecDiff:        SpecDiff(previous, resourceSpec),
+	}
+}
+
+// maxValueLength is how much of a value SummarizeSpecDiff shows
+const maxValueLength = 120
+
+// SummarizeSpecDiff renders the SpecDiff as one line per change, "+" for added, "-" for removed and "~" for
+// replaced fields, eg
+//
+//	~ terraformVersion = "1.5.7"
+func SummarizeSpecDiff(specDiff string) ([]string, error) {
+	patches := []jsonpatch.JsonPatchOperation{}
+	if err := json.Unmarshal([]byte(specDiff), &patches); err != nil {
+		return nil, fmt.Errorf("spec diff is not a JSON Patch: %s", err)
+	}
+	lines := []string{}
+	for _, patch := range patches {
+		field := specDiffField(patch.Path)
+		value, _ := json.Marshal(patch.Value)
+		if len(value) > maxValueLength {
+			value = append(value[:maxValueLength], "..."...)
+		}
+		switch patch.Operation {
+		case "add":
+			lines = append(lines, fmt.Sprintf("+ %s = %s", field, value))
+		case "remove":
+			lines = append(lines, fmt.Sprintf("- %s", field))
+		default:
+			lines = append(lines, fmt.Sprintf("~ %s = %s", field, value))
+		}
+	}
+	return lines, nil
+}
+
+// specDiffField turns a JSON Pointer like /env/0/value into env[0].value
+func specDiffField(path string) string {
+	field := ""
+	for _, token := range strings.Split(strings.TrimPrefix(path, "/"), "/") {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		if _, err := strconv.Atoi(token); err == nil {
+			field += "[" + token + "]"
+			continue
+		}
+		if field != "" {
+			field += "."
+		}
+		field += token
+	}
+	return field
+}
+
+// RecordResourceSpec saves the spec of the generation, redacted by the spec sanitizer, unless the latest spec saved
+// for it is the same. It returns whether the spec was saved. Failures to communicate with the database will cause a panic.
+func (h Handler) RecordResourceSpec(uuid, generation string, resourceSpec []byte) bool {
+	h, span := h.startSpan("record resource spec",
+		attribute.String(logging.ResourceUUID, uuid),
+		attribute.String(logging.Generation, generation),
+	)
+	defer span.End()
+	resourceSpec = h.specSanitizer.Sanitize(resourceSpec)
+
+	if saved := h.mustFindResourceSpec(uuid, generation); saved != nil && SameSpec([]byte(saved.ResourceSpec), resourceSpec) {
+		return false
+	}
+	if err := h.AddResourceSpec(h.newResourceSpec(uuid, generation, resourceSpec)); err != nil {
+		log.Panic(err)
+	}
+	return true
+}
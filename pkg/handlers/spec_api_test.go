@@ -0,0 +1,98 @@
+package handlers_test
+
+import (
+	"testing"
+
+	"github.com/galleybytes/monitor/pkg/fakeapi"
+	"github.com/galleybytes/monitor/pkg/handlers"
+	"github.com/galleybytes/monitor/pkg/models"
+	"github.com/galleybytes/monitor/pkg/sanitize"
+)
+
+// newSpecHandler returns a handler of the fake API that redacts the specs it saves
+func newSpecHandler(t *testing.T, api *fakeapi.Server) handlers.Handler {
+	t.Helper()
+	specSanitizer, err := sanitize.New([]byte("test-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := handlers.NewWithToken(api.URL, api.Token, nil).NegotiateSchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h.WithSpecSanitizer(specSanitizer)
+}
+
+func TestFindPreviousResourceSpecSkipsGenerationsWithoutSpec(t *testing.T) {
+	api := fakeapi.New()
+	defer api.Close()
+	h := newSpecHandler(t, api)
+
+	const uuid = "00000000-0000-0000-0000-000000000001"
+	if err := h.AddResourceSpec(models.TFOResourceSpec{TFOResourceUUID: uuid, Generation: "2", ResourceSpec: `{"terraformVersion":"1.5.6"}`}); err != nil {
+		t.Fatal(err)
+	}
+
+	if previous, err := h.FindPreviousResourceSpec(uuid, "2"); err != nil || previous != nil {
+		t.Errorf("FindPreviousResourceSpec() of the first spec = %v, %v, want nil", previous, err)
+	}
+	previous, err := h.FindPreviousResourceSpec(uuid, "5")
+	if err != nil || previous == nil || previous.Generation != "2" {
+		t.Fatalf("FindPreviousResourceSpec() = %v, %v, want generation 2", previous, err)
+	}
+
+	h.RecordResourceSpec(uuid, "5", []byte(`{"terraformVersion":"1.5.7"}`))
+	saved, err := h.FindResourceSpec(uuid, "5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved == nil {
+		t.Fatal("the spec of generation 5 was not recorded")
+	}
+	if want := `[{"op":"replace","path":"/terraformVersion","value":"1.5.7"}]`; saved.SpecDiff != want {
+		t.Errorf("SpecDiff = %s, want %s", saved.SpecDiff, want)
+	}
+}
+
+func TestRecordResourceSpecWithoutSpecDiffs(t *testing.T) {
+	api := fakeapi.New()
+	defer api.Close()
+	// An API that does not report the schema version the spec diff was added in would drop it
+	api.InjectFault(fakeapi.Fault{PathPrefix: "/api/v1/schema-version", StatusCode: 404})
+	h := newSpecHandler(t, api)
+	if err := h.SpecDiffSupported(); err == nil {
+		t.Fatal("SpecDiffSupported() returned no error for an API without a schema version")
+	}
+
+	const uuid = "00000000-0000-0000-0000-000000000001"
+	if err := h.AddResourceSpec(models.TFOResourceSpec{TFOResourceUUID: uuid, Generation: "1", ResourceSpec: `{"terraformVersion":"1.5.6"}`}); err != nil {
+		t.Fatal(err)
+	}
+	h.RecordResourceSpec(uuid, "2", []byte(`{"terraformVersion":"1.5.7"}`))
+	saved, err := h.FindResourceSpec(uuid, "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved == nil || saved.SpecDiff != "" {
+		t.Errorf("expected the spec to be recorded without its diff, got %+v", saved)
+	}
+}
+
+func TestFindPreviousResourceSpecIsBounded(t *testing.T) {
+	api := fakeapi.New()
+	defer api.Close()
+	h := newSpecHandler(t, api)
+
+	const uuid = "00000000-0000-0000-0000-000000000001"
+	if err := h.AddResourceSpec(models.TFOResourceSpec{TFOResourceUUID: uuid, Generation: "2", ResourceSpec: `{"terraformVersion":"1.5.6"}`}); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := len(api.Requests())
+	if previous, err := h.FindPreviousResourceSpec(uuid, "100"); err != nil || previous != nil {
+		t.Errorf("FindPreviousResourceSpec() = %v, %v, want nil for a spec 98 generations back", previous, err)
+	}
+	if n := len(api.Requests()) - requests; n > 5 {
+		t.Errorf("FindPreviousResourceSpec() made %d requests, want at most 5", n)
+	}
+}
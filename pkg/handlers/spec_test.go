@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSameSpec(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want bool
+	}{
+		{name: "formatting and order", a: `{"a": 1, "b": [1, 2]}`, b: `{"b":[1,2],"a":1}`, want: true},
+		{name: "changed value", a: `{"a": 1}`, b: `{"a": 2}`},
+		{name: "array order", a: `{"b": [1, 2]}`, b: `{"b": [2, 1]}`},
+		{name: "not json", a: `spec`, b: `spec`, want: true},
+		{name: "not json changed", a: `spec`, b: `{"a": 1}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SameSpec([]byte(tt.a), []byte(tt.b)); got != tt.want {
+				t.Errorf("SameSpec() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSpecDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		previous []byte
+		spec     string
+		want     string
+	}{
+		{
+			name: "first generation",
+			spec: `{"terraformVersion":"1.5.6"}`,
+		},
+		{
+			name:     "sorted by path",
+			previous: []byte(`{"terraformVersion":"1.5.6","keepLatestPodsOnly":true,"env":[{"name":"A","value":"1"}]}`),
+			spec:     `{"terraformVersion":"1.5.7","requireApproval":true,"env":[{"name":"A","value":"2"}]}`,
+			want: `[{"op":"replace","path":"/env/0/value","value":"2"},{"op":"remove","path":"/keepLatestPodsOnly"},` +
+				`{"op":"add","path":"/requireApproval","value":true},{"op":"replace","path":"/terraformVersion","value":"1.5.7"}]`,
+		},
+		{
+			name:     "unchanged",
+			previous: []byte(`{"terraformVersion":"1.5.7"}`),
+			spec:     `{"terraformVersion": "1.5.7"}`,
+			want:     `[]`,
+		},
+		{
+			name:     "not json",
+			previous: []byte(`spec`),
+			spec:     `{"terraformVersion":"1.5.7"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SpecDiff(tt.previous, []byte(tt.spec)); got != tt.want {
+				t.Errorf("SpecDiff() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSummarizeSpecDiff(t *testing.T) {
+	long := `"` + strings.Repeat("x", 150) + `"`
+	specDiff := `[{"op":"replace","path":"/env/0/value","value":"2"},{"op":"remove","path":"/keepLatestPodsOnly"},` +
+		`{"op":"add","path":"/requireApproval","value":true},{"op":"add","path":"/scriptsConfigMap","value":` + long + `}]`
+	got, err := SummarizeSpecDiff(specDiff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`~ env[0].value = "2"`,
+		`- keepLatestPodsOnly`,
+		`+ requireApproval = true`,
+		`+ scriptsConfigMap = ` + long[:maxValueLength] + `...`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SummarizeSpecDiff() = %q, want %q", got, want)
+	}
+
+	if _, err := SummarizeSpecDiff("not a patch"); err == nil {
+		t.Error("SummarizeSpecDiff() accepted a diff that is not a JSON Patch")
+	}
+}
+
+func TestSpecDiffField(t *testing.T) {
+	tests := map[string]string{
+		"/terraformVersion":               "terraformVersion",
+		"/env/0/value":                    "env[0].value",
+		"/taskOptions/1/env/10/name":      "taskOptions[1].env[10].name",
+		"/annotations/example.com~1token": "annotations.example.com/token",
+		"/annotations/a~0b":               "annotations.a~b",
+		"/0":                              "[0]",
+	}
+	for path, want := range tests {
+		if got := specDiffField(path); got != want {
+			t.Errorf("specDiffField(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
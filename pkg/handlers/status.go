@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"fmt"
+
+	"github.com/galleybytes/monitor/pkg/logging"
+	"github.com/galleybytes/monitor/pkg/models"
+	gocache "github.com/patrickmn/go-cache"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// GenerationStatus is what the monitors shipped for a generation of a resource. The monitor manager reads it to
+// report the monitoring state on the resource.
+type GenerationStatus struct {
+	TaskPods []TaskPodStatus
+}
+
+// TaskPodStatus is what was shipped for a task pod and the latest approval of it, if any
+type TaskPodStatus struct {
+	TaskPod  models.TaskPod
+	Lines    int
+	Approval *models.Approval
+}
+
+// Lines is the number of lines shipped by every task pod of the generation
+func (s GenerationStatus) Lines() int {
+	lines := 0
+	for _, taskPod := range s.TaskPods {
+		lines += taskPod.Lines
+	}
+	return lines
+}
+
+// Latest returns the task pod of the task type with the highest rerun, eg the plan an approval is asked for
+func (s GenerationStatus) Latest(taskType string) *TaskPodStatus {
+	var latest *TaskPodStatus
+	for n := range s.TaskPods {
+		taskPod := &s.TaskPods[n]
+		if taskPod.TaskPod.TaskType == taskType && (latest == nil || taskPod.TaskPod.Rerun > latest.TaskPod.Rerun) {
+			latest = taskPod
+		}
+	}
+	return latest
+}
+
+// Stage is what terraform-operator runs of the generation a status is asked for. Only the task pods it is running
+// can still ship lines.
+type Stage struct {
+	// Active is whether terraform-operator is still running the workflow of the generation
+	Active bool
+	// TaskType is the task type of the current stage, empty when it is not known
+	TaskType string
+}
+
+// running is whether the task pod can still ship lines. The markers of the monitor are shipped while any task of
+// the generation runs.
+func (s Stage) running(taskPod models.TaskPod) bool {
+	if !s.Active {
+		return false
+	}
+	return s.TaskType == "" || taskPod.TaskType == s.TaskType || taskPod.TaskType == MarkerTaskType
+}
+
+// lineCount is the number of lines of a task pod in the cache. A count taken after the task pod stopped running
+// is final and not counted again.
+type lineCount struct {
+	lines int
+	final bool
+}
+
+func lineCountKey(uid string) string {
+	return fmt.Sprintf("lines/%s", uid)
+}
+
+// GenerationStatus returns the task pods registered for the generation with their line counts and approvals.
+// The API has no count of the lines of a task pod, so counting downloads its logs. Only the task pods of the
+// current stage are counted on every call, the counts of the others are cached once they stopped running.
+func (h Handler) GenerationStatus(uuid, generation string, stage Stage) (GenerationStatus, error) {
+	h, span := h.startSpan("generation status", attribute.String(logging.ResourceUUID, uuid))
+	defer span.End()
+
+	taskPods, err := h.FindTaskPods(uuid, generation)
+	if err != nil {
+		return GenerationStatus{}, err
+	}
+	status := GenerationStatus{TaskPods: []TaskPodStatus{}}
+	for _, taskPod := range taskPods {
+		taskPodStatus := TaskPodStatus{TaskPod: taskPod}
+		if cached, found := h.cache.Get(lineCountKey(taskPod.UUID)); found && cached.(lineCount).final {
+			taskPodStatus.Lines = cached.(lineCount).lines
+		} else {
+			tfoTaskLogs, err := h.FindTaskLogs(taskPod.UUID)
+			if err != nil {
+				return GenerationStatus{}, err
+			}
+			taskPodStatus.Lines = len(tfoTaskLogs)
+			final := !stage.running(taskPod)
+			h.cache.Set(lineCountKey(taskPod.UUID), lineCount{lines: taskPodStatus.Lines, final: final}, gocache.NoExpiration)
+		}
+		approvalStatus, err := h.FindApprovalStatus(taskPod.UUID)
+		if err != nil {
+			return GenerationStatus{}, err
+		}
+		if approvalStatus != nil {
+			taskPodStatus.Approval = &approvalStatus.Approval
+		}
+		status.TaskPods = append(status.TaskPods, taskPodStatus)
+	}
+	return status, nil
+}
@@ -0,0 +1,118 @@
+package handlers_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/galleybytes/monitor/pkg/fakeapi"
+	"github.com/galleybytes/monitor/pkg/handlers"
+	"github.com/galleybytes/monitor/pkg/models"
+	gocache "github.com/patrickmn/go-cache"
+)
+
+// logDownloads counts the requests for the logs of a task pod since the requests before
+func logDownloads(api *fakeapi.Server, before int) int {
+	n := 0
+	for _, request := range api.Requests()[before:] {
+		if strings.HasPrefix(request, "GET ") && strings.HasSuffix(request, "/logs") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestGenerationStatusCachesTheLinesOfTaskPodsThatStoppedRunning(t *testing.T) {
+	api := fakeapi.New()
+	defer api.Close()
+	h := handlers.NewWithToken(api.URL, api.Token, gocache.New(gocache.NoExpiration, gocache.NoExpiration))
+
+	const uuid = "00000000-0000-0000-0000-000000000001"
+	cluster, err := h.GetOrSetCluster("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.AddTFOResource(models.TFOResource{UUID: uuid, Namespace: "default", Name: "example", CurrentGeneration: "1", Cluster: *cluster})
+	found, err := h.FindTFOResource(uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tfoResource := *found
+	write := func(taskType string, lineNos ...string) {
+		t.Helper()
+		taskPod, err := h.GetOrSetTaskPod(tfoResource, taskType, "1", 0, taskType+"-uid")
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := []models.TFOTaskLog{}
+		for _, lineNo := range lineNos {
+			lines = append(lines, models.TFOTaskLog{TFOResource: tfoResource, TaskPod: taskPod, LineNo: lineNo, Message: "line " + lineNo})
+		}
+		if _, err := h.WriteAllLines(tfoResource, taskPod, lines); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("init", "1")
+
+	for _, step := range []struct {
+		name      string
+		taskType  string
+		lineNos   []string
+		stage     handlers.Stage
+		lines     int
+		downloads int
+	}{
+		{name: "running init", stage: handlers.Stage{Active: true, TaskType: "init"}, lines: 1, downloads: 1},
+		{name: "init grown", taskType: "init", lineNos: []string{"1", "2"}, stage: handlers.Stage{Active: true, TaskType: "init"}, lines: 2, downloads: 1},
+		// init is counted once more after it stopped running, then only plan is
+		{name: "running plan", taskType: "plan", lineNos: []string{"1"}, stage: handlers.Stage{Active: true, TaskType: "plan"}, lines: 3, downloads: 2},
+		{name: "plan grown", taskType: "plan", lineNos: []string{"1", "2"}, stage: handlers.Stage{Active: true, TaskType: "plan"}, lines: 4, downloads: 1},
+		{name: "completed", taskType: "plan", lineNos: []string{"1", "2", "3"}, lines: 5, downloads: 1},
+		{name: "completed again", lines: 5, downloads: 0},
+	} {
+		if step.lineNos != nil {
+			write(step.taskType, step.lineNos...)
+		}
+		before := len(api.Requests())
+		status, err := h.GenerationStatus(uuid, "1", step.stage)
+		if err != nil {
+			t.Fatalf("%s: %s", step.name, err)
+		}
+		if status.Lines() != step.lines {
+			t.Errorf("%s: Lines() = %d, want %d", step.name, status.Lines(), step.lines)
+		}
+		if n := logDownloads(api, before); n != step.downloads {
+			t.Errorf("%s: the logs were downloaded %d times, want %d", step.name, n, step.downloads)
+		}
+	}
+}
+
+func TestGenerationStatusReturnsTheErrorsOfTheAPI(t *testing.T) {
+	api := fakeapi.New()
+	defer api.Close()
+	h := handlers.NewWithToken(api.URL, api.Token, gocache.New(gocache.NoExpiration, gocache.NoExpiration))
+
+	const uuid = "00000000-0000-0000-0000-000000000001"
+	cluster, err := h.GetOrSetCluster("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.AddTFOResource(models.TFOResource{UUID: uuid, Namespace: "default", Name: "example", CurrentGeneration: "1", Cluster: *cluster})
+	found, err := h.FindTFOResource(uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.GetOrSetTaskPod(*found, "plan", "1", 0, "plan-uid"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fault := range []fakeapi.Fault{
+		{PathPrefix: "/api/v1/resource/", StatusCode: 500},
+		{PathPrefix: "/api/v1/task/", StatusCode: 500},
+	} {
+		api.InjectFault(fault)
+		if _, err := h.GenerationStatus(uuid, "1", handlers.Stage{Active: true}); err == nil {
+			t.Errorf("expected an error when %s fails", fault.PathPrefix)
+		}
+		api.ClearFaults()
+	}
+}
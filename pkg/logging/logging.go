@@ -0,0 +1,102 @@
+// Package logging sets up the monitor's structured logger. Records are JSON by default and carry the same field
+// names everywhere so they can be filtered by resource or task in a log aggregator.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/galleybytes/monitor/pkg/models"
+)
+
+// Field names shared by every record
+const (
+	Cluster      = "cluster"
+	Namespace    = "namespace"
+	Resource     = "resource"
+	ResourceUUID = "resource_uuid"
+	Generation   = "generation"
+	TaskType     = "task_type"
+	Rerun        = "rerun"
+	TaskPodUUID  = "task_pod_uuid"
+	Endpoint     = "endpoint"
+	Method       = "method"
+	StatusCode   = "status_code"
+	Latency      = "latency"
+)
+
+// Level is the minimum level that is logged. It can be changed while the monitor runs with SetLevel.
+var Level = new(slog.LevelVar)
+
+// Setup makes a handler of the format ("json" or "text") the default for slog and the standard log package
+func Setup(w io.Writer, format string) error {
+	options := &slog.HandlerOptions{Level: Level}
+	var handler slog.Handler
+	switch format {
+	case "json", "":
+		handler = slog.NewJSONHandler(w, options)
+	case "text":
+		handler = slog.NewTextHandler(w, options)
+	default:
+		return fmt.Errorf("unknown log format '%s'", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// FromEnv sets up logging from MONITOR_LOG_FORMAT and MONITOR_LOG_LEVEL. When MONITOR_LOG_LEVEL_FILE is set the
+// level is re-read from the file every interval, which allows changing the level of a running monitor by
+// updating a mounted ConfigMap.
+func FromEnv() error {
+	if err := Setup(os.Stderr, os.Getenv("MONITOR_LOG_FORMAT")); err != nil {
+		return err
+	}
+	if level := os.Getenv("MONITOR_LOG_LEVEL"); level != "" {
+		if err := SetLevel(level); err != nil {
+			return err
+		}
+	}
+	if file := os.Getenv("MONITOR_LOG_LEVEL_FILE"); file != "" {
+		go followLevelFile(file, 10*time.Second)
+	}
+	return nil
+}
+
+// SetLevel changes the level, eg "debug", "info", "warn" or "error"
+func SetLevel(level string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(strings.TrimSpace(level))); err != nil {
+		return fmt.Errorf("invalid log level '%s'", level)
+	}
+	if l != Level.Level() {
+		Level.Set(l)
+		slog.Info("Log level changed", "level", l.String())
+	}
+	return nil
+}
+
+func followLevelFile(file string, interval time.Duration) {
+	for {
+		b, err := os.ReadFile(file)
+		if err == nil && len(strings.TrimSpace(string(b))) > 0 {
+			if err := SetLevel(string(b)); err != nil {
+				slog.Warn("Could not read the log level", "file", file, "error", err)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// TaskAttrs are the fields identifying the task pod
+func TaskAttrs(taskPod models.TaskPod) []any {
+	return []any{
+		Generation, taskPod.Generation,
+		TaskType, taskPod.TaskType,
+		Rerun, taskPod.Rerun,
+		TaskPodUUID, taskPod.UUID,
+	}
+}
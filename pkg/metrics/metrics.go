@@ -0,0 +1,28 @@
+// Package metrics publishes the monitor's counters with expvar. They are served as JSON on /debug/vars when
+// MONITOR_METRICS_ADDR is set.
+package metrics
+
+import (
+	"expvar"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// ClusterMismatches counts the resources found bound to another cluster, keyed by the policy that resolved it
+var ClusterMismatches = expvar.NewMap("cluster_mismatches")
+
+// ServeFromEnv serves the metrics on MONITOR_METRICS_ADDR, eg ":9090", in the background
+func ServeFromEnv() {
+	addr := os.Getenv("MONITOR_METRICS_ADDR")
+	if addr == "" {
+		return
+	}
+	go func() {
+		mux := http.NewServeMux()
+		mux.Handle("/debug/vars", expvar.Handler())
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			slog.Error("Metrics server stopped", "addr", addr, "error", err)
+		}
+	}()
+}
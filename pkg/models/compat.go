@@ -0,0 +1,67 @@
+package models
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"reflect"
+	"strings"
+)
+
+// payloads are API responses for each model in the encoding the terraform-operator-api uses, the Go field names
+// unless a field has a json tag. The file name is the name of the model in Models.
+//
+//go:embed payloads/*.json
+var payloads embed.FS
+
+// CheckPayloads decodes every API payload into its model and fails on any field the model does not know about.
+// go test ./pkg/models runs it for every payload, run it after changing a model, or after replacing the payloads
+// with responses of a new API release, to find changes that need a new SchemaVersion.
+func CheckPayloads() error {
+	entries, err := payloads.ReadDir("payloads")
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), path.Ext(entry.Name()))
+		model, found := Models[name]
+		if !found {
+			return fmt.Errorf("payload %s does not belong to a model", entry.Name())
+		}
+		data, err := payloads.ReadFile(path.Join("payloads", entry.Name()))
+		if err != nil {
+			return err
+		}
+		if err := checkPayload(data, reflect.TypeOf(model)); err != nil {
+			return fmt.Errorf("payload %s: %s", entry.Name(), err)
+		}
+	}
+	return nil
+}
+
+func checkPayload(data []byte, t reflect.Type) error {
+	response := struct {
+		StatusInfo StatusInfo        `json:"status_info"`
+		Data       []json.RawMessage `json:"data"`
+	}{}
+	if err := strictUnmarshal(data, &response); err != nil {
+		return err
+	}
+	if len(response.Data) == 0 {
+		return fmt.Errorf("no data")
+	}
+	for i, item := range response.Data {
+		if err := strictUnmarshal(item, reflect.New(t).Interface()); err != nil {
+			return fmt.Errorf("data[%d]: %s", i, err)
+		}
+	}
+	return nil
+}
+
+func strictUnmarshal(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
@@ -0,0 +1,42 @@
+package models
+
+import (
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestPayloads fails when an API payload has a field its model does not know about. A model change that makes
+// this fail needs a new SchemaVersion.
+func TestPayloads(t *testing.T) {
+	entries, err := payloads.ReadDir("payloads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 {
+		t.Fatal("no recorded payloads")
+	}
+	for _, entry := range entries {
+		t.Run(entry.Name(), func(t *testing.T) {
+			model, found := Models[strings.TrimSuffix(entry.Name(), path.Ext(entry.Name()))]
+			if !found {
+				t.Fatalf("payload %s does not belong to a model", entry.Name())
+			}
+			data, err := payloads.ReadFile(path.Join("payloads", entry.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := checkPayload(data, reflect.TypeOf(model)); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestCheckPayloadUnknownField(t *testing.T) {
+	data := []byte(`{"status_info":{"status_code":200},"data":[{"Name":"c1","Region":"us-east-1"}]}`)
+	if err := checkPayload(data, reflect.TypeOf(Cluster{})); err == nil {
+		t.Error("checkPayload() accepted a field Cluster does not have")
+	}
+}
@@ -0,0 +1,12 @@
+package models
+
+// Response is the envelope of every terraform-operator-api response. Data is expected to be a list.
+type Response struct {
+	StatusInfo StatusInfo  `json:"status_info"`
+	Data       interface{} `json:"data"`
+}
+
+type StatusInfo struct {
+	StatusCode int    `json:"status_code"`
+	Message    string `json:"message"`
+}
@@ -0,0 +1,167 @@
+package models
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// SchemaVersion is the version of the models in this package, as "<major>.<minor>". The major version changes
+// when a field is removed, renamed or changes type. The minor version changes when a field is added.
+const SchemaVersion = "1.2"
+
+// SpecDiffSchemaVersion is the first schema version with TFOResourceSpec.SpecDiff
+const SpecDiffSchemaVersion = "1.1"
+
+// RetentionSchemaVersion is the first schema version whose API lists the deleted resources and purges their history
+const RetentionSchemaVersion = "1.1"
+
+// ClusterAdoptionSchemaVersion is the first schema version with ClusterAdoption
+const ClusterAdoptionSchemaVersion = "1.2"
+
+// Models are the types that are exchanged with the terraform-operator-api, keyed by the name used in the
+// generated schema
+var Models = map[string]interface{}{
+	"Cluster":         Cluster{},
+	"TFOResource":     TFOResource{},
+	"TFOResourceSpec": TFOResourceSpec{},
+	"TaskPod":         TaskPod{},
+	"TFOTaskLog":      TFOTaskLog{},
+	"Approval":        Approval{},
+	"ClusterAdoption": ClusterAdoption{},
+}
+
+// ParseSchemaVersion splits a version like "1.0" into its major and minor parts
+func ParseSchemaVersion(version string) (int, int, error) {
+	parts := strings.SplitN(version, ".", 2)
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid schema version '%s'", version)
+	}
+	minor := 0
+	if len(parts) == 2 {
+		minor, err = strconv.Atoi(parts[1])
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid schema version '%s'", version)
+		}
+	}
+	return major, minor, nil
+}
+
+// CompatibleSchemaVersion checks that models of the given version can be read and written with this package.
+// The major versions have to match. A different minor version only adds fields which are ignored.
+func CompatibleSchemaVersion(version string) error {
+	major, _, err := ParseSchemaVersion(version)
+	if err != nil {
+		return err
+	}
+	ownMajor, _, _ := ParseSchemaVersion(SchemaVersion)
+	if major != ownMajor {
+		return fmt.Errorf("schema version %s is not compatible with the monitor's schema version %s", version, SchemaVersion)
+	}
+	return nil
+}
+
+// RequireSchemaVersion checks that models of the given version have the fields the feature was added with in the
+// minimum version. An empty version, which is an API that does not report one, has none of them.
+func RequireSchemaVersion(version, minimum, feature string) error {
+	if version == "" {
+		return fmt.Errorf("%s need schema version %s but no schema version was reported", feature, minimum)
+	}
+	major, minor, err := ParseSchemaVersion(version)
+	if err != nil {
+		return err
+	}
+	minimumMajor, minimumMinor, _ := ParseSchemaVersion(minimum)
+	if major != minimumMajor || minor < minimumMinor {
+		return fmt.Errorf("%s need schema version %s but the schema version is %s", feature, minimum, version)
+	}
+	return nil
+}
+
+// JSONSchema returns a JSON schema (draft-07) describing how the models are encoded
+func JSONSchema() map[string]interface{} {
+	definitions := map[string]interface{}{}
+	for _, model := range Models {
+		typeSchema(reflect.TypeOf(model), definitions)
+	}
+	return map[string]interface{}{
+		"$schema":     "http://json-schema.org/draft-07/schema#",
+		"$id":         fmt.Sprintf("https://github.com/galleybytes/monitor/pkg/models/v%s", SchemaVersion),
+		"title":       "terraform-operator monitor models",
+		"version":     SchemaVersion,
+		"definitions": definitions,
+	}
+}
+
+func typeSchema(t reflect.Type, definitions map[string]interface{}) map[string]interface{} {
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case reflect.TypeOf(gorm.DeletedAt{}):
+		return map[string]interface{}{"type": []string{"string", "null"}, "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem(), definitions)
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem(), definitions)}
+	case reflect.Struct:
+		if _, found := Models[t.Name()]; found && t.PkgPath() == reflect.TypeOf(Cluster{}).PkgPath() {
+			if _, defined := definitions[t.Name()]; !defined {
+				// Reserve the name before recursing so models referring to each other terminate
+				definitions[t.Name()] = nil
+				definitions[t.Name()] = structSchema(t, definitions)
+			}
+			return map[string]interface{}{"$ref": "#/definitions/" + t.Name()}
+		}
+		return structSchema(t, definitions)
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+func structSchema(t reflect.Type, definitions map[string]interface{}) map[string]interface{} {
+	properties := map[string]interface{}{}
+	addProperties(t, properties, definitions)
+	return map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+}
+
+// addProperties adds the JSON encoded fields of the struct, flattening embedded structs like encoding/json does
+func addProperties(t reflect.Type, properties map[string]interface{}, definitions map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := field.Name
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		if tagName := strings.Split(tag, ",")[0]; tagName != "" {
+			name = tagName
+		} else if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			addProperties(field.Type, properties, definitions)
+			continue
+		}
+		properties[name] = typeSchema(field.Type, definitions)
+	}
+}
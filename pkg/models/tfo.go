@@ -31,11 +31,14 @@ type TFOResourceSpec struct {
 	TFOResourceUUID string `json:"tfo_resource_uuid"`
 	Generation      string
 	ResourceSpec    string
+
+	// SpecDiff is the JSON Patch from the spec of the previous generation, empty for the first generation
+	SpecDiff string `json:",omitempty"`
 }
 
 type TFOResource struct {
 	UUID      string `json:"uuid" gorm:"primaryKey"`
-	CreatedBy string 
+	CreatedBy string
 	CreatedAt time.Time
 	UpdatedBy string
 	UpdatedAt time.Time
@@ -53,6 +56,16 @@ type TFOResource struct {
 	CurrentGeneration string
 }
 
+// ClusterAdoption records that a resource bound to one cluster was adopted by another. The records are only added,
+// unlike the UpdatedBy of the resource which the next update overwrites.
+type ClusterAdoption struct {
+	gorm.Model
+	TFOResourceUUID string `json:"tfo_resource_uuid"`
+	FromClusterID   uint   `json:"from_cluster_id"`
+	ToClusterID     uint   `json:"to_cluster_id"`
+	Generation      string `json:"generation"`
+}
+
 type Cluster struct {
 	gorm.Model
 	Name string
@@ -0,0 +1,182 @@
+package monitor
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/galleybytes/monitor/pkg/database"
+	"github.com/galleybytes/monitor/pkg/handlers"
+	"github.com/galleybytes/monitor/pkg/sanitize"
+	"github.com/galleybytes/monitor/pkg/watch"
+	gocache "github.com/patrickmn/go-cache"
+)
+
+// Config is everything the monitor needs to follow the logs of one terraform-operator resource
+type Config struct {
+	// Backend is "api" to use the terraform-operator-api or "database" to write directly to Postgres
+	Backend string
+
+	// ManagerServiceHost is the monitor manager that hands out API access. Only used by the api backend.
+	ManagerServiceHost string
+
+	// ServiceAccountTokenFile is the projected service account token the monitor authenticates to the manager
+	// with to get a token scoped to its resource
+	ServiceAccountTokenFile string
+
+	ClusterName        string
+	ResourceUUID       string
+	ResourceNamespace  string
+	ResourceName       string
+	ResourceGeneration string
+
+	// RootPath is the TFO_ROOT_PATH the task pods write their logs under, in generations/<generation>
+	RootPath string
+
+	// Watcher selects how file changes are detected
+	Watcher      watch.Mode
+	PollInterval time.Duration
+
+	// ApprovalInterval is how often approvals are read for the task pods that have shipped logs
+	ApprovalInterval time.Duration
+
+	// RegistrationTimeout is how long Run waits for the monitor manager to register the generation
+	RegistrationTimeout time.Duration
+
+	// SpecInterval is how often the resource is read to catch edits of its spec. Zero does not read it.
+	SpecInterval time.Duration
+
+	// SpecSanitizer redacts the specs commands like backfill record. It is only set when MONITOR_SPEC_REDACT_KEY
+	// is, see RequireSpecSanitizer.
+	SpecSanitizer sanitize.Sanitizer
+}
+
+// ConfigFromEnv reads the config from the env the monitor manager sets on the task pods. TFO_GENERATION is not
+// required here since commands like backfill work on every generation.
+func ConfigFromEnv() (Config, error) {
+	config := Config{
+		Backend:            os.Getenv("MONITOR_BACKEND"),
+		ManagerServiceHost: os.Getenv("MONITOR_MANAGER_SERVICE_HOST"),
+		// MONITOR_SERVICE_ACCOUNT_TOKEN_FILE is mounted by the manager's webhook
+		ServiceAccountTokenFile: os.Getenv("MONITOR_SERVICE_ACCOUNT_TOKEN_FILE"),
+		ClusterName:             os.Getenv("CLUSTER_NAME"),
+		ResourceUUID:            os.Getenv("TFO_RESOURCE_UUID"),
+		ResourceNamespace:       os.Getenv("TFO_NAMESPACE"),
+		ResourceName:            os.Getenv("TFO_RESOURCE"),
+		ResourceGeneration:      os.Getenv("TFO_GENERATION"),
+		RootPath:                os.Getenv("TFO_ROOT_PATH"),
+		// MONITOR_WATCHER selects how file changes are detected. Use "poll" or "auto" when TFO_ROOT_PATH is on a
+		// volume that does not support inotify.
+		Watcher:             watch.Mode(os.Getenv("MONITOR_WATCHER")),
+		PollInterval:        2 * time.Second,
+		ApprovalInterval:    15 * time.Second,
+		RegistrationTimeout: 2 * time.Minute,
+		SpecInterval:        30 * time.Second,
+	}
+	if config.Backend == "" {
+		config.Backend = "api"
+	}
+	if config.Watcher == "" {
+		config.Watcher = watch.ModeInotify
+	}
+	if s := os.Getenv("MONITOR_REGISTRATION_TIMEOUT"); s != "" {
+		registrationTimeout, err := time.ParseDuration(s)
+		if err != nil {
+			return config, fmt.Errorf("MONITOR_REGISTRATION_TIMEOUT is not a valid duration: %s", err)
+		}
+		config.RegistrationTimeout = registrationTimeout
+	}
+	if s := os.Getenv("MONITOR_SPEC_INTERVAL"); s != "" {
+		specInterval, err := time.ParseDuration(s)
+		if err != nil {
+			return config, fmt.Errorf("MONITOR_SPEC_INTERVAL is not a valid duration: %s", err)
+		}
+		config.SpecInterval = specInterval
+	}
+	if s := os.Getenv("MONITOR_POLL_INTERVAL"); s != "" {
+		pollInterval, err := time.ParseDuration(s)
+		if err != nil {
+			return config, fmt.Errorf("MONITOR_POLL_INTERVAL is not a valid duration: %s", err)
+		}
+		config.PollInterval = pollInterval
+	}
+
+	for _, env := range [][2]string{
+		{"TFO_RESOURCE_UUID", config.ResourceUUID},
+		{"TFO_NAMESPACE", config.ResourceNamespace},
+		{"TFO_RESOURCE", config.ResourceName},
+		{"TFO_ROOT_PATH", config.RootPath},
+	} {
+		if env[1] == "" {
+			return config, fmt.Errorf("%s cannot be empty", env[0])
+		}
+	}
+
+	// The rest of the env comes from the <resource>-monitor-envs ConfigMap and Secret the monitor manager writes.
+	// They are optional in the pod so a missing one does not keep the task from running, and is reported here.
+	if config.ClusterName == "" {
+		return config, config.notDistributed("CLUSTER_NAME", "ConfigMap")
+	}
+	if config.Backend == "api" && config.ManagerServiceHost == "" {
+		return config, config.notDistributed("MONITOR_MANAGER_SERVICE_HOST", "ConfigMap")
+	}
+	// The key is only needed to record specs, which is checked with RequireSpecSanitizer by what records them
+	if os.Getenv("MONITOR_SPEC_REDACT_KEY") != "" {
+		specSanitizer, err := sanitize.FromEnv()
+		if err != nil {
+			return config, err
+		}
+		config.SpecSanitizer = specSanitizer
+	}
+	return config, nil
+}
+
+// notDistributed is the error for an env of the <resource>-monitor-envs ConfigMap or Secret that is not set
+func (c Config) notDistributed(env, kind string) error {
+	return fmt.Errorf("%s cannot be empty, it is set by the %s-monitor-envs %s in namespace %s: check that the monitor manager is running and handles the namespace", env, c.ResourceName, kind, c.ResourceNamespace)
+}
+
+// RequireSpecSanitizer returns an error when the specs cannot be recorded because MONITOR_SPEC_REDACT_KEY is not
+// set. Specs redacted without the key would hide changes of the redacted values, so they are not recorded at all.
+func (c Config) RequireSpecSanitizer() error {
+	if c.SpecSanitizer.HasKey() {
+		return nil
+	}
+	return c.notDistributed("MONITOR_SPEC_REDACT_KEY", "Secret")
+}
+
+// GenerationsDir is the directory the task pods of the generation write their logs to
+func (c Config) GenerationsDir(generation string) string {
+	return fmt.Sprintf("%s/generations/%s", c.RootPath, generation)
+}
+
+// NewBackend returns the handler for the configured backend
+func NewBackend(config Config, cache *gocache.Cache) (handlers.Backend, error) {
+	switch config.Backend {
+	case "api":
+		accessURL := fmt.Sprintf("%s/api-token-please?resource_uuid=%s", config.ManagerServiceHost, url.QueryEscape(config.ResourceUUID))
+		handler, err := handlers.NewFromManager(accessURL, config.ServiceAccountTokenFile, cache)
+		if err != nil {
+			return nil, err
+		}
+		handler, err = handler.NegotiateSchemaVersion()
+		if err != nil {
+			return nil, err
+		}
+		return handler.WithSpecSanitizer(config.SpecSanitizer), nil
+	case "database":
+		dsn, err := database.DSNFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		// The API, or the monitor manager with MONITOR_DB_AUTO_MIGRATE=true, migrates the schema, monitors only use it
+		backend, err := database.New(dsn, false, cache)
+		if err != nil {
+			return nil, err
+		}
+		return backend.WithSpecSanitizer(config.SpecSanitizer), nil
+	default:
+		return nil, fmt.Errorf("unknown backend '%s'", config.Backend)
+	}
+}
@@ -0,0 +1,55 @@
+package monitor
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/galleybytes/monitor/pkg/tfoclient"
+)
+
+// Clock is how the monitor waits. Replace it to drive the approval poll and the wait for the generation
+// directory without sleeping.
+type Clock interface {
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// FileSystem is how the monitor reads TFO_ROOT_PATH and writes the approval files into it. Paths are the same
+// absolute paths the Watcher reports.
+type FileSystem interface {
+	Stat(name string) (fs.FileInfo, error)
+	ReadDir(name string) ([]fs.DirEntry, error)
+	Open(name string) (fs.File, error)
+	WriteFile(name string, data []byte, perm fs.FileMode) error
+}
+
+type osFileSystem struct{}
+
+func (osFileSystem) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (osFileSystem) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
+
+func (osFileSystem) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	return os.WriteFile(name, data, perm)
+}
+
+// ResourceReader is how the monitor reads its Terraform resource. *tfoclient.Client reads it from the Kubernetes
+// API.
+type ResourceReader interface {
+	Get(ctx context.Context, namespace, name string) (*tfoclient.Resource, error)
+}
@@ -0,0 +1,521 @@
+// Package monitor follows the logs the terraform-operator task pods write under TFO_ROOT_PATH and ships them to
+// the configured sinks. It is what the monitor binary runs and can be embedded in other binaries.
+package monitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/galleybytes/monitor/pkg/handlers"
+	"github.com/galleybytes/monitor/pkg/logging"
+	"github.com/galleybytes/monitor/pkg/models"
+	"github.com/galleybytes/monitor/pkg/sink"
+	"github.com/galleybytes/monitor/pkg/tracing"
+	"github.com/galleybytes/monitor/pkg/watch"
+	gocache "github.com/patrickmn/go-cache"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type Monitor struct {
+	config  Config
+	backend handlers.Backend
+	sink    sink.Sink
+	watcher watch.Watcher
+	clock   Clock
+	fs      FileSystem
+	offsets *watch.Offsets
+
+	// resourceReader is nil when the resource cannot be read, eg outside of a cluster without a kubeconfig
+	resourceReader ResourceReader
+
+	mu             sync.Mutex
+	stop           <-chan struct{}
+	tfoResource    models.TFOResource
+	generation     string
+	generationsDir string
+	cancel         context.CancelFunc
+	// nextGeneration is the newest generation directory that appeared, it is followed once it is registered
+	nextGeneration string
+	followers      sync.WaitGroup
+	stopErr        error
+	done           chan struct{}
+
+	// taskPods are the generation dirs of the task pods that shipped logs, where their approval files go
+	taskPods map[string]string
+
+	// markerLineNos is the last line number shipped for each marker task pod
+	markerMu      sync.Mutex
+	markerLineNos map[string]int
+}
+
+// Option replaces one of the monitor's dependencies
+type Option func(*Monitor)
+
+// WithBackend sets the API client. The default is created from the config by NewBackend.
+func WithBackend(backend handlers.Backend) Option {
+	return func(m *Monitor) { m.backend = backend }
+}
+
+// WithSink sets where logs are shipped. The default is read from MONITOR_SINKS.
+func WithSink(s sink.Sink) Option {
+	return func(m *Monitor) { m.sink = s }
+}
+
+// WithWatcher sets the watcher. The default is created for the config's Watcher mode.
+func WithWatcher(watcher watch.Watcher) Option {
+	return func(m *Monitor) { m.watcher = watcher }
+}
+
+func WithClock(clock Clock) Option {
+	return func(m *Monitor) { m.clock = clock }
+}
+
+func WithFileSystem(fs FileSystem) Option {
+	return func(m *Monitor) { m.fs = fs }
+}
+
+// WithResourceReader sets how the resource is read to catch edits of its spec. The default reads it from the
+// Kubernetes API with tfoclient.
+func WithResourceReader(resourceReader ResourceReader) Option {
+	return func(m *Monitor) { m.resourceReader = resourceReader }
+}
+
+func New(config Config, options ...Option) *Monitor {
+	m := &Monitor{
+		config:         config,
+		clock:          realClock{},
+		fs:             osFileSystem{},
+		offsets:        watch.NewOffsets(),
+		generation:     config.ResourceGeneration,
+		nextGeneration: config.ResourceGeneration,
+		taskPods:       map[string]string{},
+		done:           make(chan struct{}),
+
+		markerLineNos: map[string]int{},
+	}
+	for _, option := range options {
+		option(m)
+	}
+	return m
+}
+
+// Run verifies the monitor manager registered the resource, ships the logs already written and then follows new logs and approvals until ctx
+// is done or Shutdown is called. Run can only be called once.
+func (m *Monitor) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	m.mu.Lock()
+	m.cancel = cancel
+	m.mu.Unlock()
+	defer close(m.done)
+	defer cancel()
+
+	if m.config.ResourceGeneration == "" {
+		return fmt.Errorf("TFO_GENERATION cannot be empty")
+	}
+
+	var err error
+	if m.backend == nil {
+		cache := gocache.New(gocache.NoExpiration, gocache.NoExpiration)
+		m.backend, err = NewBackend(m.config, cache)
+		if err != nil {
+			return err
+		}
+	}
+	if m.sink == nil {
+		m.sink, err = sink.FromEnv(m.backend)
+		if err != nil {
+			return err
+		}
+	}
+	defer m.sink.Close()
+
+	// The calls to the backend are made with ctx, stopping cancels the requests in flight and they fail like any
+	// other request the backend could not answer.
+	m.stop = ctx.Done()
+	m.tfoResource, err = m.verifyRegistration(ctx, m.generation)
+	if err != nil {
+		return err
+	}
+	slog.Info("Resource is registered", logging.Generation, m.generation)
+	m.shipSpecDiff(ctx, m.tfoResource, m.generation)
+
+	if m.watcher == nil {
+		m.watcher, err = watch.New(m.config.Watcher, m.config.PollInterval, m.offsets)
+		if err != nil {
+			return err
+		}
+	}
+	defer m.watcher.Close()
+	defer m.followers.Wait()
+
+	m.generationsDir = m.config.GenerationsDir(m.generation)
+	slog.Debug("Waiting for the generation directory", "dir", m.generationsDir)
+	for {
+		fileInfo, err := m.fs.Stat(m.generationsDir)
+		if err == nil && fileInfo.IsDir() {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return m.err()
+		case <-m.clock.After(50 * time.Millisecond):
+		}
+	}
+
+	m.watcher.Add(m.generationsDir)
+	// Watch for new generation directories which are created when the resource is edited
+	m.watcher.Add(filepath.Join(m.config.RootPath, "generations"))
+
+	// Read in all files on init
+	m.shipExistingLogs(ctx, m.generationsDir)
+	slog.Info("Starting log watcher", "watcher", string(m.config.Watcher))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		m.watch(ctx)
+	}()
+	defer wg.Wait()
+
+	if m.config.SpecInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.watchSpec(ctx)
+		}()
+	}
+
+	// Start a poll for messages on the approvals model
+	slog.Info("Starting approval watcher", "interval", m.config.ApprovalInterval.String())
+	for {
+		m.findApprovals(ctx)
+		select {
+		case <-ctx.Done():
+			return m.err()
+		case <-m.clock.After(m.config.ApprovalInterval):
+		}
+	}
+}
+
+// failed stops Run with err once the monitor manager revoked the API access, eg because the resource was deleted,
+// since nothing can be shipped anymore. Other failures are retried.
+func (m *Monitor) failed(err error) {
+	if !errors.Is(err, handlers.ErrAccessRevoked) {
+		return
+	}
+	m.mu.Lock()
+	if m.stopErr == nil {
+		m.stopErr = err
+	}
+	cancel := m.cancel
+	m.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// err is why Run stopped, nil when it was stopped by ctx or Shutdown
+func (m *Monitor) err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stopErr
+}
+
+// Shutdown stops Run and waits for it to return, closing the watcher and flushing the sinks
+func (m *Monitor) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	cancel := m.cancel
+	m.mu.Unlock()
+	if cancel == nil {
+		return fmt.Errorf("monitor is not running")
+	}
+	cancel()
+	select {
+	case <-m.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *Monitor) watch(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-m.watcher.Events():
+			if !ok {
+				return
+			}
+			slog.Debug("File event", "file", event.Name, "op", event.Op.String())
+			m.handleEvent(ctx, event)
+		case err, ok := <-m.watcher.Errors():
+			if !ok {
+				return
+			}
+			slog.Error("Watcher failed", "error", err)
+		}
+	}
+}
+
+func (m *Monitor) handleEvent(ctx context.Context, event watch.Event) {
+	ctx, span := tracing.Start(ctx, "monitor.event",
+		attribute.String("file", event.Name),
+		attribute.String("op", event.Op.String()),
+	)
+	defer span.End()
+
+	if event.Op == watch.Create {
+		file, err := m.fs.Stat(event.Name)
+		if err == nil && file.IsDir() {
+			if !m.claimGeneration(event.Name) {
+				return
+			}
+			// Waiting for the registration of the new generation does not hold up the events of the generation
+			// still being followed
+			m.followers.Add(1)
+			go func() {
+				defer m.followers.Done()
+				m.followGeneration(ctx, event.Name)
+			}()
+			return
+		}
+	}
+	if event.Op == watch.Create || event.Op == watch.Write {
+		isLog, taskType, rerun, generation, uid := handlers.ParseFile(event.Name)
+		if !isLog {
+			return
+		}
+		m.shipLogFile(ctx, event.Name, taskType, generation, rerun, uid)
+	}
+}
+
+// verifyRegistration waits for the monitor manager to register the generation of the resource. It returns the
+// resource the logs are shipped under, which is the fork when the manager forked the resource.
+func (m *Monitor) verifyRegistration(ctx context.Context, generation string) (models.TFOResource, error) {
+	ctx, span := tracing.Start(ctx, "monitor.verify_registration", attribute.String(logging.Generation, generation))
+	defer span.End()
+
+	backend := m.backend.WithContext(ctx)
+	timeout := m.clock.After(m.config.RegistrationTimeout)
+	for {
+		tfoResource, reason, err := FindRegistration(backend, m.config, generation)
+		if err != nil {
+			// The backend could not be reached, it is asked again until the registration times out
+			slog.Warn("Could not look up the registration", logging.Generation, generation, "error", err)
+			reason = fmt.Sprintf("the backend could not be reached: %s", err)
+		} else if tfoResource != nil {
+			return *tfoResource, nil
+		} else {
+			slog.Debug("Waiting for the resource to be registered", logging.Generation, generation, "reason", reason)
+		}
+		select {
+		case <-m.stop:
+			return models.TFOResource{}, fmt.Errorf("stopped before the resource was registered")
+		case <-timeout:
+			err := fmt.Errorf("generation %s was not registered within %s, %s: check that the monitor manager is running", generation, m.config.RegistrationTimeout, reason)
+			tracing.Fail(span, err)
+			return models.TFOResource{}, err
+		case <-m.clock.After(time.Second):
+		}
+	}
+}
+
+// FindRegistration returns the resource of the config as registered by the monitor manager at generation or later,
+// or the reason it is not registered yet. An error is returned when the backend could not be reached.
+func FindRegistration(backend handlers.Backend, config Config, generation string) (*models.TFOResource, string, error) {
+	cluster, err := backend.FindCluster(config.ClusterName)
+	if err != nil {
+		return nil, "", err
+	}
+	if cluster == nil {
+		return nil, fmt.Sprintf("cluster %s is not registered", config.ClusterName), nil
+	}
+	tfoResource, err := backend.FindTFOResource(config.ResourceUUID)
+	if err != nil {
+		return nil, "", err
+	}
+	if tfoResource == nil {
+		return nil, "resource is not registered", nil
+	}
+	if tfoResource.ClusterID != cluster.ID {
+		tfoResource, err = backend.FindTFOResource(handlers.ForkUUID(config.ResourceUUID, *cluster))
+		if err != nil {
+			return nil, "", err
+		}
+		if tfoResource == nil {
+			return nil, "resource is bound to another cluster", nil
+		}
+	}
+	current, _ := strconv.Atoi(tfoResource.CurrentGeneration)
+	want, _ := strconv.Atoi(generation)
+	if current < want {
+		return nil, fmt.Sprintf("resource is registered at generation %s", tfoResource.CurrentGeneration), nil
+	}
+	return tfoResource, "", nil
+}
+
+// claimGeneration checks that dir is a generation directory directly under TFO_ROOT_PATH/generations and that its
+// generation is greater than any seen before, and records it as the next generation to follow
+func (m *Monitor) claimGeneration(dir string) bool {
+	if filepath.Dir(dir) != filepath.Join(m.config.RootPath, "generations") {
+		return false
+	}
+	generation, err := strconv.Atoi(filepath.Base(dir))
+	if err != nil {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	next, err := strconv.Atoi(m.nextGeneration)
+	if err != nil || generation <= next {
+		return false
+	}
+	m.nextGeneration = filepath.Base(dir)
+	return true
+}
+
+// followGeneration starts following the logs of the generation in dir once the manager has registered it. The
+// resource was edited, when it was edited again meanwhile only the newest generation is followed.
+func (m *Monitor) followGeneration(ctx context.Context, dir string) {
+	generation := filepath.Base(dir)
+	slog.Info("Following generation", logging.Generation, generation)
+	tfoResource, err := m.verifyRegistration(ctx, generation)
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		slog.Error("Shipping the logs of the generation under the previous registration", logging.Generation, generation, "error", err)
+	}
+	m.mu.Lock()
+	if generation != m.nextGeneration {
+		m.mu.Unlock()
+		slog.Info("Not following generation, the resource was edited again", logging.Generation, generation, "next_generation", m.nextGeneration)
+		return
+	}
+	if err == nil {
+		m.tfoResource = tfoResource
+	}
+	m.generation = generation
+	m.generationsDir = dir
+	m.mu.Unlock()
+	if err == nil {
+		m.shipSpecDiff(ctx, tfoResource, generation)
+	}
+	m.watcher.Add(dir)
+	m.shipExistingLogs(ctx, dir)
+}
+
+// shipLogFile sends the lines of the log file to the configured sinks. The file is tracked before it is read and
+// only recorded as shipped once the sinks wrote it, so the auto watcher keeps sending it after a failed write
+// until a write succeeds.
+func (m *Monitor) shipLogFile(ctx context.Context, file, taskType, generation string, rerun int, uid string) {
+	m.offsets.Track(file)
+
+	// The size is read before the file so anything appended during the read is seen again on the next reconcile
+	fileInfo, statErr := m.fs.Stat(file)
+
+	m.mu.Lock()
+	tfoResource := m.tfoResource
+	m.mu.Unlock()
+
+	taskPod, err := m.backend.WithContext(ctx).GetOrSetTaskPod(tfoResource, taskType, generation, rerun, uid)
+	if err != nil {
+		trace.SpanFromContext(ctx).RecordError(err)
+		slog.Error("Could not register the task pod", logging.Generation, generation, logging.TaskPodUUID, uid, "file", file, "error", err)
+		m.failed(err)
+		return
+	}
+	m.mu.Lock()
+	m.taskPods[uid] = filepath.Dir(file)
+	m.mu.Unlock()
+
+	f, err := m.fs.Open(file)
+	if err != nil {
+		slog.Error("Could not read the log file", append(logging.TaskAttrs(taskPod), "file", file, "error", err)...)
+		return
+	}
+	defer f.Close()
+	_, scanSpan := tracing.Start(ctx, "monitor.scan", attribute.String("file", file))
+	lines := handlers.ScanLines(f, tfoResource, taskPod)
+	scanSpan.SetAttributes(attribute.Int("lines", len(lines)))
+	scanSpan.End()
+	if err := m.sink.Write(ctx, tfoResource, taskPod, lines); err != nil {
+		trace.SpanFromContext(ctx).RecordError(err)
+		slog.Error("Could not ship the log file", append(logging.TaskAttrs(taskPod), "file", file, "error", err)...)
+		m.failed(err)
+		return
+	}
+	if statErr == nil {
+		m.offsets.Set(file, fileInfo.Size())
+	}
+}
+
+// shipExistingLogs writes every log file already found in dir
+func (m *Monitor) shipExistingLogs(ctx context.Context, dir string) {
+	entries, err := m.fs.ReadDir(dir)
+	if err != nil {
+		slog.Error("Could not list the generation directory", "dir", dir, "error", err)
+		return
+	}
+	for _, entry := range entries {
+		file := filepath.Join(dir, entry.Name())
+		isLog, taskType, rerun, generation, uid := handlers.ParseFile(file)
+		if !isLog {
+			continue
+		}
+		m.shipLogFile(ctx, file, taskType, generation, rerun, uid)
+	}
+}
+
+// findApprovals writes the approval files of the task pods that have shipped logs into the generation dir each
+// task pod writes its logs to, which is not the generation being followed for the task pods of earlier generations
+func (m *Monitor) findApprovals(ctx context.Context) {
+	m.mu.Lock()
+	uids := []string{}
+	dirs := map[string]string{}
+	for uid, dir := range m.taskPods {
+		uids = append(uids, uid)
+		dirs[uid] = dir
+	}
+	m.mu.Unlock()
+
+	ctx, span := tracing.Start(ctx, "monitor.approval_poll", attribute.Int("task_pods", len(uids)))
+	defer span.End()
+	if len(uids) == 0 {
+		return
+	}
+	approvals, err := m.backend.WithContext(ctx).FindApprovals(uids)
+	if err != nil {
+		tracing.Fail(span, err)
+		slog.Error("Could not read the approvals", "error", err)
+		m.failed(err)
+		return
+	}
+	m.writeApprovalFiles(approvals, dirs)
+}
+
+// writeApprovalFiles creates the file that tells a task it has been approved or canceled unless it exists. The file
+// is written to the dir of the task pod in dirs.
+func (m *Monitor) writeApprovalFiles(approvals []models.Approval, dirs map[string]string) {
+	for _, approval := range approvals {
+		dir, found := dirs[approval.TaskPodUUID]
+		if !found {
+			continue
+		}
+		file := handlers.ApprovalFile(dir, approval)
+		if _, err := m.fs.Stat(file); err == nil {
+			continue
+		}
+		if err := m.fs.WriteFile(file, []byte{}, 0644); err != nil {
+			slog.Error("Could not write the approval file", logging.TaskPodUUID, approval.TaskPodUUID, "file", file, "error", err)
+		}
+	}
+}
@@ -0,0 +1,809 @@
+package monitor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/galleybytes/monitor/pkg/handlers"
+	"github.com/galleybytes/monitor/pkg/models"
+	"github.com/galleybytes/monitor/pkg/tfoclient"
+	"github.com/galleybytes/monitor/pkg/watch"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	testCluster = "test-cluster"
+	testUUID    = "00000000-0000-0000-0000-000000000001"
+)
+
+// fakeBackend keeps the registration, task pods and specs in memory. Calls the monitor does not make panic on the
+// nil Backend.
+type fakeBackend struct {
+	handlers.Backend
+
+	mu            sync.Mutex
+	cluster       *models.Cluster
+	tfoResource   *models.TFOResource
+	taskPods      map[string]models.TaskPod
+	resourceSpecs []models.TFOResourceSpec
+	approvals     map[string]models.Approval
+	err           error
+	lookupErr     error
+	lookupFails   int
+	specErr       error
+	specDiffErr   error
+	taskLogsErr   error
+}
+
+func newFakeBackend(generation string) *fakeBackend {
+	cluster := models.Cluster{Name: testCluster}
+	cluster.ID = 1
+	return &fakeBackend{
+		cluster: &cluster,
+		tfoResource: &models.TFOResource{
+			UUID:              testUUID,
+			Namespace:         "default",
+			Name:              "example",
+			CurrentGeneration: generation,
+			Cluster:           cluster,
+			ClusterID:         cluster.ID,
+		},
+		taskPods:  map[string]models.TaskPod{},
+		approvals: map[string]models.Approval{},
+	}
+}
+
+func (b *fakeBackend) register(generation string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tfoResource.CurrentGeneration = generation
+}
+
+func (b *fakeBackend) WithContext(ctx context.Context) handlers.Backend {
+	return b
+}
+
+func (b *fakeBackend) FindCluster(name string) (*models.Cluster, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.lookupFails > 0 {
+		b.lookupFails--
+		return nil, b.lookupErr
+	}
+	if name != b.cluster.Name {
+		return nil, nil
+	}
+	return b.cluster, nil
+}
+
+func (b *fakeBackend) FindTFOResource(uuid string) (*models.TFOResource, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tfoResource == nil || uuid != b.tfoResource.UUID {
+		return nil, nil
+	}
+	tfoResource := *b.tfoResource
+	return &tfoResource, nil
+}
+
+// failLookups makes the next n lookups of the registration fail with err
+func (b *fakeBackend) failLookups(n int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lookupFails = n
+	b.lookupErr = err
+}
+
+func (b *fakeBackend) GetOrSetTaskPod(tfoResource models.TFOResource, taskType, generation string, rerun int, uid string) (models.TaskPod, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return models.TaskPod{}, b.err
+	}
+	taskPod := models.TaskPod{UUID: uid, TaskType: taskType, Generation: generation, Rerun: rerun, TFOResourceUUID: tfoResource.UUID}
+	b.taskPods[uid] = taskPod
+	return taskPod, nil
+}
+
+// fail makes registering task pods fail with err until it is called with nil
+func (b *fakeBackend) fail(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.err = err
+}
+
+func (b *fakeBackend) approve(uid string, isApproved bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.approvals[uid] = models.Approval{TaskPodUUID: uid, IsApproved: isApproved}
+}
+
+func (b *fakeBackend) FindApprovals(uids []string) ([]models.Approval, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	approvals := []models.Approval{}
+	for _, uid := range uids {
+		if approval, found := b.approvals[uid]; found {
+			approvals = append(approvals, approval)
+		}
+	}
+	return approvals, nil
+}
+
+func (b *fakeBackend) FindTaskLogs(uid string) ([]models.TFOTaskLog, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.taskLogsErr != nil {
+		return nil, b.taskLogsErr
+	}
+	return []models.TFOTaskLog{}, nil
+}
+
+// failTaskLogs makes reading the saved logs fail with err until it is called with nil
+func (b *fakeBackend) failTaskLogs(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.taskLogsErr = err
+}
+
+func (b *fakeBackend) RecordResourceSpec(uuid, generation string, resourceSpec []byte) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.resourceSpecs = append(b.resourceSpecs, models.TFOResourceSpec{TFOResourceUUID: uuid, Generation: generation, ResourceSpec: string(resourceSpec)})
+	return true
+}
+
+func (b *fakeBackend) FindResourceSpec(uuid, generation string) (*models.TFOResourceSpec, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.specErr != nil {
+		return nil, b.specErr
+	}
+	for i := len(b.resourceSpecs) - 1; i >= 0; i-- {
+		if b.resourceSpecs[i].TFOResourceUUID == uuid && b.resourceSpecs[i].Generation == generation {
+			resourceSpec := b.resourceSpecs[i]
+			return &resourceSpec, nil
+		}
+	}
+	return nil, nil
+}
+
+func (b *fakeBackend) SpecDiffSupported() error {
+	return b.specDiffErr
+}
+
+func (b *fakeBackend) FindPreviousResourceSpec(uuid, generation string) (*models.TFOResourceSpec, error) {
+	n, _ := strconv.Atoi(generation)
+	for i := n - 1; i > 0; i-- {
+		if resourceSpec, err := b.FindResourceSpec(uuid, strconv.Itoa(i)); err != nil || resourceSpec != nil {
+			return resourceSpec, err
+		}
+	}
+	return nil, nil
+}
+
+// failSpecs makes reading the specs fail with err until it is called with nil
+func (b *fakeBackend) failSpecs(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.specErr = err
+}
+
+// fakeSink records the lines written for each task pod and fails while failing is set
+type fakeSink struct {
+	mu      sync.Mutex
+	lines   map[string][]models.TFOTaskLog
+	failing bool
+}
+
+func newFakeSink() *fakeSink {
+	return &fakeSink{lines: map[string][]models.TFOTaskLog{}}
+}
+
+func (s *fakeSink) Write(ctx context.Context, tfoResource models.TFOResource, taskPod models.TaskPod, lines []models.TFOTaskLog) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failing {
+		return fmt.Errorf("sink is failing")
+	}
+	s.lines[taskPod.UUID] = lines
+	return nil
+}
+
+func (s *fakeSink) Close() error {
+	return nil
+}
+
+func (s *fakeSink) messages(uid string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	messages := []string{}
+	for _, line := range s.lines[uid] {
+		messages = append(messages, line.Message)
+	}
+	return messages
+}
+
+func (s *fakeSink) setFailing(failing bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failing = failing
+}
+
+// fakeWatcher delivers the events the test sends
+type fakeWatcher struct {
+	events chan watch.Event
+	errors chan error
+}
+
+func newFakeWatcher() *fakeWatcher {
+	return &fakeWatcher{events: make(chan watch.Event), errors: make(chan error)}
+}
+
+// flush returns once the monitor handled the events sent before, since it takes one event at a time
+func (w *fakeWatcher) flush() {
+	w.events <- watch.Event{Name: "/flush", Op: watch.Chmod}
+}
+
+func (w *fakeWatcher) Add(name string) error      { return nil }
+func (w *fakeWatcher) Events() <-chan watch.Event { return w.events }
+func (w *fakeWatcher) Errors() <-chan error       { return w.errors }
+func (w *fakeWatcher) Close() error               { return nil }
+
+// fastClock waits a millisecond for any duration
+type fastClock struct{}
+
+func (fastClock) After(d time.Duration) <-chan time.Time {
+	return time.After(time.Millisecond)
+}
+
+// retryClock waits a millisecond for the retries of the registration and never times out
+type retryClock struct{}
+
+func (retryClock) After(d time.Duration) <-chan time.Time {
+	if d > time.Second {
+		return nil
+	}
+	return time.After(time.Millisecond)
+}
+
+// fakeResourceReader returns the resource the test set
+type fakeResourceReader struct {
+	mu       sync.Mutex
+	resource *tfoclient.Resource
+	reads    int
+}
+
+func (r *fakeResourceReader) Get(ctx context.Context, namespace, name string) (*tfoclient.Resource, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reads++
+	resource := *r.resource
+	return &resource, nil
+}
+
+func (r *fakeResourceReader) set(generation int64, resourceVersion string, spec string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.resource = &tfoclient.Resource{
+		ObjectMeta: metav1.ObjectMeta{UID: types.UID(testUUID), Generation: generation, ResourceVersion: resourceVersion},
+		Spec:       json.RawMessage(spec),
+	}
+}
+
+func testConfig(rootPath string) Config {
+	return Config{
+		ClusterName:         testCluster,
+		ResourceUUID:        testUUID,
+		ResourceNamespace:   "default",
+		ResourceName:        "example",
+		ResourceGeneration:  "1",
+		RootPath:            rootPath,
+		ApprovalInterval:    time.Second,
+		RegistrationTimeout: time.Second,
+	}
+}
+
+func writeLog(t *testing.T, file, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// run starts the monitor and stops it when the test ends
+func run(t *testing.T, m *Monitor) <-chan error {
+	t.Helper()
+	errCh := make(chan error, 1)
+	go func() { errCh <- m.Run(context.Background()) }()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		m.Shutdown(ctx)
+	})
+	return errCh
+}
+
+func waitFor(t *testing.T, condition func() bool, format string, a ...interface{}) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf(format, a...)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRunShipsExistingAndAppendedLines(t *testing.T) {
+	rootPath := t.TempDir()
+	file := filepath.Join(rootPath, "generations", "1", "plan.0.uid-plan.out")
+	writeLog(t, file, "line 1\nline 2\n")
+
+	backend := newFakeBackend("1")
+	s := newFakeSink()
+	watcher := newFakeWatcher()
+	m := New(testConfig(rootPath), WithBackend(backend), WithSink(s), WithWatcher(watcher), WithClock(fastClock{}))
+	run(t, m)
+
+	waitFor(t, func() bool { return len(s.messages("uid-plan")) == 2 }, "existing lines were not shipped: %q", s.messages("uid-plan"))
+	if offset, found := m.offsets.Get(file); !found || offset != int64(len("line 1\nline 2\n")) {
+		t.Errorf("offset = %d, %v, want the size of the file", offset, found)
+	}
+
+	writeLog(t, file, "line 1\nline 2\nline 3\n")
+	watcher.events <- watch.Event{Name: file, Op: watch.Write}
+	waitFor(t, func() bool { return len(s.messages("uid-plan")) == 3 }, "appended line was not shipped: %q", s.messages("uid-plan"))
+	if got := strings.Join(s.messages("uid-plan"), ","); got != "line 1,line 2,line 3" {
+		t.Errorf("shipped %s", got)
+	}
+}
+
+func TestRunKeepsTheOffsetOfFailedWrites(t *testing.T) {
+	rootPath := t.TempDir()
+	file := filepath.Join(rootPath, "generations", "1", "apply.0.uid-apply.out")
+	writeLog(t, file, "line 1\n")
+
+	s := newFakeSink()
+	s.setFailing(true)
+	watcher := newFakeWatcher()
+	m := New(testConfig(rootPath), WithBackend(newFakeBackend("1")), WithSink(s), WithWatcher(watcher), WithClock(fastClock{}))
+	run(t, m)
+
+	watcher.events <- watch.Event{Name: file, Op: watch.Write}
+	watcher.flush()
+	if offset, found := m.offsets.Get(file); !found || offset != 0 {
+		t.Fatalf("offset = %d, %v, want a file the sinks failed to write to be tracked but not shipped", offset, found)
+	}
+
+	s.setFailing(false)
+	watcher.events <- watch.Event{Name: file, Op: watch.Write}
+	waitFor(t, func() bool { offset, _ := m.offsets.Get(file); return offset == int64(len("line 1\n")) },
+		"the file was not recorded as shipped after the sinks wrote it")
+}
+
+func TestRunRetriesWhenTheBackendFails(t *testing.T) {
+	rootPath := t.TempDir()
+	file := filepath.Join(rootPath, "generations", "1", "plan.0.uid-plan.out")
+	writeLog(t, file, "line 1\n")
+
+	backend := newFakeBackend("1")
+	backend.fail(fmt.Errorf("backend is unavailable"))
+	s := newFakeSink()
+	watcher := newFakeWatcher()
+	m := New(testConfig(rootPath), WithBackend(backend), WithSink(s), WithWatcher(watcher), WithClock(fastClock{}))
+	errs := run(t, m)
+
+	watcher.events <- watch.Event{Name: file, Op: watch.Write}
+	watcher.flush()
+	if offset, _ := m.offsets.Get(file); offset != 0 {
+		t.Fatal("a file whose task pod could not be registered was recorded as shipped")
+	}
+
+	backend.fail(nil)
+	watcher.events <- watch.Event{Name: file, Op: watch.Write}
+	waitFor(t, func() bool { return len(s.messages("uid-plan")) == 1 }, "the file was not shipped once the backend recovered")
+	select {
+	case err := <-errs:
+		t.Fatalf("Run() returned %v", err)
+	default:
+	}
+}
+
+func TestRunStopsWhenTheAccessIsRevoked(t *testing.T) {
+	rootPath := t.TempDir()
+	file := filepath.Join(rootPath, "generations", "1", "plan.0.uid-plan.out")
+	writeLog(t, file, "line 1\n")
+
+	backend := newFakeBackend("1")
+	backend.fail(fmt.Errorf("%w: resource was deleted", handlers.ErrAccessRevoked))
+	m := New(testConfig(rootPath), WithBackend(backend), WithSink(newFakeSink()), WithWatcher(newFakeWatcher()), WithClock(fastClock{}))
+	select {
+	case err := <-run(t, m):
+		if !errors.Is(err, handlers.ErrAccessRevoked) {
+			t.Errorf("Run() = %v, want the revoked access", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() kept running after the access was revoked")
+	}
+}
+
+// mapFileSystem keeps the files in memory under their absolute paths
+type mapFileSystem struct {
+	mu    sync.Mutex
+	files fstest.MapFS
+}
+
+func (f *mapFileSystem) Stat(name string) (fs.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return fs.Stat(f.files, strings.TrimPrefix(name, "/"))
+}
+
+func (f *mapFileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return fs.ReadDir(f.files, strings.TrimPrefix(name, "/"))
+}
+
+func (f *mapFileSystem) Open(name string) (fs.File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.files.Open(strings.TrimPrefix(name, "/"))
+}
+
+func (f *mapFileSystem) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.files[strings.TrimPrefix(name, "/")] = &fstest.MapFile{Data: data, Mode: perm}
+	return nil
+}
+
+func TestFindApprovalsWritesApprovalFiles(t *testing.T) {
+	backend := newFakeBackend("1")
+	backend.approve("uid-approved", true)
+	backend.approve("uid-canceled", false)
+	files := &mapFileSystem{files: fstest.MapFS{}}
+	m := New(testConfig("/tfo"), WithBackend(backend), WithFileSystem(files))
+	// The monitor follows generation 2, the approved task pod ran in generation 1
+	m.generationsDir = "/tfo/generations/2"
+	m.taskPods["uid-approved"] = "/tfo/generations/1"
+	m.taskPods["uid-canceled"] = "/tfo/generations/2"
+	m.taskPods["uid-undecided"] = "/tfo/generations/2"
+
+	m.findApprovals(context.Background())
+	names := []string{}
+	for name := range files.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	expected := "tfo/generations/1/_approved_uid-approved,tfo/generations/2/_canceled_uid-canceled"
+	if got := strings.Join(names, ","); got != expected {
+		t.Errorf("wrote %s, want %s", got, expected)
+	}
+}
+
+func TestRunFollowsNewGeneration(t *testing.T) {
+	rootPath := t.TempDir()
+	writeLog(t, filepath.Join(rootPath, "generations", "1", "plan.0.uid-1.out"), "generation 1\n")
+
+	backend := newFakeBackend("1")
+	s := newFakeSink()
+	watcher := newFakeWatcher()
+	m := New(testConfig(rootPath), WithBackend(backend), WithSink(s), WithWatcher(watcher), WithClock(fastClock{}))
+	run(t, m)
+	waitFor(t, func() bool { return len(s.messages("uid-1")) == 1 }, "generation 1 was not shipped")
+
+	dir := filepath.Join(rootPath, "generations", "2")
+	writeLog(t, filepath.Join(dir, "plan.0.uid-2.out"), "generation 2\n")
+	backend.register("2")
+	watcher.events <- watch.Event{Name: dir, Op: watch.Create}
+	waitFor(t, func() bool { return len(s.messages("uid-2")) == 1 }, "generation 2 was not shipped")
+
+	m.mu.Lock()
+	generation := m.generation
+	m.mu.Unlock()
+	if generation != "2" {
+		t.Errorf("following generation %s, want 2", generation)
+	}
+
+	// Older generations are not followed again
+	watcher.events <- watch.Event{Name: filepath.Join(rootPath, "generations", "1"), Op: watch.Create}
+	watcher.flush()
+	m.mu.Lock()
+	generation = m.generation
+	m.mu.Unlock()
+	if generation != "2" {
+		t.Errorf("following generation %s after an event of generation 1, want 2", generation)
+	}
+}
+
+func TestRunShipsWhileTheNewGenerationIsNotRegistered(t *testing.T) {
+	rootPath := t.TempDir()
+	file := filepath.Join(rootPath, "generations", "1", "plan.0.uid-1.out")
+	writeLog(t, file, "line 1\n")
+
+	backend := newFakeBackend("1")
+	config := testConfig(rootPath)
+	config.RegistrationTimeout = time.Minute
+	s := newFakeSink()
+	watcher := newFakeWatcher()
+	m := New(config, WithBackend(backend), WithSink(s), WithWatcher(watcher), WithClock(retryClock{}))
+	run(t, m)
+	waitFor(t, func() bool { return len(s.messages("uid-1")) == 1 }, "generation 1 was not shipped")
+
+	dir := filepath.Join(rootPath, "generations", "2")
+	writeLog(t, filepath.Join(dir, "plan.0.uid-2.out"), "generation 2\n")
+	watcher.events <- watch.Event{Name: dir, Op: watch.Create}
+	// The watcher reports the directory again when it reconciles
+	watcher.events <- watch.Event{Name: dir, Op: watch.Create}
+
+	writeLog(t, file, "line 1\nline 2\n")
+	watcher.events <- watch.Event{Name: file, Op: watch.Write}
+	waitFor(t, func() bool { return len(s.messages("uid-1")) == 2 }, "the logs of generation 1 were held up by the registration of generation 2")
+
+	backend.register("2")
+	waitFor(t, func() bool { return len(s.messages("uid-2")) == 1 }, "generation 2 was not shipped once it was registered")
+}
+
+func TestRunFailsWhenNotRegistered(t *testing.T) {
+	backend := newFakeBackend("1")
+	backend.tfoResource = nil
+	m := New(testConfig(t.TempDir()), WithBackend(backend), WithSink(newFakeSink()), WithWatcher(newFakeWatcher()), WithClock(fastClock{}))
+
+	select {
+	case err := <-run(t, m):
+		if err == nil || !strings.Contains(err.Error(), "was not registered") {
+			t.Errorf("Run() error = %v, want the resource not to be registered", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not give up on the registration")
+	}
+}
+
+func TestRunRetriesTheRegistrationWhenTheBackendFails(t *testing.T) {
+	rootPath := t.TempDir()
+	writeLog(t, filepath.Join(rootPath, "generations", "1", "plan.0.uid-plan.out"), "line 1\n")
+
+	backend := newFakeBackend("1")
+	backend.failLookups(3, fmt.Errorf("backend is unavailable"))
+	config := testConfig(rootPath)
+	config.RegistrationTimeout = time.Minute
+	s := newFakeSink()
+	m := New(config, WithBackend(backend), WithSink(s), WithWatcher(newFakeWatcher()), WithClock(retryClock{}))
+	errs := run(t, m)
+
+	waitFor(t, func() bool { return len(s.messages("uid-plan")) == 1 }, "the logs were not shipped once the backend recovered")
+	select {
+	case err := <-errs:
+		t.Fatalf("Run() returned %v", err)
+	default:
+	}
+}
+
+func TestRunFailsWithoutGeneration(t *testing.T) {
+	config := testConfig(t.TempDir())
+	config.ResourceGeneration = ""
+	m := New(config, WithBackend(newFakeBackend("1")), WithSink(newFakeSink()))
+	if err := m.Run(context.Background()); err == nil {
+		t.Error("Run() without TFO_GENERATION did not fail")
+	}
+}
+
+func TestShutdownBeforeRun(t *testing.T) {
+	if err := New(testConfig(t.TempDir())).Shutdown(context.Background()); err == nil {
+		t.Error("Shutdown() of a monitor that is not running did not fail")
+	}
+}
+
+func TestWatchSpecMarksEdits(t *testing.T) {
+	rootPath := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(rootPath, "generations", "1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	config := testConfig(rootPath)
+	config.SpecInterval = time.Millisecond
+
+	backend := newFakeBackend("1")
+	s := newFakeSink()
+	reader := &fakeResourceReader{}
+	reader.set(1, "100", `{"terraformVersion":"1.5.6"}`)
+	m := New(config, WithBackend(backend), WithSink(s), WithWatcher(newFakeWatcher()), WithClock(fastClock{}), WithResourceReader(reader))
+	run(t, m)
+
+	marker := handlers.MarkerTaskPodUUID(testUUID, "1")
+	// Only the metadata changed
+	reader.set(1, "101", `{"terraformVersion": "1.5.6"}`)
+	time.Sleep(50 * time.Millisecond)
+	if messages := s.messages(marker); len(messages) != 0 {
+		t.Fatalf("marked an edit of the metadata: %q", messages)
+	}
+
+	reader.set(2, "102", `{"terraformVersion":"1.5.7"}`)
+	waitFor(t, func() bool { return len(s.messages(marker)) == 1 }, "the spec edit was not marked")
+	if message := s.messages(marker)[0]; !strings.Contains(message, "generation 1 -> 2 (resourceVersion 102)") {
+		t.Errorf("marker = %s", message)
+	}
+	markerLine := func() models.TFOTaskLog {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.lines[marker][0]
+	}
+	if lineNo := markerLine().LineNo; lineNo != "1" {
+		t.Errorf("marker line number = %s, want the first marker to be line 1", lineNo)
+	}
+
+	// The sink is given the lines of each write
+	reader.set(3, "103", `{"terraformVersion":"1.5.8"}`)
+	waitFor(t, func() bool { return strings.Contains(markerLine().Message, "2 -> 3") }, "the second spec edit was not marked")
+	if lineNo := markerLine().LineNo; lineNo != "2" {
+		t.Errorf("marker line number = %s, want the second marker to be line 2", lineNo)
+	}
+	// The manager registers the specs, the monitor has no key to redact them with
+	if resourceSpec, _ := backend.FindResourceSpec(testUUID, "2"); resourceSpec != nil {
+		t.Errorf("the monitor recorded the spec %v", resourceSpec)
+	}
+}
+
+func TestWatchSpecRetriesTheMarkerWhenTheBackendFails(t *testing.T) {
+	rootPath := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(rootPath, "generations", "1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	config := testConfig(rootPath)
+	config.SpecInterval = time.Millisecond
+
+	backend := newFakeBackend("1")
+	s := newFakeSink()
+	reader := &fakeResourceReader{}
+	reader.set(1, "100", `{"terraformVersion":"1.5.6"}`)
+	m := New(config, WithBackend(backend), WithSink(s), WithWatcher(newFakeWatcher()), WithClock(fastClock{}), WithResourceReader(reader))
+	errs := run(t, m)
+
+	marker := handlers.MarkerTaskPodUUID(testUUID, "1")
+	waitFor(t, func() bool { reader.mu.Lock(); defer reader.mu.Unlock(); return reader.reads > 0 }, "the resource was not read")
+	backend.failTaskLogs(fmt.Errorf("backend is unavailable"))
+	reader.set(2, "102", `{"terraformVersion":"1.5.7"}`)
+	time.Sleep(50 * time.Millisecond)
+	if messages := s.messages(marker); len(messages) != 0 {
+		t.Fatalf("marked the edit without the saved lines: %q", messages)
+	}
+
+	backend.failTaskLogs(nil)
+	waitFor(t, func() bool { return len(s.messages(marker)) == 1 }, "the edit was not marked once the backend recovered")
+	select {
+	case err := <-errs:
+		t.Fatalf("Run() returned %v", err)
+	default:
+	}
+}
+
+func TestShipSpecDiffIsSkippedWhenTheSpecCannotBeRead(t *testing.T) {
+	backend := newFakeBackend("2")
+	backend.resourceSpecs = []models.TFOResourceSpec{
+		{TFOResourceUUID: testUUID, Generation: "1", ResourceSpec: `{"terraformVersion":"1.5.6"}`},
+		{TFOResourceUUID: testUUID, Generation: "2", ResourceSpec: `{"terraformVersion":"1.5.7"}`,
+			SpecDiff: `[{"op":"replace","path":"/terraformVersion","value":"1.5.7"}]`},
+	}
+	backend.failSpecs(fmt.Errorf("backend is unavailable"))
+	s := newFakeSink()
+	m := New(testConfig(t.TempDir()), WithBackend(backend), WithSink(s))
+	uid := handlers.MarkerTaskPodUUID(testUUID, "2")
+
+	m.shipSpecDiff(context.Background(), *backend.tfoResource, "2")
+	if shipped := s.messages(uid); len(shipped) != 0 {
+		t.Fatalf("shipped %q without the spec", shipped)
+	}
+
+	backend.failSpecs(nil)
+	m.shipSpecDiff(context.Background(), *backend.tfoResource, "2")
+	expected := `--- monitor: 1 changes to the spec since generation 1 ---,~ terraformVersion = "1.5.7"`
+	if got := strings.Join(s.messages(uid), ","); got != expected {
+		t.Errorf("shipped %s, want %s", got, expected)
+	}
+}
+
+func TestShipSpecDiffIsSkippedWhenTheBackendDoesNotSaveThem(t *testing.T) {
+	backend := newFakeBackend("2")
+	backend.resourceSpecs = []models.TFOResourceSpec{
+		{TFOResourceUUID: testUUID, Generation: "1", ResourceSpec: `{"terraformVersion":"1.5.6"}`},
+		{TFOResourceUUID: testUUID, Generation: "2", ResourceSpec: `{"terraformVersion":"1.5.7"}`,
+			SpecDiff: `[{"op":"replace","path":"/terraformVersion","value":"1.5.7"}]`},
+	}
+	backend.specDiffErr = fmt.Errorf("the API does not report a schema version")
+	s := newFakeSink()
+	m := New(testConfig(t.TempDir()), WithBackend(backend), WithSink(s))
+
+	m.shipSpecDiff(context.Background(), *backend.tfoResource, "2")
+	if shipped := s.messages(handlers.MarkerTaskPodUUID(testUUID, "2")); len(shipped) != 0 {
+		t.Errorf("shipped %q although the backend does not save spec diffs", shipped)
+	}
+	if _, ok := backend.taskPods[handlers.MarkerTaskPodUUID(testUUID, "2")]; ok {
+		t.Error("created the monitor task pod although the backend does not save spec diffs")
+	}
+}
+
+func TestConfigFromEnvReportsTheEnvOfTheManager(t *testing.T) {
+	full := map[string]string{
+		"TFO_RESOURCE_UUID":            "00000000-0000-0000-0000-000000000001",
+		"TFO_NAMESPACE":                "default",
+		"TFO_RESOURCE":                 "example",
+		"TFO_ROOT_PATH":                "/home/tfo-runner",
+		"CLUSTER_NAME":                 "test",
+		"MONITOR_MANAGER_SERVICE_HOST": "https://monitor-manager.tf-system.svc",
+		"MONITOR_SPEC_REDACT_KEY":      "key",
+	}
+	for _, test := range []struct {
+		missing  string
+		expected string
+	}{
+		{"", ""},
+		{"TFO_RESOURCE_UUID", "TFO_RESOURCE_UUID cannot be empty"},
+		{"CLUSTER_NAME", "set by the example-monitor-envs ConfigMap in namespace default"},
+		{"MONITOR_MANAGER_SERVICE_HOST", "set by the example-monitor-envs ConfigMap in namespace default"},
+	} {
+		t.Run(test.missing, func(t *testing.T) {
+			for name, value := range full {
+				if name == test.missing {
+					value = ""
+				}
+				t.Setenv(name, value)
+			}
+			_, err := ConfigFromEnv()
+			if test.expected == "" {
+				if err != nil {
+					t.Errorf("ConfigFromEnv() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.missing) || !strings.Contains(err.Error(), test.expected) {
+				t.Errorf("ConfigFromEnv() error = %v, want it to name %s and %q", err, test.missing, test.expected)
+			}
+		})
+	}
+
+	// The key is only required by what records specs
+	for name, value := range full {
+		t.Setenv(name, value)
+	}
+	t.Setenv("MONITOR_SPEC_REDACT_KEY", "")
+	config, err := ConfigFromEnv()
+	if err != nil {
+		t.Fatalf("ConfigFromEnv() without MONITOR_SPEC_REDACT_KEY error = %v", err)
+	}
+	if err := config.RequireSpecSanitizer(); err == nil || !strings.Contains(err.Error(), "set by the example-monitor-envs Secret in namespace default") {
+		t.Errorf("RequireSpecSanitizer() = %v, want it to name the example-monitor-envs Secret", err)
+	}
+}
+
+func TestRunReturnsTheErrorOfTheFirstManagerToken(t *testing.T) {
+	t.Setenv("MONITOR_MANAGER_CA", "")
+	config := testConfig(t.TempDir())
+	config.Backend = "api"
+	// Nothing listens on the port
+	config.ManagerServiceHost = "http://127.0.0.1:1"
+	select {
+	case err := <-run(t, New(config)):
+		if err == nil {
+			t.Error("Run() returned no error when the manager is unavailable")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not return when the manager is unavailable")
+	}
+}
@@ -0,0 +1,210 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/galleybytes/monitor/pkg/handlers"
+	"github.com/galleybytes/monitor/pkg/logging"
+	"github.com/galleybytes/monitor/pkg/models"
+	"github.com/galleybytes/monitor/pkg/tfoclient"
+	"github.com/galleybytes/monitor/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// watchSpec reads the resource every SpecInterval until ctx is done. The first read is what the manager registered,
+// every later change of the spec is marked in the logs of the generation being followed, since the task pods of a
+// run keep running with the spec they started with. A change that could not be marked is marked at the next
+// interval. The manager registers the spec of the new generation.
+func (m *Monitor) watchSpec(ctx context.Context) {
+	if m.resourceReader == nil {
+		client, err := tfoclient.NewFromEnv()
+		if err != nil {
+			slog.Warn("Not watching the resource spec", "error", err)
+			return
+		}
+		m.resourceReader = client
+	}
+	slog.Info("Starting spec watcher", "interval", m.config.SpecInterval.String())
+
+	var last *tfoclient.Resource
+	for {
+		resource, err := m.resourceReader.Get(ctx, m.config.ResourceNamespace, m.config.ResourceName)
+		switch {
+		case ctx.Err() != nil:
+			return
+		case apierrors.IsForbidden(err):
+			// The service account of the task pod is not allowed to read the resource, it will not be allowed later
+			slog.Warn("Not watching the resource spec", "error", err)
+			return
+		case err != nil:
+			slog.Warn("Could not read the resource", "error", err)
+		case string(resource.UID) != m.config.ResourceUUID:
+			// The resource was deleted and created again with the same name, its pods run their own monitor
+			slog.Debug("Resource was replaced", "uid", string(resource.UID))
+		case last == nil:
+			last = resource
+		case resource.ResourceVersion != last.ResourceVersion:
+			if handlers.SameSpec(last.Spec, resource.Spec) {
+				last = resource
+			} else if err := m.specChanged(ctx, last, resource); err != nil {
+				slog.Error("Could not ship the spec marker, retrying at the next interval", "error", err)
+				m.failed(err)
+			} else {
+				last = resource
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.clock.After(m.config.SpecInterval):
+		}
+	}
+}
+
+// specChanged ships a marker line under the MarkerTaskType task pod of the generation being followed
+func (m *Monitor) specChanged(ctx context.Context, previous, resource *tfoclient.Resource) error {
+	m.mu.Lock()
+	tfoResource := m.tfoResource
+	generation := m.generation
+	m.mu.Unlock()
+
+	newGeneration := strconv.FormatInt(resource.Generation, 10)
+	ctx, span := tracing.Start(ctx, "monitor.spec_change",
+		attribute.String(logging.Generation, generation),
+		attribute.String("new_generation", newGeneration),
+	)
+	defer span.End()
+
+	backend := m.backend.WithContext(ctx)
+	slog.Info("Resource spec changed", logging.Generation, generation, "new_generation", newGeneration,
+		"resource_version", resource.ResourceVersion)
+
+	uid := handlers.MarkerTaskPodUUID(tfoResource.UUID, generation)
+	taskPod, err := backend.GetOrSetTaskPod(tfoResource, handlers.MarkerTaskType, generation, 0, uid)
+	if err != nil {
+		tracing.Fail(span, err)
+		return err
+	}
+	message := fmt.Sprintf("--- monitor: the spec of %s/%s was edited at %s, generation %d -> %d (resourceVersion %s) ---",
+		m.config.ResourceNamespace, m.config.ResourceName, time.Now().UTC().Format(time.RFC3339),
+		previous.Generation, resource.Generation, resource.ResourceVersion)
+	lines, err := m.markerLines(backend, tfoResource, taskPod, []string{message}, false)
+	if err == nil {
+		err = m.sink.Write(ctx, tfoResource, taskPod, lines)
+	}
+	if err != nil {
+		tracing.Fail(span, err)
+		return err
+	}
+	return nil
+}
+
+// shipSpecDiff ships what changed in the spec since the previous generation under the MarkerTaskType task pod of
+// the generation when the monitor starts following it. A restarted monitor does not ship the diff again.
+func (m *Monitor) shipSpecDiff(ctx context.Context, tfoResource models.TFOResource, generation string) {
+	ctx, span := tracing.Start(ctx, "monitor.spec_diff", attribute.String(logging.Generation, generation))
+	defer span.End()
+
+	backend := m.backend.WithContext(ctx)
+	if err := backend.SpecDiffSupported(); err != nil {
+		trace.SpanFromContext(ctx).RecordError(err)
+		slog.Error("The backend does not save spec diffs, the spec diff is not shipped", logging.Generation, generation, "error", err)
+		return
+	}
+	resourceSpec, err := backend.FindResourceSpec(tfoResource.UUID, generation)
+	if err != nil {
+		trace.SpanFromContext(ctx).RecordError(err)
+		slog.Error("Could not read the spec, the spec diff is not shipped", logging.Generation, generation, "error", err)
+		m.failed(err)
+		return
+	}
+	if resourceSpec == nil || resourceSpec.SpecDiff == "" {
+		return
+	}
+	changes, err := handlers.SummarizeSpecDiff(resourceSpec.SpecDiff)
+	if err != nil {
+		slog.Warn("Could not read the spec diff", logging.Generation, generation, "error", err)
+		return
+	}
+	if len(changes) == 0 {
+		return
+	}
+
+	uid := handlers.MarkerTaskPodUUID(tfoResource.UUID, generation)
+	taskPod, err := backend.GetOrSetTaskPod(tfoResource, handlers.MarkerTaskType, generation, 0, uid)
+	if err != nil {
+		trace.SpanFromContext(ctx).RecordError(err)
+		slog.Error("Could not ship the spec diff", logging.Generation, generation, "error", err)
+		m.failed(err)
+		return
+	}
+	previous, err := backend.FindPreviousResourceSpec(tfoResource.UUID, generation)
+	if err != nil {
+		trace.SpanFromContext(ctx).RecordError(err)
+		slog.Error("Could not read the previous spec, the spec diff is not shipped", logging.Generation, generation, "error", err)
+		m.failed(err)
+		return
+	}
+	header := fmt.Sprintf("--- monitor: %d changes to the spec ---", len(changes))
+	if previous != nil {
+		header = fmt.Sprintf("--- monitor: %d changes to the spec since generation %s ---", len(changes), previous.Generation)
+	}
+	lines, err := m.markerLines(backend, tfoResource, taskPod, append([]string{header}, changes...), true)
+	if err != nil {
+		trace.SpanFromContext(ctx).RecordError(err)
+		slog.Error("Could not read the lines of the marker task pod, the spec diff is not shipped", logging.Generation, generation, "error", err)
+		m.failed(err)
+		return
+	}
+	if len(lines) == 0 {
+		return
+	}
+	if err := m.sink.Write(ctx, tfoResource, taskPod, lines); err != nil {
+		trace.SpanFromContext(ctx).RecordError(err)
+		slog.Error("Could not ship the spec diff", append(logging.TaskAttrs(taskPod), "error", err)...)
+		m.failed(err)
+	}
+}
+
+// markerLines numbers the messages as the next lines of the marker task pod. Marker task pods have no log file so
+// their lines are numbered 1, 2, 3... in the order they are shipped, continuing from the lines already saved for the
+// task pod so a restarted monitor does not number over them. With once, nothing is returned when the first message
+// was already saved.
+func (m *Monitor) markerLines(backend handlers.Backend, tfoResource models.TFOResource, taskPod models.TaskPod, messages []string, once bool) ([]models.TFOTaskLog, error) {
+	m.markerMu.Lock()
+	defer m.markerMu.Unlock()
+
+	next, numbered := m.markerLineNos[taskPod.UUID]
+	if !numbered || once {
+		saved, err := backend.FindTaskLogs(taskPod.UUID)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range saved {
+			if once && line.Message == messages[0] {
+				return nil, nil
+			}
+			if lineNo, err := strconv.Atoi(line.LineNo); err == nil && lineNo > next {
+				next = lineNo
+			}
+		}
+	}
+	lines := []models.TFOTaskLog{}
+	for _, message := range messages {
+		next++
+		lines = append(lines, models.TFOTaskLog{
+			Message:     message,
+			TFOResource: tfoResource,
+			TaskPod:     taskPod,
+			LineNo:      strconv.Itoa(next),
+		})
+	}
+	m.markerLineNos[taskPod.UUID] = next
+	return lines, nil
+}
@@ -0,0 +1,226 @@
+// Package sanitize redacts sensitive fields from the resource spec before it is stored. Terraform resources can
+// hold inline env values, credentials and backend config with keys in them. Redacted values are replaced with an
+// HMAC keyed with a per-deployment key, so a change of the value still shows in the spec diffs without storing the
+// value or a hash that short values can be guessed from.
+package sanitize
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Builtin are the rules every Sanitizer has, for the fields of the terraform-operator resource spec that are known
+// to hold secrets. The paths are relative to the spec, which is what is stored.
+var Builtin = []string{
+	"$.taskOptions[*].env[*].value",
+	"$.env[*].value",
+	"$.credentials",
+	"$.backend",
+}
+
+// redactedPrefix starts every redacted value so values are not redacted twice
+const redactedPrefix = "redacted:"
+
+// Sanitizer redacts the fields matched by its rules. The zero value has no key and panics when it is used, use New.
+type Sanitizer struct {
+	rules []Rule
+
+	// key is the HMAC key of the redacted values
+	key []byte
+}
+
+// New returns a Sanitizer with the Builtin rules and the extra rules that redacts values with an HMAC keyed with
+// key. There is no Sanitizer without a key: replacing every value with the same placeholder would hide changes of
+// the values from the diffs.
+func New(key []byte, extra ...string) (Sanitizer, error) {
+	if len(key) == 0 {
+		return Sanitizer{}, fmt.Errorf("a key is required to redact the spec")
+	}
+	s := Sanitizer{key: key}
+	for _, path := range append(append([]string{}, Builtin...), extra...) {
+		rule, err := ParseRule(path)
+		if err != nil {
+			return Sanitizer{}, err
+		}
+		s.rules = append(s.rules, rule)
+	}
+	return s, nil
+}
+
+// FromEnv reads the extra rules from MONITOR_SPEC_REDACT, a comma separated list of JSONPaths like
+// $.taskOptions[*].annotations.token, and the key from MONITOR_SPEC_REDACT_KEY. The manager and the monitors need
+// the same key so the specs they record compare equal, the manager creates it on its first start.
+func FromEnv() (Sanitizer, error) {
+	key := os.Getenv("MONITOR_SPEC_REDACT_KEY")
+	if key == "" {
+		return Sanitizer{}, fmt.Errorf("MONITOR_SPEC_REDACT_KEY cannot be empty")
+	}
+	return WithKeyFromEnv([]byte(key))
+}
+
+// WithKeyFromEnv is FromEnv with a key that was not read from MONITOR_SPEC_REDACT_KEY, like the one the manager
+// keeps in its Secret. The extra rules are still read from MONITOR_SPEC_REDACT.
+func WithKeyFromEnv(key []byte) (Sanitizer, error) {
+	if len(key) == 0 {
+		return Sanitizer{}, fmt.Errorf("the spec redaction key cannot be empty")
+	}
+	extra := []string{}
+	for _, path := range strings.Split(os.Getenv("MONITOR_SPEC_REDACT"), ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			extra = append(extra, path)
+		}
+	}
+	s, err := New(key, extra...)
+	if err != nil {
+		return Sanitizer{}, fmt.Errorf("MONITOR_SPEC_REDACT is not valid: %s", err)
+	}
+	return s, nil
+}
+
+// HasKey reports whether the sanitizer was created with New and can be used
+func (s Sanitizer) HasKey() bool {
+	return len(s.key) > 0
+}
+
+// Sanitize returns the spec with the matched values redacted. A spec that is not JSON or has nothing to redact is
+// returned as is.
+func (s Sanitizer) Sanitize(resourceSpec []byte) []byte {
+	if len(s.key) == 0 {
+		panic("the spec sanitizer has no key, create it with New")
+	}
+	decoder := json.NewDecoder(bytes.NewReader(resourceSpec))
+	decoder.UseNumber()
+	var obj interface{}
+	if err := decoder.Decode(&obj); err != nil {
+		return resourceSpec
+	}
+	redacted := false
+	for _, rule := range s.rules {
+		obj = s.redact(obj, rule.segments, &redacted)
+	}
+	if !redacted {
+		return resourceSpec
+	}
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return resourceSpec
+	}
+	return b
+}
+
+func (s Sanitizer) redact(node interface{}, segments []segment, redacted *bool) interface{} {
+	if len(segments) == 0 {
+		if node == nil {
+			return nil
+		}
+		if value, ok := node.(string); ok && strings.HasPrefix(value, redactedPrefix) {
+			return value
+		}
+		*redacted = true
+		return s.hash(node)
+	}
+	segment, rest := segments[0], segments[1:]
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if segment.wildcard {
+			for key, value := range n {
+				n[key] = s.redact(value, rest, redacted)
+			}
+		} else if value, found := n[segment.key]; found && segment.index < 0 {
+			n[segment.key] = s.redact(value, rest, redacted)
+		}
+	case []interface{}:
+		if segment.wildcard {
+			for i, value := range n {
+				n[i] = s.redact(value, rest, redacted)
+			}
+		} else if segment.index >= 0 && segment.index < len(n) {
+			n[segment.index] = s.redact(n[segment.index], rest, redacted)
+		}
+	}
+	return node
+}
+
+// hash is the redacted value, eg redacted:hmac-sha256:9f86d081884c7d659a2feaa0c55ad015
+func (s Sanitizer) hash(value interface{}) string {
+	b, _ := json.Marshal(value)
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(b)
+	return redactedPrefix + "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// Rule is a JSONPath of the values to redact. Only child members (.name, ['name']), array indexes ([0]) and
+// wildcards ([*], .*) are supported.
+type Rule struct {
+	Path     string
+	segments []segment
+}
+
+// segment is a member when index is -1 and not a wildcard
+type segment struct {
+	key      string
+	index    int
+	wildcard bool
+}
+
+// ParseRule parses a JSONPath like $.taskOptions[*].env[*].value
+func ParseRule(path string) (Rule, error) {
+	rule := Rule{Path: path}
+	if !strings.HasPrefix(path, "$") {
+		return rule, fmt.Errorf("'%s' does not start with $", path)
+	}
+	rest := path[1:]
+	for rest != "" {
+		switch {
+		case strings.HasPrefix(rest, "."):
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			name := rest[1 : end+1]
+			if name == "" {
+				return rule, fmt.Errorf("'%s' has an empty member", path)
+			}
+			if name == "*" {
+				rule.segments = append(rule.segments, segment{index: -1, wildcard: true})
+			} else {
+				rule.segments = append(rule.segments, segment{key: name, index: -1})
+			}
+			rest = rest[end+1:]
+		case strings.HasPrefix(rest, "['"), strings.HasPrefix(rest, `["`):
+			quote := rest[1:2]
+			end := strings.Index(rest[2:], quote+"]")
+			if end < 0 {
+				return rule, fmt.Errorf("'%s' has an unterminated member", path)
+			}
+			rule.segments = append(rule.segments, segment{key: rest[2 : end+2], index: -1})
+			rest = rest[end+4:]
+		case strings.HasPrefix(rest, "["):
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return rule, fmt.Errorf("'%s' has an unterminated index", path)
+			}
+			if index := rest[1:end]; index == "*" {
+				rule.segments = append(rule.segments, segment{index: -1, wildcard: true})
+			} else if n, err := strconv.Atoi(index); err == nil && n >= 0 {
+				rule.segments = append(rule.segments, segment{index: n})
+			} else {
+				return rule, fmt.Errorf("'%s' has an unsupported index '%s'", path, index)
+			}
+			rest = rest[end+1:]
+		default:
+			return rule, fmt.Errorf("'%s' is not a supported JSONPath", path)
+		}
+	}
+	if len(rule.segments) == 0 {
+		return rule, fmt.Errorf("'%s' matches the whole resource", path)
+	}
+	return rule, nil
+}
@@ -0,0 +1,183 @@
+package sanitize
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		path     string
+		segments []segment
+		wantErr  bool
+	}{
+		{path: "$.credentials", segments: []segment{{key: "credentials", index: -1}}},
+		{path: "$.taskOptions[*].env[*].value", segments: []segment{
+			{key: "taskOptions", index: -1}, {index: -1, wildcard: true},
+			{key: "env", index: -1}, {index: -1, wildcard: true},
+			{key: "value", index: -1},
+		}},
+		{path: "$.env[0].value", segments: []segment{{key: "env", index: -1}, {index: 0}, {key: "value", index: -1}}},
+		{path: "$.annotations['vault.hashicorp.com/token']", segments: []segment{
+			{key: "annotations", index: -1}, {key: "vault.hashicorp.com/token", index: -1},
+		}},
+		{path: `$.annotations["a.b"].*`, segments: []segment{
+			{key: "annotations", index: -1}, {key: "a.b", index: -1}, {index: -1, wildcard: true},
+		}},
+		{path: "credentials", wantErr: true},
+		{path: "$", wantErr: true},
+		{path: "$..credentials", wantErr: true},
+		{path: "$.env[-1]", wantErr: true},
+		{path: "$.env[?(@.name)]", wantErr: true},
+		{path: "$.annotations['token", wantErr: true},
+		{path: "$.env[0", wantErr: true},
+		{path: "$credentials", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rule, err := ParseRule(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseRule() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(rule.segments) != len(tt.segments) {
+				t.Fatalf("ParseRule() segments = %+v, want %+v", rule.segments, tt.segments)
+			}
+			for i := range tt.segments {
+				if rule.segments[i] != tt.segments[i] {
+					t.Errorf("ParseRule() segment %d = %+v, want %+v", i, rule.segments[i], tt.segments[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	s, err := New([]byte("key"), "$.terraformModule.token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := `{
+		"terraformVersion": "1.5.7",
+		"credentials": [{"secretNameRef": {"name": "aws"}}],
+		"backend": "terraform { backend \"s3\" { access_key = \"AKIA\" } }",
+		"env": [{"name": "TF_VAR_password", "value": "hunter2"}, {"name": "TF_VAR_count", "value": 3}],
+		"taskOptions": [{"for": ["*"], "env": [{"name": "TOKEN", "value": "ghp"}, {"name": "FROM_SECRET"}]}],
+		"terraformModule": {"source": "https://github.com/galleybytes/e2e.git", "token": "ghp-secret"},
+		"keepLatestPodsOnly": false,
+		"ttl": 12345678901234567890
+	}`
+	sanitized := s.Sanitize([]byte(spec))
+	for _, secret := range []string{"aws", "AKIA", "hunter2", "ghp", "ghp-secret"} {
+		if strings.Contains(string(sanitized), `"`+secret) {
+			t.Errorf("Sanitize() kept %s: %s", secret, sanitized)
+		}
+	}
+	obj := map[string]interface{}{}
+	if err := json.Unmarshal(sanitized, &obj); err != nil {
+		t.Fatalf("Sanitize() is not JSON: %s", err)
+	}
+	for _, kept := range []string{"TF_VAR_password", "FROM_SECRET", "https://github.com/galleybytes/e2e.git", `"terraformVersion":"1.5.7"`, "12345678901234567890"} {
+		if !strings.Contains(string(sanitized), kept) {
+			t.Errorf("Sanitize() did not keep %s: %s", kept, sanitized)
+		}
+	}
+	if strings.Contains(string(sanitized), `"FROM_SECRET","value"`) {
+		t.Errorf("Sanitize() added a value that was not set: %s", sanitized)
+	}
+
+	if again := s.Sanitize(sanitized); string(again) != string(sanitized) {
+		t.Errorf("Sanitize() of a sanitized spec = %s, want it unchanged", again)
+	}
+	if notJSON := s.Sanitize([]byte("not json")); string(notJSON) != "not json" {
+		t.Errorf("Sanitize() of a spec that is not JSON = %s, want it unchanged", notJSON)
+	}
+	unchanged := `{"terraformVersion": "1.5.7"}`
+	if got := s.Sanitize([]byte(unchanged)); string(got) != unchanged {
+		t.Errorf("Sanitize() without anything to redact = %s, want it unchanged", got)
+	}
+}
+
+func TestSanitizeKey(t *testing.T) {
+	redacted := func(s Sanitizer, value string) string {
+		obj := map[string]string{}
+		json.Unmarshal(s.Sanitize([]byte(`{"credentials":"`+value+`"}`)), &obj)
+		return obj["credentials"]
+	}
+	newSanitizer := func(key string) Sanitizer {
+		s, err := New([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	a := newSanitizer("a")
+	b := newSanitizer("b")
+
+	if !strings.HasPrefix(redacted(a, "secret"), "redacted:hmac-sha256:") {
+		t.Errorf("redacted value = %s, want an HMAC", redacted(a, "secret"))
+	}
+	if redacted(a, "secret") != redacted(newSanitizer("a"), "secret") {
+		t.Error("the same key redacts a value differently")
+	}
+	if redacted(a, "secret") == redacted(a, "other") {
+		t.Error("different values are redacted the same")
+	}
+	if redacted(a, "secret") == redacted(b, "secret") {
+		t.Error("different keys redact a value the same")
+	}
+	if _, err := New(nil); err == nil {
+		t.Error("New() without a key returned no error")
+	}
+	if !a.HasKey() || (Sanitizer{}).HasKey() {
+		t.Error("HasKey() does not tell a sanitizer created with New from the zero value")
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("MONITOR_SPEC_REDACT", " $.a.token , ,$.b[*]")
+	t.Setenv("MONITOR_SPEC_REDACT_KEY", "key")
+	s, err := FromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.rules) != len(Builtin)+2 {
+		t.Errorf("FromEnv() has %d rules, want %d", len(s.rules), len(Builtin)+2)
+	}
+	if string(s.key) != "key" {
+		t.Errorf("FromEnv() key = %q, want %q", s.key, "key")
+	}
+
+	t.Setenv("MONITOR_SPEC_REDACT", "a.token")
+	if _, err := FromEnv(); err == nil {
+		t.Error("FromEnv() accepted a rule that is not a JSONPath")
+	}
+
+	t.Setenv("MONITOR_SPEC_REDACT", "")
+	t.Setenv("MONITOR_SPEC_REDACT_KEY", "")
+	if _, err := FromEnv(); err == nil {
+		t.Error("FromEnv() without MONITOR_SPEC_REDACT_KEY returned no error")
+	}
+}
+
+func TestWithKeyFromEnv(t *testing.T) {
+	t.Setenv("MONITOR_SPEC_REDACT", "$.a.token")
+	t.Setenv("MONITOR_SPEC_REDACT_KEY", "")
+	s, err := WithKeyFromEnv([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.rules) != len(Builtin)+1 {
+		t.Errorf("WithKeyFromEnv() has %d rules, want %d", len(s.rules), len(Builtin)+1)
+	}
+	if string(s.key) != "key" {
+		t.Errorf("WithKeyFromEnv() key = %q, want %q", s.key, "key")
+	}
+
+	if _, err := WithKeyFromEnv(nil); err == nil {
+		t.Error("WithKeyFromEnv() without a key returned no error")
+	}
+}
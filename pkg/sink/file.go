@@ -0,0 +1,181 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/galleybytes/monitor/pkg/models"
+)
+
+// fileSink writes newline-delimited JSON records to a local file. When the file grows past maxSize it is renamed
+// to <path>.1, older files are shifted up, and anything past maxBackups is removed. The line numbers already in
+// the files are read when the sink is created, so a restarted monitor does not write them again.
+type fileSink struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+	tracker    *lineTracker
+}
+
+func NewFileSink(path string, maxSize int64, maxBackups int) (Sink, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	s := &fileSink{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+		tracker:    newLineTracker(),
+	}
+	if err := s.readWritten(); err != nil {
+		return nil, err
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func fileSinkFromEnv() (Sink, error) {
+	path := os.Getenv("MONITOR_SINK_FILE_PATH")
+	if path == "" {
+		return nil, fmt.Errorf("MONITOR_SINK_FILE_PATH cannot be empty when using the file sink")
+	}
+	maxSize := int64(10 * 1024 * 1024)
+	if s := os.Getenv("MONITOR_SINK_FILE_MAX_SIZE"); s != "" {
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("MONITOR_SINK_FILE_MAX_SIZE is not a number: %s", err)
+		}
+		maxSize = i
+	}
+	maxBackups := 5
+	if s := os.Getenv("MONITOR_SINK_FILE_MAX_BACKUPS"); s != "" {
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("MONITOR_SINK_FILE_MAX_BACKUPS is not a number: %s", err)
+		}
+		maxBackups = i
+	}
+	return NewFileSink(path, maxSize, maxBackups)
+}
+
+func (s *fileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file = file
+	s.size = fileInfo.Size()
+	return nil
+}
+
+// readWritten seeds the tracker with the last line number of each task pod in the file and its backups
+func (s *fileSink) readWritten() error {
+	files := []string{s.path}
+	for i := 1; i <= s.maxBackups; i++ {
+		files = append(files, fmt.Sprintf("%s.%d", s.path, i))
+	}
+	for _, name := range files {
+		file, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var record Record
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				// A line cut short by a crash while writing
+				continue
+			}
+			key := taskPodKey(record.Generation, record.TaskType, record.Rerun, record.TaskPodUUID)
+			if record.LineNo > s.tracker.written[key] {
+				s.tracker.written[key] = record.LineNo
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("could not read %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+func (s *fileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	for i := s.maxBackups; i > 0; i-- {
+		backup := fmt.Sprintf("%s.%d", s.path, i)
+		if i == s.maxBackups {
+			os.Remove(backup)
+			continue
+		}
+		os.Rename(backup, fmt.Sprintf("%s.%d", s.path, i+1))
+	}
+	if s.maxBackups > 0 {
+		if err := os.Rename(s.path, s.path+".1"); err != nil {
+			return err
+		}
+	} else {
+		os.Remove(s.path)
+	}
+	return s.open()
+}
+
+func (s *fileSink) Write(ctx context.Context, tfoResource models.TFOResource, taskPod models.TaskPod, lines []models.TFOTaskLog) error {
+	unwritten, err := s.tracker.unwritten(ctx, tfoResource, taskPod, lines)
+	if err != nil || len(unwritten) == 0 {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, line := range unwritten {
+		b, err := json.Marshal(newRecord(tfoResource, taskPod, line))
+		if err != nil {
+			s.tracker.markWritten(taskPod, unwritten[:i])
+			return err
+		}
+		b = append(b, '\n')
+		if s.maxSize > 0 && s.size > 0 && s.size+int64(len(b)) > s.maxSize {
+			if err := s.rotate(); err != nil {
+				s.tracker.markWritten(taskPod, unwritten[:i])
+				return err
+			}
+		}
+		n, err := s.file.Write(b)
+		s.size += int64(n)
+		if err != nil {
+			s.tracker.markWritten(taskPod, unwritten[:i])
+			return err
+		}
+	}
+	s.tracker.markWritten(taskPod, unwritten)
+	return nil
+}
+
+func (s *fileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
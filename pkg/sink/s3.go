@@ -0,0 +1,313 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/galleybytes/monitor/pkg/models"
+)
+
+// s3Sink uploads every batch of new lines as a newline-delimited JSON object to an S3 compatible object store
+// like AWS S3 or MinIO. Objects are named
+// <prefix>/<namespace>/<resource>/<generation>/<task>.<rerun>.<task-pod-uuid>/<first-line>-<last-line>.ndjson
+// The objects of a task pod are listed before its first upload, the last line in their names is where a
+// restarted monitor continues.
+type s3Sink struct {
+	client       *http.Client
+	endpoint     *url.URL
+	bucket       string
+	prefix       string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	pathStyle    bool
+	tracker      *lineTracker
+}
+
+type S3Config struct {
+	// Endpoint is the URL of the object store, eg https://s3.us-east-1.amazonaws.com or http://minio:9000
+	Endpoint  string
+	Bucket    string
+	Prefix    string
+	Region    string
+	AccessKey string
+	SecretKey string
+
+	// SessionToken is sent with temporary credentials, eg those of an assumed IAM role
+	SessionToken string
+
+	// PathStyle puts the bucket in the path instead of the host name which is what MinIO expects
+	PathStyle bool
+}
+
+func NewS3Sink(config S3Config) (Sink, error) {
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint '%s': %s", config.Endpoint, err)
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint '%s': expected scheme://host", config.Endpoint)
+	}
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("bucket cannot be empty")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	s := &s3Sink{
+		client:       &http.Client{Timeout: 30 * time.Second},
+		endpoint:     endpoint,
+		bucket:       config.Bucket,
+		prefix:       strings.Trim(config.Prefix, "/"),
+		region:       config.Region,
+		accessKey:    config.AccessKey,
+		secretKey:    config.SecretKey,
+		sessionToken: config.SessionToken,
+		pathStyle:    config.PathStyle,
+		tracker:      newLineTracker(),
+	}
+	s.tracker.last = s.lastLineNo
+	return s, nil
+}
+
+// s3SinkFromEnv reads the object store from MONITOR_SINK_S3_* and the credentials from AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN. MONITOR_SINK_S3_PATH_STYLE defaults to "true" for MinIO, set it to
+// "false" for the virtual host style of AWS S3.
+func s3SinkFromEnv() (Sink, error) {
+	return NewS3Sink(S3Config{
+		Endpoint:     os.Getenv("MONITOR_SINK_S3_ENDPOINT"),
+		Bucket:       os.Getenv("MONITOR_SINK_S3_BUCKET"),
+		Prefix:       os.Getenv("MONITOR_SINK_S3_PREFIX"),
+		Region:       os.Getenv("MONITOR_SINK_S3_REGION"),
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		PathStyle:    os.Getenv("MONITOR_SINK_S3_PATH_STYLE") != "false",
+	})
+}
+
+func (s *s3Sink) Write(ctx context.Context, tfoResource models.TFOResource, taskPod models.TaskPod, lines []models.TFOTaskLog) error {
+	unwritten, err := s.tracker.unwritten(ctx, tfoResource, taskPod, lines)
+	if err != nil || len(unwritten) == 0 {
+		return err
+	}
+
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, line := range unwritten {
+		if err := encoder.Encode(newRecord(tfoResource, taskPod, line)); err != nil {
+			return err
+		}
+	}
+
+	key := path.Join(
+		s.taskPodPrefix(tfoResource, taskPod),
+		fmt.Sprintf("%s-%s.ndjson", unwritten[0].LineNo, unwritten[len(unwritten)-1].LineNo),
+	)
+	if err := s.putObject(ctx, key, body.Bytes()); err != nil {
+		return fmt.Errorf("failed to upload '%s' to bucket '%s': %s", key, s.bucket, err)
+	}
+	s.tracker.markWritten(taskPod, unwritten)
+	return nil
+}
+
+func (s *s3Sink) taskPodPrefix(tfoResource models.TFOResource, taskPod models.TaskPod) string {
+	return path.Join(
+		s.prefix,
+		tfoResource.Namespace,
+		tfoResource.Name,
+		taskPod.Generation,
+		fmt.Sprintf("%s.%d.%s", taskPod.TaskType, taskPod.Rerun, taskPod.UUID),
+	)
+}
+
+// lastLineNo is the highest last line in the names of the objects already uploaded for the task pod
+func (s *s3Sink) lastLineNo(ctx context.Context, tfoResource models.TFOResource, taskPod models.TaskPod) (int, error) {
+	prefix := s.taskPodPrefix(tfoResource, taskPod) + "/"
+	keys, err := s.listObjects(ctx, prefix)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list '%s' in bucket '%s': %s", prefix, s.bucket, err)
+	}
+	last := 0
+	for _, key := range keys {
+		lineRange := strings.TrimSuffix(path.Base(key), ".ndjson")
+		if i := strings.LastIndex(lineRange, "-"); i >= 0 {
+			if lineNo, err := strconv.Atoi(lineRange[i+1:]); err == nil && lineNo > last {
+				last = lineNo
+			}
+		}
+	}
+	return last, nil
+}
+
+func (s *s3Sink) bucketURL() url.URL {
+	bucketURL := *s.endpoint
+	if s.pathStyle {
+		bucketURL.Path = path.Join("/", s.endpoint.Path, s.bucket)
+	} else {
+		bucketURL.Host = s.bucket + "." + s.endpoint.Host
+		bucketURL.Path = path.Join("/", s.endpoint.Path)
+	}
+	return bucketURL
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// listObjects returns the keys under prefix with ListObjectsV2
+func (s *s3Sink) listObjects(ctx context.Context, prefix string) ([]string, error) {
+	keys := []string{}
+	continuationToken := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+		bucketURL := s.bucketURL()
+		// Encode sorts by key, SigV4 expects spaces as %20
+		bucketURL.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, bucketURL.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		s.sign(request, nil, time.Now().UTC())
+
+		response, err := s.client.Do(request)
+		if err != nil {
+			return nil, err
+		}
+		responseBody, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if response.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("GET %s returned a %d: %s", bucketURL.String(), response.StatusCode, string(responseBody))
+		}
+		var result listBucketResult
+		if err := xml.Unmarshal(responseBody, &result); err != nil {
+			return nil, fmt.Errorf("could not read the object list: %s", err)
+		}
+		for _, content := range result.Contents {
+			keys = append(keys, content.Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		continuationToken = result.NextContinuationToken
+	}
+}
+
+func (s *s3Sink) putObject(ctx context.Context, key string, data []byte) error {
+	objectURL := s.bucketURL()
+	objectURL.Path = path.Join(objectURL.Path, key)
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPut, objectURL.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/x-ndjson")
+	s.sign(request, data, time.Now().UTC())
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		responseBody, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("PUT %s returned a %d: %s", objectURL.String(), response.StatusCode, string(responseBody))
+	}
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to the request, and the session token of temporary
+// credentials
+func (s *s3Sink) sign(request *http.Request, payload []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(payload)
+
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.accessKey == "" {
+		// Anonymous access, eg a bucket with a public write policy
+		return
+	}
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := fmt.Sprintf("host:%s\nx-amz-content-sha256:%s\nx-amz-date:%s\n",
+		request.URL.Host, payloadHash, amzDate)
+	if s.sessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", s.sessionToken)
+		signedHeaders += ";x-amz-security-token"
+		canonicalHeaders += fmt.Sprintf("x-amz-security-token:%s\n", s.sessionToken)
+	}
+	if contentType := request.Header.Get("Content-Type"); contentType != "" {
+		signedHeaders = "content-type;" + signedHeaders
+		canonicalHeaders = fmt.Sprintf("content-type:%s\n", contentType) + canonicalHeaders
+	}
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		request.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, s.region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	signingKey = hmacSHA256(signingKey, s.region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func (s *s3Sink) Close() error {
+	return nil
+}
@@ -0,0 +1,200 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/galleybytes/monitor/pkg/handlers"
+	"github.com/galleybytes/monitor/pkg/models"
+)
+
+// Sink is a destination for task logs. Write is called with every line of a log file each time the file changes,
+// so a sink is responsible for skipping lines it has already written. The ctx carries the trace of the file
+// event that triggered the write.
+type Sink interface {
+	Write(ctx context.Context, tfoResource models.TFOResource, taskPod models.TaskPod, lines []models.TFOTaskLog) error
+	Close() error
+}
+
+// Record is a single log line as written by the stdout, file and object storage sinks
+type Record struct {
+	Time         time.Time `json:"time"`
+	Cluster      string    `json:"cluster,omitempty"`
+	Namespace    string    `json:"namespace"`
+	Resource     string    `json:"resource"`
+	ResourceUUID string    `json:"resource_uuid"`
+	Generation   string    `json:"generation"`
+	TaskType     string    `json:"task_type"`
+	Rerun        int       `json:"rerun"`
+	TaskPodUUID  string    `json:"task_pod_uuid"`
+	LineNo       int       `json:"line_no"`
+	Message      string    `json:"message"`
+}
+
+func newRecord(tfoResource models.TFOResource, taskPod models.TaskPod, line models.TFOTaskLog) Record {
+	lineNo, _ := strconv.Atoi(line.LineNo)
+	return Record{
+		Time:         time.Now().UTC(),
+		Cluster:      tfoResource.Cluster.Name,
+		Namespace:    tfoResource.Namespace,
+		Resource:     tfoResource.Name,
+		ResourceUUID: tfoResource.UUID,
+		Generation:   taskPod.Generation,
+		TaskType:     taskPod.TaskType,
+		Rerun:        taskPod.Rerun,
+		TaskPodUUID:  taskPod.UUID,
+		LineNo:       lineNo,
+		Message:      line.Message,
+	}
+}
+
+// lineTracker remembers the last line number written for each task pod, keyed by taskPodKey. Sinks that can read back what they wrote
+// set last, so a restarted monitor continues after the lines written before the restart instead of writing the
+// logs again.
+type lineTracker struct {
+	mu      sync.Mutex
+	written map[string]int
+
+	// last returns the last line number the sink wrote for a task pod, it is called once per task pod
+	last func(ctx context.Context, tfoResource models.TFOResource, taskPod models.TaskPod) (int, error)
+}
+
+// taskPodKey identifies a task pod by its generation, task type and rerun besides its uuid, the same as the records
+// and object names of the sinks do
+func taskPodKey(generation, taskType string, rerun int, uid string) string {
+	return fmt.Sprintf("%s/%s/%d/%s", generation, taskType, rerun, uid)
+}
+
+func newLineTracker() *lineTracker {
+	return &lineTracker{written: map[string]int{}}
+}
+
+// unwritten returns the lines after the last line written for the task pod
+func (t *lineTracker) unwritten(ctx context.Context, tfoResource models.TFOResource, taskPod models.TaskPod, lines []models.TFOTaskLog) ([]models.TFOTaskLog, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := taskPodKey(taskPod.Generation, taskPod.TaskType, taskPod.Rerun, taskPod.UUID)
+	last, found := t.written[key]
+	if !found && t.last != nil {
+		var err error
+		last, err = t.last(ctx, tfoResource, taskPod)
+		if err != nil {
+			return nil, err
+		}
+		t.written[key] = last
+	}
+	unwritten := []models.TFOTaskLog{}
+	for _, line := range lines {
+		if lineNo, err := strconv.Atoi(line.LineNo); err == nil && lineNo <= last {
+			continue
+		}
+		unwritten = append(unwritten, line)
+	}
+	return unwritten, nil
+}
+
+func (t *lineTracker) markWritten(taskPod models.TaskPod, lines []models.TFOTaskLog) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := taskPodKey(taskPod.Generation, taskPod.TaskType, taskPod.Rerun, taskPod.UUID)
+	for _, line := range lines {
+		if lineNo, err := strconv.Atoi(line.LineNo); err == nil && lineNo > t.written[key] {
+			t.written[key] = lineNo
+		}
+	}
+}
+
+type backendSink struct {
+	backend handlers.Backend
+}
+
+// NewBackendSink writes logs to the terraform-operator-api, or to the database when the monitor runs with the
+// database backend. The backend is queried for the lines it already has.
+func NewBackendSink(backend handlers.Backend) Sink {
+	return backendSink{backend: backend}
+}
+
+func (s backendSink) Write(ctx context.Context, tfoResource models.TFOResource, taskPod models.TaskPod, lines []models.TFOTaskLog) error {
+	_, err := s.backend.WithContext(ctx).WriteAllLines(tfoResource, taskPod, lines)
+	return err
+}
+
+func (s backendSink) Close() error {
+	return nil
+}
+
+// multiSink fans out to several sinks. A failing sink does not stop the others from being written.
+type multiSink []Sink
+
+func NewMultiSink(sinks ...Sink) Sink {
+	return multiSink(sinks)
+}
+
+func (s multiSink) Write(ctx context.Context, tfoResource models.TFOResource, taskPod models.TaskPod, lines []models.TFOTaskLog) error {
+	errs := []error{}
+	for _, sink := range s {
+		if err := sink.Write(ctx, tfoResource, taskPod, lines); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s multiSink) Close() error {
+	errs := []string{}
+	for _, sink := range s {
+		if err := sink.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// FromEnv builds the sinks listed in MONITOR_SINKS, a comma separated list of "api", "stdout", "file" and "s3".
+// When MONITOR_SINKS is empty only the backend is used. "database" is accepted as another name for "api" since
+// both write to the configured backend.
+func FromEnv(backend handlers.Backend) (Sink, error) {
+	names := os.Getenv("MONITOR_SINKS")
+	if names == "" {
+		names = "api"
+	}
+
+	sinks := []Sink{}
+	for _, name := range strings.Split(names, ",") {
+		switch strings.TrimSpace(name) {
+		case "api", "database":
+			sinks = append(sinks, NewBackendSink(backend))
+		case "stdout":
+			sinks = append(sinks, NewStdoutSink(os.Stdout))
+		case "file":
+			fileSink, err := fileSinkFromEnv()
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, fileSink)
+		case "s3":
+			s3Sink, err := s3SinkFromEnv()
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, s3Sink)
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown sink '%s'", name)
+		}
+	}
+
+	if len(sinks) == 1 {
+		return sinks[0], nil
+	}
+	return NewMultiSink(sinks...), nil
+}
@@ -0,0 +1,248 @@
+package sink
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/galleybytes/monitor/pkg/handlers"
+	"github.com/galleybytes/monitor/pkg/models"
+	gocache "github.com/patrickmn/go-cache"
+)
+
+var (
+	testResource = models.TFOResource{UUID: "resource-uuid", Namespace: "default", Name: "example"}
+	testTaskPod  = models.TaskPod{UUID: "task-pod-uuid", TaskType: "plan", Generation: "1"}
+)
+
+func testLines(from, to int) []models.TFOTaskLog {
+	lines := []models.TFOTaskLog{}
+	for i := from; i <= to; i++ {
+		lines = append(lines, models.TFOTaskLog{LineNo: strconv.Itoa(i), Message: "line " + strconv.Itoa(i)})
+	}
+	return lines
+}
+
+func readRecords(t *testing.T, data []byte) []Record {
+	t.Helper()
+	records := []Record{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("record %q is not JSON: %s", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func lineNos(records []Record) []int {
+	lineNos := []int{}
+	for _, record := range records {
+		lineNos = append(lineNos, record.LineNo)
+	}
+	return lineNos
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestStdoutSinkWritesOnlyNewLines(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewStdoutSink(&buf)
+	ctx := context.Background()
+
+	if err := s.Write(ctx, testResource, testTaskPod, testLines(1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write(ctx, testResource, testTaskPod, testLines(1, 3)); err != nil {
+		t.Fatal(err)
+	}
+
+	records := readRecords(t, buf.Bytes())
+	if got := lineNos(records); !equalInts(got, []int{1, 2, 3}) {
+		t.Fatalf("expected lines [1 2 3], got %v", got)
+	}
+	record := records[2]
+	if record.Message != "line 3" || record.TaskPodUUID != testTaskPod.UUID || record.Resource != testResource.Name {
+		t.Errorf("unexpected record %+v", record)
+	}
+}
+
+func TestSinkTracksTheLinesOfEveryRerun(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewStdoutSink(&buf)
+	ctx := context.Background()
+
+	rerun := testTaskPod
+	rerun.Rerun = 1
+	if err := s.Write(ctx, testResource, testTaskPod, testLines(1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write(ctx, testResource, rerun, testLines(1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if got := lineNos(readRecords(t, buf.Bytes())); !equalInts(got, []int{1, 2, 1, 2}) {
+		t.Errorf("expected the lines of both reruns, got %v", got)
+	}
+}
+
+func TestFileSinkContinuesAfterRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs.ndjson")
+	ctx := context.Background()
+
+	s, err := NewFileSink(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write(ctx, testResource, testTaskPod, testLines(1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, err = NewFileSink(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write(ctx, testResource, testTaskPod, testLines(1, 4)); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := lineNos(readRecords(t, data)); !equalInts(got, []int{1, 2, 3, 4}) {
+		t.Errorf("expected lines [1 2 3 4], got %v", got)
+	}
+}
+
+func TestFileSinkRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs.ndjson")
+	ctx := context.Background()
+
+	// Every record is larger than maxSize so each goes to a file of its own
+	s, err := NewFileSink(path, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write(ctx, testResource, testTaskPod, testLines(1, 4)); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	for file, lineNo := range map[string]int{path: 4, path + ".1": 3, path + ".2": 2} {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := lineNos(readRecords(t, data)); !equalInts(got, []int{lineNo}) {
+			t.Errorf("expected %s to have line %d, got %v", file, lineNo, got)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected no more than 2 backups")
+	}
+
+	// The backups are read on restart as well
+	s, err = NewFileSink(path, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Write(ctx, testResource, testTaskPod, testLines(1, 4)); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := lineNos(readRecords(t, data)); !equalInts(got, []int{4}) {
+		t.Errorf("expected nothing to be written again, got %v", got)
+	}
+}
+
+func TestFileSinkSkipsTruncatedRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs.ndjson")
+	record, _ := json.Marshal(newRecord(testResource, testTaskPod, testLines(1, 1)[0]))
+	data := append(record, '\n')
+	data = append(data, `{"task_pod_uuid":"task-pod-uuid","line_no":`...)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewFileSink(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	unwritten, err := s.(*fileSink).tracker.unwritten(context.Background(), testResource, testTaskPod, testLines(1, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unwritten) != 1 || unwritten[0].LineNo != "2" {
+		t.Errorf("expected only line 2 to be unwritten, got %v", unwritten)
+	}
+}
+
+func TestMultiSinkWritesToEverySink(t *testing.T) {
+	var a, b bytes.Buffer
+	failing, err := NewS3Sink(S3Config{Endpoint: "http://127.0.0.1:0", Bucket: "bucket"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewMultiSink(NewStdoutSink(&a), failing, NewStdoutSink(&b))
+
+	if err := s.Write(context.Background(), testResource, testTaskPod, testLines(1, 1)); err == nil {
+		t.Error("expected the error of the failing sink")
+	}
+	if len(readRecords(t, a.Bytes())) != 1 || len(readRecords(t, b.Bytes())) != 1 {
+		t.Errorf("expected the other sinks to be written")
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("MONITOR_SINKS", "stdout, api")
+	s, err := FromEnv(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if multi, ok := s.(multiSink); !ok || len(multi) != 2 {
+		t.Errorf("expected 2 sinks, got %#v", s)
+	}
+
+	t.Setenv("MONITOR_SINKS", "kafka")
+	if _, err := FromEnv(nil); err == nil {
+		t.Error("expected an unknown sink to fail")
+	}
+
+	t.Setenv("MONITOR_SINKS", "file")
+	t.Setenv("MONITOR_SINK_FILE_PATH", "")
+	if _, err := FromEnv(nil); err == nil {
+		t.Error("expected the file sink to require a path")
+	}
+}
+
+func TestBackendSinkReturnsWriteErrors(t *testing.T) {
+	// Nothing listens on the port so every request fails
+	backend := handlers.NewWithToken("http://127.0.0.1:1", "token", gocache.New(gocache.NoExpiration, gocache.NoExpiration))
+	if err := NewBackendSink(backend).Write(context.Background(), testResource, testTaskPod, testLines(1, 2)); err == nil {
+		t.Error("Write() returned no error when the lines could not be written")
+	}
+}
@@ -0,0 +1,45 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/galleybytes/monitor/pkg/models"
+)
+
+// stdoutSink writes newline-delimited JSON records so cluster log collectors can pick up the task logs from the
+// monitor container
+type stdoutSink struct {
+	mu      sync.Mutex
+	w       io.Writer
+	tracker *lineTracker
+}
+
+func NewStdoutSink(w io.Writer) Sink {
+	return &stdoutSink{w: w, tracker: newLineTracker()}
+}
+
+func (s *stdoutSink) Write(ctx context.Context, tfoResource models.TFOResource, taskPod models.TaskPod, lines []models.TFOTaskLog) error {
+	// Lines already written to stdout cannot be read back, a restarted monitor writes the logs again
+	unwritten, err := s.tracker.unwritten(ctx, tfoResource, taskPod, lines)
+	if err != nil || len(unwritten) == 0 {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	encoder := json.NewEncoder(s.w)
+	for _, line := range unwritten {
+		if err := encoder.Encode(newRecord(tfoResource, taskPod, line)); err != nil {
+			return err
+		}
+	}
+	s.tracker.markWritten(taskPod, unwritten)
+	return nil
+}
+
+func (s *stdoutSink) Close() error {
+	return nil
+}
@@ -0,0 +1,107 @@
+// Package tfapi finds the API groups and versions terraform-operator serves Terraform resources in. Older
+// releases of terraform-operator serve tf.isaaguilar.com, newer ones tf.galleybytes.com, and a cluster that is
+// being migrated can serve both.
+package tfapi
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Groups are the API groups of terraform-operator, newest first
+var Groups = []string{"tf.galleybytes.com", "tf.isaaguilar.com"}
+
+// Resource is the plural name of the Terraform resource in every group
+const Resource = "terraforms"
+
+// GroupVersion is an API group and version. The version is empty when the preferred version the API server
+// serves should be used.
+type GroupVersion struct {
+	Group   string
+	Version string
+}
+
+func (gv GroupVersion) String() string {
+	if gv.Version == "" {
+		return gv.Group
+	}
+	return gv.Group + "/" + gv.Version
+}
+
+// ParseGroups reads a comma separated list of groups with an optional version, eg
+// "tf.galleybytes.com,tf.isaaguilar.com/v1alpha2", in the order they are preferred. An empty list is Groups.
+func ParseGroups(s string) ([]GroupVersion, error) {
+	groupVersions := []GroupVersion{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		group, version, _ := strings.Cut(item, "/")
+		if group == "" || strings.Contains(version, "/") {
+			return nil, fmt.Errorf("'%s' is not a group or group/version", item)
+		}
+		groupVersions = append(groupVersions, GroupVersion{Group: group, Version: version})
+	}
+	if len(groupVersions) == 0 {
+		for _, group := range Groups {
+			groupVersions = append(groupVersions, GroupVersion{Group: group})
+		}
+	}
+	return groupVersions, nil
+}
+
+// APIGroup is the discovery document the API server serves at /apis/<group>
+type APIGroup struct {
+	Name             string             `json:"name"`
+	Versions         []VersionDiscovery `json:"versions"`
+	PreferredVersion VersionDiscovery   `json:"preferredVersion"`
+}
+
+// VersionDiscovery is a version of an APIGroup
+type VersionDiscovery struct {
+	GroupVersion string `json:"groupVersion"`
+	Version      string `json:"version"`
+}
+
+// Resolve picks the version to use of each wanted group that is served, in the order of wanted. Groups without a
+// version get the preferred version. A pinned version that is not served is an error since it was asked for
+// explicitly.
+func Resolve(wanted []GroupVersion, served map[string]APIGroup) ([]GroupVersion, error) {
+	resolved := []GroupVersion{}
+	for _, groupVersion := range wanted {
+		apiGroup, found := served[groupVersion.Group]
+		if !found {
+			continue
+		}
+		if groupVersion.Version == "" {
+			resolved = append(resolved, GroupVersion{Group: groupVersion.Group, Version: apiGroup.PreferredVersion.Version})
+			continue
+		}
+		servesVersion := false
+		for _, version := range apiGroup.Versions {
+			servesVersion = servesVersion || version.Version == groupVersion.Version
+		}
+		if !servesVersion {
+			return nil, fmt.Errorf("%s is not served", groupVersion)
+		}
+		resolved = append(resolved, groupVersion)
+	}
+	if len(resolved) == 0 {
+		return nil, fmt.Errorf("none of %s are served, is terraform-operator installed?", describe(wanted))
+	}
+	return resolved, nil
+}
+
+// ResourceNameLabel is the label terraform-operator sets on the task pods of a resource in the group
+func ResourceNameLabel(group string) string {
+	return fmt.Sprintf("%s.%s/resourceName", Resource, group)
+}
+
+func describe(groupVersions []GroupVersion) string {
+	s := []string{}
+	for _, groupVersion := range groupVersions {
+		s = append(s, groupVersion.String())
+	}
+	return strings.Join(s, ", ")
+}
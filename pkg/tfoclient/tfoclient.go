@@ -0,0 +1,145 @@
+// Package tfoclient reads terraform-operator resources from the Kubernetes API. It uses the pod's service account
+// in the cluster and the kubeconfig outside of it, and finds the resources in whichever API group and version
+// terraform-operator serves.
+package tfoclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/galleybytes/monitor/pkg/tfapi"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// Resource is a Terraform resource. The spec is kept as JSON since it differs between the groups and versions.
+type Resource struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec json.RawMessage `json:"spec"`
+}
+
+// Client reads Terraform resources in the served groups in the order they are preferred
+type Client struct {
+	dynamicClient dynamic.Interface
+	resources     []schema.GroupVersionResource
+}
+
+// Config returns the in-cluster config when running in a pod and the kubeconfig, eg $KUBECONFIG, otherwise. The
+// in-cluster config reads the service account token from its file whenever the kubelet rotates it, so bound
+// service account tokens keep working past their expiry.
+func Config() (*rest.Config, error) {
+	config, err := rest.InClusterConfig()
+	if err == nil {
+		return config, nil
+	}
+	if err != rest.ErrNotInCluster {
+		return nil, err
+	}
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	config, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{}).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("not running in a cluster and no kubeconfig could be loaded: %s", err)
+	}
+	return config, nil
+}
+
+// New returns a client for the groups in MONITOR_API_GROUPS that are served
+func New(config *rest.Config) (*Client, error) {
+	wanted, err := tfapi.ParseGroups(os.Getenv("MONITOR_API_GROUPS"))
+	if err != nil {
+		return nil, fmt.Errorf("MONITOR_API_GROUPS is not valid: %s", err)
+	}
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	resources, err := Resources(discoveryClient, wanted)
+	if err != nil {
+		return nil, err
+	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{dynamicClient: dynamicClient, resources: resources}, nil
+}
+
+// NewFromEnv returns a client with Config
+func NewFromEnv() (*Client, error) {
+	config, err := Config()
+	if err != nil {
+		return nil, err
+	}
+	return New(config)
+}
+
+// Resources discovers which of the wanted groups are served and returns the Terraform resource of each in the
+// version to use, see tfapi.Resolve
+func Resources(client discovery.DiscoveryInterface, wanted []tfapi.GroupVersion) ([]schema.GroupVersionResource, error) {
+	apiGroupList, err := client.ServerGroups()
+	if err != nil {
+		return nil, fmt.Errorf("could not discover the API groups: %s", err)
+	}
+	served := map[string]tfapi.APIGroup{}
+	for _, apiGroup := range apiGroupList.Groups {
+		versions := []tfapi.VersionDiscovery{}
+		for _, version := range apiGroup.Versions {
+			versions = append(versions, tfapi.VersionDiscovery{GroupVersion: version.GroupVersion, Version: version.Version})
+		}
+		served[apiGroup.Name] = tfapi.APIGroup{
+			Name:     apiGroup.Name,
+			Versions: versions,
+			PreferredVersion: tfapi.VersionDiscovery{
+				GroupVersion: apiGroup.PreferredVersion.GroupVersion,
+				Version:      apiGroup.PreferredVersion.Version,
+			},
+		}
+	}
+	groupVersions, err := tfapi.Resolve(wanted, served)
+	if err != nil {
+		return nil, err
+	}
+	resources := []schema.GroupVersionResource{}
+	for _, groupVersion := range groupVersions {
+		resources = append(resources, schema.GroupVersionResource{Group: groupVersion.Group, Version: groupVersion.Version, Resource: tfapi.Resource})
+	}
+	return resources, nil
+}
+
+// Get returns the resource from the first group it is found in. The error is a Kubernetes API status error, so
+// errors.IsNotFound and errors.IsForbidden work on it, when the API server refused the request.
+func (c *Client) Get(ctx context.Context, namespace, name string) (*Resource, error) {
+	var notFound error
+	for _, resource := range c.resources {
+		u, err := c.dynamicClient.Resource(resource).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			notFound = err
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not get terraform '%s/%s' from %s: %w", namespace, name, resource.GroupVersion(), err)
+		}
+		b, err := u.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		r := Resource{}
+		if err := json.Unmarshal(b, &r); err != nil {
+			return nil, fmt.Errorf("terraform '%s/%s' from %s could not be read: %s", namespace, name, resource.GroupVersion(), err)
+		}
+		if len(r.Spec) == 0 {
+			r.Spec = json.RawMessage("{}")
+		}
+		return &r, nil
+	}
+	return nil, fmt.Errorf("terraform '%s/%s' was not found in any served group: %w", namespace, name, notFound)
+}
@@ -0,0 +1,157 @@
+package watch
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// auto forwards inotify events and on every interval reconciles the size of each watched file against the
+// offset that has been shipped. A file that grew without an event, or a file or directory that appeared without
+// one, is reported as if inotify had delivered it.
+type auto struct {
+	inotify  *inotify
+	interval time.Duration
+	offsets  *Offsets
+
+	mu       sync.Mutex
+	watched  map[string]bool
+	reported map[string]int64
+	dirs     map[string]bool
+
+	events chan Event
+	errors chan error
+	done   chan bool
+	once   sync.Once
+}
+
+func newAuto(interval time.Duration, offsets *Offsets) (*auto, error) {
+	inotify, err := newInotify()
+	if err != nil {
+		return nil, err
+	}
+	w := &auto{
+		inotify:  inotify,
+		interval: interval,
+		offsets:  offsets,
+		watched:  map[string]bool{},
+		reported: map[string]int64{},
+		dirs:     map[string]bool{},
+		events:   make(chan Event),
+		errors:   make(chan error),
+		done:     make(chan bool),
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *auto) Add(name string) error {
+	fileInfo, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	if err := w.inotify.Add(name); err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.watched[name] = fileInfo.IsDir()
+	return nil
+}
+
+func (w *auto) run() {
+	defer close(w.events)
+	defer close(w.errors)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case event, ok := <-w.inotify.Events():
+			if !ok {
+				return
+			}
+			if !w.send(event) {
+				return
+			}
+		case err, ok := <-w.inotify.Errors():
+			if !ok {
+				return
+			}
+			select {
+			case w.errors <- err:
+			case <-w.done:
+				return
+			}
+		case <-ticker.C:
+			for _, event := range w.reconcile() {
+				if !w.send(event) {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (w *auto) send(event Event) bool {
+	select {
+	case w.events <- event:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+// reconcile returns an event for every watched file whose size does not match its shipped offset. Tracked files
+// are reported on every interval until the consumer acknowledges their size with Offsets.Set, so a failed write
+// is retried even when the file does not grow. Each size of an untracked file is only reported once so files the
+// consumer chooses to ignore do not produce an event on every interval. A directory directly under a watched
+// directory, eg the directory of a new generation, is reported once when it is not watched itself.
+func (w *auto) reconcile() []Event {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	events := []Event{}
+	for name, isDir := range w.watched {
+		current, err := scan(name, isDir)
+		if err != nil {
+			continue
+		}
+		for file, state := range current {
+			if state.isDir {
+				if _, watched := w.watched[file]; !watched && !w.dirs[file] {
+					w.dirs[file] = true
+					events = append(events, Event{Name: file, Op: Create})
+				}
+				continue
+			}
+			offset, tracked := w.offsets.Get(file)
+			if tracked {
+				if offset != state.size {
+					events = append(events, Event{Name: file, Op: Write})
+				}
+				continue
+			}
+			if reported, found := w.reported[file]; found && reported == state.size {
+				continue
+			}
+			w.reported[file] = state.size
+			events = append(events, Event{Name: file, Op: Create})
+		}
+	}
+	return events
+}
+
+func (w *auto) Events() <-chan Event {
+	return w.events
+}
+
+func (w *auto) Errors() <-chan error {
+	return w.errors
+}
+
+func (w *auto) Close() error {
+	w.once.Do(func() { close(w.done) })
+	return w.inotify.Close()
+}
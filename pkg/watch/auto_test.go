@@ -0,0 +1,183 @@
+package watch
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// newTestAuto returns an auto watcher of dir without inotify or a ticker so reconcile can be called directly
+func newTestAuto(t *testing.T, dir string) *auto {
+	t.Helper()
+	return &auto{
+		offsets:  NewOffsets(),
+		watched:  map[string]bool{dir: true},
+		reported: map[string]int64{},
+		dirs:     map[string]bool{},
+	}
+}
+
+func writeFile(t *testing.T, file, content string) {
+	t.Helper()
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// ship acknowledges the file the way the monitor does after the sinks wrote it
+func ship(t *testing.T, w *auto, file string) {
+	t.Helper()
+	fileInfo, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.offsets.Set(file, fileInfo.Size())
+}
+
+func TestAutoReconcile(t *testing.T) {
+	type step struct {
+		do       func(t *testing.T, w *auto, dir string)
+		expected []Event
+	}
+	for _, test := range []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "growth",
+			steps: []step{
+				{
+					do:       func(t *testing.T, w *auto, dir string) { writeFile(t, filepath.Join(dir, "plan.out"), "line 1\n") },
+					expected: []Event{{Name: "plan.out", Op: Create}},
+				},
+				{
+					do: func(t *testing.T, w *auto, dir string) { ship(t, w, filepath.Join(dir, "plan.out")) },
+				},
+				{
+					do: func(t *testing.T, w *auto, dir string) {
+						writeFile(t, filepath.Join(dir, "plan.out"), "line 1\nline 2\n")
+					},
+					expected: []Event{{Name: "plan.out", Op: Write}},
+				},
+				{
+					do: func(t *testing.T, w *auto, dir string) { ship(t, w, filepath.Join(dir, "plan.out")) },
+				},
+			},
+		},
+		{
+			name: "truncation",
+			steps: []step{
+				{
+					do: func(t *testing.T, w *auto, dir string) {
+						writeFile(t, filepath.Join(dir, "plan.out"), "line 1\nline 2\n")
+						ship(t, w, filepath.Join(dir, "plan.out"))
+					},
+				},
+				{
+					do:       func(t *testing.T, w *auto, dir string) { writeFile(t, filepath.Join(dir, "plan.out"), "line 1\n") },
+					expected: []Event{{Name: "plan.out", Op: Write}},
+				},
+				{
+					do: func(t *testing.T, w *auto, dir string) { ship(t, w, filepath.Join(dir, "plan.out")) },
+				},
+			},
+		},
+		{
+			name: "rotation",
+			steps: []step{
+				{
+					do: func(t *testing.T, w *auto, dir string) {
+						writeFile(t, filepath.Join(dir, "plan.out"), "line 1\nline 2\n")
+						ship(t, w, filepath.Join(dir, "plan.out"))
+					},
+				},
+				{
+					do: func(t *testing.T, w *auto, dir string) {
+						if err := os.Rename(filepath.Join(dir, "plan.out"), filepath.Join(dir, "plan.out.1")); err != nil {
+							t.Fatal(err)
+						}
+						writeFile(t, filepath.Join(dir, "plan.out"), "line 3\n")
+					},
+					expected: []Event{{Name: "plan.out", Op: Write}, {Name: "plan.out.1", Op: Create}},
+				},
+				{
+					// The rotated file is not tracked by the consumer so it is only reported once
+					do:       func(t *testing.T, w *auto, dir string) { ship(t, w, filepath.Join(dir, "plan.out")) },
+					expected: []Event{},
+				},
+			},
+		},
+		{
+			name: "retry after a failed write",
+			steps: []step{
+				{
+					do: func(t *testing.T, w *auto, dir string) {
+						writeFile(t, filepath.Join(dir, "plan.out"), "line 1\n")
+						w.offsets.Track(filepath.Join(dir, "plan.out"))
+					},
+					expected: []Event{{Name: "plan.out", Op: Write}},
+				},
+				{
+					// The write failed so the file is reported again although it did not grow
+					do:       func(t *testing.T, w *auto, dir string) {},
+					expected: []Event{{Name: "plan.out", Op: Write}},
+				},
+				{
+					do: func(t *testing.T, w *auto, dir string) { ship(t, w, filepath.Join(dir, "plan.out")) },
+				},
+			},
+		},
+		{
+			name: "new directory",
+			steps: []step{
+				{
+					do: func(t *testing.T, w *auto, dir string) {
+						if err := os.Mkdir(filepath.Join(dir, "2"), 0755); err != nil {
+							t.Fatal(err)
+						}
+					},
+					expected: []Event{{Name: "2", Op: Create}},
+				},
+				{
+					// The directory is only reported once whether or not the consumer watches it
+					do: func(t *testing.T, w *auto, dir string) {},
+				},
+			},
+		},
+		{
+			name: "ignored file",
+			steps: []step{
+				{
+					do:       func(t *testing.T, w *auto, dir string) { writeFile(t, filepath.Join(dir, "approval.txt"), "") },
+					expected: []Event{{Name: "approval.txt", Op: Create}},
+				},
+				{
+					do: func(t *testing.T, w *auto, dir string) {},
+				},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			w := newTestAuto(t, dir)
+			for i, step := range test.steps {
+				step.do(t, w, dir)
+				got := w.reconcile()
+				for j := range got {
+					got[j].Name, _ = filepath.Rel(dir, got[j].Name)
+				}
+				sort.Slice(got, func(a, b int) bool { return got[a].Name < got[b].Name })
+				if len(got) != len(step.expected) {
+					t.Fatalf("step %d: expected the events %v, got %v", i, step.expected, got)
+				}
+				for j := range got {
+					if got[j] != step.expected[j] {
+						t.Errorf("step %d: expected the events %v, got %v", i, step.expected, got)
+						break
+					}
+				}
+			}
+		})
+	}
+}
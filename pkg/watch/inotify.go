@@ -0,0 +1,75 @@
+package watch
+
+import (
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+type inotify struct {
+	watcher *fsnotify.Watcher
+	events  chan Event
+	errors  chan error
+	done    chan bool
+	once    sync.Once
+}
+
+func newInotify() (*inotify, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	w := &inotify{
+		watcher: watcher,
+		events:  make(chan Event),
+		errors:  make(chan error),
+		done:    make(chan bool),
+	}
+	go w.run()
+	return w, nil
+}
+
+// run translates fsnotify events until the underlying watcher is closed
+func (w *inotify) run() {
+	defer close(w.events)
+	defer close(w.errors)
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			select {
+			case w.events <- Event{Name: event.Name, Op: Op(event.Op)}:
+			case <-w.done:
+				return
+			}
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			select {
+			case w.errors <- err:
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
+
+func (w *inotify) Add(name string) error {
+	return w.watcher.Add(name)
+}
+
+func (w *inotify) Events() <-chan Event {
+	return w.events
+}
+
+func (w *inotify) Errors() <-chan error {
+	return w.errors
+}
+
+func (w *inotify) Close() error {
+	w.once.Do(func() { close(w.done) })
+	return w.watcher.Close()
+}
@@ -0,0 +1,176 @@
+package watch
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type fileState struct {
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+// poller is a stat based Watcher. Every interval it lists the watched directories and stats the watched files,
+// then compares the results with the previous scan.
+type poller struct {
+	interval time.Duration
+
+	mu      sync.Mutex
+	watched map[string]bool
+	states  map[string]fileState
+
+	events chan Event
+	errors chan error
+	done   chan bool
+	once   sync.Once
+}
+
+func newPoller(interval time.Duration) *poller {
+	w := &poller{
+		interval: interval,
+		watched:  map[string]bool{},
+		states:   map[string]fileState{},
+		events:   make(chan Event),
+		errors:   make(chan error),
+		done:     make(chan bool),
+	}
+	go w.run()
+	return w
+}
+
+func (w *poller) Add(name string) error {
+	fileInfo, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.watched[name] = fileInfo.IsDir()
+
+	// Take a snapshot so files that already exist are not reported as created
+	current, err := scan(name, fileInfo.IsDir())
+	if err != nil {
+		return err
+	}
+	for file, state := range current {
+		w.states[file] = state
+	}
+	return nil
+}
+
+func (w *poller) run() {
+	defer close(w.events)
+	defer close(w.errors)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			events, errs := w.poll()
+			for _, err := range errs {
+				select {
+				case w.errors <- err:
+				case <-w.done:
+					return
+				}
+			}
+			for _, event := range events {
+				select {
+				case w.events <- event:
+				case <-w.done:
+					return
+				}
+			}
+		}
+	}
+}
+
+// poll scans every watched path and returns the changes since the previous poll
+func (w *poller) poll() ([]Event, []error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	events := []Event{}
+	errs := []error{}
+	seen := map[string]bool{}
+	for name, isDir := range w.watched {
+		current, err := scan(name, isDir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			errs = append(errs, err)
+			continue
+		}
+		for file, state := range current {
+			seen[file] = true
+			previous, found := w.states[file]
+			w.states[file] = state
+			if !found {
+				events = append(events, Event{Name: file, Op: Create})
+				continue
+			}
+			if state.isDir {
+				continue
+			}
+			if state.size != previous.size || !state.modTime.Equal(previous.modTime) {
+				events = append(events, Event{Name: file, Op: Write})
+			}
+		}
+	}
+
+	for file := range w.states {
+		if !seen[file] {
+			delete(w.states, file)
+			events = append(events, Event{Name: file, Op: Remove})
+		}
+	}
+	return events, errs
+}
+
+// scan returns the state of a single file, or of every entry directly under a directory
+func scan(name string, isDir bool) (map[string]fileState, error) {
+	states := map[string]fileState{}
+	if !isDir {
+		fileInfo, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		states[name] = fileState{size: fileInfo.Size(), modTime: fileInfo.ModTime(), isDir: fileInfo.IsDir()}
+		return states, nil
+	}
+
+	entries, err := os.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		fileInfo, err := entry.Info()
+		if err != nil {
+			// The file was removed between listing and stat
+			continue
+		}
+		file := filepath.Join(name, entry.Name())
+		states[file] = fileState{size: fileInfo.Size(), modTime: fileInfo.ModTime(), isDir: fileInfo.IsDir()}
+	}
+	return states, nil
+}
+
+func (w *poller) Events() <-chan Event {
+	return w.events
+}
+
+func (w *poller) Errors() <-chan error {
+	return w.errors
+}
+
+func (w *poller) Close() error {
+	w.once.Do(func() { close(w.done) })
+	return nil
+}
@@ -0,0 +1,218 @@
+package watch
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// newTestPoller returns a poller of dir without a ticker so poll can be called directly
+func newTestPoller(t *testing.T, dir string) *poller {
+	t.Helper()
+	w := &poller{
+		watched: map[string]bool{},
+		states:  map[string]fileState{},
+	}
+	if err := w.Add(dir); err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func mkdir(t *testing.T, dir string) {
+	t.Helper()
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoll(t *testing.T) {
+	type step struct {
+		do       func(t *testing.T, w *poller, dir string)
+		expected []Event
+	}
+	for _, test := range []struct {
+		name     string
+		existing []string
+		steps    []step
+	}{
+		{
+			name: "create",
+			steps: []step{
+				{
+					do:       func(t *testing.T, w *poller, dir string) { writeFile(t, filepath.Join(dir, "plan.out"), "line 1\n") },
+					expected: []Event{{Name: "plan.out", Op: Create}},
+				},
+				{
+					// A file that did not change is not reported again
+					do: func(t *testing.T, w *poller, dir string) {},
+				},
+			},
+		},
+		{
+			name:     "existing file",
+			existing: []string{"plan.out"},
+			steps: []step{
+				{
+					// Files that were there when the directory was added are not reported as created
+					do: func(t *testing.T, w *poller, dir string) {},
+				},
+			},
+		},
+		{
+			name:     "write",
+			existing: []string{"plan.out"},
+			steps: []step{
+				{
+					do: func(t *testing.T, w *poller, dir string) {
+						writeFile(t, filepath.Join(dir, "plan.out"), "line 1\nline 2\n")
+					},
+					expected: []Event{{Name: "plan.out", Op: Write}},
+				},
+				{
+					do: func(t *testing.T, w *poller, dir string) {},
+				},
+			},
+		},
+		{
+			name:     "remove",
+			existing: []string{"plan.out"},
+			steps: []step{
+				{
+					do: func(t *testing.T, w *poller, dir string) {
+						if err := os.Remove(filepath.Join(dir, "plan.out")); err != nil {
+							t.Fatal(err)
+						}
+					},
+					expected: []Event{{Name: "plan.out", Op: Remove}},
+				},
+				{
+					do: func(t *testing.T, w *poller, dir string) {},
+				},
+			},
+		},
+		{
+			name:     "rename",
+			existing: []string{"plan.out"},
+			steps: []step{
+				{
+					do: func(t *testing.T, w *poller, dir string) {
+						if err := os.Rename(filepath.Join(dir, "plan.out"), filepath.Join(dir, "plan.out.1")); err != nil {
+							t.Fatal(err)
+						}
+					},
+					expected: []Event{{Name: "plan.out", Op: Remove}, {Name: "plan.out.1", Op: Create}},
+				},
+			},
+		},
+		{
+			name: "new subdirectory",
+			steps: []step{
+				{
+					do:       func(t *testing.T, w *poller, dir string) { mkdir(t, filepath.Join(dir, "2")) },
+					expected: []Event{{Name: "2", Op: Create}},
+				},
+				{
+					// Only the entries directly under a watched directory are reported, and a directory is not
+					// reported as written when its entries change
+					do: func(t *testing.T, w *poller, dir string) {
+						writeFile(t, filepath.Join(dir, "2", "plan.out"), "line 1\n")
+					},
+				},
+				{
+					// The consumer watches the new directory, which takes a snapshot of it
+					do: func(t *testing.T, w *poller, dir string) {
+						if err := w.Add(filepath.Join(dir, "2")); err != nil {
+							t.Fatal(err)
+						}
+					},
+				},
+				{
+					do: func(t *testing.T, w *poller, dir string) {
+						writeFile(t, filepath.Join(dir, "2", "plan.out"), "line 1\nline 2\n")
+						writeFile(t, filepath.Join(dir, "2", "apply.out"), "line 1\n")
+					},
+					expected: []Event{{Name: "2/apply.out", Op: Create}, {Name: "2/plan.out", Op: Write}},
+				},
+			},
+		},
+		{
+			name: "removed subdirectory",
+			steps: []step{
+				{
+					do: func(t *testing.T, w *poller, dir string) {
+						mkdir(t, filepath.Join(dir, "2"))
+						writeFile(t, filepath.Join(dir, "2", "plan.out"), "line 1\n")
+						if err := w.Add(filepath.Join(dir, "2")); err != nil {
+							t.Fatal(err)
+						}
+					},
+					expected: []Event{{Name: "2", Op: Create}},
+				},
+				{
+					// A watched directory that is gone is not an error, its entries are reported as removed
+					do: func(t *testing.T, w *poller, dir string) {
+						if err := os.RemoveAll(filepath.Join(dir, "2")); err != nil {
+							t.Fatal(err)
+						}
+					},
+					expected: []Event{{Name: "2", Op: Remove}, {Name: "2/plan.out", Op: Remove}},
+				},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, file := range test.existing {
+				writeFile(t, filepath.Join(dir, file), "line 1\n")
+			}
+			w := newTestPoller(t, dir)
+			for i, step := range test.steps {
+				step.do(t, w, dir)
+				got, errs := w.poll()
+				if len(errs) != 0 {
+					t.Fatalf("step %d: poll returned the errors %v", i, errs)
+				}
+				for j := range got {
+					got[j].Name, _ = filepath.Rel(dir, got[j].Name)
+				}
+				sort.Slice(got, func(a, b int) bool { return got[a].Name < got[b].Name })
+				if len(got) != len(step.expected) {
+					t.Fatalf("step %d: expected the events %v, got %v", i, step.expected, got)
+				}
+				for j := range got {
+					if got[j] != step.expected[j] {
+						t.Errorf("step %d: expected the events %v, got %v", i, step.expected, got)
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPollerSendsEvents(t *testing.T) {
+	dir := t.TempDir()
+	w := newPoller(10 * time.Millisecond)
+	if err := w.Add(dir); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "plan.out"), "line 1\n")
+
+	select {
+	case event := <-w.Events():
+		if expected := (Event{Name: filepath.Join(dir, "plan.out"), Op: Create}); event != expected {
+			t.Errorf("expected the event %v, got %v", expected, event)
+		}
+	case err := <-w.Errors():
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event was sent")
+	}
+
+	w.Close()
+	for range w.Events() {
+	}
+}
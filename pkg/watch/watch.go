@@ -0,0 +1,121 @@
+package watch
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Op describes a set of file operations. The values mirror fsnotify so that events coming from either
+// implementation can be handled the same way.
+type Op uint32
+
+const (
+	Create Op = 1 << iota
+	Write
+	Remove
+	Rename
+	Chmod
+)
+
+func (op Op) String() string {
+	names := []string{}
+	if op&Create == Create {
+		names = append(names, "CREATE")
+	}
+	if op&Write == Write {
+		names = append(names, "WRITE")
+	}
+	if op&Remove == Remove {
+		names = append(names, "REMOVE")
+	}
+	if op&Rename == Rename {
+		names = append(names, "RENAME")
+	}
+	if op&Chmod == Chmod {
+		names = append(names, "CHMOD")
+	}
+	return strings.Join(names, "|")
+}
+
+// Event is a file change reported by a Watcher
+type Event struct {
+	Name string
+	Op   Op
+}
+
+// Watcher reports changes to files and directories. Adding a directory watches the entries directly under it.
+type Watcher interface {
+	Add(name string) error
+	Events() <-chan Event
+	Errors() <-chan error
+	Close() error
+}
+
+type Mode string
+
+const (
+	// ModeInotify relies entirely on kernel notifications
+	ModeInotify Mode = "inotify"
+
+	// ModePoll stats every watched file on an interval. Use this when TFO_ROOT_PATH lives on a volume that does
+	// not deliver inotify events, like NFS or some CSI drivers.
+	ModePoll Mode = "poll"
+
+	// ModeAuto uses inotify but periodically compares file sizes against the shipped offsets to catch any
+	// events that were never delivered.
+	ModeAuto Mode = "auto"
+)
+
+// New returns the Watcher for the given mode. The offsets are only used by ModeAuto and may be nil otherwise.
+func New(mode Mode, interval time.Duration, offsets *Offsets) (Watcher, error) {
+	switch mode {
+	case ModeInotify, "":
+		return newInotify()
+	case ModePoll:
+		return newPoller(interval), nil
+	case ModeAuto:
+		if offsets == nil {
+			offsets = NewOffsets()
+		}
+		return newAuto(interval, offsets)
+	default:
+		return nil, fmt.Errorf("unknown watcher mode '%s'", mode)
+	}
+}
+
+// Offsets keeps track of how many bytes of each file have been shipped
+type Offsets struct {
+	mu      sync.Mutex
+	offsets map[string]int64
+}
+
+func NewOffsets() *Offsets {
+	return &Offsets{offsets: map[string]int64{}}
+}
+
+// Set records that the file has been shipped up to offset
+func (o *Offsets) Set(name string, offset int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.offsets[name] = offset
+}
+
+// Track records that the consumer is shipping the file before any of it has been shipped. The auto watcher keeps
+// reporting a tracked file until its offset matches its size, so a failed first write is retried as well.
+func (o *Offsets) Track(name string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, found := o.offsets[name]; !found {
+		o.offsets[name] = 0
+	}
+}
+
+// Get returns the shipped offset of the file and whether the file is tracked at all
+func (o *Offsets) Get(name string) (int64, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	offset, found := o.offsets[name]
+	return offset, found
+}
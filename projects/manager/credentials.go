@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/galleybytes/monitor/pkg/access"
+	"github.com/galleybytes/monitor/pkg/database"
+	"github.com/galleybytes/monitor/pkg/handlers"
+	gocache "github.com/patrickmn/go-cache"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// credentials are what the manager distributes to the namespace of each resource in the <name>-monitor-envs
+// ConfigMap and Secret
+//
+// With MONITOR_CREDENTIALS=token (the default) the monitors use the api backend and exchange their service account
+// token with the manager for a short lived token scoped to their resource, so no credentials leave the manager's
+// namespace. The API verifies the tokens with access.Verifier. The exchange is only served over TLS, the monitors
+// verify the manager with the CA of the webhook certificate in MONITOR_MANAGER_CA.
+//
+// MONITOR_CREDENTIALS=database is opt-in for clusters without the API. The monitors write to the database as the
+// role in MONITOR_DB_MONITOR_USER and MONITOR_DB_MONITOR_PASSWORD, which must not be the PGUSER of the manager, so
+// the password of the manager is never copied into the namespaces.
+type credentials struct {
+	mode          string
+	configMapData map[string]string
+
+	// secretData is nil when nothing secret is distributed. Secrets distributed earlier are deleted.
+	secretData map[string][]byte
+}
+
+func credentialsFromEnv(clusterName, certDir string) credentials {
+	switch mode := envOrPanic("MONITOR_CREDENTIALS", "token"); mode {
+	case "token":
+		if certDir == "" {
+			log.Fatal("MONITOR_CREDENTIALS=token requires MONITOR_WEBHOOK_CERT_DIR, tokens are not handed out over plain HTTP")
+		}
+		managerCA, err := os.ReadFile(filepath.Join(certDir, "ca.crt"))
+		if err != nil {
+			log.Fatal("Could not read the CA the monitors verify the manager with: ", err)
+		}
+		return credentials{
+			mode: mode,
+			configMapData: map[string]string{
+				"CLUSTER_NAME":                 clusterName,
+				"MONITOR_BACKEND":              "api",
+				"MONITOR_MANAGER_SERVICE_HOST": envOrPanic("MONITOR_MANAGER_SERVICE_HOST", "https://monitor-manager.tf-system.svc"),
+				"MONITOR_MANAGER_CA":           string(managerCA),
+			},
+		}
+	case "database":
+		monitorUser := envOrPanic("MONITOR_DB_MONITOR_USER")
+		if monitorUser == envOrPanic("PGUSER") {
+			log.Fatal("MONITOR_DB_MONITOR_USER cannot be the PGUSER of the manager, its password would be copied into every namespace")
+		}
+		log.Println("WARNING: MONITOR_CREDENTIALS=database copies the password of MONITOR_DB_MONITOR_USER into the " +
+			"namespace of every resource. Anyone who can read Secrets in those namespaces can write as that role.")
+		return credentials{
+			mode: mode,
+			configMapData: map[string]string{
+				"CLUSTER_NAME":    clusterName,
+				"MONITOR_BACKEND": "database",
+				"DBHOST":          envOrPanic("DBHOST"),
+				"PGPORT":          envOrPanic("PGPORT", "5432"),
+				"PGUSER":          monitorUser,
+				"PGDATABASE":      envOrPanic("PGDATABASE"),
+			},
+			secretData: map[string][]byte{
+				"PGPASSWORD": []byte(envOrPanic("MONITOR_DB_MONITOR_PASSWORD")),
+			},
+		}
+	default:
+		log.Fatalf("unknown MONITOR_CREDENTIALS '%s', use token or database", mode)
+	}
+	return credentials{}
+}
+
+// specRedactSecret holds the MONITOR_SPEC_REDACT_KEY in the manager's namespace under "key"
+const specRedactSecret = "monitor-manager-spec-redact"
+
+// ensureSpecRedactKey returns MONITOR_SPEC_REDACT_KEY, or the key of the specRedactSecret in the namespace when it
+// is not set. The Secret is created with a random key on the first start, so the specs are always redacted with a
+// key that stays the same across restarts and replicas.
+func ensureSpecRedactKey(client kubernetes.Interface, namespace string) (string, error) {
+	if key := os.Getenv("MONITOR_SPEC_REDACT_KEY"); key != "" {
+		return key, nil
+	}
+	ctx := context.TODO()
+	secretClient := client.CoreV1().Secrets(namespace)
+	secret, err := secretClient.Get(ctx, specRedactSecret, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		labels, _ := withManagedLabels(nil)
+		secret, err = secretClient.Create(ctx, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: specRedactSecret, Labels: labels},
+			Data:       map[string][]byte{"key": []byte(hex.EncodeToString(b))},
+		}, metav1.CreateOptions{})
+		if errors.IsAlreadyExists(err) {
+			// Another replica created it first
+			secret, err = secretClient.Get(ctx, specRedactSecret, metav1.GetOptions{})
+		} else if err == nil {
+			log.Printf("Created the spec redaction key in secret '%s/%s'\n", namespace, specRedactSecret)
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not get the spec redaction key from secret '%s/%s': %s", namespace, specRedactSecret, err)
+	}
+	key := string(secret.Data["key"])
+	if key == "" {
+		return "", fmt.Errorf("secret '%s/%s' has no key", namespace, specRedactSecret)
+	}
+	return key, nil
+}
+
+// applySecret creates or updates the Secret, or deletes the Secret distributed by an earlier version when there
+// is nothing secret to distribute. It returns what it changed like createOrUpdateSecret.
+func (c credentials) applySecret(client kubernetes.Interface, resourceName, namespace string, ownerReference metav1.OwnerReference) (string, error) {
+	if c.secretData != nil {
+		return createOrUpdateSecret(client, resourceName, namespace, c.secretData, ownerReference)
+	}
+	name := fmt.Sprintf("%s-monitor-envs", resourceName)
+	err := client.CoreV1().Secrets(namespace).Delete(context.TODO(), name, metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return "", err
+	}
+	if err != nil {
+		return "", nil
+	}
+	log.Printf("...deleted secret '%s/%s'\n", namespace, name)
+	return "deleted", nil
+}
+
+// newBackend is where the manager registers resources. MONITOR_BACKEND is "database" (the default) or "api" to
+// use the API at TFO_API_HOST with TFO_API_TOKEN. The schema of the database belongs to the API, the manager
+// only migrates it with MONITOR_DB_AUTO_MIGRATE=true, eg for clusters without the API.
+func newBackend() (handlers.Backend, error) {
+	cache := gocache.New(gocache.NoExpiration, gocache.NoExpiration)
+	switch backend := envOrPanic("MONITOR_BACKEND", "database"); backend {
+	case "api":
+		return handlers.NewWithToken(envOrPanic("TFO_API_HOST"), envOrPanic("TFO_API_TOKEN"), cache).NegotiateSchemaVersion()
+	case "database":
+	default:
+		return nil, fmt.Errorf("unknown backend '%s'", backend)
+	}
+	dsn, err := database.DSNFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return database.New(dsn, os.Getenv("MONITOR_DB_AUTO_MIGRATE") == "true", cache)
+}
+
+// tokenAudience is the audience of the projected service account token the webhook mounts into the monitor
+func tokenAudience() string {
+	return envOrPanic("MONITOR_TOKEN_AUDIENCE", "monitor-manager")
+}
+
+// tokenReviewer authenticates service account tokens with the TokenReview API
+func tokenReviewer(client kubernetes.Interface, audience string) access.Reviewer {
+	return func(token string) (string, error) {
+		review, err := client.AuthenticationV1().TokenReviews().Create(context.TODO(), &authenticationv1.TokenReview{
+			Spec: authenticationv1.TokenReviewSpec{Token: token, Audiences: []string{audience}},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			return "", err
+		}
+		if !review.Status.Authenticated {
+			return "", fmt.Errorf("token was not authenticated: %s", review.Status.Error)
+		}
+		// Service accounts are named system:serviceaccount:<namespace>:<name>
+		parts := strings.Split(review.Status.User.Username, ":")
+		if len(parts) != 4 || parts[0] != "system" || parts[1] != "serviceaccount" {
+			return "", fmt.Errorf("%s is not a service account", review.Status.User.Username)
+		}
+		return parts[2], nil
+	}
+}
+
+// newExchanger hands out tokens for TFO_API_HOST signed with MONITOR_TOKEN_SIGNING_KEY, which the API verifies
+// the tokens with using an access.Verifier. Tokens expire after MONITOR_TOKEN_TTL.
+func newExchanger(client kubernetes.Interface, r *registry, clusterName string) access.Exchanger {
+	ttl, err := time.ParseDuration(envOrPanic("MONITOR_TOKEN_TTL", "1h"))
+	if err != nil {
+		log.Fatal("MONITOR_TOKEN_TTL is not a valid duration: ", err)
+	}
+	return access.Exchanger{
+		Host:        envOrPanic("TFO_API_HOST"),
+		Key:         []byte(envOrPanic("MONITOR_TOKEN_SIGNING_KEY")),
+		TTL:         ttl,
+		ClusterName: clusterName,
+		Backend:     r.backend,
+		Review:      tokenReviewer(client, tokenAudience()),
+	}
+}
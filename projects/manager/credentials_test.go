@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestEnsureSpecRedactKey(t *testing.T) {
+	t.Setenv("MONITOR_SPEC_REDACT_KEY", "")
+	client := fake.NewSimpleClientset()
+
+	key, err := ensureSpecRedactKey(client, "tf-system")
+	if err != nil {
+		t.Fatalf("ensureSpecRedactKey() error = %v", err)
+	}
+	if len(key) != 64 {
+		t.Errorf("ensureSpecRedactKey() = %q, want 32 random bytes in hex", key)
+	}
+	secret, err := client.CoreV1().Secrets("tf-system").Get(context.TODO(), specRedactSecret, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("the secret was not created: %v", err)
+	}
+	if string(secret.Data["key"]) != key {
+		t.Errorf("the secret holds %q, want %q", secret.Data["key"], key)
+	}
+
+	// A restart reads the key it created
+	if again, err := ensureSpecRedactKey(client, "tf-system"); err != nil || again != key {
+		t.Errorf("ensureSpecRedactKey() after a restart = %q, %v, want %q", again, err, key)
+	}
+
+	t.Setenv("MONITOR_SPEC_REDACT_KEY", "from-env")
+	if key, err := ensureSpecRedactKey(client, "tf-system"); err != nil || key != "from-env" {
+		t.Errorf("ensureSpecRedactKey() = %q, %v, want MONITOR_SPEC_REDACT_KEY", key, err)
+	}
+}
+
+func TestEnsureSpecRedactKeyWithoutKey(t *testing.T) {
+	t.Setenv("MONITOR_SPEC_REDACT_KEY", "")
+	client := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: specRedactSecret, Namespace: "tf-system"},
+		Data:       map[string][]byte{"other": []byte("value")},
+	})
+	if _, err := ensureSpecRedactKey(client, "tf-system"); err == nil {
+		t.Error("ensureSpecRedactKey() returned no error for a secret without a key")
+	}
+}
+
+func TestCredentialsFromEnv(t *testing.T) {
+	for name, value := range map[string]string{
+		"MONITOR_CREDENTIALS":         "",
+		"MONITOR_SPEC_REDACT_KEY":     "key",
+		"DBHOST":                      "database",
+		"PGUSER":                      "pg",
+		"PGPASSWORD":                  "pass",
+		"PGDATABASE":                  "crud",
+		"MONITOR_DB_MONITOR_USER":     "monitor",
+		"MONITOR_DB_MONITOR_PASSWORD": "monitor-pass",
+	} {
+		t.Setenv(name, value)
+	}
+	certDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(certDir, "ca.crt"), []byte("ca"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing secret is distributed with tokens, the default, so the Secret of earlier versions is deleted
+	c := credentialsFromEnv("test-cluster", certDir)
+	if c.mode != "token" || c.configMapData["MONITOR_MANAGER_CA"] != "ca" || c.secretData != nil {
+		t.Errorf("expected the token credentials without a Secret by default, got %+v", c)
+	}
+
+	// The database credentials are those of the monitor role, never the password of the manager
+	t.Setenv("MONITOR_CREDENTIALS", "database")
+	c = credentialsFromEnv("test-cluster", certDir)
+	if c.mode != "database" || c.configMapData["MONITOR_BACKEND"] != "database" || c.configMapData["PGUSER"] != "monitor" ||
+		string(c.secretData["PGPASSWORD"]) != "monitor-pass" {
+		t.Errorf("expected the credentials of the monitor role, got %+v", c)
+	}
+	if _, found := c.secretData["MONITOR_SPEC_REDACT_KEY"]; found {
+		t.Error("the spec redaction key is distributed to the namespaces")
+	}
+}
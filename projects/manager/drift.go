@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+// driftResync is how often every ConfigMap and Secret is compared again, which also catches drift missed while
+// the manager was not the leader
+const driftResync = 10 * time.Minute
+
+// reconciler repairs the <name>-monitor-envs ConfigMaps and Secrets when they are edited or deleted by someone
+// else, and records an Event on the resource with what it fixed
+type reconciler struct {
+	client             kubernetes.Interface
+	dynamicClient      dynamic.Interface
+	terraformResources terraformResources
+	scope              scope
+	credentials        credentials
+	recorder           record.EventRecorder
+}
+
+func newReconciler(client kubernetes.Interface, dynamicClient dynamic.Interface, terraformResources terraformResources, s scope, c credentials) *reconciler {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return &reconciler{
+		client:             client,
+		dynamicClient:      dynamicClient,
+		terraformResources: terraformResources,
+		scope:              s,
+		credentials:        c,
+		recorder:           broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "monitor-manager"}),
+	}
+}
+
+// start watches the ConfigMaps and Secrets with managedLabels in the watched namespaces until stopCh is closed
+func (r *reconciler) start(stopCh <-chan struct{}) {
+	selectManaged := func(options *metav1.ListOptions) {
+		options.LabelSelector = labels.SelectorFromSet(managedLabels).String()
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(old, new interface{}) {
+			r.reconcile(new)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			r.reconcile(obj)
+		},
+	}
+	for _, namespace := range r.scope.watchedNamespaces() {
+		factory := informers.NewSharedInformerFactoryWithOptions(r.client, driftResync,
+			informers.WithNamespace(namespace), informers.WithTweakListOptions(selectManaged))
+		factory.Core().V1().ConfigMaps().Informer().AddEventHandler(handler)
+		factory.Core().V1().Secrets().Informer().AddEventHandler(handler)
+		factory.Start(stopCh)
+	}
+}
+
+// reconcile applies the desired state for the resource that owns the ConfigMap or Secret
+func (r *reconciler) reconcile(obj interface{}) {
+	object, ok := obj.(metav1.Object)
+	if !ok {
+		return
+	}
+	owner := metav1.GetControllerOf(object)
+	if owner == nil || owner.Kind != "Terraform" || !r.scope.includes(object.GetNamespace()) {
+		return
+	}
+	terraformResource, found := r.terraformResources.forAPIVersion(owner.APIVersion)
+	if !found {
+		return
+	}
+	if err := r.repair(terraformResource, object.GetNamespace(), owner.Name, owner.UID); err != nil {
+		log.Println("ERROR in drift repair", err)
+	}
+}
+
+// repair writes the ConfigMap and Secret of the resource and records an Event when anything had drifted
+func (r *reconciler) repair(terraformResource schema.GroupVersionResource, namespace, name string, uid types.UID) error {
+	u, err := r.dynamicClient.Resource(terraformResource).Namespace(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		// The garbage collector deletes the ConfigMap and Secret of deleted resources
+		return nil
+	} else if err != nil {
+		return err
+	}
+	tf, err := decodeTerraform(u.Object)
+	if err != nil {
+		return err
+	}
+	if tf.UID != uid || tf.DeletionTimestamp != nil || !r.scope.selects(tf.Namespace, tf.Labels) {
+		return nil
+	}
+
+	ownerReference := terraformOwnerReference(tf)
+	fixes := []string{}
+	configMapChange, err := createOrUpdateConfigMap(r.client, tf.Name, tf.Namespace, r.credentials.configMapData, ownerReference)
+	if err != nil {
+		return err
+	}
+	if configMapChange != "" {
+		fixes = append(fixes, fmt.Sprintf("configmap %s-monitor-envs %s", tf.Name, configMapChange))
+	}
+	secretChange, err := r.credentials.applySecret(r.client, tf.Name, tf.Namespace, ownerReference)
+	if err != nil {
+		return err
+	}
+	if secretChange != "" {
+		fixes = append(fixes, fmt.Sprintf("secret %s-monitor-envs %s", tf.Name, secretChange))
+	}
+	if len(fixes) == 0 {
+		return nil
+	}
+
+	message := "Repaired drift: " + strings.Join(fixes, "; ")
+	log.Printf("%s/%s: %s\n", tf.Namespace, tf.Name, message)
+	r.recorder.Event(&corev1.ObjectReference{
+		APIVersion:      ownerReference.APIVersion,
+		Kind:            ownerReference.Kind,
+		Namespace:       tf.Namespace,
+		Name:            tf.Name,
+		UID:             tf.UID,
+		ResourceVersion: tf.ResourceVersion,
+	}, corev1.EventTypeNormal, "MonitorEnvsRepaired", message)
+	return nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+var testTerraformResource = schema.GroupVersionResource{Group: "tf.galleybytes.com", Version: "v1beta1", Resource: "terraforms"}
+
+// testTerraform is a Terraform resource named example in the default namespace as the dynamic client returns it
+func testTerraform(uid string, generation int64) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": testTerraformResource.GroupVersion().String(),
+		"kind":       "Terraform",
+		"metadata": map[string]interface{}{
+			"name":       "example",
+			"namespace":  "default",
+			"uid":        uid,
+			"generation": generation,
+		},
+		"spec": map[string]interface{}{},
+	}}
+}
+
+func newTestDynamicClient(objects ...runtime.Object) *dynamicfake.FakeDynamicClient {
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{testTerraformResource: "TerraformList"}, objects...)
+}
+
+func testCredentials() credentials {
+	return credentials{
+		mode:          "database",
+		configMapData: map[string]string{"CLUSTER_NAME": "test-cluster", "MONITOR_BACKEND": "database"},
+		secretData:    map[string][]byte{"PGPASSWORD": []byte("password")},
+	}
+}
+
+func testOwnerReference(uid string) metav1.OwnerReference {
+	tf, _ := decodeTerraform(testTerraform(uid, 1).Object)
+	return terraformOwnerReference(tf)
+}
+
+func testConfigMap(uid string, data map[string]string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "example-monitor-envs",
+			Namespace:       "default",
+			Labels:          managedLabels,
+			OwnerReferences: []metav1.OwnerReference{testOwnerReference(uid)},
+		},
+		Data: data,
+	}
+}
+
+func newTestReconciler(client *fake.Clientset, dynamicClient *dynamicfake.FakeDynamicClient) (*reconciler, *record.FakeRecorder) {
+	recorder := record.NewFakeRecorder(10)
+	return &reconciler{
+		client:             client,
+		dynamicClient:      dynamicClient,
+		terraformResources: terraformResources{testTerraformResource},
+		credentials:        testCredentials(),
+		recorder:           recorder,
+	}, recorder
+}
+
+func events(recorder *record.FakeRecorder) []string {
+	events := []string{}
+	for {
+		select {
+		case event := <-recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestReconcileRepairsDrift(t *testing.T) {
+	configMap := testConfigMap("uid-1", map[string]string{"CLUSTER_NAME": "other-cluster", "MONITOR_BACKEND": "database", "EXTRA": "x"})
+	client := fake.NewSimpleClientset(configMap)
+	r, recorder := newTestReconciler(client, newTestDynamicClient(testTerraform("uid-1", 1)))
+
+	r.reconcile(configMap)
+
+	repaired, err := client.CoreV1().ConfigMaps("default").Get(context.TODO(), "example-monitor-envs", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffKeys(repaired.Data, r.credentials.configMapData)) > 0 {
+		t.Errorf("expected the configmap to be repaired, got %v", repaired.Data)
+	}
+	secret, err := client.CoreV1().Secrets("default").Get(context.TODO(), "example-monitor-envs", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(secret.Data["PGPASSWORD"]) != "password" {
+		t.Errorf("expected the secret to be created, got %v", secret.Data)
+	}
+
+	expected := "Normal MonitorEnvsRepaired Repaired drift: configmap example-monitor-envs changed CLUSTER_NAME, removed EXTRA; secret example-monitor-envs created"
+	if got := events(recorder); len(got) != 1 || got[0] != expected {
+		t.Errorf("expected the event %q, got %v", expected, got)
+	}
+
+	// Nothing is left to repair
+	r.reconcile(repaired)
+	if got := events(recorder); len(got) != 0 {
+		t.Errorf("expected no event, got %v", got)
+	}
+}
+
+func TestReconcileIgnores(t *testing.T) {
+	notOwned := testConfigMap("uid-1", map[string]string{})
+	notOwned.OwnerReferences = nil
+	otherKind := testConfigMap("uid-1", map[string]string{})
+	otherKind.OwnerReferences[0].Kind = "Deployment"
+	otherGroup := testConfigMap("uid-1", map[string]string{})
+	otherGroup.OwnerReferences[0].APIVersion = "tf.isaaguilar.com/v1alpha2"
+	otherNamespace := testConfigMap("uid-1", map[string]string{})
+	otherNamespace.Namespace = "kube-system"
+	recreated := testConfigMap("uid-0", map[string]string{})
+
+	for name, configMap := range map[string]*corev1.ConfigMap{
+		"not owned":               notOwned,
+		"owned by another kind":   otherKind,
+		"group is not watched":    otherGroup,
+		"namespace out of scope":  otherNamespace,
+		"resource was recreated":  recreated,
+		"resource does not exist": testConfigMap("uid-1", map[string]string{}),
+	} {
+		t.Run(name, func(t *testing.T) {
+			objects := []runtime.Object{}
+			if name != "resource does not exist" {
+				objects = append(objects, testTerraform("uid-1", 1))
+			}
+			client := fake.NewSimpleClientset()
+			r, recorder := newTestReconciler(client, newTestDynamicClient(objects...))
+			r.scope = scope{excludeNamespaces: []string{"kube-system"}}
+
+			r.reconcile(configMap)
+			if actions := client.Actions(); len(actions) != 0 {
+				t.Errorf("expected nothing to be written, got %v", actions)
+			}
+			if got := events(recorder); len(got) != 0 {
+				t.Errorf("expected no event, got %v", got)
+			}
+		})
+	}
+}
+
+func TestReconcileDeletesTheSecretOfEarlierVersions(t *testing.T) {
+	configMap := testConfigMap("uid-1", testCredentials().configMapData)
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+		Name:            "example-monitor-envs",
+		Namespace:       "default",
+		Labels:          managedLabels,
+		OwnerReferences: []metav1.OwnerReference{testOwnerReference("uid-1")},
+	}}
+	client := fake.NewSimpleClientset(configMap, secret)
+	r, recorder := newTestReconciler(client, newTestDynamicClient(testTerraform("uid-1", 1)))
+	r.credentials.secretData = nil
+
+	r.reconcile(secret)
+	if _, err := client.CoreV1().Secrets("default").Get(context.TODO(), "example-monitor-envs", metav1.GetOptions{}); err == nil {
+		t.Error("expected the secret to be deleted")
+	}
+	expected := "Normal MonitorEnvsRepaired Repaired drift: secret example-monitor-envs deleted"
+	if got := events(recorder); len(got) != 1 || got[0] != expected {
+		t.Errorf("expected the event %q, got %v", expected, got)
+	}
+}
+
+func TestStartRepairsEditedAndDeletedConfigMaps(t *testing.T) {
+	configMap := testConfigMap("uid-1", testCredentials().configMapData)
+	client := fake.NewSimpleClientset(configMap)
+	r, _ := newTestReconciler(client, newTestDynamicClient(testTerraform("uid-1", 1)))
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	r.start(stopCh)
+
+	configMaps := client.CoreV1().ConfigMaps("default")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		// The edit is repeated until the informer watches, edits before that are only seen on the resync
+		edited := configMap.DeepCopy()
+		edited.Data = map[string]string{"CLUSTER_NAME": "edited"}
+		if _, err := configMaps.Update(context.TODO(), edited, metav1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+		current, err := configMaps.Get(context.TODO(), configMap.Name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if current.Data["CLUSTER_NAME"] == "test-cluster" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the edited configmap to be repaired, got %v", current.Data)
+		}
+	}
+
+	if err := configMaps.Delete(context.TODO(), configMap.Name, metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, err := configMaps.Get(context.TODO(), configMap.Name, metav1.GetOptions{}); err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the deleted configmap to be created again")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
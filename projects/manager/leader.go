@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// leaseLock is the Lease the replicas elect the leader with. POD_NAME and POD_NAMESPACE are set with the
+// downward API; the hostname is the pod name when they are not.
+func leaseLock(client kubernetes.Interface) *resourcelock.LeaseLock {
+	identity := os.Getenv("POD_NAME")
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Fatal("Failed to get the hostname for leader election: ", err)
+		}
+		identity = hostname
+	}
+	return &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      envOrPanic("MONITOR_LEASE_NAME", "monitor-manager"),
+			Namespace: envOrPanic("POD_NAMESPACE", "tf-system"),
+		},
+		Client:     client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}
+}
+
+// lead calls run once this replica is the leader and returns when ctx is done. The lease is released when ctx is
+// done so the next replica takes over without waiting for the lease to expire. A replica that loses the lease
+// without being stopped exits so it does not keep writing next to the new leader.
+//
+// Leader election is skipped with MONITOR_LEADER_ELECTION=false, eg when running outside the cluster.
+func lead(ctx context.Context, client kubernetes.Interface, run func(ctx context.Context)) {
+	if os.Getenv("MONITOR_LEADER_ELECTION") == "false" {
+		run(ctx)
+		return
+	}
+
+	lock := leaseLock(client)
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		ReleaseOnCancel: true,
+		LeaseDuration:   15 * time.Second,
+		RenewDeadline:   10 * time.Second,
+		RetryPeriod:     2 * time.Second,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: run,
+			OnStoppedLeading: func() {
+				if ctx.Err() == nil {
+					log.Fatal("Lost the lease ", lock.LeaseMeta.Name, ", exiting")
+				}
+				log.Println("Released the lease", lock.LeaseMeta.Name)
+			},
+			OnNewLeader: func(identity string) {
+				if identity != lock.Identity() {
+					log.Println("Leader is", identity)
+				}
+			},
+		},
+	})
+}
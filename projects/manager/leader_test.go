@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestLeaseLock(t *testing.T) {
+	t.Setenv("POD_NAME", "monitor-manager-0")
+	t.Setenv("POD_NAMESPACE", "monitoring")
+	t.Setenv("MONITOR_LEASE_NAME", "")
+	lock := leaseLock(fake.NewSimpleClientset())
+	if lock.Identity() != "monitor-manager-0" || lock.LeaseMeta.Namespace != "monitoring" || lock.LeaseMeta.Name != "monitor-manager" {
+		t.Errorf("unexpected lock %s %+v", lock.Identity(), lock.LeaseMeta)
+	}
+}
+
+func TestLeadWithoutLeaderElection(t *testing.T) {
+	t.Setenv("MONITOR_LEADER_ELECTION", "false")
+	ran := false
+	lead(context.Background(), nil, func(ctx context.Context) { ran = true })
+	if !ran {
+		t.Error("expected run to be called")
+	}
+}
+
+// candidate leads with the identity until its context is canceled. started is closed once it leads, stopped
+// once lead returned.
+type candidate struct {
+	cancel  context.CancelFunc
+	started chan struct{}
+	stopped chan struct{}
+}
+
+func startCandidate(t *testing.T, client *fake.Clientset, identity string) candidate {
+	t.Setenv("POD_NAME", identity)
+	ctx, cancel := context.WithCancel(context.Background())
+	c := candidate{cancel: cancel, started: make(chan struct{}), stopped: make(chan struct{})}
+	go func() {
+		defer close(c.stopped)
+		lead(ctx, client, func(ctx context.Context) {
+			close(c.started)
+			<-ctx.Done()
+		})
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-c.stopped
+	})
+	return c
+}
+
+func leaseHolder(t *testing.T, client *fake.Clientset) string {
+	t.Helper()
+	lease, err := client.CoordinationV1().Leases("tf-system").Get(context.TODO(), "monitor-manager", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.Spec.HolderIdentity == nil {
+		return ""
+	}
+	return *lease.Spec.HolderIdentity
+}
+
+func TestLeadHandsOverTheLease(t *testing.T) {
+	t.Setenv("MONITOR_LEADER_ELECTION", "")
+	t.Setenv("POD_NAMESPACE", "")
+	t.Setenv("MONITOR_LEASE_NAME", "")
+	client := fake.NewSimpleClientset()
+
+	first := startCandidate(t, client, "replica-a")
+	select {
+	case <-first.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the first replica to lead")
+	}
+	if got := leaseHolder(t, client); got != "replica-a" {
+		t.Fatalf("expected replica-a to hold the lease, got %q", got)
+	}
+
+	second := startCandidate(t, client, "replica-b")
+	select {
+	case <-second.started:
+		t.Fatal("expected the second replica to wait for the lease")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// The lease is released on cancel so the second replica takes over within a retry period, 2s jittered by up
+	// to 120%, instead of waiting for the lease to expire
+	first.cancel()
+	<-first.stopped
+	select {
+	case <-second.started:
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the second replica to take over the released lease")
+	}
+	if got := leaseHolder(t, client); got != "replica-b" {
+		t.Errorf("expected replica-b to hold the lease, got %q", got)
+	}
+}
+
+// Another replica writes the ConfigMap between the get and the write of this replica
+func TestCreateOrUpdateConfigMapRetriesConflicts(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		existing []runtime.Object
+		verb     string
+		err      error
+	}{
+		{
+			name: "create",
+			verb: "create",
+			err:  errors.NewAlreadyExists(schema.GroupResource{Resource: "configmaps"}, "example-monitor-envs"),
+		},
+		{
+			name:     "update",
+			existing: []runtime.Object{&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "example-monitor-envs", Namespace: "default"}}},
+			verb:     "update",
+			err:      errors.NewConflict(schema.GroupResource{Resource: "configmaps"}, "example-monitor-envs", fmt.Errorf("the object has been modified")),
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset(test.existing...)
+			failures := 0
+			client.PrependReactor(test.verb, "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				if failures > 0 {
+					return false, nil, nil
+				}
+				failures++
+				return true, nil, test.err
+			})
+
+			data := map[string]string{"CLUSTER_NAME": "test-cluster"}
+			if _, err := createOrUpdateConfigMap(client, "example", "default", data, metav1.OwnerReference{}); err != nil {
+				t.Fatal(err)
+			}
+			configMap, err := client.CoreV1().ConfigMaps("default").Get(context.TODO(), "example-monitor-envs", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if failures != 1 || configMap.Data["CLUSTER_NAME"] != "test-cluster" {
+				t.Errorf("expected the write to be retried once, got %d failures and %+v", failures, configMap.Data)
+			}
+		})
+	}
+}
@@ -5,20 +5,24 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
 
-	tfv1alpha2 "github.com/isaaguilar/terraform-operator/pkg/apis/tf/v1alpha2"
 	"github.com/mattbaird/jsonpatch"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/dynamic"
-	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/retry"
 )
 
 func kubernetesConfig(kubeconfigPath string) *rest.Config {
@@ -39,102 +43,227 @@ func envOrPanic(env string, defaultValue ...string) string {
 	return value
 }
 
-func createOrUpdateConfigMap(client kubernetes.Interface, resourceName, namespace string, data map[string]string, ownerReference metav1.OwnerReference) error {
+// conflictOrExists is retried by createOrUpdateConfigMap and createOrUpdateSecret. Another replica may have
+// created or updated the object between the get and the write, eg during a rollout.
+func conflictOrExists(err error) bool {
+	return errors.IsConflict(err) || errors.IsAlreadyExists(err)
+}
+
+// managedLabels are set on the ConfigMaps and Secrets the manager writes so it can watch them for drift
+var managedLabels = map[string]string{"app.kubernetes.io/managed-by": "monitor-manager"}
+
+// withManagedLabels returns the labels with managedLabels added and whether any were missing
+func withManagedLabels(labels map[string]string) (map[string]string, bool) {
+	missing := false
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	for key, value := range managedLabels {
+		if labels[key] != value {
+			labels[key] = value
+			missing = true
+		}
+	}
+	return labels, missing
+}
+
+// diffKeys describes how current differs from desired by key, without the values since they may be secret
+func diffKeys[V comparable](current, desired map[string]V) []string {
+	changes := []string{}
+	for _, key := range sortedKeys(desired) {
+		if value, found := current[key]; !found {
+			changes = append(changes, "added "+key)
+		} else if value != desired[key] {
+			changes = append(changes, "changed "+key)
+		}
+	}
+	for _, key := range sortedKeys(current) {
+		if _, found := desired[key]; !found {
+			changes = append(changes, "removed "+key)
+		}
+	}
+	return changes
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func stringData(data map[string][]byte) map[string]string {
+	s := map[string]string{}
+	for key, value := range data {
+		s[key] = string(value)
+	}
+	return s
+}
+
+// createOrUpdateConfigMap writes the ConfigMap and returns what it changed, eg "created" or
+// "changed CLUSTER_NAME", or "" when it was up to date
+func createOrUpdateConfigMap(client kubernetes.Interface, resourceName, namespace string, data map[string]string, ownerReference metav1.OwnerReference) (string, error) {
 	ctx := context.TODO()
 	name := fmt.Sprintf("%s-monitor-envs", resourceName)
 	configMapClient := client.CoreV1().ConfigMaps(namespace)
 
-	configMap, err := configMapClient.Get(ctx, name, metav1.GetOptions{})
-	if err != nil && errors.IsNotFound(err) {
-		configMap := corev1.ConfigMap{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:            name,
-				OwnerReferences: []metav1.OwnerReference{ownerReference},
-			},
-			Data: data,
-		}
-		_, err := configMapClient.Create(ctx, &configMap, metav1.CreateOptions{})
-		if err != nil {
-			return err
-		}
-		log.Printf("...created configmap '%s/%s'\n", namespace, name)
-		// return nil
-	} else if err != nil {
-		return err
-	} else {
-		configMap.Data = data
-		_, err = configMapClient.Update(ctx, configMap, metav1.UpdateOptions{})
-		if err != nil {
+	change := ""
+	err := retry.OnError(retry.DefaultRetry, conflictOrExists, func() error {
+		configMap, err := configMapClient.Get(ctx, name, metav1.GetOptions{})
+		if err != nil && errors.IsNotFound(err) {
+			labels, _ := withManagedLabels(nil)
+			configMap := corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:            name,
+					Labels:          labels,
+					OwnerReferences: []metav1.OwnerReference{ownerReference},
+				},
+				Data: data,
+			}
+			_, err := configMapClient.Create(ctx, &configMap, metav1.CreateOptions{})
+			if err != nil {
+				return err
+			}
+			change = "created"
+			log.Printf("...created configmap '%s/%s'\n", namespace, name)
+		} else if err != nil {
 			return err
+		} else {
+			changes := diffKeys(configMap.Data, data)
+			var labelsMissing bool
+			configMap.Labels, labelsMissing = withManagedLabels(configMap.Labels)
+			if len(changes) == 0 && !labelsMissing {
+				change = ""
+				return nil
+			}
+			// The update carries the resourceVersion of the get so a concurrent write returns a conflict
+			configMap.Data = data
+			_, err = configMapClient.Update(ctx, configMap, metav1.UpdateOptions{})
+			if err != nil {
+				return err
+			}
+			change = strings.Join(changes, ", ")
+			log.Printf("...updated configmap '%s/%s'\n", namespace, name)
 		}
-		log.Printf("...updated configmap '%s/%s'\n", namespace, name)
-		// return nil
-	}
-	return nil
+		return nil
+	})
+	return change, err
 }
 
 func boolp(b bool) *bool {
 	return &b
 }
 
-func createOrUpdateSecret(client kubernetes.Interface, resourceName, namespace string, data map[string][]byte, ownerReference metav1.OwnerReference) error {
+// terraformOwnerReference makes the resource the owner of its ConfigMap and Secret so they are deleted with it
+func terraformOwnerReference(tf terraform) metav1.OwnerReference {
+	return metav1.OwnerReference{
+		Name:       tf.Name,
+		UID:        tf.UID,
+		Kind:       "Terraform",
+		APIVersion: tf.APIVersion,
+		Controller: boolp(true),
+	}
+}
+
+// createOrUpdateSecret writes the Secret and returns what it changed like createOrUpdateConfigMap
+func createOrUpdateSecret(client kubernetes.Interface, resourceName, namespace string, data map[string][]byte, ownerReference metav1.OwnerReference) (string, error) {
 	ctx := context.TODO()
 	name := fmt.Sprintf("%s-monitor-envs", resourceName)
 	secretClient := client.CoreV1().Secrets(namespace)
 
-	secret, err := secretClient.Get(ctx, name, metav1.GetOptions{})
-	if err != nil && errors.IsNotFound(err) {
-		secret := corev1.Secret{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:            name,
-				OwnerReferences: []metav1.OwnerReference{ownerReference},
-			},
-			Data: data,
-		}
-		_, err := secretClient.Create(ctx, &secret, metav1.CreateOptions{})
-		if err != nil {
-			return err
-		}
-		log.Printf("...created secret '%s/%s'\n", namespace, name)
-		// return nil
-	} else if err != nil {
-		return err
-	} else {
-		secret.Data = data
-		_, err = secretClient.Update(ctx, secret, metav1.UpdateOptions{})
-		if err != nil {
+	change := ""
+	err := retry.OnError(retry.DefaultRetry, conflictOrExists, func() error {
+		secret, err := secretClient.Get(ctx, name, metav1.GetOptions{})
+		if err != nil && errors.IsNotFound(err) {
+			labels, _ := withManagedLabels(nil)
+			secret := corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:            name,
+					Labels:          labels,
+					OwnerReferences: []metav1.OwnerReference{ownerReference},
+				},
+				Data: data,
+			}
+			_, err := secretClient.Create(ctx, &secret, metav1.CreateOptions{})
+			if err != nil {
+				return err
+			}
+			change = "created"
+			log.Printf("...created secret '%s/%s'\n", namespace, name)
+		} else if err != nil {
 			return err
+		} else {
+			changes := diffKeys(stringData(secret.Data), stringData(data))
+			var labelsMissing bool
+			secret.Labels, labelsMissing = withManagedLabels(secret.Labels)
+			if len(changes) == 0 && !labelsMissing {
+				change = ""
+				return nil
+			}
+			secret.Data = data
+			_, err = secretClient.Update(ctx, secret, metav1.UpdateOptions{})
+			if err != nil {
+				return err
+			}
+			change = strings.Join(changes, ", ")
+			log.Printf("...updated secret '%s/%s'\n", namespace, name)
 		}
-		log.Printf("...updated secret '%s/%s'\n", namespace, name)
-		// return nil
-	}
-	return nil
+		return nil
+	})
+	return change, err
 }
 
 func main() {
-	configMapData := map[string]string{
-		"CLUSTER_NAME": envOrPanic("CLUSTER_NAME"),
-		"DBHOST":       envOrPanic("DBHOST"),
-		"PGPORT":       envOrPanic("PGPORT", "5432"),
-		"PGUSER":       envOrPanic("PGUSER"),
-		"PGDATABASE":   envOrPanic("PGDATABASE"),
+	if len(os.Args) > 1 && os.Args[1] == "webhook-review" {
+		webhookReview(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "rbac" {
+		rbac()
+		return
 	}
-	_ = configMapData
-	secretData := map[string][]byte{
-		"PGPASSWORD": []byte(envOrPanic("PGPASSWORD")),
+
+	scope, err := scopeFromEnv()
+	if err != nil {
+		log.Fatal(err)
 	}
-	_ = secretData
 
 	config := kubernetesConfig(os.Getenv("KUBECONFIG"))
 	client := kubernetes.NewForConfigOrDie(config)
 	dynamicClient := dynamic.NewForConfigOrDie(config)
-	group := tfv1alpha2.SchemeGroupVersion.Group
-	version := tfv1alpha2.SchemeGroupVersion.Version
-	terraformResource := schema.GroupVersionResource{Group: group, Version: version, Resource: "terraforms"}
+
+	// The manager redacts the specs it registers with the key, there is no redaction without one
+	specRedactKey, err := ensureSpecRedactKey(client, envOrPanic("POD_NAMESPACE", "tf-system"))
+	if err != nil {
+		log.Fatal("Failed to get the spec redaction key: ", err)
+	}
+
+	clusterName := envOrPanic("CLUSTER_NAME")
+	certDir := os.Getenv("MONITOR_WEBHOOK_CERT_DIR")
+	credentials := credentialsFromEnv(clusterName, certDir)
+
+	backend, err := newBackend()
+	if err != nil {
+		log.Fatal("Failed to connect to the backend: ", err)
+	}
+	registry, err := newRegistry(clusterName, backend, []byte(specRedactKey))
+	if err != nil {
+		log.Fatal("Failed to register the cluster: ", err)
+	}
+
+	terraformResources, err := discoverTerraformResources(client.Discovery())
+	if err != nil {
+		log.Fatal("Failed to discover the Terraform resources: ", err)
+	}
+
+	status := newStatusReporter(client, dynamicClient, terraformResources, registry, credentials)
+	registrations := newRegistrations(registry)
 
 	var handler cache.ResourceEventHandlerFuncs
 	handler.AddFunc = func(obj interface{}) {
-		tf := tfv1alpha2.Terraform{}
+		tf := terraform{}
 		b, err := json.Marshal(obj)
 		if err != nil {
 			log.Println("ERROR in add event", err)
@@ -144,25 +273,27 @@ func main() {
 			log.Println("ERROR in add event", err)
 		}
 		log.Println("add event:", tf.Name)
-		ownerReference := metav1.OwnerReference{
-			Name:       tf.Name,
-			UID:        tf.UID,
-			Kind:       "Terraform",
-			APIVersion: "tf.isaaguilar.com/v1alpha2",
-			Controller: boolp(true),
-		}
-		err = createOrUpdateConfigMap(client, tf.Name, tf.Namespace, configMapData, ownerReference)
+		ownerReference := terraformOwnerReference(tf)
+		_, err = createOrUpdateConfigMap(client, tf.Name, tf.Namespace, credentials.configMapData, ownerReference)
+		if err != nil {
+			log.Println("ERROR in add event", err)
+		}
+		_, err = credentials.applySecret(client, tf.Name, tf.Namespace, ownerReference)
 		if err != nil {
 			log.Println("ERROR in add event", err)
 		}
-		err = createOrUpdateSecret(client, tf.Name, tf.Namespace, secretData, ownerReference)
+		err = registrations.register(tf, obj)
+		if err != nil {
+			log.Println("ERROR in add event", err)
+		}
+		err = status.report(tf)
 		if err != nil {
 			log.Println("ERROR in add event", err)
 		}
 	}
 	handler.UpdateFunc = func(old, new interface{}) {
-		tfold := tfv1alpha2.Terraform{}
-		tfnew := tfv1alpha2.Terraform{}
+		tfold := terraform{}
+		tfnew := terraform{}
 
 		bold, err := json.Marshal(old)
 		if err != nil {
@@ -192,18 +323,20 @@ func main() {
 			for _, patch := range patches {
 				if patch.Operation == "replace" && patch.Path == "/metadata/generation" {
 					log.Println("Moving from generation", tfold.Generation, "=>", tfnew.Generation)
-					ownerReference := metav1.OwnerReference{
-						Name:       tfnew.Name,
-						UID:        tfnew.UID,
-						Kind:       "Terraform",
-						APIVersion: "tf.isaaguilar.com/v1alpha2",
-						Controller: boolp(true),
+					ownerReference := terraformOwnerReference(tfnew)
+					_, err = createOrUpdateConfigMap(client, tfnew.Name, tfnew.Namespace, credentials.configMapData, ownerReference)
+					if err != nil {
+						log.Println("ERROR in update event", err)
 					}
-					err = createOrUpdateConfigMap(client, tfnew.Name, tfnew.Namespace, configMapData, ownerReference)
+					_, err = credentials.applySecret(client, tfnew.Name, tfnew.Namespace, ownerReference)
 					if err != nil {
 						log.Println("ERROR in update event", err)
 					}
-					err = createOrUpdateSecret(client, tfnew.Name, tfnew.Namespace, secretData, ownerReference)
+					err = registrations.register(tfnew, new)
+					if err != nil {
+						log.Println("ERROR in update event", err)
+					}
+					err = status.report(tfnew)
 					if err != nil {
 						log.Println("ERROR in update event", err)
 					}
@@ -213,19 +346,73 @@ func main() {
 
 	}
 	handler.DeleteFunc = func(obj interface{}) {
-		log.Println("delete event")
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		tf := terraform{}
+		b, err := json.Marshal(obj)
+		if err != nil {
+			log.Println("ERROR in delete event", err)
+		}
+		err = json.Unmarshal(b, &tf)
+		if err != nil {
+			log.Println("ERROR in delete event", err)
+		}
+		log.Println("delete event:", tf.Name)
+		registrations.forget(tf)
+		err = registry.delete(tf)
+		if err != nil {
+			log.Println("ERROR in delete event", err)
+		}
 	}
 
-	informer := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 0)
-	informer.ForResource(terraformResource).Informer().AddEventHandler(handler)
+	// The webhook and the token exchange are stateless so every replica serves them. The webhook is only served
+	// when a certificate is mounted, eg by cert-manager, since the API server only calls webhooks over TLS. The
+	// token exchange requires the certificate too.
+	mux := http.NewServeMux()
+	if certDir != "" {
+		mux.Handle("/inject", newInjector(scope, func(namespace string) (map[string]string, error) {
+			ns, err := client.CoreV1().Namespaces().Get(context.TODO(), namespace, metav1.GetOptions{})
+			if err != nil {
+				return nil, err
+			}
+			return ns.Labels, nil
+		}))
+	}
+	if credentials.mode == "token" {
+		mux.Handle("/api-token-please", newExchanger(client, registry, clusterName))
+	}
+	go serve(envOrPanic("MONITOR_ADDR", ":8443"), certDir, mux)
 
-	log.Println("Start informer")
-	stopCh := make(chan struct{})
-	defer close(stopCh)
-	informer.Start(stopCh)
-	// TODO watch for stop
-	<-stopCh
-	// select {}
-	log.Println("Stop informer")
-	os.Exit(1) // should this be 0 instead?
+	retentionInterval, err := time.ParseDuration(envOrPanic("MONITOR_RETENTION_INTERVAL", "1h"))
+	if err != nil {
+		log.Fatal("MONITOR_RETENTION_INTERVAL is not a valid duration: ", err)
+	}
+	statusInterval, err := time.ParseDuration(envOrPanic("MONITOR_STATUS_INTERVAL", "1m"))
+	if err != nil {
+		log.Fatal("MONITOR_STATUS_INTERVAL is not a valid duration: ", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Only the leader runs the informer so replicas do not race on the ConfigMaps, Secrets and registrations
+	lead(ctx, client, func(ctx context.Context) {
+		log.Println("Start informer for", terraformResources, "in", scope)
+		informers := []cache.SharedIndexInformer{}
+		for _, factory := range scope.informerFactories(dynamicClient) {
+			for _, terraformResource := range terraformResources {
+				informer := factory.ForResource(terraformResource).Informer()
+				informer.AddEventHandler(handler)
+				informers = append(informers, informer)
+			}
+			factory.Start(ctx.Done())
+		}
+		go registrations.retry(ctx.Done())
+		go registry.collectGarbageEvery(retentionInterval, ctx.Done())
+		go status.reportEvery(statusInterval, informers, ctx.Done())
+		newReconciler(client, dynamicClient, terraformResources, scope, credentials).start(ctx.Done())
+		<-ctx.Done()
+		log.Println("Stop informer")
+	})
 }
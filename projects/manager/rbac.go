@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/galleybytes/monitor/pkg/tfapi"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// namespacedRules are what the manager needs in each namespace it handles. Namespaces are cluster scoped but a
+// RoleBinding allows getting its own namespace, which is all the webhook reads.
+var namespacedRules = []rbacv1.PolicyRule{
+	{APIGroups: []string{""}, Resources: []string{"configmaps", "secrets"}, Verbs: []string{"get", "list", "watch", "create", "update", "delete"}},
+	{APIGroups: []string{""}, Resources: []string{"events"}, Verbs: []string{"create", "patch"}},
+	{APIGroups: tfapi.Groups, Resources: []string{tfapi.Resource}, Verbs: []string{"get", "list", "watch", "patch"}},
+	{APIGroups: []string{""}, Resources: []string{"namespaces"}, Verbs: []string{"get"}},
+}
+
+// tokenReviewRules are what the token exchange needs to authenticate the monitors
+var tokenReviewRules = []rbacv1.PolicyRule{
+	{APIGroups: []string{"authentication.k8s.io"}, Resources: []string{"tokenreviews"}, Verbs: []string{"create"}},
+}
+
+// leaseRules are what the manager needs in its own namespace for leader election
+var leaseRules = []rbacv1.PolicyRule{
+	{APIGroups: []string{"coordination.k8s.io"}, Resources: []string{"leases"}, Verbs: []string{"get", "create", "update"}},
+}
+
+// specRedactKeyRules are what the manager needs in its own namespace to create the spec redaction key on its first
+// start. A create cannot be limited by name.
+var specRedactKeyRules = []rbacv1.PolicyRule{
+	{APIGroups: []string{""}, Resources: []string{"secrets"}, ResourceNames: []string{specRedactSecret}, Verbs: []string{"get"}},
+	{APIGroups: []string{""}, Resources: []string{"secrets"}, Verbs: []string{"create"}},
+}
+
+func roleAndBinding(name, namespace string, rules []rbacv1.PolicyRule, serviceAccount, serviceAccountNamespace string) []interface{} {
+	role := rbacv1.Role{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "Role"},
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Rules:      rules,
+	}
+	roleBinding := rbacv1.RoleBinding{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "RoleBinding"},
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Subjects: []rbacv1.Subject{
+			{Kind: rbacv1.ServiceAccountKind, Name: serviceAccount, Namespace: serviceAccountNamespace},
+		},
+		RoleRef: rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: name},
+	}
+	return []interface{}{role, roleBinding}
+}
+
+// writeRBAC writes the namespaced Roles and RoleBindings for the scope as YAML. It needs MONITOR_NAMESPACES since
+// watching every namespace needs the ClusterRole.
+func writeRBAC(w io.Writer, s scope, serviceAccount, managerNamespace string) error {
+	namespaces := s.watchedNamespaces()
+	if len(namespaces) == 1 && namespaces[0] == metav1.NamespaceAll {
+		return fmt.Errorf("MONITOR_NAMESPACES is required for namespaced roles, watching every namespace needs deploy/clusterrole.yaml")
+	}
+	objects := roleAndBinding("monitor-manager-leader-election", managerNamespace, leaseRules, serviceAccount, managerNamespace)
+	objects = append(objects, roleAndBinding(specRedactSecret, managerNamespace, specRedactKeyRules, serviceAccount, managerNamespace)...)
+	// TokenReviews are cluster scoped
+	objects = append(objects,
+		rbacv1.ClusterRole{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "ClusterRole"},
+			ObjectMeta: metav1.ObjectMeta{Name: "monitor-manager-token-review"},
+			Rules:      tokenReviewRules,
+		},
+		rbacv1.ClusterRoleBinding{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "ClusterRoleBinding"},
+			ObjectMeta: metav1.ObjectMeta{Name: "monitor-manager-token-review"},
+			Subjects: []rbacv1.Subject{
+				{Kind: rbacv1.ServiceAccountKind, Name: serviceAccount, Namespace: managerNamespace},
+			},
+			RoleRef: rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: "monitor-manager-token-review"},
+		},
+	)
+	for _, namespace := range namespaces {
+		objects = append(objects, roleAndBinding("monitor-manager", namespace, namespacedRules, serviceAccount, managerNamespace)...)
+	}
+	for n, object := range objects {
+		b, err := yaml.Marshal(object)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			fmt.Fprintln(w, "---")
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rbac prints the namespaced Roles and RoleBindings for the scope in the env, eg
+//
+//	MONITOR_NAMESPACES=team-a,team-b manager rbac | kubectl apply -f -
+func rbac() {
+	s, err := scopeFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = writeRBAC(os.Stdout, s, envOrPanic("MONITOR_SERVICE_ACCOUNT", "monitor-manager"), envOrPanic("POD_NAMESPACE", "tf-system"))
+	if err != nil {
+		log.Fatal(err)
+	}
+}
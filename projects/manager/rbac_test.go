@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// rbacObject is what the tests read of the objects writeRBAC writes
+type rbacObject struct {
+	Kind     string `json:"kind"`
+	Metadata struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+	Rules    []rbacv1.PolicyRule `json:"rules"`
+	Subjects []rbacv1.Subject    `json:"subjects"`
+}
+
+func (o rbacObject) String() string {
+	if o.Metadata.Namespace == "" {
+		return fmt.Sprintf("%s %s", o.Kind, o.Metadata.Name)
+	}
+	return fmt.Sprintf("%s %s/%s", o.Kind, o.Metadata.Namespace, o.Metadata.Name)
+}
+
+func readRBAC(t *testing.T, b []byte) []rbacObject {
+	t.Helper()
+	objects := []rbacObject{}
+	for _, document := range strings.Split(string(b), "\n---\n") {
+		object := rbacObject{}
+		if err := yaml.Unmarshal([]byte(document), &object); err != nil {
+			t.Fatalf("%s\n%s", err, document)
+		}
+		objects = append(objects, object)
+	}
+	return objects
+}
+
+func TestWriteRBAC(t *testing.T) {
+	clusterScoped := []string{
+		"ClusterRole monitor-manager-token-review",
+		"ClusterRoleBinding monitor-manager-token-review",
+	}
+	managerNamespace := []string{
+		"Role tf-system/monitor-manager-leader-election",
+		"Role tf-system/monitor-manager-spec-redact",
+		"RoleBinding tf-system/monitor-manager-leader-election",
+		"RoleBinding tf-system/monitor-manager-spec-redact",
+	}
+	for _, test := range []struct {
+		name     string
+		scope    scope
+		expected []string
+	}{
+		{
+			name:  "allowed",
+			scope: scope{namespaces: []string{"team-a", "team-b"}},
+			expected: append(append(append([]string{}, clusterScoped...), managerNamespace...),
+				"Role team-a/monitor-manager", "Role team-b/monitor-manager",
+				"RoleBinding team-a/monitor-manager", "RoleBinding team-b/monitor-manager"),
+		},
+		{
+			name:  "allowed and denied",
+			scope: scope{namespaces: []string{"team-a", "team-b"}, excludeNamespaces: []string{"team-b"}},
+			expected: append(append(append([]string{}, clusterScoped...), managerNamespace...),
+				"Role team-a/monitor-manager", "RoleBinding team-a/monitor-manager"),
+		},
+		{
+			name:     "label selector",
+			scope:    scope{namespaces: []string{"team-a"}, labelSelector: "team=infra"},
+			expected: append(append(append([]string{}, clusterScoped...), managerNamespace...), "Role team-a/monitor-manager", "RoleBinding team-a/monitor-manager"),
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			b := bytes.Buffer{}
+			if err := writeRBAC(&b, test.scope, "monitor-manager", "tf-system"); err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, object := range readRBAC(t, b.Bytes()) {
+				got = append(got, object.String())
+				for _, subject := range object.Subjects {
+					if subject.Name != "monitor-manager" || subject.Namespace != "tf-system" {
+						t.Errorf("%s is bound to %s/%s, want tf-system/monitor-manager", object, subject.Namespace, subject.Name)
+					}
+				}
+				if object.Kind == "Role" && object.Metadata.Name == "monitor-manager" && len(object.Rules) != len(namespacedRules) {
+					t.Errorf("%s has %d rules, want the %d namespacedRules", object, len(object.Rules), len(namespacedRules))
+				}
+			}
+			sort.Strings(got)
+			sort.Strings(test.expected)
+			if strings.Join(got, "\n") != strings.Join(test.expected, "\n") {
+				t.Errorf("writeRBAC() wrote\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(test.expected, "\n"))
+			}
+		})
+	}
+}
+
+func TestWriteRBACNeedsNamespaces(t *testing.T) {
+	for _, s := range []scope{{}, {excludeNamespaces: []string{"kube-system"}}, {labelSelector: "team=infra"}} {
+		if err := writeRBAC(&bytes.Buffer{}, s, "monitor-manager", "tf-system"); err == nil {
+			t.Errorf("writeRBAC() of %s returned no error, watching every namespace needs the ClusterRole", s)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/galleybytes/monitor/pkg/database"
+	"github.com/galleybytes/monitor/pkg/handlers"
+	"github.com/galleybytes/monitor/pkg/models"
+	"github.com/galleybytes/monitor/pkg/sanitize"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// registry registers the resources and their specs so the monitors only have to verify that the generation they
+// ship logs for is known
+type registry struct {
+	backend   handlers.Backend
+	cluster   models.Cluster
+	retention handlers.RetentionPolicy
+}
+
+// newRegistry registers the cluster with the backend. Resources bound to another cluster are resolved with
+// MONITOR_CLUSTER_MISMATCH_POLICY, the specs are redacted with specRedactKey, the builtin rules and
+// MONITOR_SPEC_REDACT and the history of deleted resources is kept according to MONITOR_RETENTION_POLICY.
+func newRegistry(clusterName string, backend handlers.Backend, specRedactKey []byte) (*registry, error) {
+	policy, err := handlers.ParseClusterMismatchPolicy(os.Getenv("MONITOR_CLUSTER_MISMATCH_POLICY"))
+	if err != nil {
+		return nil, err
+	}
+	if policy == handlers.ClusterMismatchAdopt {
+		// Every adoption is recorded, a backend that cannot record them would only fail the registrations
+		if err := backend.AdoptionSupported(); err != nil {
+			return nil, fmt.Errorf("MONITOR_CLUSTER_MISMATCH_POLICY=%s: %s", policy, err)
+		}
+	}
+	retention, err := handlers.ParseRetentionPolicy(os.Getenv("MONITOR_RETENTION_POLICY"))
+	if err != nil {
+		return nil, err
+	}
+	if !retention.Forever {
+		// Fail closed rather than keeping the history of deleted resources the policy asked to purge
+		if err := backend.RetentionSupported(); err != nil {
+			return nil, fmt.Errorf("MONITOR_RETENTION_POLICY=%s: %s", retention, err)
+		}
+	}
+	specSanitizer, err := sanitize.WithKeyFromEnv(specRedactKey)
+	if err != nil {
+		return nil, err
+	}
+	switch b := backend.(type) {
+	case handlers.Handler:
+		backend = b.WithClusterMismatchPolicy(policy).WithSpecSanitizer(specSanitizer)
+	case database.Backend:
+		backend = b.WithClusterMismatchPolicy(policy).WithSpecSanitizer(specSanitizer)
+	}
+	r := &registry{backend: backend, retention: retention}
+	cluster, err := r.backend.GetOrSetCluster(clusterName)
+	if err != nil {
+		return nil, fmt.Errorf("could not register cluster '%s': %s", clusterName, err)
+	}
+	r.cluster = *cluster
+	return r, nil
+}
+
+// register registers the current generation of the resource with its spec. Only the spec is saved, the metadata
+// and status change without a new generation.
+func (r *registry) register(tf terraform, obj interface{}) (err error) {
+	// The backends panic when the database is unavailable, which must not stop the informer
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("%v", recovered)
+		}
+	}()
+
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	resource := struct {
+		Spec json.RawMessage `json:"spec"`
+	}{}
+	if err := json.Unmarshal(b, &resource); err != nil {
+		return err
+	}
+	resourceSpec := []byte(resource.Spec)
+	generation := strconv.FormatInt(tf.Generation, 10)
+	tfoResource, err := r.backend.RegisterTFOResource(string(tf.UID), tf.Namespace, tf.Name, generation, r.cluster, resourceSpec)
+	if err != nil {
+		return err
+	}
+	log.Printf("...registered '%s/%s' generation %s as %s\n", tf.Namespace, tf.Name, generation, tfoResource.UUID)
+	return nil
+}
+
+// registrations retries the registrations that failed. The informers do not resync and only register a resource
+// again when its generation changes, so a failure would otherwise leave the resource unregistered until its monitor
+// gives up on the registration. The failed resources are retried with a backoff from a second to a minute.
+type registrations struct {
+	registry *registry
+	queue    workqueue.RateLimitingInterface
+
+	// mu serializes the registrations so a retry never registers an older generation after a newer one
+	mu sync.Mutex
+	// pending is the latest object of each resource whose registration failed, by its uid
+	pending map[string]interface{}
+}
+
+func newRegistrations(r *registry) *registrations {
+	return &registrations{
+		registry: r,
+		queue:    workqueue.NewRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(time.Second, time.Minute)),
+		pending:  map[string]interface{}{},
+	}
+}
+
+// register registers the current generation of the resource and retries it until it succeeds when it fails
+func (q *registrations) register(tf terraform, obj interface{}) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.registerLocked(tf, obj)
+}
+
+func (q *registrations) registerLocked(tf terraform, obj interface{}) error {
+	uid := string(tf.UID)
+	if err := q.registry.register(tf, obj); err != nil {
+		q.pending[uid] = obj
+		q.queue.AddRateLimited(uid)
+		return err
+	}
+	delete(q.pending, uid)
+	q.queue.Forget(uid)
+	return nil
+}
+
+// forget stops retrying the registration of a deleted resource
+func (q *registrations) forget(tf terraform) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.pending, string(tf.UID))
+	q.queue.Forget(string(tf.UID))
+}
+
+// retry registers the failed resources again until stop is closed
+func (q *registrations) retry(stop <-chan struct{}) {
+	go func() {
+		<-stop
+		q.queue.ShutDown()
+	}()
+	for {
+		item, shutdown := q.queue.Get()
+		if shutdown {
+			return
+		}
+		q.retryOne(item.(string))
+		q.queue.Done(item)
+	}
+}
+
+func (q *registrations) retryOne(uid string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	obj, found := q.pending[uid]
+	if !found {
+		// Registered or deleted since it failed
+		return
+	}
+	tf, err := decodeTerraform(obj)
+	if err == nil {
+		err = q.registerLocked(tf, obj)
+	}
+	if err != nil {
+		log.Println("ERROR retrying the registration", err)
+	}
+}
+
+// delete marks the resource registered by this cluster as deleted and purges its history right away when the
+// retention policy does not keep it
+func (r *registry) delete(tf terraform) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("%v", recovered)
+		}
+	}()
+
+	uuid := string(tf.UID)
+	found, err := r.backend.FindTFOResource(uuid)
+	if err != nil {
+		return err
+	}
+	if found != nil && found.ClusterID != r.cluster.ID {
+		// Only the fork belongs to this cluster. The resource is left alone when it was not forked.
+		uuid = handlers.ForkUUID(uuid, r.cluster)
+	}
+	tfoResource := r.backend.DeleteTFOResource(uuid, handlers.DeletedBy(r.cluster))
+	if tfoResource == nil {
+		log.Printf("...'%s/%s' was not registered by this cluster\n", tf.Namespace, tf.Name)
+		return nil
+	}
+	log.Printf("...marked '%s/%s' (%s) as deleted\n", tf.Namespace, tf.Name, tfoResource.UUID)
+	if !r.retention.Forever && r.retention.Days == 0 {
+		r.backend.PurgeTFOResource(tfoResource.UUID)
+	}
+	return nil
+}
+
+// collectGarbage purges the history of the resources that were deleted longer ago than the retention policy keeps
+func (r *registry) collectGarbage() (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("%v", recovered)
+		}
+	}()
+
+	before, purge := r.retention.PurgeBefore(time.Now())
+	if !purge {
+		return nil
+	}
+	for _, tfoResource := range r.backend.FindDeletedTFOResources(before) {
+		r.backend.PurgeTFOResource(tfoResource.UUID)
+		log.Printf("...purged the history of '%s/%s' (%s) deleted at %s\n", tfoResource.Namespace, tfoResource.Name, tfoResource.UUID, tfoResource.DeletedAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// collectGarbageEvery runs collectGarbage until stopCh is closed
+func (r *registry) collectGarbageEvery(interval time.Duration, stopCh <-chan struct{}) {
+	if r.retention.Forever {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := r.collectGarbage(); err != nil {
+			log.Println("ERROR in garbage collection", err)
+		}
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/galleybytes/monitor/pkg/handlers"
+	"github.com/galleybytes/monitor/pkg/models"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// flakyBackend fails the first registrations and records the generations registered after
+type flakyBackend struct {
+	handlers.Backend
+
+	mu         sync.Mutex
+	fails      int
+	registered []string
+}
+
+func (b *flakyBackend) RegisterTFOResource(uuid, namespace, name, currentGeneration string, cluster models.Cluster, resourceSpec []byte) (models.TFOResource, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.fails > 0 {
+		b.fails--
+		return models.TFOResource{}, fmt.Errorf("connection refused")
+	}
+	b.registered = append(b.registered, currentGeneration)
+	return models.TFOResource{UUID: uuid, CurrentGeneration: currentGeneration}, nil
+}
+
+func (b *flakyBackend) generations() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string{}, b.registered...)
+}
+
+func testRegistrations(backend handlers.Backend) *registrations {
+	q := newRegistrations(&registry{backend: backend, cluster: testCluster()})
+	q.queue = workqueue.NewRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(time.Millisecond, 10*time.Millisecond))
+	return q
+}
+
+func waitForGenerations(t *testing.T, backend *flakyBackend, expected string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for fmt.Sprint(backend.generations()) != expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the generations %s to be registered, got %v", expected, backend.generations())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRegistrationsRetryFailures(t *testing.T) {
+	backend := &flakyBackend{fails: 3}
+	q := testRegistrations(backend)
+	stop := make(chan struct{})
+	defer close(stop)
+	go q.retry(stop)
+
+	obj := testTerraform("uid-1", 1)
+	tf, _ := decodeTerraform(obj.Object)
+	if err := q.register(tf, obj.Object); err == nil {
+		t.Fatal("expected the first registration to fail")
+	}
+	waitForGenerations(t, backend, "[1]")
+}
+
+func TestRegistrationsDoNotRetryAnOlderGeneration(t *testing.T) {
+	backend := &flakyBackend{fails: 1}
+	q := testRegistrations(backend)
+
+	old := testTerraform("uid-1", 1)
+	tf, _ := decodeTerraform(old.Object)
+	if err := q.register(tf, old.Object); err == nil {
+		t.Fatal("expected the first registration to fail")
+	}
+	new := testTerraform("uid-1", 2)
+	tf, _ = decodeTerraform(new.Object)
+	if err := q.register(tf, new.Object); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go q.retry(stop)
+	time.Sleep(50 * time.Millisecond)
+	if got := fmt.Sprint(backend.generations()); got != "[2]" {
+		t.Errorf("expected only generation 2 to be registered, got %s", got)
+	}
+}
+
+func TestRegistrationsForgetDeletedResources(t *testing.T) {
+	backend := &flakyBackend{fails: 1}
+	q := testRegistrations(backend)
+
+	obj := testTerraform("uid-1", 1)
+	tf, _ := decodeTerraform(obj.Object)
+	if err := q.register(tf, obj.Object); err == nil {
+		t.Fatal("expected the first registration to fail")
+	}
+	q.forget(tf)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go q.retry(stop)
+	time.Sleep(50 * time.Millisecond)
+	if got := backend.generations(); len(got) != 0 {
+		t.Errorf("expected the deleted resource not to be registered, got %v", got)
+	}
+}
+
+func TestNewRegistryNeedsANegotiatedSchemaVersion(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	backend, err := handlers.NewWithToken(server.URL, "token", nil).NegotiateSchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, env := range []map[string]string{
+		{"MONITOR_RETENTION_POLICY": "purge"},
+		{"MONITOR_RETENTION_POLICY": "30d"},
+		{"MONITOR_CLUSTER_MISMATCH_POLICY": "adopt"},
+	} {
+		t.Run(fmt.Sprint(env), func(t *testing.T) {
+			for key, value := range env {
+				t.Setenv(key, value)
+			}
+			if _, err := newRegistry("test", backend, []byte("key")); err == nil {
+				t.Errorf("newRegistry() with %v returned no error for an API without a schema version", env)
+			}
+		})
+	}
+}
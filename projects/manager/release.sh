@@ -4,7 +4,7 @@ cd "$dir"
 repo=${repo:-ghcr.io/galleybytes/monitor-manager}
 tag=$(git describe --tags --dirty --match 'manager-*'|sed s,manager-,,)
 tag=${tag:-0.0.0}
-GOOS=linux GOARCH=amd64 go build -installsuffix cgo -v -o bin/manager main.go
+GOOS=linux GOARCH=amd64 go build -installsuffix cgo -v -o bin/manager .
 docker build . -t "$repo:$tag"
 if [[ "$RELEASE_PROJECT" == true ]];then
   docker push "$repo:$tag"
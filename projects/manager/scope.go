@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+)
+
+// scope is which terraform resources the manager handles
+type scope struct {
+	// namespaces are watched one by one when set, which only needs namespaced roles. Otherwise every namespace
+	// is watched.
+	namespaces []string
+
+	// excludeNamespaces are never watched
+	excludeNamespaces []string
+
+	// labelSelector selects the resources by their labels, eg "team=infra,env!=dev"
+	labelSelector string
+}
+
+func splitList(s string) []string {
+	list := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// scopeFromEnv reads MONITOR_NAMESPACES and MONITOR_EXCLUDE_NAMESPACES, comma separated, and
+// MONITOR_LABEL_SELECTOR
+func scopeFromEnv() (scope, error) {
+	s := scope{
+		namespaces:        splitList(os.Getenv("MONITOR_NAMESPACES")),
+		excludeNamespaces: splitList(os.Getenv("MONITOR_EXCLUDE_NAMESPACES")),
+		labelSelector:     os.Getenv("MONITOR_LABEL_SELECTOR"),
+	}
+	if _, err := labels.Parse(s.labelSelector); err != nil {
+		return s, fmt.Errorf("MONITOR_LABEL_SELECTOR is not a valid label selector: %s", err)
+	}
+	return s, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// includes checks the namespace is handled
+func (s scope) includes(namespace string) bool {
+	if contains(s.excludeNamespaces, namespace) {
+		return false
+	}
+	return len(s.namespaces) == 0 || contains(s.namespaces, namespace)
+}
+
+// selects checks the resource in the namespace with the labels is handled
+func (s scope) selects(namespace string, resourceLabels map[string]string) bool {
+	selector, err := labels.Parse(s.labelSelector)
+	if err != nil {
+		return false
+	}
+	return s.includes(namespace) && selector.Matches(labels.Set(resourceLabels))
+}
+
+func (s scope) String() string {
+	description := "every namespace"
+	if len(s.namespaces) > 0 {
+		description = "namespaces " + strings.Join(s.namespaces, ",")
+	}
+	if len(s.excludeNamespaces) > 0 {
+		description += " except " + strings.Join(s.excludeNamespaces, ",")
+	}
+	if s.labelSelector != "" {
+		description += " with labels " + s.labelSelector
+	}
+	return description
+}
+
+// watchedNamespaces are the namespaces that get their own informer, or metav1.NamespaceAll
+func (s scope) watchedNamespaces() []string {
+	if len(s.namespaces) == 0 {
+		return []string{metav1.NamespaceAll}
+	}
+	namespaces := []string{}
+	for _, namespace := range s.namespaces {
+		if s.includes(namespace) {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	return namespaces
+}
+
+// listOptions filters the resources on the server. Excluded namespaces are filtered with a field selector when
+// every namespace is watched.
+func (s scope) listOptions(options *metav1.ListOptions) {
+	options.LabelSelector = s.labelSelector
+	if len(s.namespaces) == 0 && len(s.excludeNamespaces) > 0 {
+		selectors := []fields.Selector{}
+		for _, namespace := range s.excludeNamespaces {
+			selectors = append(selectors, fields.OneTermNotEqualSelector("metadata.namespace", namespace))
+		}
+		options.FieldSelector = fields.AndSelectors(selectors...).String()
+	}
+}
+
+// informerFactories returns an informer factory for each watched namespace
+func (s scope) informerFactories(client dynamic.Interface) []dynamicinformer.DynamicSharedInformerFactory {
+	factories := []dynamicinformer.DynamicSharedInformerFactory{}
+	for _, namespace := range s.watchedNamespaces() {
+		factories = append(factories, dynamicinformer.NewFilteredDynamicSharedInformerFactory(client, 0, namespace, s.listOptions))
+	}
+	return factories
+}
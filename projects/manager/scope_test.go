@@ -0,0 +1,119 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestScopeFromEnv(t *testing.T) {
+	t.Setenv("MONITOR_NAMESPACES", " team-a, ,team-b ")
+	t.Setenv("MONITOR_EXCLUDE_NAMESPACES", "kube-system")
+	t.Setenv("MONITOR_LABEL_SELECTOR", "team=infra")
+	s, err := scopeFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(s.namespaces, ",") != "team-a,team-b" || strings.Join(s.excludeNamespaces, ",") != "kube-system" || s.labelSelector != "team=infra" {
+		t.Errorf("scopeFromEnv() = %+v", s)
+	}
+
+	t.Setenv("MONITOR_LABEL_SELECTOR", "team in (")
+	if _, err := scopeFromEnv(); err == nil {
+		t.Error("scopeFromEnv() accepted an invalid MONITOR_LABEL_SELECTOR")
+	}
+}
+
+func TestScopeIncludes(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		scope     scope
+		namespace string
+		expected  bool
+	}{
+		{"every namespace", scope{}, "team-a", true},
+		{"allowed", scope{namespaces: []string{"team-a", "team-b"}}, "team-b", true},
+		{"not allowed", scope{namespaces: []string{"team-a"}}, "team-b", false},
+		{"denied", scope{excludeNamespaces: []string{"kube-system"}}, "kube-system", false},
+		{"not denied", scope{excludeNamespaces: []string{"kube-system"}}, "team-a", true},
+		{"allowed and denied", scope{namespaces: []string{"team-a"}, excludeNamespaces: []string{"team-a"}}, "team-a", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.scope.includes(test.namespace); got != test.expected {
+				t.Errorf("includes(%q) = %t, want %t", test.namespace, got, test.expected)
+			}
+		})
+	}
+}
+
+func TestScopeSelects(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		scope     scope
+		namespace string
+		labels    map[string]string
+		expected  bool
+	}{
+		{"no selector", scope{}, "team-a", nil, true},
+		{"matching labels", scope{labelSelector: "team=infra,env!=dev"}, "team-a", map[string]string{"team": "infra", "env": "prod"}, true},
+		{"excluded value", scope{labelSelector: "team=infra,env!=dev"}, "team-a", map[string]string{"team": "infra", "env": "dev"}, false},
+		{"missing label", scope{labelSelector: "team=infra"}, "team-a", map[string]string{"env": "prod"}, false},
+		{"set based", scope{labelSelector: "team in (infra,data)"}, "team-a", map[string]string{"team": "data"}, true},
+		{"existence", scope{labelSelector: "!skip-monitor"}, "team-a", map[string]string{"skip-monitor": ""}, false},
+		{"matching labels in a denied namespace", scope{excludeNamespaces: []string{"team-a"}, labelSelector: "team=infra"}, "team-a", map[string]string{"team": "infra"}, false},
+		{"invalid selector", scope{labelSelector: "team in ("}, "team-a", map[string]string{"team": "infra"}, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.scope.selects(test.namespace, test.labels); got != test.expected {
+				t.Errorf("selects(%q, %v) = %t, want %t", test.namespace, test.labels, got, test.expected)
+			}
+		})
+	}
+}
+
+func TestScopeWatchedNamespaces(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		scope    scope
+		expected []string
+	}{
+		{"every namespace", scope{excludeNamespaces: []string{"kube-system"}}, []string{metav1.NamespaceAll}},
+		{"allowed", scope{namespaces: []string{"team-a", "team-b"}}, []string{"team-a", "team-b"}},
+		{"allowed and denied", scope{namespaces: []string{"team-a", "team-b"}, excludeNamespaces: []string{"team-b"}}, []string{"team-a"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.scope.watchedNamespaces(); strings.Join(got, ",") != strings.Join(test.expected, ",") {
+				t.Errorf("watchedNamespaces() = %q, want %q", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestScopeListOptions(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		scope         scope
+		labelSelector string
+		fieldSelector string
+	}{
+		{"every namespace", scope{}, "", ""},
+		{"label selector", scope{labelSelector: "team=infra"}, "team=infra", ""},
+		{"denied", scope{excludeNamespaces: []string{"kube-system"}}, "", "metadata.namespace!=kube-system"},
+		{"several denied", scope{excludeNamespaces: []string{"kube-system", "tf-system"}, labelSelector: "team=infra"}, "team=infra",
+			"metadata.namespace!=kube-system,metadata.namespace!=tf-system"},
+		// Each allowed namespace has its own informer, the denied ones are not watched at all
+		{"allowed and denied", scope{namespaces: []string{"team-a"}, excludeNamespaces: []string{"kube-system"}}, "", ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			options := metav1.ListOptions{}
+			test.scope.listOptions(&options)
+			if options.LabelSelector != test.labelSelector {
+				t.Errorf("LabelSelector = %q, want %q", options.LabelSelector, test.labelSelector)
+			}
+			if options.FieldSelector != test.fieldSelector {
+				t.Errorf("FieldSelector = %q, want %q", options.FieldSelector, test.fieldSelector)
+			}
+		})
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/galleybytes/monitor/pkg/handlers"
+	"github.com/galleybytes/monitor/pkg/models"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// conditionsAnnotation holds the monitoring conditions of the resource as a JSON list of metav1.Condition.
+	// The status subresource belongs to terraform-operator, which replaces it on every reconcile.
+	conditionsAnnotation = "monitor.galleybytes.com/conditions"
+
+	// statusAnnotation is a one word summary of the conditions for kubectl get -o custom-columns
+	statusAnnotation = "monitor.galleybytes.com/status"
+
+	conditionMonitorConfigured = "MonitorConfigured"
+	conditionLogsShipping      = "LogsShipping"
+	conditionAwaitingApproval  = "AwaitingApproval"
+	conditionApprovalDecided   = "ApprovalDecided"
+)
+
+// statusReporter keeps the monitoring conditions of the resources up to date from the ConfigMaps the manager
+// writes and what the monitors shipped to the backend
+type statusReporter struct {
+	client             kubernetes.Interface
+	dynamicClient      dynamic.Interface
+	terraformResources terraformResources
+	registry           *registry
+	credentials        credentials
+	now                func() time.Time
+}
+
+func newStatusReporter(client kubernetes.Interface, dynamicClient dynamic.Interface, terraformResources terraformResources, r *registry, c credentials) *statusReporter {
+	return &statusReporter{
+		client:             client,
+		dynamicClient:      dynamicClient,
+		terraformResources: terraformResources,
+		registry:           r,
+		credentials:        c,
+		now:                time.Now,
+	}
+}
+
+// lookup returns the resource registered by this cluster, which is the fork when the resource is bound to another
+// cluster, and the status of its current generation. The backend caches the line counts of the task pods that are no
+// longer running.
+func (r *registry) lookup(tf terraform) (tfoResource *models.TFOResource, status handlers.GenerationStatus, err error) {
+	tfoResource, err = r.backend.FindTFOResource(string(tf.UID))
+	if err != nil {
+		return nil, status, err
+	}
+	if tfoResource != nil && tfoResource.ClusterID != r.cluster.ID {
+		tfoResource, err = r.backend.FindTFOResource(handlers.ForkUUID(string(tf.UID), r.cluster))
+		if err != nil {
+			return nil, status, err
+		}
+	}
+	if tfoResource == nil {
+		return nil, status, nil
+	}
+	status, err = r.backend.GenerationStatus(tfoResource.UUID, strconv.FormatInt(tf.Generation, 10), tf.stage())
+	if err != nil {
+		return nil, status, err
+	}
+	return tfoResource, status, nil
+}
+
+// configured checks the ConfigMap and the registration of the current generation
+func (s *statusReporter) configured(tf terraform, tfoResource *models.TFOResource) metav1.Condition {
+	condition := metav1.Condition{Type: conditionMonitorConfigured, Status: metav1.ConditionFalse}
+	name := fmt.Sprintf("%s-monitor-envs", tf.Name)
+	configMap, err := s.client.CoreV1().ConfigMaps(tf.Namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	switch {
+	case err != nil:
+		condition.Reason, condition.Message = "EnvsMissing", fmt.Sprintf("configmap %s: %s", name, err)
+	case len(diffKeys(configMap.Data, s.credentials.configMapData)) > 0:
+		condition.Reason, condition.Message = "EnvsDrifted", fmt.Sprintf("configmap %s differs from the desired env", name)
+	case tfoResource == nil:
+		condition.Reason, condition.Message = "NotRegistered", "the resource is not registered with the backend"
+	case tfoResource.CurrentGeneration != strconv.FormatInt(tf.Generation, 10):
+		condition.Reason, condition.Message = "GenerationNotRegistered", fmt.Sprintf("generation %s is registered instead of %d", tfoResource.CurrentGeneration, tf.Generation)
+	default:
+		condition.Status, condition.Reason, condition.Message = metav1.ConditionTrue, "Configured", fmt.Sprintf("registered as %s", tfoResource.UUID)
+	}
+	return condition
+}
+
+// conditions derives the monitoring conditions of the current generation
+func (s *statusReporter) conditions(tf terraform) []metav1.Condition {
+	tfoResource, status, err := s.registry.lookup(tf)
+	if err != nil {
+		unknown := func(conditionType string) metav1.Condition {
+			return metav1.Condition{Type: conditionType, Status: metav1.ConditionUnknown, Reason: "BackendUnavailable", Message: err.Error()}
+		}
+		return []metav1.Condition{
+			unknown(conditionMonitorConfigured), unknown(conditionLogsShipping),
+			unknown(conditionAwaitingApproval), unknown(conditionApprovalDecided),
+		}
+	}
+	conditions := []metav1.Condition{s.configured(tf, tfoResource)}
+
+	logsShipping := metav1.Condition{Type: conditionLogsShipping, Status: metav1.ConditionFalse, Reason: "NoLogs",
+		Message: fmt.Sprintf("no logs have been shipped for generation %d", tf.Generation)}
+	if lines := status.Lines(); lines > 0 {
+		logsShipping.Status, logsShipping.Reason = metav1.ConditionTrue, "Shipping"
+		logsShipping.Message = fmt.Sprintf("%d lines from %d task pods of generation %d", lines, len(status.TaskPods), tf.Generation)
+	}
+	conditions = append(conditions, logsShipping)
+
+	// terraform-operator holds the workflow after the plan until the plan pod is approved or canceled
+	awaiting := metav1.Condition{Type: conditionAwaitingApproval, Status: metav1.ConditionFalse, Reason: "ApprovalNotRequired"}
+	decided := metav1.Condition{Type: conditionApprovalDecided, Status: metav1.ConditionFalse, Reason: "ApprovalNotRequired"}
+	if tf.Spec.RequireApproval {
+		plan := status.Latest("plan")
+		switch {
+		case plan == nil:
+			awaiting.Reason, decided.Reason = "NoPlan", "NoPlan"
+		case plan.Approval == nil:
+			awaiting.Status, awaiting.Reason = metav1.ConditionTrue, "PlanAwaitingApproval"
+			awaiting.Message = fmt.Sprintf("plan %s is waiting to be approved or canceled", plan.TaskPod.UUID)
+			decided.Reason = "Undecided"
+		case plan.Approval.IsApproved:
+			awaiting.Reason = "Decided"
+			decided.Status, decided.Reason, decided.Message = metav1.ConditionTrue, "Approved", fmt.Sprintf("plan %s was approved", plan.TaskPod.UUID)
+		default:
+			awaiting.Reason = "Decided"
+			decided.Status, decided.Reason, decided.Message = metav1.ConditionTrue, "Canceled", fmt.Sprintf("plan %s was canceled", plan.TaskPod.UUID)
+		}
+	}
+	return append(conditions, awaiting, decided)
+}
+
+// summary is the statusAnnotation for the conditions
+func summary(conditions []metav1.Condition) string {
+	switch {
+	case meta.IsStatusConditionPresentAndEqual(conditions, conditionMonitorConfigured, metav1.ConditionUnknown):
+		return "Unknown"
+	case !meta.IsStatusConditionTrue(conditions, conditionMonitorConfigured):
+		return "NotConfigured"
+	case meta.IsStatusConditionTrue(conditions, conditionAwaitingApproval):
+		return "AwaitingApproval"
+	case meta.IsStatusConditionTrue(conditions, conditionLogsShipping):
+		return "Shipping"
+	}
+	return "Configured"
+}
+
+// report patches the conditions of the resource when they changed. The last transition times of conditions that
+// did not change are kept.
+func (s *statusReporter) report(tf terraform) error {
+	if tf.DeletionTimestamp != nil {
+		return nil
+	}
+	current := []metav1.Condition{}
+	if value, found := tf.Annotations[conditionsAnnotation]; found {
+		if err := json.Unmarshal([]byte(value), &current); err != nil {
+			log.Printf("...replacing unreadable %s of '%s/%s': %s\n", conditionsAnnotation, tf.Namespace, tf.Name, err)
+			current = []metav1.Condition{}
+		}
+	}
+	conditions := append([]metav1.Condition{}, current...)
+	for _, condition := range s.conditions(tf) {
+		condition.ObservedGeneration = tf.Generation
+		condition.LastTransitionTime = metav1.NewTime(s.now())
+		meta.SetStatusCondition(&conditions, condition)
+	}
+	b, err := json.Marshal(conditions)
+	if err != nil {
+		return err
+	}
+	status := summary(conditions)
+	if string(b) == tf.Annotations[conditionsAnnotation] && status == tf.Annotations[statusAnnotation] {
+		return nil
+	}
+
+	// The patch carries the uid so the annotations are not written to a resource recreated with the same name
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"uid": tf.UID,
+			"annotations": map[string]string{
+				conditionsAnnotation: string(b),
+				statusAnnotation:     status,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	terraformResource, found := s.terraformResources.forAPIVersion(tf.APIVersion)
+	if !found {
+		return fmt.Errorf("%s is not watched", tf.APIVersion)
+	}
+	_, err = s.dynamicClient.Resource(terraformResource).Namespace(tf.Namespace).
+		Patch(context.TODO(), tf.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return err
+	}
+	log.Printf("...reported '%s/%s' as %s\n", tf.Namespace, tf.Name, status)
+	return nil
+}
+
+// reportEvery reports the conditions of the resources in the informers until stopCh is closed
+func (s *statusReporter) reportEvery(interval time.Duration, informers []cache.SharedIndexInformer, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+		for _, informer := range informers {
+			for _, obj := range informer.GetStore().List() {
+				tf, err := decodeTerraform(obj)
+				if err == nil {
+					err = s.report(tf)
+				}
+				if err != nil {
+					log.Println("ERROR in status report", err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/galleybytes/monitor/pkg/handlers"
+	"github.com/galleybytes/monitor/pkg/models"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+// fakeBackend returns the resources and generation statuses the test set. Calls the manager does not make in
+// these tests panic on the nil Backend.
+type fakeBackend struct {
+	handlers.Backend
+
+	tfoResources map[string]*models.TFOResource
+	status       handlers.GenerationStatus
+	unavailable  bool
+	statusErr    error
+
+	// stage is what the last GenerationStatus was called with
+	stage handlers.Stage
+}
+
+func (b *fakeBackend) FindTFOResource(uuid string) (*models.TFOResource, error) {
+	if b.unavailable {
+		return nil, fmt.Errorf("connection refused")
+	}
+	return b.tfoResources[uuid], nil
+}
+
+func (b *fakeBackend) GenerationStatus(uuid, generation string, stage handlers.Stage) (handlers.GenerationStatus, error) {
+	b.stage = stage
+	return b.status, b.statusErr
+}
+
+func testCluster() models.Cluster {
+	cluster := models.Cluster{Name: "test-cluster"}
+	cluster.ID = 1
+	return cluster
+}
+
+func newTestStatusReporter(backend *fakeBackend, objects ...runtime.Object) (*statusReporter, *dynamicfake.FakeDynamicClient) {
+	client := fake.NewSimpleClientset(testConfigMap("uid-1", testCredentials().configMapData))
+	dynamicClient := newTestDynamicClient(objects...)
+	r := &registry{backend: backend, cluster: testCluster()}
+	s := newStatusReporter(client, dynamicClient, terraformResources{testTerraformResource}, r, testCredentials())
+	s.now = func() time.Time { return time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC) }
+	return s, dynamicClient
+}
+
+func registered(generation string) *fakeBackend {
+	return &fakeBackend{tfoResources: map[string]*models.TFOResource{
+		"uid-1": {UUID: "uid-1", CurrentGeneration: generation, ClusterID: 1},
+	}}
+}
+
+func conditionReasons(conditions []metav1.Condition) map[string]string {
+	reasons := map[string]string{}
+	for _, condition := range conditions {
+		reasons[condition.Type] = string(condition.Status) + "/" + condition.Reason
+	}
+	return reasons
+}
+
+func TestConditions(t *testing.T) {
+	planTaskPod := models.TaskPod{UUID: "plan-uid", TaskType: "plan"}
+	for _, test := range []struct {
+		name            string
+		backend         *fakeBackend
+		requireApproval bool
+		expected        map[string]string
+		summary         string
+	}{
+		{
+			name:    "not registered",
+			backend: &fakeBackend{},
+			expected: map[string]string{
+				conditionMonitorConfigured: "False/NotRegistered",
+				conditionLogsShipping:      "False/NoLogs",
+				conditionAwaitingApproval:  "False/ApprovalNotRequired",
+			},
+			summary: "NotConfigured",
+		},
+		{
+			name:     "generation not registered",
+			backend:  registered("1"),
+			expected: map[string]string{conditionMonitorConfigured: "False/GenerationNotRegistered"},
+			summary:  "NotConfigured",
+		},
+		{
+			name:     "backend unavailable",
+			backend:  &fakeBackend{unavailable: true},
+			expected: map[string]string{conditionMonitorConfigured: "Unknown/BackendUnavailable", conditionApprovalDecided: "Unknown/BackendUnavailable"},
+			summary:  "Unknown",
+		},
+		{
+			name: "status unavailable",
+			backend: func() *fakeBackend {
+				b := registered("2")
+				b.statusErr = fmt.Errorf("connection refused")
+				return b
+			}(),
+			expected: map[string]string{conditionMonitorConfigured: "Unknown/BackendUnavailable", conditionApprovalDecided: "Unknown/BackendUnavailable"},
+			summary:  "Unknown",
+		},
+		{
+			name: "shipping",
+			backend: func() *fakeBackend {
+				b := registered("2")
+				b.status.TaskPods = []handlers.TaskPodStatus{{TaskPod: models.TaskPod{UUID: "init-uid", TaskType: "init"}, Lines: 3}}
+				return b
+			}(),
+			expected: map[string]string{conditionMonitorConfigured: "True/Configured", conditionLogsShipping: "True/Shipping"},
+			summary:  "Shipping",
+		},
+		{
+			name: "awaiting approval",
+			backend: func() *fakeBackend {
+				b := registered("2")
+				b.status.TaskPods = []handlers.TaskPodStatus{{TaskPod: planTaskPod, Lines: 3}}
+				return b
+			}(),
+			requireApproval: true,
+			expected:        map[string]string{conditionAwaitingApproval: "True/PlanAwaitingApproval", conditionApprovalDecided: "False/Undecided"},
+			summary:         "AwaitingApproval",
+		},
+		{
+			name: "approved",
+			backend: func() *fakeBackend {
+				b := registered("2")
+				b.status.TaskPods = []handlers.TaskPodStatus{{TaskPod: planTaskPod, Lines: 3, Approval: &models.Approval{IsApproved: true}}}
+				return b
+			}(),
+			requireApproval: true,
+			expected:        map[string]string{conditionAwaitingApproval: "False/Decided", conditionApprovalDecided: "True/Approved"},
+			summary:         "Shipping",
+		},
+		{
+			name: "canceled",
+			backend: func() *fakeBackend {
+				b := registered("2")
+				b.status.TaskPods = []handlers.TaskPodStatus{{TaskPod: planTaskPod, Approval: &models.Approval{IsApproved: false}}}
+				return b
+			}(),
+			requireApproval: true,
+			expected:        map[string]string{conditionApprovalDecided: "True/Canceled", conditionLogsShipping: "False/NoLogs"},
+			summary:         "Configured",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s, _ := newTestStatusReporter(test.backend)
+			tf, _ := decodeTerraform(testTerraform("uid-1", 2).Object)
+			tf.Spec.RequireApproval = test.requireApproval
+
+			conditions := s.conditions(tf)
+			reasons := conditionReasons(conditions)
+			for conditionType, expected := range test.expected {
+				if reasons[conditionType] != expected {
+					t.Errorf("expected %s to be %s, got %s", conditionType, expected, reasons[conditionType])
+				}
+			}
+			if got := summary(conditions); got != test.summary {
+				t.Errorf("expected the summary %s, got %s", test.summary, got)
+			}
+		})
+	}
+}
+
+func TestConditionsOfDriftedEnvs(t *testing.T) {
+	s, _ := newTestStatusReporter(registered("2"))
+	s.credentials.configMapData = map[string]string{"CLUSTER_NAME": "other-cluster"}
+	tf, _ := decodeTerraform(testTerraform("uid-1", 2).Object)
+	if got := conditionReasons(s.conditions(tf))[conditionMonitorConfigured]; got != "False/EnvsDrifted" {
+		t.Errorf("expected the drifted configmap to be reported, got %s", got)
+	}
+
+	tf.Name = "missing"
+	if got := conditionReasons(s.conditions(tf))[conditionMonitorConfigured]; got != "False/EnvsMissing" {
+		t.Errorf("expected the missing configmap to be reported, got %s", got)
+	}
+}
+
+func TestLookupFindsTheFork(t *testing.T) {
+	fork := handlers.ForkUUID("uid-1", testCluster())
+	backend := &fakeBackend{tfoResources: map[string]*models.TFOResource{
+		"uid-1": {UUID: "uid-1", CurrentGeneration: "2", ClusterID: 2},
+		fork:    {UUID: fork, CurrentGeneration: "2", ClusterID: 1},
+	}}
+	r := &registry{backend: backend, cluster: testCluster()}
+	tf, _ := decodeTerraform(testTerraform("uid-1", 2).Object)
+	tfoResource, _, err := r.lookup(tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tfoResource == nil || tfoResource.UUID != fork {
+		t.Errorf("expected the fork registered by this cluster, got %+v", tfoResource)
+	}
+}
+
+func patches(dynamicClient *dynamicfake.FakeDynamicClient) []clienttesting.PatchAction {
+	patches := []clienttesting.PatchAction{}
+	for _, action := range dynamicClient.Actions() {
+		if patch, ok := action.(clienttesting.PatchAction); ok {
+			patches = append(patches, patch)
+		}
+	}
+	return patches
+}
+
+func TestReportPatchesTheAnnotations(t *testing.T) {
+	backend := registered("2")
+	s, dynamicClient := newTestStatusReporter(backend, testTerraform("uid-1", 2))
+	tf, _ := decodeTerraform(testTerraform("uid-1", 2).Object)
+
+	if err := s.report(tf); err != nil {
+		t.Fatal(err)
+	}
+	u, err := dynamicClient.Resource(testTerraformResource).Namespace("default").Get(context.TODO(), "example", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := u.GetAnnotations()[statusAnnotation]; got != "Configured" {
+		t.Errorf("expected the status Configured, got %s", got)
+	}
+	conditions := []metav1.Condition{}
+	if err := json.Unmarshal([]byte(u.GetAnnotations()[conditionsAnnotation]), &conditions); err != nil {
+		t.Fatal(err)
+	}
+	configured := meta.FindStatusCondition(conditions, conditionMonitorConfigured)
+	if configured == nil || configured.ObservedGeneration != 2 || !configured.LastTransitionTime.Time.Equal(s.now()) {
+		t.Errorf("unexpected condition %+v", configured)
+	}
+
+	// Unchanged conditions are not written again and keep their transition time
+	tf, _ = decodeTerraform(u.Object)
+	s.now = func() time.Time { return time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC) }
+	if err := s.report(tf); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(patches(dynamicClient)); got != 1 {
+		t.Errorf("expected a single patch, got %d", got)
+	}
+
+	backend.status.TaskPods = []handlers.TaskPodStatus{{TaskPod: models.TaskPod{UUID: "init-uid", TaskType: "init"}, Lines: 1}}
+	if err := s.report(tf); err != nil {
+		t.Fatal(err)
+	}
+	u, err = dynamicClient.Resource(testTerraformResource).Namespace("default").Get(context.TODO(), "example", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := u.GetAnnotations()[statusAnnotation]; got != "Shipping" {
+		t.Errorf("expected the status Shipping, got %s", got)
+	}
+	conditions = []metav1.Condition{}
+	if err := json.Unmarshal([]byte(u.GetAnnotations()[conditionsAnnotation]), &conditions); err != nil {
+		t.Fatal(err)
+	}
+	if configured := meta.FindStatusCondition(conditions, conditionMonitorConfigured); !configured.LastTransitionTime.Time.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected the transition time of %s to be kept, got %s", conditionMonitorConfigured, configured.LastTransitionTime)
+	}
+	if shipping := meta.FindStatusCondition(conditions, conditionLogsShipping); !shipping.LastTransitionTime.Time.Equal(s.now()) {
+		t.Errorf("expected %s to transition, got %s", conditionLogsShipping, shipping.LastTransitionTime)
+	}
+}
+
+func TestReportSkipsDeletedResources(t *testing.T) {
+	s, dynamicClient := newTestStatusReporter(registered("2"), testTerraform("uid-1", 2))
+	tf, _ := decodeTerraform(testTerraform("uid-1", 2).Object)
+	now := metav1.Now()
+	tf.DeletionTimestamp = &now
+	if err := s.report(tf); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(patches(dynamicClient)); got != 0 {
+		t.Errorf("expected no patch, got %d", got)
+	}
+}
+
+func TestLookupIsActiveUntilTheGenerationCompleted(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		status map[string]interface{}
+		stage  handlers.Stage
+	}{
+		{"no status", nil, handlers.Stage{Active: true}},
+		{"running", map[string]interface{}{"phase": "running", "stage": map[string]interface{}{"generation": int64(2), "podType": "plan"}}, handlers.Stage{Active: true, TaskType: "plan"}},
+		{"completed", map[string]interface{}{"phase": "completed", "stage": map[string]interface{}{"generation": int64(2), "podType": "apply"}}, handlers.Stage{}},
+		{"completed an earlier generation", map[string]interface{}{"phase": "completed", "stage": map[string]interface{}{"generation": int64(1), "podType": "apply"}}, handlers.Stage{Active: true}},
+		{"running an earlier generation", map[string]interface{}{"phase": "running", "stage": map[string]interface{}{"generation": int64(1), "podType": "apply"}}, handlers.Stage{Active: true}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			backend := registered("2")
+			r := &registry{backend: backend, cluster: testCluster()}
+			obj := testTerraform("uid-1", 2)
+			if test.status != nil {
+				obj.Object["status"] = test.status
+			}
+			tf, _ := decodeTerraform(obj.Object)
+			if _, _, err := r.lookup(tf); err != nil {
+				t.Fatal(err)
+			}
+			if backend.stage != test.stage {
+				t.Errorf("GenerationStatus() was called with stage %+v, want %+v", backend.stage, test.stage)
+			}
+		})
+	}
+}
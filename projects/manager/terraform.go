@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/galleybytes/monitor/pkg/handlers"
+	"github.com/galleybytes/monitor/pkg/tfapi"
+	"github.com/galleybytes/monitor/pkg/tfoclient"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+)
+
+// terraform is the part of a Terraform resource the manager reads. It is the same in every group and version
+// terraform-operator serves, so the manager does not depend on the types of a single release.
+type terraform struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec struct {
+		// RequireApproval holds the workflow after the plan until the plan pod is approved or canceled
+		RequireApproval bool `json:"requireApproval,omitempty"`
+	} `json:"spec"`
+
+	Status struct {
+		// Phase is "completed" when terraform-operator finished the workflow of the generation of the Stage
+		Phase string `json:"phase,omitempty"`
+		Stage struct {
+			Generation int64 `json:"generation,omitempty"`
+			// TaskType is the task terraform-operator is running for the generation
+			TaskType string `json:"podType,omitempty"`
+		} `json:"stage"`
+	} `json:"status"`
+}
+
+// stage is what terraform-operator runs of the current generation, so the monitor may still ship logs for it. The
+// task type of the Stage is only known once terraform-operator picked up the current generation.
+func (tf terraform) stage() handlers.Stage {
+	stage := handlers.Stage{Active: tf.Status.Phase != "completed" || tf.Status.Stage.Generation != tf.Generation}
+	if stage.Active && tf.Status.Stage.Generation == tf.Generation {
+		stage.TaskType = tf.Status.Stage.TaskType
+	}
+	return stage
+}
+
+// decodeTerraform reads a resource from an informer or the dynamic client
+func decodeTerraform(obj interface{}) (terraform, error) {
+	tf := terraform{}
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return tf, err
+	}
+	err = json.Unmarshal(b, &tf)
+	return tf, err
+}
+
+// terraformResources are the served group versions the Terraform resources are watched in
+type terraformResources []schema.GroupVersionResource
+
+// discoverTerraformResources finds the groups in MONITOR_API_GROUPS the API server serves and their preferred
+// version, unless a version is pinned like tf.isaaguilar.com/v1alpha2. The groups are only discovered at start
+// so the manager has to be restarted when terraform-operator is installed or upgraded to a new group.
+func discoverTerraformResources(client discovery.DiscoveryInterface) (terraformResources, error) {
+	wanted, err := tfapi.ParseGroups(os.Getenv("MONITOR_API_GROUPS"))
+	if err != nil {
+		return nil, fmt.Errorf("MONITOR_API_GROUPS is not valid: %s", err)
+	}
+	return tfoclient.Resources(client, wanted)
+}
+
+// forAPIVersion returns the watched resource of the group of apiVersion. Only the group is compared so owner
+// references written with an older version of the group still resolve.
+func (r terraformResources) forAPIVersion(apiVersion string) (schema.GroupVersionResource, bool) {
+	groupVersion, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil {
+		return schema.GroupVersionResource{}, false
+	}
+	for _, resource := range r {
+		if resource.Group == groupVersion.Group {
+			return resource, true
+		}
+	}
+	return schema.GroupVersionResource{}, false
+}
+
+func (r terraformResources) String() string {
+	s := ""
+	for n, resource := range r {
+		if n > 0 {
+			s += ", "
+		}
+		s += resource.GroupVersion().String()
+	}
+	return s
+}
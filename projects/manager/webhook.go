@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/galleybytes/monitor/pkg/tfapi"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// injectKey is the namespace label and pod annotation that opt in ("enabled" or "true") or out ("disabled"
+	// or "false") of injection. The pod annotation wins over the namespace label.
+	injectKey = "monitor.galleybytes.com/inject"
+
+	monitorContainerName = "monitor"
+
+	serviceAccountTokenVolume = "monitor-token"
+	serviceAccountTokenPath   = "/var/run/secrets/monitor"
+)
+
+// monitorEnvs are copied from the task container so the monitor follows the same resource and generation
+var monitorEnvs = []string{"TFO_RESOURCE", "TFO_RESOURCE_UUID", "TFO_NAMESPACE", "TFO_GENERATION", "TFO_ROOT_PATH"}
+
+type patchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// injector injects the monitor sidecar into terraform-operator task pods
+type injector struct {
+	image string
+
+	// scope skips pods in namespaces the manager does not handle
+	scope scope
+
+	// audience of the service account token the monitor authenticates to the manager with
+	audience string
+
+	// enabledByDefault is used for namespaces without the inject label
+	enabledByDefault bool
+
+	// namespaceLabels looks up the labels of the namespace of the pod
+	namespaceLabels func(namespace string) (map[string]string, error)
+}
+
+func newInjector(s scope, namespaceLabels func(namespace string) (map[string]string, error)) injector {
+	return injector{
+		image:            envOrPanic("MONITOR_IMAGE", "ghcr.io/galleybytes/monitor:latest"),
+		scope:            s,
+		audience:         tokenAudience(),
+		enabledByDefault: envOrPanic("MONITOR_INJECTION_DEFAULT", "enabled") == "enabled",
+		namespaceLabels:  namespaceLabels,
+	}
+}
+
+func optedIn(value string) (bool, bool) {
+	switch value {
+	case "enabled", "true":
+		return true, true
+	case "disabled", "false":
+		return false, true
+	}
+	return false, false
+}
+
+// isTaskPod checks for the label terraform-operator sets on every task pod, in the group of its release
+func isTaskPod(pod corev1.Pod) bool {
+	for _, group := range tfapi.Groups {
+		if _, found := pod.Labels[tfapi.ResourceNameLabel(group)]; found {
+			return true
+		}
+	}
+	return false
+}
+
+// enabled decides if the pod gets the sidecar. It returns the reason when it does not.
+func (i injector) enabled(pod corev1.Pod, namespaceLabels map[string]string) (bool, string) {
+	if !isTaskPod(pod) {
+		return false, "not a terraform-operator task pod"
+	}
+	for _, container := range append(pod.Spec.InitContainers, pod.Spec.Containers...) {
+		if container.Name == monitorContainerName {
+			return false, "already injected"
+		}
+	}
+	if enabled, found := optedIn(pod.Annotations[injectKey]); found {
+		if !enabled {
+			return false, "disabled by the pod annotation"
+		}
+		return true, ""
+	}
+	if enabled, found := optedIn(namespaceLabels[injectKey]); found {
+		if !enabled {
+			return false, "disabled by the namespace label"
+		}
+		return true, ""
+	}
+	if !i.enabledByDefault {
+		return false, "namespace has not opted in"
+	}
+	return true, ""
+}
+
+// sidecar is the monitor container for the task pod. It reads the env and the volume mount of TFO_ROOT_PATH from
+// the task container.
+func (i injector) sidecar(pod corev1.Pod) (corev1.Container, error) {
+	var task *corev1.Container
+	for n := range pod.Spec.Containers {
+		if pod.Spec.Containers[n].Name == "task" {
+			task = &pod.Spec.Containers[n]
+		}
+	}
+	if task == nil {
+		return corev1.Container{}, fmt.Errorf("task container not found")
+	}
+
+	envs := map[string]corev1.EnvVar{}
+	for _, env := range task.Env {
+		envs[env.Name] = env
+	}
+	container := corev1.Container{
+		Name:            monitorContainerName,
+		Image:           i.image,
+		ImagePullPolicy: corev1.PullIfNotPresent,
+		Env: []corev1.EnvVar{
+			{Name: "MONITOR_SERVICE_ACCOUNT_TOKEN_FILE", Value: serviceAccountTokenPath + "/token"},
+		},
+		VolumeMounts: []corev1.VolumeMount{
+			{Name: serviceAccountTokenVolume, MountPath: serviceAccountTokenPath, ReadOnly: true},
+		},
+	}
+	// The env is copied as it is, so a value read from a ConfigMap, a Secret or a field of the pod is read the same
+	// way by the monitor. The webhook needs the value of TFO_RESOURCE and TFO_ROOT_PATH itself.
+	for _, name := range monitorEnvs {
+		env, found := envs[name]
+		if !found || (env.Value == "" && env.ValueFrom == nil) {
+			return corev1.Container{}, fmt.Errorf("%s is not set on the task container", name)
+		}
+		container.Env = append(container.Env, env)
+	}
+	for _, name := range []string{"TFO_RESOURCE", "TFO_ROOT_PATH"} {
+		if envs[name].Value == "" {
+			return corev1.Container{}, fmt.Errorf("%s of the task container must be a value", name)
+		}
+	}
+
+	// The env distributed to the namespace by the manager. The Secret only holds the password of the
+	// monitor role with MONITOR_CREDENTIALS=database. Both are optional so the task still runs when the manager did not write them
+	// yet, the monitor exits with the env that is missing instead.
+	envsName := fmt.Sprintf("%s-monitor-envs", envs["TFO_RESOURCE"].Value)
+	container.EnvFrom = []corev1.EnvFromSource{
+		{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: envsName}, Optional: boolp(true)}},
+		{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: envsName}, Optional: boolp(true)}},
+	}
+
+	rootPathMounted := false
+	for _, volumeMount := range task.VolumeMounts {
+		if volumeMount.MountPath == envs["TFO_ROOT_PATH"].Value {
+			container.VolumeMounts = append(container.VolumeMounts, volumeMount)
+			rootPathMounted = true
+		}
+	}
+	if !rootPathMounted {
+		return corev1.Container{}, fmt.Errorf("no volume is mounted at TFO_ROOT_PATH %s", envs["TFO_ROOT_PATH"].Value)
+	}
+	return container, nil
+}
+
+// patch adds the monitor as a native sidecar, an init container that keeps running, so the pod still completes
+// when the task does. This needs Kubernetes 1.29 or later.
+func (i injector) patch(pod corev1.Pod) ([]patchOperation, error) {
+	container, err := i.sidecar(pod)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(container)
+	if err != nil {
+		return nil, err
+	}
+	// k8s.io/api does not know restartPolicy on containers yet
+	sidecar := map[string]interface{}{}
+	if err := json.Unmarshal(b, &sidecar); err != nil {
+		return nil, err
+	}
+	sidecar["restartPolicy"] = "Always"
+
+	// The projected service account token the monitor exchanges for an API token. The kubelet rotates it.
+	expirationSeconds := int64(3600)
+	volume := corev1.Volume{
+		Name: serviceAccountTokenVolume,
+		VolumeSource: corev1.VolumeSource{
+			Projected: &corev1.ProjectedVolumeSource{
+				Sources: []corev1.VolumeProjection{
+					{ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+						Audience:          i.audience,
+						ExpirationSeconds: &expirationSeconds,
+						Path:              "token",
+					}},
+				},
+			},
+		},
+	}
+
+	patch := []patchOperation{}
+	if len(pod.Spec.InitContainers) == 0 {
+		patch = append(patch, patchOperation{Op: "add", Path: "/spec/initContainers", Value: []interface{}{sidecar}})
+	} else {
+		patch = append(patch, patchOperation{Op: "add", Path: "/spec/initContainers/-", Value: sidecar})
+	}
+	if len(pod.Spec.Volumes) == 0 {
+		patch = append(patch, patchOperation{Op: "add", Path: "/spec/volumes", Value: []corev1.Volume{volume}})
+	} else {
+		patch = append(patch, patchOperation{Op: "add", Path: "/spec/volumes/-", Value: volume})
+	}
+	return patch, nil
+}
+
+// review answers the admission review of a pod. It never denies the pod; pods that are not injected are allowed
+// as they are.
+func (i injector) review(request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	response := &admissionv1.AdmissionResponse{UID: request.UID, Allowed: true}
+
+	pod := corev1.Pod{}
+	if err := json.Unmarshal(request.Object.Raw, &pod); err != nil {
+		response.Result = &metav1.Status{Message: fmt.Sprintf("could not read the pod: %s", err)}
+		return response
+	}
+	namespace := request.Namespace
+	if namespace == "" {
+		namespace = pod.Namespace
+	}
+	if !i.scope.includes(namespace) {
+		response.Result = &metav1.Status{Message: fmt.Sprintf("namespace '%s' is not handled by the manager", namespace)}
+		return response
+	}
+	namespaceLabels, err := i.namespaceLabels(namespace)
+	if err != nil {
+		response.Result = &metav1.Status{Message: fmt.Sprintf("could not read namespace '%s': %s", namespace, err)}
+		return response
+	}
+	if enabled, reason := i.enabled(pod, namespaceLabels); !enabled {
+		response.Result = &metav1.Status{Message: reason}
+		return response
+	}
+
+	patch, err := i.patch(pod)
+	if err == nil {
+		response.Patch, err = json.Marshal(patch)
+	}
+	if err != nil {
+		response.Result = &metav1.Status{Message: fmt.Sprintf("could not inject the monitor: %s", err)}
+		return response
+	}
+	patchType := admissionv1.PatchTypeJSONPatch
+	response.PatchType = &patchType
+	return response
+}
+
+// reviewJSON decodes an AdmissionReview, answers it and encodes the response
+func (i injector) reviewJSON(r io.Reader, w io.Writer) error {
+	admissionReview := admissionv1.AdmissionReview{}
+	if err := json.NewDecoder(r).Decode(&admissionReview); err != nil {
+		return err
+	}
+	if admissionReview.Request == nil {
+		return fmt.Errorf("admission review has no request")
+	}
+	admissionReview.Response = i.review(admissionReview.Request)
+	admissionReview.Request = nil
+	return json.NewEncoder(w).Encode(admissionReview)
+}
+
+func (i injector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := i.reviewJSON(r.Body, w); err != nil {
+		log.Println("ERROR in admission review", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// serve serves the webhook and the token exchange over TLS with tls.crt and tls.key from certDir, or over plain
+// HTTP when certDir is not set
+func serve(addr, certDir string, handler http.Handler) {
+	log.Println("Serving on", addr)
+	var err error
+	if certDir != "" {
+		err = http.ListenAndServeTLS(addr, filepath.Join(certDir, "tls.crt"), filepath.Join(certDir, "tls.key"), handler)
+	} else {
+		err = http.ListenAndServe(addr, handler)
+	}
+	log.Fatal("Server stopped: ", err)
+}
+
+// webhookReview answers an AdmissionReview read from stdin without a cluster, eg
+//
+//	manager webhook-review -namespace-labels monitor.galleybytes.com/inject=enabled < review.json
+func webhookReview(args []string) {
+	namespaceLabels := map[string]string{}
+	if len(args) == 2 && args[0] == "-namespace-labels" {
+		for _, label := range strings.Split(args[1], ",") {
+			key, value, _ := strings.Cut(label, "=")
+			namespaceLabels[key] = value
+		}
+	} else if len(args) != 0 {
+		log.Fatal("usage: manager webhook-review [-namespace-labels key=value,...] < review.json")
+	}
+	s, err := scopeFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	i := newInjector(s, func(string) (map[string]string, error) { return namespaceLabels, nil })
+	if err := i.reviewJSON(os.Stdin, os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
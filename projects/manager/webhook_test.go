@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/galleybytes/monitor/pkg/tfapi"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func testInjector(namespaceLabels map[string]string) injector {
+	return injector{
+		image:            "monitor:test",
+		audience:         "monitor-manager",
+		enabledByDefault: true,
+		namespaceLabels: func(namespace string) (map[string]string, error) {
+			return namespaceLabels, nil
+		},
+	}
+}
+
+// testTaskPod is a task pod like terraform-operator creates it
+func testTaskPod() corev1.Pod {
+	return corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "example-plan-abcde",
+			Namespace: "default",
+			Labels:    map[string]string{tfapi.ResourceNameLabel(tfapi.Groups[0]): "example"},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name: "task",
+				Env: []corev1.EnvVar{
+					{Name: "TFO_RESOURCE", Value: "example"},
+					{Name: "TFO_RESOURCE_UUID", Value: "uid-1"},
+					{Name: "TFO_NAMESPACE", Value: "default"},
+					{Name: "TFO_GENERATION", Value: "1"},
+					{Name: "TFO_ROOT_PATH", Value: "/home/tfo-runner"},
+				},
+				VolumeMounts: []corev1.VolumeMount{{Name: "tfohome", MountPath: "/home/tfo-runner"}},
+			}},
+			Volumes: []corev1.Volume{{Name: "tfohome"}},
+		},
+	}
+}
+
+func admissionRequest(t *testing.T, pod corev1.Pod) *admissionv1.AdmissionRequest {
+	t.Helper()
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &admissionv1.AdmissionRequest{UID: "review-1", Namespace: pod.Namespace, Object: runtime.RawExtension{Raw: raw}}
+}
+
+// sidecarPatch is a patch operation with the value left as JSON
+type sidecarPatch struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+func TestReviewInjectsTheSidecar(t *testing.T) {
+	response := testInjector(nil).review(admissionRequest(t, testTaskPod()))
+	if !response.Allowed || response.UID != "review-1" {
+		t.Fatalf("expected the pod to be allowed, got %+v", response)
+	}
+	if response.PatchType == nil || *response.PatchType != admissionv1.PatchTypeJSONPatch {
+		t.Fatalf("expected a JSON patch, got %+v", response)
+	}
+	patch := []sidecarPatch{}
+	if err := json.Unmarshal(response.Patch, &patch); err != nil {
+		t.Fatal(err)
+	}
+	if len(patch) != 2 || patch[0].Path != "/spec/initContainers" || patch[1].Path != "/spec/volumes/-" {
+		t.Fatalf("unexpected patch %s", response.Patch)
+	}
+
+	sidecars := []struct {
+		corev1.Container
+		RestartPolicy string `json:"restartPolicy"`
+	}{}
+	if err := json.Unmarshal(patch[0].Value, &sidecars); err != nil {
+		t.Fatal(err)
+	}
+	sidecar := sidecars[0]
+	if sidecar.Name != monitorContainerName || sidecar.Image != "monitor:test" || sidecar.RestartPolicy != "Always" {
+		t.Errorf("unexpected sidecar %+v", sidecar)
+	}
+	env := map[string]string{}
+	for _, e := range sidecar.Env {
+		env[e.Name] = e.Value
+	}
+	for _, name := range monitorEnvs {
+		if env[name] == "" {
+			t.Errorf("expected %s to be copied from the task container", name)
+		}
+	}
+	if sidecar.EnvFrom[0].ConfigMapRef.Name != "example-monitor-envs" {
+		t.Errorf("expected the env of the resource, got %+v", sidecar.EnvFrom)
+	}
+	for _, envFrom := range sidecar.EnvFrom {
+		optional := (envFrom.ConfigMapRef != nil && envFrom.ConfigMapRef.Optional != nil && *envFrom.ConfigMapRef.Optional) ||
+			(envFrom.SecretRef != nil && envFrom.SecretRef.Optional != nil && *envFrom.SecretRef.Optional)
+		if !optional {
+			t.Errorf("expected the env of the resource to be optional so the task runs without it, got %+v", envFrom)
+		}
+	}
+	mounts := map[string]string{}
+	for _, volumeMount := range sidecar.VolumeMounts {
+		mounts[volumeMount.Name] = volumeMount.MountPath
+	}
+	if mounts["tfohome"] != "/home/tfo-runner" || mounts[serviceAccountTokenVolume] != serviceAccountTokenPath {
+		t.Errorf("unexpected volume mounts %+v", sidecar.VolumeMounts)
+	}
+
+	volume := corev1.Volume{}
+	if err := json.Unmarshal(patch[1].Value, &volume); err != nil {
+		t.Fatal(err)
+	}
+	if volume.Projected == nil || volume.Projected.Sources[0].ServiceAccountToken.Audience != "monitor-manager" {
+		t.Errorf("expected a projected token for the manager, got %+v", volume)
+	}
+}
+
+func TestSidecarCopiesTheEnvReadFromTheTaskPod(t *testing.T) {
+	pod := testTaskPod()
+	uuidFrom := &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.labels['uuid']"}}
+	pod.Spec.Containers[0].Env[1] = corev1.EnvVar{Name: "TFO_RESOURCE_UUID", ValueFrom: uuidFrom}
+	sidecar, err := testInjector(nil).sidecar(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, env := range sidecar.Env {
+		if env.Name == "TFO_RESOURCE_UUID" {
+			if env.ValueFrom == nil || env.ValueFrom.FieldRef == nil || env.ValueFrom.FieldRef.FieldPath != uuidFrom.FieldRef.FieldPath {
+				t.Errorf("expected TFO_RESOURCE_UUID to be read the same way as the task container, got %+v", env)
+			}
+			return
+		}
+	}
+	t.Errorf("expected TFO_RESOURCE_UUID to be copied from the task container, got %+v", sidecar.Env)
+}
+
+func TestReviewAppendsToExistingInitContainers(t *testing.T) {
+	pod := testTaskPod()
+	pod.Spec.InitContainers = []corev1.Container{{Name: "setup"}}
+	response := testInjector(nil).review(admissionRequest(t, pod))
+	patch := []sidecarPatch{}
+	if err := json.Unmarshal(response.Patch, &patch); err != nil {
+		t.Fatal(err)
+	}
+	if len(patch) != 2 || patch[0].Path != "/spec/initContainers/-" {
+		t.Errorf("unexpected patch %s", response.Patch)
+	}
+}
+
+func TestReviewSkipsPods(t *testing.T) {
+	notTaskPod := testTaskPod()
+	notTaskPod.Labels = nil
+	injected := testTaskPod()
+	injected.Spec.InitContainers = []corev1.Container{{Name: monitorContainerName}}
+	optedOut := testTaskPod()
+	optedOut.Annotations = map[string]string{injectKey: "disabled"}
+	optedIn := testTaskPod()
+	optedIn.Annotations = map[string]string{injectKey: "true"}
+	noRootPath := testTaskPod()
+	noRootPath.Spec.Containers[0].VolumeMounts = nil
+	resourceFrom := testTaskPod()
+	resourceFrom.Spec.Containers[0].Env[0] = corev1.EnvVar{Name: "TFO_RESOURCE", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"}}}
+
+	for _, test := range []struct {
+		name            string
+		pod             corev1.Pod
+		scope           scope
+		namespaceLabels map[string]string
+		disabled        bool
+		reason          string
+	}{
+		{name: "not a task pod", pod: notTaskPod, reason: "not a terraform-operator task pod"},
+		{name: "already injected", pod: injected, reason: "already injected"},
+		{name: "pod annotation", pod: optedOut, namespaceLabels: map[string]string{injectKey: "enabled"}, reason: "disabled by the pod annotation"},
+		{name: "namespace label", pod: testTaskPod(), namespaceLabels: map[string]string{injectKey: "false"}, reason: "disabled by the namespace label"},
+		{name: "default", pod: testTaskPod(), disabled: true, reason: "namespace has not opted in"},
+		{name: "pod annotation over the namespace label", pod: optedIn, namespaceLabels: map[string]string{injectKey: "disabled"}, reason: ""},
+		{name: "scope", pod: testTaskPod(), scope: scope{excludeNamespaces: []string{"default"}}, reason: "namespace 'default' is not handled by the manager"},
+		{name: "no volume at TFO_ROOT_PATH", pod: noRootPath, reason: "could not inject the monitor: no volume is mounted at TFO_ROOT_PATH /home/tfo-runner"},
+		{name: "TFO_RESOURCE read from the pod", pod: resourceFrom, reason: "could not inject the monitor: TFO_RESOURCE of the task container must be a value"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			i := testInjector(test.namespaceLabels)
+			i.scope = test.scope
+			i.enabledByDefault = !test.disabled
+			response := i.review(admissionRequest(t, test.pod))
+			if !response.Allowed {
+				t.Fatalf("expected the pod to be allowed, got %+v", response)
+			}
+			if test.reason == "" {
+				if response.Patch == nil {
+					t.Errorf("expected the pod to be injected, got %+v", response.Result)
+				}
+				return
+			}
+			if response.Patch != nil || response.Result == nil || response.Result.Message != test.reason {
+				t.Errorf("expected the pod not to be injected because %q, got %+v", test.reason, response)
+			}
+		})
+	}
+}
+
+func TestReviewAllowsWhenTheNamespaceCannotBeRead(t *testing.T) {
+	i := testInjector(nil)
+	i.namespaceLabels = func(namespace string) (map[string]string, error) {
+		return nil, fmt.Errorf("forbidden")
+	}
+	response := i.review(admissionRequest(t, testTaskPod()))
+	if !response.Allowed || response.Patch != nil || !strings.Contains(response.Result.Message, "forbidden") {
+		t.Errorf("expected the pod to be allowed as is, got %+v", response)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	body, err := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request:  admissionRequest(t, testTaskPod()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	testInjector(nil).ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body)))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected a 200, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	admissionReview := admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &admissionReview); err != nil {
+		t.Fatal(err)
+	}
+	if admissionReview.Kind != "AdmissionReview" || admissionReview.Request != nil || admissionReview.Response == nil || admissionReview.Response.Patch == nil {
+		t.Errorf("unexpected admission review %+v", admissionReview)
+	}
+
+	for _, body := range []string{"not json", `{"kind":"AdmissionReview"}`} {
+		recorder := httptest.NewRecorder()
+		testInjector(nil).ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/mutate", strings.NewReader(body)))
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("expected a 400 for %q, got %d", body, recorder.Code)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/galleybytes/monitor/pkg/models"
+)
+
+// schema prints the JSON schema of the models or checks them against the API payloads
+func schema(args []string) {
+	flags := flag.NewFlagSet("schema", flag.ExitOnError)
+	check := flags.Bool("check", false, "check the models against the API payloads")
+	flags.Parse(args)
+
+	if *check {
+		if err := models.CheckPayloads(); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("The API payloads are compatible with schema version %s", models.SchemaVersion)
+		return
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(models.JSONSchema()); err != nil {
+		log.Fatal(err)
+	}
+}